@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrorFileGone = errors.New("file is no longer available")
+
+// How often files past their expiry are deleted
+const expirySweepInterval = time.Minute
+
+// How many files each list on the admin dashboard shows
+const adminListSize = 20
+
+// FileControl is anything done to a file after it was uploaded that changes
+// whether it can be seen
+type FileControl struct {
+	Blocked   bool      `json:"blocked,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt,omitzero"`
+}
+
+func (control FileControl) Expired(now time.Time) bool {
+	return !control.ExpiresAt.IsZero() && !now.Before(control.ExpiresAt)
+}
+
+// FileControls keeps track of blocked and expiring files by short key. Like
+// the search index it can be persisted to a JSON file, but unlike the index
+// it can't be rebuilt from the bucket, so without one it's lost on restart.
+type FileControls struct {
+	persisted jsonFile
+	now       func() time.Time
+
+	mutex    sync.Mutex
+	controls map[string]FileControl
+}
+
+func NewFileControls(path string) (*FileControls, error) {
+	controls := &FileControls{
+		persisted: jsonFile{path: path},
+		now:       time.Now,
+		controls:  map[string]FileControl{},
+	}
+
+	if path == "" {
+		return controls, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return controls, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read file controls: %w", err)
+	}
+
+	if err := json.Unmarshal(content, &controls.controls); err != nil {
+		return nil, fmt.Errorf("couldn't parse file controls: %w", err)
+	}
+
+	return controls, nil
+}
+
+func (controls *FileControls) Get(key string) FileControl {
+	controls.mutex.Lock()
+	defer controls.mutex.Unlock()
+
+	return controls.controls[key]
+}
+
+// All returns every file with a control on it
+func (controls *FileControls) All() map[string]FileControl {
+	controls.mutex.Lock()
+	defer controls.mutex.Unlock()
+
+	all := make(map[string]FileControl, len(controls.controls))
+	for key, control := range controls.controls {
+		all[key] = control
+	}
+	return all
+}
+
+// Available returns ErrorFileGone if a file has been blocked or has expired
+func (controls *FileControls) Available(key string) error {
+	control := controls.Get(key)
+
+	if control.Blocked {
+		return fmt.Errorf("%w: %s is blocked", ErrorFileGone, key)
+	}
+	if control.Expired(controls.now()) {
+		return fmt.Errorf("%w: %s expired", ErrorFileGone, key)
+	}
+
+	return nil
+}
+
+// Block stops a file from being served, or lets it be again
+func (controls *FileControls) Block(key string, blocked bool) {
+	controls.update(key, func(control *FileControl) {
+		control.Blocked = blocked
+	})
+}
+
+// Expire sets when a file is deleted. A zero time means never.
+func (controls *FileControls) Expire(key string, at time.Time) {
+	controls.update(key, func(control *FileControl) {
+		control.ExpiresAt = at
+	})
+}
+
+// Forget drops any controls on a file, once it's been deleted
+func (controls *FileControls) Forget(key string) {
+	controls.update(key, func(control *FileControl) {
+		*control = FileControl{}
+	})
+}
+
+// Due returns the files that have expired, ready to be deleted
+func (controls *FileControls) Due() []string {
+	now := controls.now()
+
+	controls.mutex.Lock()
+	defer controls.mutex.Unlock()
+
+	var due []string
+	for key, control := range controls.controls {
+		if control.Expired(now) {
+			due = append(due, key)
+		}
+	}
+	slices.Sort(due)
+
+	return due
+}
+
+func (controls *FileControls) update(key string, change func(*FileControl)) {
+	controls.mutex.Lock()
+	control := controls.controls[key]
+	change(&control)
+	if control == (FileControl{}) {
+		delete(controls.controls, key)
+	} else {
+		controls.controls[key] = control
+	}
+	controls.mutex.Unlock()
+
+	controls.persist()
+}
+
+func (controls *FileControls) persist() {
+	err := controls.persisted.save(func() any { return controls.All() })
+	if err != nil {
+		slog.Error("Error saving file controls", "path", controls.persisted.path, "error", err)
+	}
+}
+
+// sweepExpired deletes expired files every interval until ctx is done
+func (webServer *WebServer) sweepExpired(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			webServer.deleteExpired(ctx)
+		}
+	}
+}
+
+func (webServer *WebServer) deleteExpired(ctx context.Context) {
+	for _, key := range webServer.Controls.Due() {
+		err := webServer.storage.DeleteFile(ctx, key)
+		if err != nil && !errors.Is(err, ErrorObjectMissing) {
+			slog.ErrorContext(ctx, "Error deleting expired file", "key", key, "error", err)
+			continue
+		}
+
+		// Grab what we know about it for webhooks before it's forgotten
+		file := webServer.adminFile(key).StoredFile
+		webServer.forgetFile(key)
+		webServer.notify(nil, EventFileExpired, file)
+		slog.InfoContext(ctx, "Deleted expired file", "key", key)
+	}
+}
+
+// forgetFile drops everything we know about a file once it's been deleted
+func (webServer *WebServer) forgetFile(key string) {
+	webServer.Search.Remove(key)
+	webServer.Controls.Forget(key)
+	webServer.Stats.Forget(key)
+}
+
+// adminOnly puts a handler behind auth and turns away anyone who isn't an
+// admin. Without auth everyone's an admin, same as everyone can edit or
+// delete anything.
+func (webServer *WebServer) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return webServer.authenticated(func(writer http.ResponseWriter, request *http.Request) {
+		if webServer.authEnabled() && !IsAdmin(request.Context()) {
+			webServer.ServeError(writer, request, fmt.Errorf("%w: %s isn't an admin", ErrorForbidden, AuthenticatedUser(request.Context())))
+			return
+		}
+		next(writer, request)
+	})
+}
+
+// adminFile is a file as shown on the admin dashboard
+type adminFile struct {
+	StoredFile
+	FileControl
+	Downloads int64
+}
+
+type adminPage struct {
+	Files        int
+	Bytes        int64
+	Recent       []adminFile
+	TopDownloads []adminFile
+	Controlled   []adminFile // blocked or expiring
+	Cache        *CacheStats
+	Routes       []RouteStats
+	Webhooks     []WebhookDelivery
+	HasWebhooks  bool
+}
+
+// cacheStatsProvider is storage with a lookup cache to report on
+type cacheStatsProvider interface {
+	CacheStats() *CacheStats
+}
+
+// adminFile fills in what we know about a file from the search index, which
+// may be nothing if it hasn't been indexed
+func (webServer *WebServer) adminFile(key string) adminFile {
+	file, found := webServer.Search.Get(key)
+	if !found {
+		file = StoredFile{Key: key, OriginalName: key}
+	}
+
+	return adminFile{
+		StoredFile:  file,
+		FileControl: webServer.Controls.Get(key),
+		Downloads:   webServer.Stats.Downloads(key),
+	}
+}
+
+func (webServer *WebServer) AdminHandler(writer http.ResponseWriter, request *http.Request) {
+	page := &adminPage{
+		Routes:      webServer.logger.Stats(),
+		Webhooks:    webServer.webhooks.Deliveries(),
+		HasWebhooks: webServer.webhooks != nil,
+	}
+	page.Files, page.Bytes = webServer.Search.Totals()
+
+	for _, file := range webServer.Search.Recent(adminListSize) {
+		page.Recent = append(page.Recent, webServer.adminFile(file.Key))
+	}
+	for _, download := range webServer.Stats.TopDownloads(adminListSize) {
+		page.TopDownloads = append(page.TopDownloads, webServer.adminFile(download.Name))
+	}
+
+	controlled := webServer.Controls.All()
+	for _, key := range slices.Sorted(maps.Keys(controlled)) {
+		page.Controlled = append(page.Controlled, webServer.adminFile(key))
+	}
+
+	if cached, ok := webServer.storage.(cacheStatsProvider); ok {
+		page.Cache = cached.CacheStats()
+	}
+
+	webServer.ServePage(writer, request, "admin", templateData{Admin: page})
+}
+
+// AdminFileActionHandler handles the admin only controls, POST
+// /admin/files/{key}/{action}
+func (webServer *WebServer) AdminFileActionHandler(writer http.ResponseWriter, request *http.Request) {
+	key := request.PathValue("key")
+	if len(key) != keyLength {
+		webServer.ServeError(writer, request, ErrorObjectMissing)
+		return
+	}
+
+	switch request.PathValue("action") {
+	case "block":
+		webServer.Controls.Block(key, true)
+		slog.InfoContext(request.Context(), "Blocked file", "key", key, "user", AuthenticatedUser(request.Context()))
+	case "unblock":
+		webServer.Controls.Block(key, false)
+		slog.InfoContext(request.Context(), "Unblocked file", "key", key, "user", AuthenticatedUser(request.Context()))
+	default:
+		webServer.ServeError(writer, request, ErrorObjectMissing)
+		return
+	}
+
+	redirectBack(writer, request, "/admin")
+}
+
+// ExpireHandler sets when a file is deleted, as a duration from now in the
+// expires form value. A blank duration means never.
+func (webServer *WebServer) ExpireHandler(writer http.ResponseWriter, request *http.Request) {
+	file, err := webServer.ownedFile(request, request.PathValue("key"))
+	if err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	var expiresAt time.Time
+	if raw := request.FormValue("expires"); raw != "" {
+		after, err := time.ParseDuration(raw)
+		if err != nil || after < 0 {
+			webServer.ServeError(writer, request, fmt.Errorf("%w: expires must be a duration like 24h", ErrorBadRequest))
+			return
+		}
+		expiresAt = webServer.Controls.now().Add(after)
+	}
+
+	webServer.Controls.Expire(file.Key, expiresAt)
+	slog.InfoContext(request.Context(), "Set file expiry", "key", file.Key, "expiresAt", expiresAt, "user", AuthenticatedUser(request.Context()))
+
+	redirectBack(writer, request, "/"+file.Key)
+}
+
+// redirectBack sends the client to the page in the next form value, as long
+// as it's on this site, or fallback otherwise
+func redirectBack(writer http.ResponseWriter, request *http.Request, fallback string) {
+	next := request.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = fallback
+	}
+
+	http.Redirect(writer, request, next, http.StatusSeeOther)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestControls(t *testing.T) (*FileControls, *fakeClock) {
+	t.Helper()
+
+	controls, err := NewFileControls(filepath.Join(t.TempDir(), "controls.json"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	controls.now = clock.Now
+
+	return controls, clock
+}
+
+func TestFileControlsBlock(t *testing.T) {
+	controls, _ := newTestControls(t)
+
+	controls.Block("ABCDE", true)
+	if err := controls.Available("ABCDE"); !errors.Is(err, ErrorFileGone) {
+		t.Errorf("Expected ErrorFileGone for a blocked file, got %v", err)
+	}
+	if err := controls.Available("FGHIJ"); err != nil {
+		t.Errorf("Expected other files to be available, got %v", err)
+	}
+
+	controls.Block("ABCDE", false)
+	if err := controls.Available("ABCDE"); err != nil {
+		t.Errorf("Expected an unblocked file to be available, got %v", err)
+	}
+	if len(controls.All()) != 0 {
+		t.Errorf("Expected nothing kept for a file without controls, got %v", controls.All())
+	}
+}
+
+func TestFileControlsExpire(t *testing.T) {
+	controls, clock := newTestControls(t)
+
+	controls.Expire("ABCDE", clock.now.Add(time.Hour))
+	if err := controls.Available("ABCDE"); err != nil {
+		t.Errorf("Expected the file to be available until it expires, got %v", err)
+	}
+	if due := controls.Due(); len(due) != 0 {
+		t.Errorf("Expected nothing due yet, got %v", due)
+	}
+
+	clock.Advance(time.Hour)
+	if err := controls.Available("ABCDE"); !errors.Is(err, ErrorFileGone) {
+		t.Errorf("Expected ErrorFileGone once expired, got %v", err)
+	}
+	if due := controls.Due(); len(due) != 1 || due[0] != "ABCDE" {
+		t.Errorf("Expected ABCDE to be due, got %v", due)
+	}
+
+	reloaded, _ := NewFileControls(controls.persisted.path)
+	if !reloaded.Get("ABCDE").ExpiresAt.Equal(clock.now) {
+		t.Errorf("Expected the expiry to be saved, got %+v", reloaded.Get("ABCDE"))
+	}
+
+	controls.Forget("ABCDE")
+	if controls.Get("ABCDE") != (FileControl{}) {
+		t.Errorf("Expected controls to be forgotten, got %+v", controls.Get("ABCDE"))
+	}
+}
+
+func TestRouteStats(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockEmptyStorage{})
+
+	for range 2 {
+		server.Router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ABCDE", nil))
+	}
+	server.Router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ping", nil))
+
+	stats := server.logger.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("Expected stats for 2 routes, got %+v", stats)
+	}
+	if stats[0] != (RouteStats{Route: "GET /ping", Requests: 1}) {
+		t.Errorf("Expected a successful ping, got %+v", stats[0])
+	}
+	if stats[1] != (RouteStats{Route: "GET /{key}", Requests: 2, ClientErrors: 2}) {
+		t.Errorf("Expected two missing files, got %+v", stats[1])
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockStorage{})
+	server.SetUsers(newTestUsers(t))
+	server.Search.Add(StoredFile{Key: "AAAAA", OriginalName: "old.png", Size: 1 << 20, UploadedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)})
+	server.Search.Add(StoredFile{Key: "BBBBB", OriginalName: "new.png", Size: 2 << 20, UploadedAt: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)})
+	server.Controls.Block("AAAAA", true)
+	server.Stats.Record(AnalyticsEvent{Name: EventDownload, Key: "BBBBB"})
+
+	request := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	request.SetBasicAuth("guest", "password1")
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Code != http.StatusForbidden {
+		t.Errorf(`Expected 403 for a regular user, but instead got %d`, responseRecorder.Code)
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/admin", nil)
+	request.SetBasicAuth("skalnik", "hunter2")
+	responseRecorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Code != http.StatusOK {
+		t.Fatalf(`Expected 200 OK, but instead got %d`, responseRecorder.Code)
+	}
+
+	body := strings.Join(strings.Fields(responseRecorder.Body.String()), " ")
+	for _, expected := range []string{"2 files, 3.0 MB", "<mark>Blocked</mark>", "/admin/files/AAAAA/unblock", "Off without a CDN", "<code>GET /admin</code>"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q on the admin page, got %s", expected, body)
+		}
+	}
+	if strings.Index(body, "new.png") > strings.Index(body, "old.png") {
+		t.Error("Expected the newest upload first")
+	}
+}
+
+func TestAdminBlockFile(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockStorage{})
+
+	request := httptest.NewRequest(http.MethodPost, "/admin/files/ABCDE/block", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Code != http.StatusSeeOther || responseRecorder.Header().Get("Location") != "/admin" {
+		t.Errorf(`Expected a redirect back to /admin, but instead got %d`, responseRecorder.Code)
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/ABCDE", nil)
+	responseRecorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Code != http.StatusGone {
+		t.Errorf(`Expected 410 for a blocked file, but instead got %d`, responseRecorder.Code)
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/ABCDE.txt", nil)
+	responseRecorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Code != http.StatusGone {
+		t.Errorf(`Expected 410 for a blocked direct link, but instead got %d`, responseRecorder.Code)
+	}
+}
+
+func TestCrossOriginPostsRefused(t *testing.T) {
+	storage := &mockOwnedStorage{}
+	server := NewWebServer("", "", "", "", storage)
+	server.SetWebhooks(nil, "https://share.example.com")
+
+	tests := []struct {
+		method  string
+		path    string
+		headers map[string]string
+		status  int
+	}{
+		{http.MethodPost, "/admin/files/ABCDE/block", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{http.MethodPost, "/ABCDE/delete", map[string]string{"Sec-Fetch-Site": "same-site"}, http.StatusForbidden},
+		{http.MethodPost, "/ABCDE/expire", map[string]string{"Origin": "https://evil.example.com"}, http.StatusForbidden},
+		{http.MethodPost, "/ABCDE/edit", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{http.MethodPost, "/", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{http.MethodDelete, "/api/files/ABCDE", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		// Reading is fine from anywhere
+		{http.MethodGet, "/ABCDE", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusOK},
+		// Our own pages, the public URL and clients that aren't browsers can
+		{http.MethodPost, "/admin/files/ABCDE/block", map[string]string{"Sec-Fetch-Site": "same-origin"}, http.StatusSeeOther},
+		{http.MethodPost, "/admin/files/ABCDE/unblock", map[string]string{"Origin": "https://share.example.com"}, http.StatusSeeOther},
+		{http.MethodPost, "/ABCDE/delete", nil, http.StatusSeeOther},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, test.path, nil)
+		request.Host = "files.example.com"
+		for name, value := range test.headers {
+			request.Header.Set(name, value)
+		}
+		responseRecorder := httptest.NewRecorder()
+		server.Router.ServeHTTP(responseRecorder, request)
+
+		if responseRecorder.Code != test.status {
+			t.Errorf(`Expected %d for %s %s with %v, but instead got %d`, test.status, test.method, test.path, test.headers, responseRecorder.Code)
+		}
+	}
+
+	if storage.deleted != "ABCDE" {
+		t.Errorf("Expected the delete without browser headers to go through, got %q", storage.deleted)
+	}
+}
+
+func TestExpireHandler(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockOwnedStorage{})
+	server.SetUsers(newTestUsers(t))
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	server.Controls.now = clock.Now
+
+	expire := func(user, password, expires string) *httptest.ResponseRecorder {
+		form := url.Values{"expires": {expires}, "next": {"//evil.example.com"}}
+		request := httptest.NewRequest(http.MethodPost, "/ABCDE/expire", strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.SetBasicAuth(user, password)
+		responseRecorder := httptest.NewRecorder()
+		server.Router.ServeHTTP(responseRecorder, request)
+		return responseRecorder
+	}
+
+	response := expire("guest", "password1", "24h")
+	if response.Code != http.StatusSeeOther || response.Header().Get("Location") != "/ABCDE" {
+		t.Errorf(`Expected a redirect back to the file, but instead got %d to %s`, response.Code, response.Header().Get("Location"))
+	}
+	if !server.Controls.Get("ABCDE").ExpiresAt.Equal(clock.now.Add(24 * time.Hour)) {
+		t.Errorf("Expected the file to expire in a day, got %+v", server.Controls.Get("ABCDE"))
+	}
+
+	if response := expire("guest", "password1", "soon"); response.Code != http.StatusBadRequest {
+		t.Errorf(`Expected 400 for a bad duration, but instead got %d`, response.Code)
+	}
+
+	_ = server.users.SetPassword("someone", "password2", RoleUser)
+	if response := expire("someone", "password2", ""); response.Code != http.StatusForbidden {
+		t.Errorf(`Expected 403 for someone else's file, but instead got %d`, response.Code)
+	}
+
+	expire("guest", "password1", "")
+	if server.Controls.Get("ABCDE") != (FileControl{}) {
+		t.Errorf("Expected a blank expiry to clear it, got %+v", server.Controls.Get("ABCDE"))
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	storage := &mockOwnedStorage{}
+	server := NewWebServer("", "", "", "", storage)
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	server.Controls.now = clock.Now
+	server.Search.Add(StoredFile{Key: "ABCDE", OriginalName: "file.txt"})
+
+	server.Controls.Expire("ABCDE", clock.now.Add(time.Minute))
+	server.deleteExpired(context.Background())
+	if storage.deleted != "" {
+		t.Errorf("Expected nothing deleted before it expires, got %q", storage.deleted)
+	}
+
+	clock.Advance(time.Minute)
+	server.deleteExpired(context.Background())
+	if storage.deleted != "ABCDE" {
+		t.Errorf("Expected ABCDE to be deleted, got %q", storage.deleted)
+	}
+	if _, found := server.Search.Get("ABCDE"); found {
+		t.Error("Expected the file to be dropped from search")
+	}
+	if len(server.Controls.Due()) != 0 {
+		t.Error("Expected the expiry to be forgotten")
+	}
+}
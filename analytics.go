@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const plausibleAPIURL = "https://plausible.io/api/event"
+
+// Events we send. Page views are what analytics services count by default,
+// the rest are custom events.
+const (
+	EventPageview = "pageview"
+	EventDownload = "download"
+	EventPreview  = "preview"
+)
+
+const (
+	analyticsQueueSize     = 1000
+	analyticsBatchSize     = 50
+	analyticsFlushInterval = 5 * time.Second
+
+	// How long sinks get to send what's left when shutting down
+	analyticsFlushTimeout = 5 * time.Second
+)
+
+// AnalyticsEvent is a page view or anything else worth counting. It's taken
+// from a request up front so it can be sent after the response has gone.
+type AnalyticsEvent struct {
+	Name      string    `json:"name"`
+	Time      time.Time `json:"time"`
+	URL       string    `json:"url"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	ClientIP  string    `json:"clientIP,omitempty"`
+	Domain    string    `json:"-"`             // Plausible domain, as it was when this happened
+	Key       string    `json:"key,omitempty"` // short key of the file, if it's about one
+
+	// Props break events down further, like by file kind
+	Props map[string]string `json:"props,omitempty"`
+
+	// So events sent later still show up in the request's trace
+	spanContext trace.SpanContext
+}
+
+func (event AnalyticsEvent) context(ctx context.Context) context.Context {
+	return trace.ContextWithSpanContext(ctx, event.spanContext)
+}
+
+// AnalyticsSink sends events somewhere. Events are handed over in batches,
+// though most sinks have to send them one at a time anyway.
+type AnalyticsSink interface {
+	Name() string
+	Send(ctx context.Context, events []AnalyticsEvent) error
+}
+
+// Analytics sends events to every sink in the background, so nobody waits on
+// an analytics service to get their file. Events are batched up, and dropped
+// if they come in faster than they can be sent.
+type Analytics struct {
+	sinks []AnalyticsSink
+	queue chan AnalyticsEvent
+
+	batchSize     int
+	flushInterval time.Duration
+}
+
+// NewAnalytics returns nil without any sinks, which tracks nothing
+func NewAnalytics(sinks ...AnalyticsSink) *Analytics {
+	if len(sinks) == 0 {
+		return nil
+	}
+
+	return &Analytics{
+		sinks:         sinks,
+		queue:         make(chan AnalyticsEvent, analyticsQueueSize),
+		batchSize:     analyticsBatchSize,
+		flushInterval: analyticsFlushInterval,
+	}
+}
+
+// Track queues an event without waiting
+func (analytics *Analytics) Track(event AnalyticsEvent) {
+	if analytics == nil {
+		return
+	}
+
+	select {
+	case analytics.queue <- event:
+	default:
+		analyticsDropped.Inc()
+	}
+}
+
+// Run sends batches of events until ctx is done, then sends what's left
+func (analytics *Analytics) Run(ctx context.Context) {
+	if analytics == nil {
+		return
+	}
+
+	ticker := time.NewTicker(analytics.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]AnalyticsEvent, 0, analytics.batchSize)
+	flush := func(ctx context.Context) {
+		if len(batch) > 0 {
+			analytics.send(ctx, batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Nothing else takes from the queue, so this can't block
+			for len(analytics.queue) > 0 {
+				batch = append(batch, <-analytics.queue)
+			}
+
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), analyticsFlushTimeout)
+			flush(flushCtx)
+			cancel()
+			return
+		case event := <-analytics.queue:
+			batch = append(batch, event)
+			if len(batch) >= analytics.batchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		}
+	}
+}
+
+func (analytics *Analytics) send(ctx context.Context, batch []AnalyticsEvent) {
+	for _, sink := range analytics.sinks {
+		if err := sink.Send(ctx, batch); err != nil {
+			slog.ErrorContext(ctx, "Failed to send analytics events", "sink", sink.Name(), "events", len(batch), "error", err)
+			analyticsFailures.Inc(sink.Name())
+		}
+	}
+}
+
+// PlausibleSink sends page views to Plausible's events API, which is
+// plausible.io unless it's self hosted
+type PlausibleSink struct {
+	APIURL string
+	client *http.Client
+}
+
+type plausibleEvent struct {
+	Name     string            `json:"name"`
+	Domain   string            `json:"domain"`
+	URL      string            `json:"url"`
+	Referrer string            `json:"referrer"`
+	Props    map[string]string `json:"props,omitempty"`
+}
+
+func NewPlausibleSink(apiURL string) *PlausibleSink {
+	return &PlausibleSink{
+		APIURL: apiURL,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (sink *PlausibleSink) Name() string {
+	return "plausible"
+}
+
+// Send skips events without a domain, since the domain can be reloaded away
+func (sink *PlausibleSink) Send(ctx context.Context, events []AnalyticsEvent) error {
+	var errs []error
+	for _, event := range events {
+		if event.Domain == "" {
+			continue
+		}
+
+		body, err := json.Marshal(plausibleEvent{
+			Name:     event.Name,
+			Domain:   event.Domain,
+			URL:      event.URL,
+			Referrer: event.Referrer,
+			Props:    event.Props,
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		errs = append(errs, postAnalyticsEvent(event.context(ctx), sink.client, "Plausible event", sink.APIURL, event, body))
+	}
+
+	return errors.Join(errs...)
+}
+
+// plausibleScriptURL is where the tracking script is served from, alongside
+// the events API
+func plausibleScriptURL(apiURL string) string {
+	parsed, err := url.Parse(apiURL)
+	if err != nil || parsed.Host == "" {
+		return "https://plausible.io/js/plausible.js"
+	}
+
+	return fmt.Sprintf("%s://%s/js/plausible.js", parsed.Scheme, parsed.Host)
+}
+
+// UmamiSink sends events to an Umami website's /api/send
+type UmamiSink struct {
+	APIURL    string
+	WebsiteID string
+	client    *http.Client
+}
+
+type umamiEvent struct {
+	Type    string       `json:"type"`
+	Payload umamiPayload `json:"payload"`
+}
+
+type umamiPayload struct {
+	Website  string            `json:"website"`
+	Hostname string            `json:"hostname"`
+	URL      string            `json:"url"`
+	Referrer string            `json:"referrer,omitempty"`
+	Name     string            `json:"name,omitempty"` // blank for page views
+	Data     map[string]string `json:"data,omitempty"`
+}
+
+func NewUmamiSink(apiURL string, websiteID string) *UmamiSink {
+	return &UmamiSink{
+		APIURL:    apiURL,
+		WebsiteID: websiteID,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (sink *UmamiSink) Name() string {
+	return "umami"
+}
+
+func (sink *UmamiSink) Send(ctx context.Context, events []AnalyticsEvent) error {
+	var errs []error
+	for _, event := range events {
+		payload := umamiPayload{Website: sink.WebsiteID, URL: event.URL, Referrer: event.Referrer, Data: event.Props}
+		if parsed, err := url.Parse(event.URL); err == nil {
+			payload.Hostname = parsed.Hostname()
+			payload.URL = parsed.RequestURI()
+		}
+		if event.Name != EventPageview {
+			payload.Name = event.Name
+		}
+
+		body, err := json.Marshal(umamiEvent{Type: "event", Payload: payload})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		errs = append(errs, postAnalyticsEvent(event.context(ctx), sink.client, "Umami event", sink.APIURL, event, body))
+	}
+
+	return errors.Join(errs...)
+}
+
+// postAnalyticsEvent sends a single event as JSON on behalf of the client
+// that caused it, since that's who analytics services count. It gets a span
+// of its own, but no traceparent, as analytics services are usually someone
+// else's and our trace IDs are none of their business.
+func postAnalyticsEvent(ctx context.Context, client *http.Client, spanName string, apiURL string, event AnalyticsEvent, body []byte) error {
+	ctx, span := tracer().Start(ctx, spanName, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, bytes.NewReader(body))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	request.Header.Set("User-Agent", event.UserAgent)
+	request.Header.Set("X-Forwarded-For", event.ClientIP)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := client.Do(request)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	_ = response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		span.SetStatus(codes.Error, response.Status)
+		return fmt.Errorf("%s rejected event: %s", spanName, response.Status)
+	}
+
+	return nil
+}
+
+// FileSink writes events as JSON lines, to keep your own records or feed
+// into something else
+type FileSink struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func NewFileSink(writer io.Writer) *FileSink {
+	return &FileSink{writer: writer}
+}
+
+func (sink *FileSink) Name() string {
+	return "file"
+}
+
+func (sink *FileSink) Send(ctx context.Context, events []AnalyticsEvent) error {
+	var lines bytes.Buffer
+	encoder := json.NewEncoder(&lines)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	_, err := sink.writer.Write(lines.Bytes())
+	return err
+}
+
+// track counts an event about a file in its stats and sends it to analytics,
+// unless the client has asked not to be tracked with Do Not Track
+func (webServer *WebServer) track(request *http.Request, name string, file StoredFile) {
+	if request.Header.Get("DNT") == "1" {
+		return
+	}
+
+	event := webServer.newAnalyticsEvent(request, name)
+	event.Key = file.Key
+	event.Props = map[string]string{"kind": kindName(file.Kind)}
+	if referrer, err := url.Parse(request.Referer()); err == nil && referrer.Host != "" {
+		event.Props["referrer"] = referrer.Hostname()
+	}
+
+	webServer.Stats.Record(event)
+	webServer.analytics.Track(event)
+}
+
+// previewable is whether a file's page shows the file itself, rather than
+// just a link to it
+func previewable(file StoredFile) bool {
+	switch file.Kind {
+	case KindImage, KindVideo, KindAudio, KindPDF:
+		return true
+	case KindText:
+		return file.Preview != ""
+	default:
+		return false
+	}
+}
+
+// newAnalyticsEvent captures what sinks need from a request
+func (webServer *WebServer) newAnalyticsEvent(request *http.Request, name string) AnalyticsEvent {
+	return AnalyticsEvent{
+		Name:        name,
+		Time:        time.Now().UTC(),
+		URL:         fmt.Sprintf("https://%s%s", request.Host, request.URL.String()),
+		Referrer:    request.Referer(),
+		UserAgent:   request.UserAgent(),
+		ClientIP:    webServer.trustedProxies.ClientIP(request),
+		Domain:      webServer.plausibleDomain(),
+		spanContext: trace.SpanContextFromContext(request.Context()),
+	}
+}
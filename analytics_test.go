@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink keeps every batch it's sent, waiting on block first if set
+type recordingSink struct {
+	mutex   sync.Mutex
+	batches [][]AnalyticsEvent
+	block   chan struct{}
+	sent    chan struct{}
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{sent: make(chan struct{}, 10)}
+}
+
+func (sink *recordingSink) Name() string {
+	return "recording"
+}
+
+func (sink *recordingSink) Send(ctx context.Context, events []AnalyticsEvent) error {
+	if sink.block != nil {
+		<-sink.block
+	}
+
+	sink.mutex.Lock()
+	sink.batches = append(sink.batches, append([]AnalyticsEvent(nil), events...))
+	sink.mutex.Unlock()
+
+	sink.sent <- struct{}{}
+	return nil
+}
+
+func (sink *recordingSink) Batches() [][]AnalyticsEvent {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	return sink.batches
+}
+
+func TestAnalyticsBatches(t *testing.T) {
+	sink := newRecordingSink()
+	analytics := NewAnalytics(sink)
+	analytics.batchSize = 2
+	analytics.flushInterval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		analytics.Run(ctx)
+		close(done)
+	}()
+
+	for _, name := range []string{"one", "two", "three"} {
+		analytics.Track(AnalyticsEvent{Name: name})
+	}
+	<-sink.sent
+
+	// What's left is sent on the way out
+	cancel()
+	<-done
+
+	batches := sink.Batches()
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 || batches[1][0].Name != "three" {
+		t.Errorf("Expected a full batch then the rest, got %+v", batches)
+	}
+}
+
+func TestAnalyticsFlushInterval(t *testing.T) {
+	sink := newRecordingSink()
+	analytics := NewAnalytics(sink)
+	analytics.flushInterval = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go analytics.Run(ctx)
+
+	analytics.Track(AnalyticsEvent{Name: "pageview"})
+
+	select {
+	case <-sink.sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a partial batch to be sent after the flush interval")
+	}
+}
+
+func TestAnalyticsDropsWhenFull(t *testing.T) {
+	// Never run, so nothing is taken off the queue
+	analytics := NewAnalytics(newRecordingSink())
+	dropped := analyticsDropped.Value()
+
+	for range analyticsQueueSize + 3 {
+		analytics.Track(AnalyticsEvent{Name: "pageview"})
+	}
+
+	if analyticsDropped.Value() != dropped+3 {
+		t.Errorf("Expected 3 events dropped, got %v", analyticsDropped.Value()-dropped)
+	}
+
+	if NewAnalytics() != nil {
+		t.Error("Expected no analytics without any sinks")
+	}
+}
+
+func TestDirectHandlerDoesntWaitForAnalytics(t *testing.T) {
+	sink := newRecordingSink()
+	sink.block = make(chan struct{})
+	defer close(sink.block)
+
+	analytics := NewAnalytics(sink)
+	analytics.flushInterval = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go analytics.Run(ctx)
+
+	server := NewWebServer("", "", "", "example.com", &mockStorage{})
+	server.SetAnalytics(analytics, "")
+
+	for range 2 {
+		responseRecorder := httptest.NewRecorder()
+		server.Router.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, "/acab1.txt", nil))
+		if responseRecorder.Code != http.StatusMovedPermanently {
+			t.Errorf(`Expected a redirect while analytics is stuck, but instead got %d`, responseRecorder.Code)
+		}
+	}
+}
+
+func TestPlausibleSinkSkipsWithoutDomain(t *testing.T) {
+	plausible := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		t.Error("Expected nothing to be sent without a domain")
+	}))
+	defer plausible.Close()
+
+	if err := NewPlausibleSink(plausible.URL).Send(context.Background(), []AnalyticsEvent{{Name: "pageview"}}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestPlausibleScriptURL(t *testing.T) {
+	if url := plausibleScriptURL(plausibleAPIURL); url != "https://plausible.io/js/plausible.js" {
+		t.Errorf("Expected plausible.io's script, got %s", url)
+	}
+	if url := plausibleScriptURL("https://stats.example.com/api/event"); url != "https://stats.example.com/js/plausible.js" {
+		t.Errorf("Expected the self hosted script, got %s", url)
+	}
+}
+
+func TestUmamiSink(t *testing.T) {
+	var received umamiEvent
+	var userAgent, forwardedFor string
+	umami := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		userAgent = request.Header.Get("User-Agent")
+		forwardedFor = request.Header.Get("X-Forwarded-For")
+		body, _ := io.ReadAll(request.Body)
+		_ = json.Unmarshal(body, &received)
+	}))
+	defer umami.Close()
+
+	event := AnalyticsEvent{
+		Name:      "pageview",
+		URL:       "https://files.example.com/acab1.txt?download=1",
+		Referrer:  "https://example.com/share",
+		UserAgent: "golang test",
+		ClientIP:  "203.0.113.7",
+	}
+	if err := NewUmamiSink(umami.URL, "website-id").Send(context.Background(), []AnalyticsEvent{event}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	payload := received.Payload
+	if received.Type != "event" || payload.Website != "website-id" || payload.Hostname != "files.example.com" ||
+		payload.URL != "/acab1.txt?download=1" || payload.Referrer != "https://example.com/share" || payload.Name != "" {
+		t.Errorf("Expected a page view for the file, got %+v", received)
+	}
+	if userAgent != "golang test" || forwardedFor != "203.0.113.7" {
+		t.Errorf("Expected the client's user agent and IP, got %q and %q", userAgent, forwardedFor)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	var output bytes.Buffer
+	sink := NewFileSink(&output)
+
+	events := []AnalyticsEvent{
+		{Name: "pageview", URL: "https://files.example.com/acab1.txt", Domain: "example.com"},
+		{Name: "pageview", URL: "https://files.example.com/bcde2.png"},
+	}
+	if err := sink.Send(context.Background(), events); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected a line per event, got %q", output.String())
+	}
+
+	var first AnalyticsEvent
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil || first.URL != events[0].URL {
+		t.Errorf("Expected the first event, got %s", lines[0])
+	}
+}
+
+func TestAnalyticsEventClientIP(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockStorage{})
+	proxies, _ := ParseTrustedProxies("10.0.0.1")
+	server.SetRateLimits(nil, proxies)
+
+	request := httptest.NewRequest(http.MethodGet, "/acab1.txt", nil)
+	request.RemoteAddr = "10.0.0.1:1234"
+	request.Header.Set("X-Forwarded-For", "203.0.113.7")
+
+	if event := server.newAnalyticsEvent(request, "pageview"); event.ClientIP != "203.0.113.7" {
+		t.Errorf("Expected the client behind the proxy, got %s", event.ClientIP)
+	}
+}
+
+// queued takes every event waiting to be sent
+func queued(analytics *Analytics) []AnalyticsEvent {
+	var events []AnalyticsEvent
+	for len(analytics.queue) > 0 {
+		events = append(events, <-analytics.queue)
+	}
+	return events
+}
+
+func TestLookupHandlerTracksPreview(t *testing.T) {
+	analytics := NewAnalytics(newRecordingSink())
+	server := NewWebServer("", "", "", "example.com", &mockImageStorage{})
+	server.SetAnalytics(analytics, "")
+
+	request := httptest.NewRequest(http.MethodGet, "/ABCDE", nil)
+	request.Header.Set("Referer", "https://chat.example.com/room/1")
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	events := queued(analytics)
+	if len(events) != 2 || events[0].Name != EventPageview || events[1].Name != EventPreview {
+		t.Fatalf("Expected a page view and a preview, got %+v", events)
+	}
+	if props := events[1].Props; props["kind"] != "image" || props["referrer"] != "chat.example.com" {
+		t.Errorf("Expected the file kind and referrer host, got %v", props)
+	}
+
+	// Already counted, so the script would count it twice
+	if strings.Contains(responseRecorder.Body.String(), `data-domain="example.com"`) {
+		t.Error("Expected no Plausible script on a server tracked page")
+	}
+}
+
+func TestDirectHandlerTracksDownload(t *testing.T) {
+	analytics := NewAnalytics(newRecordingSink())
+	server := NewWebServer("", "", "", "", &mockStorage{})
+	server.SetAnalytics(analytics, "")
+
+	server.Router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/acab1.txt", nil))
+
+	events := queued(analytics)
+	if len(events) != 2 || events[0].Name != EventPageview || events[1].Name != EventDownload {
+		t.Fatalf("Expected a page view and a download, got %+v", events)
+	}
+	if _, ok := events[1].Props["referrer"]; ok || events[1].Props["kind"] != "other" {
+		t.Errorf("Expected only the file kind without a referrer, got %v", events[1].Props)
+	}
+}
+
+func TestDoNotTrack(t *testing.T) {
+	analytics := NewAnalytics(newRecordingSink())
+	server := NewWebServer("", "", "", "", &mockImageStorage{})
+	server.SetAnalytics(analytics, "")
+
+	for _, path := range []string{"/ABCDE", "/ABCDE.png"} {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.Header.Set("DNT", "1")
+		server.Router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	if events := queued(analytics); len(events) != 0 {
+		t.Errorf("Expected nothing tracked with DNT, got %+v", events)
+	}
+}
@@ -6,25 +6,40 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
 	"log/slog"
 	"mime/multipart"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 
 	lru "github.com/hashicorp/golang-lru/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type StorageClient interface {
-	UploadFile(file multipart.File, fileHeader multipart.FileHeader) (string, error)
-	LookupFile(prefix string) (*StoredFile, error)
+	// UploadFile returns the file's URL path, and whether it was stored
+	// rather than already being there
+	UploadFile(ctx context.Context, file multipart.File, fileHeader multipart.FileHeader, details FileDetails) (string, bool, error)
+	LookupFile(ctx context.Context, prefix string) (*StoredFile, error)
+	ListFiles(ctx context.Context, continuationToken string, limit int32) (*FileListing, error)
+	UpdateFile(ctx context.Context, prefix string, details FileDetails) error
+	DeleteFile(ctx context.Context, prefix string) error
+	CheckBucket(ctx context.Context) error
 }
 
 // S3API defines the S3 operations used by AWSClient
@@ -32,6 +47,12 @@ type S3API interface {
 	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
 	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
 	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
 }
 
 // S3PresignAPI defines the presigning operations used by AWSClient
@@ -42,38 +63,126 @@ type S3PresignAPI interface {
 type AWSClient struct {
 	Bucket        string
 	CDN           string
+	Timeouts      Timeouts
+	Quotas        *Quotas // optional
+	Scanner       Scanner // optional
 	s3Client      S3API
 	presignClient S3PresignAPI
 	cache         *lru.Cache[string, *StoredFile]
+
+	bucketMutex     sync.Mutex
+	bucketCheckedAt time.Time
+	bucketErr       error
+	bucketCheck     chan struct{} // closed when the check in flight is done
 }
 
 type FileKind string
 
 const (
-	KindOther FileKind = ""
-	KindImage FileKind = "image"
-	KindVideo FileKind = "video"
+	KindOther   FileKind = ""
+	KindImage   FileKind = "image"
+	KindVideo   FileKind = "video"
+	KindAudio   FileKind = "audio"
+	KindPDF     FileKind = "pdf"
+	KindText    FileKind = "text"
+	KindArchive FileKind = "archive"
 )
 
 type StoredFile struct {
-	OriginalName string
-	Url          string
-	Kind         FileKind
+	Key          string    `json:"key"`
+	OriginalName string    `json:"name"`
+	Url          string    `json:"url"`
+	Kind         FileKind  `json:"kind"`
+	ContentType  string    `json:"contentType"`
+	Size         int64     `json:"size"`
+	UploadedAt   time.Time `json:"uploadedAt"`
+	Tags         []string  `json:"tags"`
+	Description  string    `json:"description"`
+	Uploader     string    `json:"uploader,omitempty"`
+
+	// Preview holds the beginning of text files, fetched server-side
+	Preview          string `json:"-"`
+	PreviewTruncated bool   `json:"-"`
+
+	// Dimensions of images we can decode, also fetched server-side
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+}
+
+// FileListing is a single page of stored files. NextToken is empty on the
+// last page.
+type FileListing struct {
+	Files     []StoredFile `json:"files"`
+	NextToken string       `json:"next,omitempty"`
 }
 
 var ErrorObjectMissing = errors.New("could not find object on S3")
 var ErrorInvalidKey = errors.New("encountered S3 object with unexpected key")
 
-const s3Timeout = 30 * time.Second
+// How long a bucket check is reused for, so readiness probes don't turn into
+// a steady stream of S3 requests
+const bucketCheckInterval = 10 * time.Second
+
+var ErrorBucketUnavailable = errors.New("S3 bucket unavailable")
+
+// How many lookups are cached when there's a CDN
+const lookupCacheSize = 128
+
+// How much of a text file we're willing to pull down to render a preview
+const textPreviewSize = 4 * 1024
+
+// How much of an image we'll read looking for its dimensions. They're near
+// the start, though JPEGs can have a lot of EXIF data first.
+const imageHeaderSize = 64 * 1024
+
+// Metadata key an image or video's dimensions are stored under as
+// WIDTHxHEIGHT (x-amz-meta-dimensions), so they're known without downloading it
+const dimensionsMetadataKey = "dimensions"
+
+// Image types whose dimensions we can read, with the decoders imported above
+var decodableImageTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+// Content types that aren't text/* but are still readable as plain text
+var textContentTypes = map[string]bool{
+	"application/json":       true,
+	"application/xml":        true,
+	"application/javascript": true,
+	"application/x-sh":       true,
+	"application/x-yaml":     true,
+	"application/yaml":       true,
+	"application/toml":       true,
+}
+
+var archiveContentTypes = map[string]bool{
+	"application/zip":              true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-tar":            true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/vnd.rar":          true,
+	"application/zstd":             true,
+}
 
 func formatKey(key string) string {
-	return fmt.Sprintf("/%s", key[0:keyLength])
+	return fmt.Sprintf("/%s", shortKey(key))
+}
+
+func shortKey(key string) string {
+	return key[0:keyLength]
 }
 
 func NewAWSClient(bucket string, secret string, key string, cdn string, region string) (*AWSClient, error) {
 	client := &AWSClient{
-		Bucket: bucket,
-		CDN:    cdn,
+		Bucket:   bucket,
+		CDN:      cdn,
+		Timeouts: DefaultTimeouts,
 	}
 
 	creds := credentials.NewStaticCredentialsProvider(key, secret, "")
@@ -85,12 +194,12 @@ func NewAWSClient(bucket string, secret string, key string, cdn string, region s
 	}
 
 	s3Client := s3.NewFromConfig(cfg)
-	client.s3Client = s3Client
-	client.presignClient = s3.NewPresignClient(s3Client)
+	client.s3Client = &instrumentedS3{s3Client}
+	client.presignClient = &instrumentedPresign{s3.NewPresignClient(s3Client)}
 
 	// We don't want to cache presigned URLs
 	if cdn != "" {
-		cache, err := lru.New[string, *StoredFile](128)
+		cache, err := lru.New[string, *StoredFile](lookupCacheSize)
 		if err != nil {
 			return nil, fmt.Errorf("couldn't initialize cache: %w", err)
 		}
@@ -102,56 +211,453 @@ func NewAWSClient(bucket string, secret string, key string, cdn string, region s
 	return client, nil
 }
 
-func (awsClient *AWSClient) UploadFile(file multipart.File, fileHeader multipart.FileHeader) (string, error) {
+func (awsClient *AWSClient) UploadFile(ctx context.Context, file multipart.File, fileHeader multipart.FileHeader, details FileDetails) (string, bool, error) {
+	details, err := details.Normalize()
+	if err != nil {
+		return "", false, err
+	}
+
+	ctx, span := tracer().Start(ctx, "AWSClient.UploadFile",
+		trace.WithAttributes(attribute.Int64("file.size", fileHeader.Size)))
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, awsClient.Timeouts.Upload)
+	defer cancel()
+
 	key, err := Filename(fileHeader.Filename, file)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
+	span.SetAttributes(attribute.String("file.key", key))
 
 	_, err = file.Seek(0, 0)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
-	awsFile, err := awsClient.LookupFile(key)
+	awsFile, err := awsClient.LookupFile(ctx, key)
 	if awsFile != nil {
-		slog.Debug("File already uploaded", "key", key)
-		return formatKey(key), nil
+		// Any details sent with a duplicate are dropped rather than clobbering
+		// the existing ones; they can be edited afterwards
+		slog.DebugContext(ctx, "File already uploaded", "key", key)
+		uploadDedupeHits.Inc()
+		return formatKey(key), false, nil
 	}
 
 	// Object missing is to be expected here, since we're uploading a new file
 	if err != nil && !errors.Is(err, ErrorObjectMissing) {
-		return "", err
+		return "", false, err
+	}
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", false, err
+	}
+
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return "", false, err
 	}
 
-	contentType := fileHeader.Header.Get("Content-Type")
+	uploader := AuthenticatedUser(ctx)
 
-	slog.Debug("Uploading file", "contentType", contentType, "key", key)
+	// Duplicates were scanned the first time round
+	if err := awsClient.scan(ctx, file, key, uploader); err != nil {
+		return "", false, err
+	}
 
-	_, err = awsClient.s3Client.PutObject(context.Background(), &s3.PutObjectInput{
+	// Only new files count towards a quota, so this has to wait until we
+	// know it isn't a duplicate
+	settle, err := awsClient.Quotas.Reserve(uploader, fileHeader.Size)
+	if err != nil {
+		return "", false, err
+	}
+	stored := false
+	defer func() { settle(stored) }()
+
+	declaredType := fileHeader.Header.Get("Content-Type")
+	contentType, err := DetectContentType(fileHeader.Filename, declaredType, head[:n])
+	if err != nil {
+		return "", false, err
+	}
+
+	slog.DebugContext(ctx, "Uploading file", "contentType", contentType, "declaredType", declaredType, "key", key)
+
+	putInput := &s3.PutObjectInput{
 		Bucket:      aws.String(awsClient.Bucket),
 		Key:         aws.String(key),
 		ContentType: aws.String(contentType),
 		Body:        file,
-	})
+	}
+	if len(details.Tags) > 0 {
+		putInput.Tagging = aws.String(encodeTagging(details.Tags))
+	}
+	if details.Description != "" {
+		putInput.Metadata = map[string]string{
+			descriptionMetadataKey: encodeDescription(details.Description),
+		}
+	}
+	if uploader != "" {
+		if putInput.Metadata == nil {
+			putInput.Metadata = map[string]string{}
+		}
+		// Usernames can be anything, so they're encoded like descriptions
+		putInput.Metadata[uploaderMetadataKey] = encodeDescription(uploader)
+	}
+	dimensions, err := mediaDimensions(ctx, file, contentType)
+	if err != nil {
+		return "", false, err
+	}
+	if dimensions != "" {
+		if putInput.Metadata == nil {
+			putInput.Metadata = map[string]string{}
+		}
+		putInput.Metadata[dimensionsMetadataKey] = dimensions
+	}
+	if err := checkMetadataSize(putInput.Metadata); err != nil {
+		return "", false, err
+	}
+
+	_, err = awsClient.s3Client.PutObject(ctx, putInput)
 
 	if err != nil {
-		return "", err
+		return "", false, err
+	}
+	stored = true
+
+	uploadBytes.Add(float64(fileHeader.Size))
+
+	return formatKey(key), true, nil
+}
+
+// scan runs an upload past the scanner, if there is one, quarantining it if
+// it's infected. The file is left ready to be read again.
+func (awsClient *AWSClient) scan(ctx context.Context, file multipart.File, key string, uploader string) error {
+	if awsClient.Scanner == nil {
+		return nil
+	}
+
+	scanErr := awsClient.Scanner.Scan(ctx, file)
+	if _, err := file.Seek(0, 0); err != nil {
+		return err
+	}
+	if !errors.Is(scanErr, ErrorInfected) {
+		return scanErr
+	}
+
+	slog.WarnContext(ctx, "Quarantining infected upload", "key", key, "uploader", uploader, "error", scanErr)
+
+	_, err := awsClient.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(awsClient.Bucket),
+		Key:    aws.String(quarantinePrefix + key),
+		Body:   file,
+		Metadata: map[string]string{
+			uploaderMetadataKey:   encodeDescription(uploader),
+			scanResultMetadataKey: encodeDescription(scanErr.Error()),
+		},
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error quarantining infected upload", "key", key, "error", err)
 	}
 
-	return formatKey(key), nil
+	return scanErr
 }
 
-func (awsClient *AWSClient) LookupFile(prefix string) (*StoredFile, error) {
-	value, found := awsClient.cacheGet(prefix)
+func (awsClient *AWSClient) LookupFile(ctx context.Context, prefix string) (*StoredFile, error) {
+	ctx, span := tracer().Start(ctx, "AWSClient.LookupFile",
+		trace.WithAttributes(attribute.String("file.key", prefix)))
+	defer span.End()
+
+	value, found := awsClient.cacheGet(ctx, prefix)
+	span.SetAttributes(attribute.Bool("cache.hit", found))
 
 	if found {
 		return value, nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	ctx, cancel := withTimeout(ctx, awsClient.Timeouts.Lookup)
+	defer cancel()
+
+	objectKey, err := awsClient.findObjectKey(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	headInput := &s3.HeadObjectInput{
+		Bucket: aws.String(awsClient.Bucket),
+		Key:    aws.String(objectKey),
+	}
+
+	headOutput, err := awsClient.s3Client.HeadObject(ctx, headInput)
+	if err != nil {
+		// Giving up isn't the same as the file being missing
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, ErrorObjectMissing
+	}
+
+	parts := strings.Split(objectKey, "/")
+	if len(parts) < 2 {
+		return nil, ErrorInvalidKey
+	}
+
+	fileURL, err := awsClient.fileURL(ctx, objectKey)
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := aws.ToString(headOutput.ContentType)
+	kind := KindFromContentType(contentType)
+
+	file := StoredFile{
+		Key:          shortKey(objectKey),
+		OriginalName: parts[1],
+		Url:          fileURL,
+		Kind:         kind,
+		ContentType:  contentType,
+		Size:         aws.ToInt64(headOutput.ContentLength),
+		UploadedAt:   uploadedAt(headOutput),
+		Description:  decodeDescription(headOutput.Metadata[descriptionMetadataKey]),
+		Uploader:     decodeDescription(headOutput.Metadata[uploaderMetadataKey]),
+		Tags:         []string{},
+	}
+
+	tagging, err := awsClient.s3Client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(awsClient.Bucket),
+		Key:    aws.String(objectKey),
+	})
+	if ctx.Err() != nil {
+		// Don't cache a lookup that was cut short
+		return nil, ctx.Err()
+	} else if err != nil {
+		// Tags are nice to have, and shouldn't stop us from serving the file
+		slog.WarnContext(ctx, "Error fetching tags", "key", objectKey, "error", err)
+	} else {
+		file.Tags = tagsFromTagSet(tagging.TagSet)
+	}
+
+	if kind == KindText {
+		preview, err := awsClient.fetchPreview(ctx, objectKey)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if err != nil {
+			// A missing preview shouldn't stop us from serving the file
+			slog.WarnContext(ctx, "Error fetching text preview", "key", objectKey, "error", err)
+		} else {
+			file.Preview = preview
+			file.PreviewTruncated = aws.ToInt64(headOutput.ContentLength) > int64(len(preview))
+		}
+	}
+
+	// Files uploaded before dimensions were recorded just don't have any
+	if dimensions := headOutput.Metadata[dimensionsMetadataKey]; dimensions != "" {
+		_, _ = fmt.Sscanf(dimensions, "%dx%d", &file.Width, &file.Height)
+	}
+
+	err = awsClient.cacheSet(prefix, &file)
+	if err != nil {
+		slog.WarnContext(ctx, "Error setting cache", "error", err)
+	}
+
+	return &file, nil
+}
+
+// UpdateFile replaces the tags and description of a stored file
+func (awsClient *AWSClient) UpdateFile(ctx context.Context, prefix string, details FileDetails) error {
+	details, err := details.Normalize()
+	if err != nil {
+		return err
+	}
+
+	ctx, span := tracer().Start(ctx, "AWSClient.UpdateFile",
+		trace.WithAttributes(attribute.String("file.key", prefix)))
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, awsClient.Timeouts.Update)
 	defer cancel()
 
+	objectKey, err := awsClient.findObjectKey(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	headOutput, err := awsClient.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(awsClient.Bucket),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return ErrorObjectMissing
+	}
+
+	// If we're cancelled after the copy the tags may not have been updated,
+	// but the description has, so drop cached lookups either way
+	defer awsClient.cacheInvalidate(objectKey)
+
+	if decodeDescription(headOutput.Metadata[descriptionMetadataKey]) != details.Description {
+		err = awsClient.replaceDescription(ctx, objectKey, headOutput, details.Description)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = awsClient.s3Client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(awsClient.Bucket),
+		Key:     aws.String(objectKey),
+		Tagging: &types.Tagging{TagSet: tagSet(details.Tags)},
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// replaceDescription copies an object over itself with a new description, as
+// metadata can't be edited in place. Everything else we set has to be carried
+// over too, and the upload time is kept as the copy resets LastModified.
+func (awsClient *AWSClient) replaceDescription(ctx context.Context, objectKey string, headOutput *s3.HeadObjectOutput, description string) error {
+	metadata := map[string]string{}
+	for key, value := range headOutput.Metadata {
+		metadata[key] = value
+	}
+	metadata[uploadedMetadataKey] = uploadedAt(headOutput).UTC().Format(time.RFC3339)
+	delete(metadata, descriptionMetadataKey)
+	if description != "" {
+		metadata[descriptionMetadataKey] = encodeDescription(description)
+	}
+	if err := checkMetadataSize(metadata); err != nil {
+		return err
+	}
+
+	_, err := awsClient.s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(awsClient.Bucket),
+		Key:               aws.String(objectKey),
+		CopySource:        aws.String(awsClient.Bucket + "/" + url.PathEscape(objectKey)),
+		ContentType:       headOutput.ContentType,
+		Metadata:          metadata,
+		MetadataDirective: types.MetadataDirectiveReplace,
+	})
+	return err
+}
+
+// uploadedAt is when an object was first uploaded, which is its LastModified
+// unless it's been copied over itself since
+func uploadedAt(headOutput *s3.HeadObjectOutput) time.Time {
+	if uploaded, err := time.Parse(time.RFC3339, headOutput.Metadata[uploadedMetadataKey]); err == nil {
+		return uploaded
+	}
+	return aws.ToTime(headOutput.LastModified)
+}
+
+// DeleteFile removes a stored file, giving the space back to whoever
+// uploaded it
+func (awsClient *AWSClient) DeleteFile(ctx context.Context, prefix string) error {
+	ctx, span := tracer().Start(ctx, "AWSClient.DeleteFile",
+		trace.WithAttributes(attribute.String("file.key", prefix)))
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, awsClient.Timeouts.Update)
+	defer cancel()
+
+	objectKey, err := awsClient.findObjectKey(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	// Only needed to know whose quota to give the space back to
+	headOutput, err := awsClient.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(awsClient.Bucket),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return ErrorObjectMissing
+	}
+
+	defer awsClient.cacheInvalidate(objectKey)
+
+	_, err = awsClient.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(awsClient.Bucket),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		return err
+	}
+
+	uploader := decodeDescription(headOutput.Metadata[uploaderMetadataKey])
+	awsClient.Quotas.Release(uploader, aws.ToInt64(headOutput.ContentLength))
+
+	return nil
+}
+
+// CheckBucket verifies the bucket exists and we're allowed to use it. Results
+// are cached for bucketCheckInterval, except for checks that were cut short,
+// which don't say anything about the bucket. Only one check runs at a time,
+// and anyone else who needs one waits for its result.
+func (awsClient *AWSClient) CheckBucket(ctx context.Context) error {
+	for {
+		awsClient.bucketMutex.Lock()
+		if !awsClient.bucketCheckedAt.IsZero() && time.Since(awsClient.bucketCheckedAt) < bucketCheckInterval {
+			err := awsClient.bucketErr
+			awsClient.bucketMutex.Unlock()
+			return err
+		}
+
+		check := awsClient.bucketCheck
+		if check == nil {
+			awsClient.bucketCheck = make(chan struct{})
+			awsClient.bucketMutex.Unlock()
+			return awsClient.checkBucket(ctx)
+		}
+		awsClient.bucketMutex.Unlock()
+
+		// Once it's done the result is either cached, or the check was cut
+		// short and it's our turn to try
+		select {
+		case <-check:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// checkBucket makes the check CheckBucket is waiting on, caching the result
+func (awsClient *AWSClient) checkBucket(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, awsClient.Timeouts.Lookup)
+	defer cancel()
+
+	_, err := awsClient.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(awsClient.Bucket),
+	})
+
+	awsClient.bucketMutex.Lock()
+	defer awsClient.bucketMutex.Unlock()
+
+	close(awsClient.bucketCheck)
+	awsClient.bucketCheck = nil
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = fmt.Errorf("%w: %w", ErrorBucketUnavailable, err)
+	}
+
+	awsClient.bucketCheckedAt = time.Now()
+	awsClient.bucketErr = err
+
+	return err
+}
+
+// findObjectKey finds the full key of the first object starting with prefix
+func (awsClient *AWSClient) findObjectKey(ctx context.Context, prefix string) (string, error) {
 	listInput := &s3.ListObjectsV2Input{
 		Bucket:  aws.String(awsClient.Bucket),
 		Prefix:  aws.String(prefix),
@@ -160,32 +666,88 @@ func (awsClient *AWSClient) LookupFile(prefix string) (*StoredFile, error) {
 
 	objectList, err := awsClient.s3Client.ListObjectsV2(ctx, listInput)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	if objectList.KeyCount == nil || *objectList.KeyCount < 1 ||
 		len(objectList.Contents) == 0 || objectList.Contents[0].Key == nil {
-		return nil, ErrorObjectMissing
+		return "", ErrorObjectMissing
 	}
 
 	objectKey := *objectList.Contents[0].Key
+	if strings.HasPrefix(objectKey, quarantinePrefix) {
+		return "", ErrorObjectMissing
+	}
 
-	headInput := &s3.HeadObjectInput{
-		Bucket: aws.String(awsClient.Bucket),
-		Key:    aws.String(objectKey),
+	return objectKey, nil
+}
+
+// ListFiles returns a page of stored files in key order. S3 doesn't give us
+// content types when listing, so kinds are guessed from file extensions.
+func (awsClient *AWSClient) ListFiles(ctx context.Context, continuationToken string, limit int32) (*FileListing, error) {
+	ctx, span := tracer().Start(ctx, "AWSClient.ListFiles")
+	defer span.End()
+
+	ctx, cancel := withTimeout(ctx, awsClient.Timeouts.List)
+	defer cancel()
+
+	listInput := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(awsClient.Bucket),
+		MaxKeys: aws.Int32(limit),
+	}
+	if continuationToken != "" {
+		listInput.ContinuationToken = aws.String(continuationToken)
 	}
 
-	headOutput, err := awsClient.s3Client.HeadObject(ctx, headInput)
+	objectList, err := awsClient.s3Client.ListObjectsV2(ctx, listInput)
 	if err != nil {
-		return nil, ErrorObjectMissing
+		return nil, err
 	}
 
-	parts := strings.Split(objectKey, "/")
-	if len(parts) < 2 {
-		return nil, ErrorInvalidKey
+	listing := &FileListing{
+		Files: make([]StoredFile, 0, len(objectList.Contents)),
+	}
+
+	for _, object := range objectList.Contents {
+		objectKey := aws.ToString(object.Key)
+		if strings.HasPrefix(objectKey, quarantinePrefix) {
+			continue
+		}
+
+		parts := strings.Split(objectKey, "/")
+		if len(parts) < 2 || len(parts[0]) < keyLength {
+			slog.WarnContext(ctx, "Skipping object with unexpected key", "key", objectKey)
+			continue
+		}
+
+		fileURL, err := awsClient.fileURL(ctx, objectKey)
+		if err != nil {
+			return nil, err
+		}
+
+		contentType := extensionContentType(parts[1])
+
+		listing.Files = append(listing.Files, StoredFile{
+			Key:          shortKey(objectKey),
+			OriginalName: parts[1],
+			Url:          fileURL,
+			Kind:         KindFromContentType(contentType),
+			ContentType:  contentType,
+			Size:         aws.ToInt64(object.Size),
+			UploadedAt:   aws.ToTime(object.LastModified),
+		})
+	}
+
+	if aws.ToBool(objectList.IsTruncated) {
+		listing.NextToken = aws.ToString(objectList.NextContinuationToken)
 	}
 
-	var fileURL string
+	return listing, nil
+}
+
+// fileURL builds a public URL for an object, either via the CDN or by
+// presigning a GET request
+func (awsClient *AWSClient) fileURL(ctx context.Context, objectKey string) (string, error) {
 	if awsClient.CDN == "" {
 		// For presigned URLs, we need a GetObjectInput
 		getInput := &s3.GetObjectInput{
@@ -194,45 +756,141 @@ func (awsClient *AWSClient) LookupFile(prefix string) (*StoredFile, error) {
 		}
 		presign, err := awsClient.presignClient.PresignGetObject(ctx, getInput)
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 
-		fileURL = presign.URL
-	} else {
-		// Files with URL-unsafe characters mean we need to URL encode our object key
-		escapedKey := url.QueryEscape(objectKey)
-		fileURL = fmt.Sprintf("%s/%s", awsClient.CDN, escapedKey)
+		return presign.URL, nil
 	}
 
-	kind := KindOther
-	contentType := aws.ToString(headOutput.ContentType)
-	if contentType != "" {
-		contentParts := strings.Split(contentType, "/")
-		if len(contentParts) > 0 {
-			switch contentParts[0] {
-			case "image":
-				kind = KindImage
-			case "video":
-				kind = KindVideo
-			}
+	// Files with URL-unsafe characters mean we need to URL encode our object key
+	escapedKey := url.QueryEscape(objectKey)
+	return fmt.Sprintf("%s/%s", awsClient.CDN, escapedKey), nil
+}
+
+// fetchPreview reads up to textPreviewSize bytes from the start of an object
+func (awsClient *AWSClient) fetchPreview(ctx context.Context, objectKey string) (string, error) {
+	output, err := awsClient.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(awsClient.Bucket),
+		Key:    aws.String(objectKey),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", textPreviewSize-1)),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		err := output.Body.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "Error closing preview body", "error", err)
 		}
+	}()
+
+	content, err := io.ReadAll(io.LimitReader(output.Body, textPreviewSize))
+	if err != nil {
+		return "", err
 	}
 
-	file := StoredFile{
-		OriginalName: parts[1],
-		Url:          fileURL,
-		Kind:         kind,
+	// The range may have split a multi-byte character, so drop the partial rune
+	if len(content) == textPreviewSize {
+		for i := 1; i < utf8.UTFMax && !utf8.Valid(content); i++ {
+			content = content[:len(content)-1]
+		}
 	}
 
-	err = awsClient.cacheSet(prefix, &file)
-	if err != nil {
-		slog.Warn("Error setting cache", "error", err)
+	return strings.ToValidUTF8(string(content), "\uFFFD"), nil
+}
+
+// mediaDimensions reads an uploaded image or video's dimensions as
+// WIDTHxHEIGHT, or "" if it's not one we can read. The file is left at the
+// start.
+func mediaDimensions(ctx context.Context, file io.ReadSeeker, contentType string) (string, error) {
+	var width, height int
+	var readErr error
+
+	switch mediaType := mediaType(contentType); {
+	case decodableImageTypes[mediaType]:
+		var config image.Config
+		config, _, readErr = image.DecodeConfig(io.LimitReader(file, imageHeaderSize))
+		width, height = config.Width, config.Height
+	case mp4VideoTypes[mediaType]:
+		width, height, readErr = mp4Dimensions(file)
+	default:
+		return "", nil
 	}
 
-	return &file, nil
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if readErr != nil {
+		// Dimensions are only used for embeds
+		slog.WarnContext(ctx, "Error reading dimensions", "contentType", contentType, "error", readErr)
+		return "", nil
+	}
+
+	return fmt.Sprintf("%dx%d", width, height), nil
+}
+
+// KindFromContentType picks how a file should be previewed based on its MIME type
+func KindFromContentType(contentType string) FileKind {
+	mediaType := mediaType(contentType)
+
+	switch strings.Split(mediaType, "/")[0] {
+	case "image":
+		return KindImage
+	case "video":
+		return KindVideo
+	case "audio":
+		return KindAudio
+	case "text":
+		return KindText
+	}
+
+	switch {
+	case mediaType == "application/pdf":
+		return KindPDF
+	case archiveContentTypes[mediaType]:
+		return KindArchive
+	case textContentTypes[mediaType],
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return KindText
+	}
+
+	return KindOther
 }
 
-func (awsClient *AWSClient) cacheGet(key string) (*StoredFile, bool) {
+// CacheStats describes the lookup cache, for the admin dashboard. Hits and
+// misses are since startup.
+type CacheStats struct {
+	Size     int
+	Capacity int
+	Hits     float64
+	Misses   float64
+}
+
+// HitRate is the fraction of lookups served from the cache
+func (stats CacheStats) HitRate() float64 {
+	if stats.Hits+stats.Misses == 0 {
+		return 0
+	}
+	return stats.Hits / (stats.Hits + stats.Misses)
+}
+
+// CacheStats returns nil if there's no cache, which is the case without a
+// CDN
+func (awsClient *AWSClient) CacheStats() *CacheStats {
+	if awsClient.cache == nil {
+		return nil
+	}
+
+	return &CacheStats{
+		Size:     awsClient.cache.Len(),
+		Capacity: lookupCacheSize,
+		Hits:     cacheLookups.Value("hit"),
+		Misses:   cacheLookups.Value("miss"),
+	}
+}
+
+func (awsClient *AWSClient) cacheGet(ctx context.Context, key string) (*StoredFile, bool) {
 	if awsClient.cache == nil {
 		return nil, false
 	}
@@ -240,11 +898,13 @@ func (awsClient *AWSClient) cacheGet(key string) (*StoredFile, bool) {
 	value, found := awsClient.cache.Get(key)
 
 	if !found {
-		slog.Debug("Cache miss", "key", key)
+		slog.DebugContext(ctx, "Cache miss", "key", key)
+		cacheLookups.Inc("miss")
 		return nil, false
 	}
 
-	slog.Debug("Cache hit", "key", key)
+	slog.DebugContext(ctx, "Cache hit", "key", key)
+	cacheLookups.Inc("hit")
 	return value, true
 }
 
@@ -258,6 +918,19 @@ func (awsClient *AWSClient) cacheSet(key string, file *StoredFile) error {
 	return nil
 }
 
+// cacheInvalidate drops every cached lookup that could have resolved to objectKey
+func (awsClient *AWSClient) cacheInvalidate(objectKey string) {
+	if awsClient.cache == nil {
+		return
+	}
+
+	for _, prefix := range awsClient.cache.Keys() {
+		if strings.HasPrefix(objectKey, prefix) {
+			awsClient.cache.Remove(prefix)
+		}
+	}
+}
+
 func Filename(originalName string, file io.Reader) (string, error) {
 	hasher := sha256.New()
 
@@ -5,11 +5,17 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"image"
+	"image/png"
+	"io"
 	"mime/multipart"
 	"net/textproto"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
@@ -23,6 +29,12 @@ type mockS3Client struct {
 	putObjectFunc     func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
 	listObjectsV2Func func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
 	headObjectFunc    func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	getObjectFunc     func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	copyObjectFunc    func(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	deleteObjectFunc  func(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	getTaggingFunc    func(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	putTaggingFunc    func(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
+	headBucketFunc    func(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
 }
 
 func (m *mockS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
@@ -46,6 +58,48 @@ func (m *mockS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInpu
 	return &s3.HeadObjectOutput{}, nil
 }
 
+func (m *mockS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if m.getObjectFunc != nil {
+		return m.getObjectFunc(ctx, params, optFns...)
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func (m *mockS3Client) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	if m.copyObjectFunc != nil {
+		return m.copyObjectFunc(ctx, params, optFns...)
+	}
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (m *mockS3Client) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	if m.deleteObjectFunc != nil {
+		return m.deleteObjectFunc(ctx, params, optFns...)
+	}
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *mockS3Client) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	if m.getTaggingFunc != nil {
+		return m.getTaggingFunc(ctx, params, optFns...)
+	}
+	return &s3.GetObjectTaggingOutput{}, nil
+}
+
+func (m *mockS3Client) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	if m.putTaggingFunc != nil {
+		return m.putTaggingFunc(ctx, params, optFns...)
+	}
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+func (m *mockS3Client) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	if m.headBucketFunc != nil {
+		return m.headBucketFunc(ctx, params, optFns...)
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
 // Mock presign client for testing
 type mockPresignClient struct {
 	presignGetObjectFunc func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
@@ -168,7 +222,7 @@ func TestCacheGetNilCache(t *testing.T) {
 		cache: nil,
 	}
 
-	value, found := client.cacheGet("anykey")
+	value, found := client.cacheGet(context.Background(), "anykey")
 
 	if found {
 		t.Error("Expected found to be false when cache is nil")
@@ -219,7 +273,7 @@ func TestLookupFileWithCDN(t *testing.T) {
 		cache:    cache,
 	}
 
-	file, err := client.LookupFile("abc12")
+	file, err := client.LookupFile(context.Background(), "abc12")
 
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
@@ -234,8 +288,8 @@ func TestLookupFileWithCDN(t *testing.T) {
 		t.Errorf("Expected URL '%s', got '%s'", expectedURL, file.Url)
 	}
 
-	if file.Kind != KindOther {
-		t.Errorf("Expected Kind to be KindOther for text/plain, got %q", file.Kind)
+	if file.Kind != KindText {
+		t.Errorf("Expected Kind to be KindText for text/plain, got %q", file.Kind)
 	}
 }
 
@@ -270,7 +324,7 @@ func TestLookupFileWithPresignedURL(t *testing.T) {
 		cache:         nil,
 	}
 
-	file, err := client.LookupFile("abc12")
+	file, err := client.LookupFile(context.Background(), "abc12")
 
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
@@ -298,7 +352,7 @@ func TestLookupFileNotFound(t *testing.T) {
 		cache:    nil,
 	}
 
-	_, err := client.LookupFile("nonexistent")
+	_, err := client.LookupFile(context.Background(), "nonexistent")
 
 	if !errors.Is(err, ErrorObjectMissing) {
 		t.Errorf("Expected ErrorObjectMissing, got %v", err)
@@ -328,7 +382,7 @@ func TestLookupFileCacheHit(t *testing.T) {
 		cache:    cache,
 	}
 
-	file, err := client.LookupFile("abc12")
+	file, err := client.LookupFile(context.Background(), "abc12")
 
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
@@ -363,7 +417,7 @@ func TestLookupFileInvalidKey(t *testing.T) {
 		cache:    nil,
 	}
 
-	_, err := client.LookupFile("invalid")
+	_, err := client.LookupFile(context.Background(), "invalid")
 
 	if !errors.Is(err, ErrorInvalidKey) {
 		t.Errorf("Expected ErrorInvalidKey, got %v", err)
@@ -396,7 +450,7 @@ func TestLookupFileImageContentType(t *testing.T) {
 		cache:    cache,
 	}
 
-	file, err := client.LookupFile("abc12")
+	file, err := client.LookupFile(context.Background(), "abc12")
 
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
@@ -433,7 +487,7 @@ func TestLookupFileVideoContentType(t *testing.T) {
 		cache:    cache,
 	}
 
-	file, err := client.LookupFile("abc12")
+	file, err := client.LookupFile(context.Background(), "abc12")
 
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
@@ -444,6 +498,198 @@ func TestLookupFileVideoContentType(t *testing.T) {
 	}
 }
 
+func TestLookupFileTextPreview(t *testing.T) {
+	var requestedRange string
+
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{
+				KeyCount: aws.Int32(1),
+				Contents: []types.Object{
+					{Key: aws.String("abc123/notes.md")},
+				},
+			}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			return &s3.HeadObjectOutput{
+				ContentType:   aws.String("text/markdown; charset=utf-8"),
+				ContentLength: aws.Int64(textPreviewSize * 2),
+			}, nil
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			requestedRange = aws.ToString(params.Range)
+			// A multi-byte character straddling the end of the range
+			content := strings.Repeat("a", textPreviewSize-1) + "é"
+			return &s3.GetObjectOutput{
+				Body: io.NopCloser(strings.NewReader(content[:textPreviewSize])),
+			}, nil
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+		cache:    nil,
+	}
+
+	file, err := client.LookupFile(context.Background(), "abc12")
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if file.Kind != KindText {
+		t.Errorf("Expected Kind to be KindText, got %q", file.Kind)
+	}
+
+	if requestedRange != "bytes=0-4095" {
+		t.Errorf("Expected preview to request the first 4096 bytes, got %q", requestedRange)
+	}
+
+	if file.Preview != strings.Repeat("a", textPreviewSize-1) {
+		t.Errorf("Expected preview to drop the partial character, got %d bytes", len(file.Preview))
+	}
+
+	if !file.PreviewTruncated {
+		t.Error("Expected preview to be marked as truncated")
+	}
+}
+
+func TestLookupFileImageDimensions(t *testing.T) {
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{
+				KeyCount: aws.Int32(1),
+				Contents: []types.Object{
+					{Key: aws.String("abc123/picture.png")},
+				},
+			}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			return &s3.HeadObjectOutput{
+				ContentType: aws.String("image/png"),
+				Metadata:    map[string]string{"dimensions": "3x2"},
+			}, nil
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			t.Error("Expected image dimensions to come from metadata, not the image")
+			return nil, errors.New("unexpected GetObject")
+		},
+	}
+
+	client := &AWSClient{Bucket: "test-bucket", CDN: "https://cdn.example.com", s3Client: mockS3}
+
+	file, err := client.LookupFile(context.Background(), "abc12")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if file.Width != 3 || file.Height != 2 {
+		t.Errorf("Expected 3x2, got %dx%d", file.Width, file.Height)
+	}
+}
+
+func TestUploadFileRecordsImageDimensions(t *testing.T) {
+	var picture bytes.Buffer
+	if err := png.Encode(&picture, image.NewGray(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatal(err)
+	}
+
+	var putInput *s3.PutObjectInput
+	var uploaded []byte
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{KeyCount: aws.Int32(0)}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			putInput = params
+			uploaded, _ = io.ReadAll(params.Body)
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+
+	client := &AWSClient{Bucket: "test-bucket", s3Client: mockS3}
+
+	fileHeader, _ := createMockFileHeader("picture.png", picture.Bytes(), "image/png")
+	file, _ := fileHeader.Open()
+	defer file.Close()
+
+	if _, _, err := client.UploadFile(context.Background(), file, *fileHeader, FileDetails{}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if putInput.Metadata["dimensions"] != "3x2" {
+		t.Errorf("Expected dimensions to be recorded, got %v", putInput.Metadata)
+	}
+	if !bytes.Equal(uploaded, picture.Bytes()) {
+		t.Error("Expected the whole image to be uploaded after reading its dimensions")
+	}
+}
+
+func TestLookupFilePreviewErrorStillServesFile(t *testing.T) {
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{
+				KeyCount: aws.Int32(1),
+				Contents: []types.Object{
+					{Key: aws.String("abc123/notes.txt")},
+				},
+			}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			return &s3.HeadObjectOutput{
+				ContentType: aws.String("text/plain"),
+			}, nil
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			return nil, errors.New("S3 get error")
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+		cache:    nil,
+	}
+
+	file, err := client.LookupFile(context.Background(), "abc12")
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if file.Preview != "" {
+		t.Errorf("Expected no preview, got %q", file.Preview)
+	}
+}
+
+func TestKindFromContentType(t *testing.T) {
+	cases := map[string]FileKind{
+		"image/png":                     KindImage,
+		"image/svg+xml":                 KindImage,
+		"video/mp4":                     KindVideo,
+		"audio/mpeg":                    KindAudio,
+		"application/pdf":               KindPDF,
+		"text/plain; charset=utf-8":     KindText,
+		"application/json":              KindText,
+		"application/ld+json":           KindText,
+		"application/zip":               KindArchive,
+		"application/x-7z-compressed":   KindArchive,
+		"application/octet-stream":      KindOther,
+		"":                              KindOther,
+		"APPLICATION/PDF":               KindPDF,
+		"application/vnd.ms-powerpoint": KindOther,
+	}
+
+	for contentType, expected := range cases {
+		if kind := KindFromContentType(contentType); kind != expected {
+			t.Errorf("KindFromContentType(%q) = %q, want %q", contentType, kind, expected)
+		}
+	}
+}
+
 func TestLookupFileListError(t *testing.T) {
 	mockS3 := &mockS3Client{
 		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
@@ -458,7 +704,7 @@ func TestLookupFileListError(t *testing.T) {
 		cache:    nil,
 	}
 
-	_, err := client.LookupFile("abc12")
+	_, err := client.LookupFile(context.Background(), "abc12")
 
 	if err == nil {
 		t.Error("Expected error, got nil")
@@ -487,7 +733,7 @@ func TestLookupFileGetObjectError(t *testing.T) {
 		cache:    nil,
 	}
 
-	_, err := client.LookupFile("abc12")
+	_, err := client.LookupFile(context.Background(), "abc12")
 
 	if !errors.Is(err, ErrorObjectMissing) {
 		t.Errorf("Expected ErrorObjectMissing, got %v", err)
@@ -525,26 +771,33 @@ func TestLookupFilePresignError(t *testing.T) {
 		cache:         nil,
 	}
 
-	_, err := client.LookupFile("abc12")
+	_, err := client.LookupFile(context.Background(), "abc12")
 
 	if err == nil {
 		t.Error("Expected error, got nil")
 	}
 }
 
-// UploadFile tests
-
-func TestUploadFileSuccess(t *testing.T) {
+func TestLookupFileDetails(t *testing.T) {
 	mockS3 := &mockS3Client{
 		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
-			// File doesn't exist yet
 			return &s3.ListObjectsV2Output{
-				KeyCount: aws.Int32(0),
-				Contents: []types.Object{},
+				KeyCount: aws.Int32(1),
+				Contents: []types.Object{
+					{Key: aws.String("abc123/diagram.png")},
+				},
 			}, nil
 		},
-		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
-			return &s3.PutObjectOutput{}, nil
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			return &s3.HeadObjectOutput{
+				ContentType: aws.String("image/png"),
+				Metadata:    map[string]string{"description": encodeDescription("Réseau diagram")},
+			}, nil
+		},
+		getTaggingFunc: func(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+			return &s3.GetObjectTaggingOutput{
+				TagSet: tagSet([]string{"work", "diagrams"}),
+			}, nil
 		},
 	}
 
@@ -555,47 +808,52 @@ func TestUploadFileSuccess(t *testing.T) {
 		cache:    nil,
 	}
 
-	fileHeader, _ := createMockFileHeader("test.txt", []byte("test content"), "text/plain")
-	file, _ := fileHeader.Open()
-	defer file.Close()
-
-	url, err := client.UploadFile(file, *fileHeader)
+	file, err := client.LookupFile(context.Background(), "abc12")
 
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 
-	// URL should be /keyLength characters (5)
-	if len(url) != 6 { // "/" + 5 chars
-		t.Errorf("Expected URL length 6, got %d: %s", len(url), url)
+	if file.Description != "Réseau diagram" {
+		t.Errorf("Expected decoded description, got '%s'", file.Description)
 	}
 
-	if url[0] != '/' {
-		t.Errorf("Expected URL to start with '/', got '%s'", url)
+	if strings.Join(file.Tags, ",") != "diagrams,work" {
+		t.Errorf("Expected sorted tags, got %v", file.Tags)
 	}
 }
 
-func TestUploadFileAlreadyExists(t *testing.T) {
+func TestUpdateFile(t *testing.T) {
 	cache, _ := lru.New[string, *StoredFile](128)
+	cache.Add("abc12", &StoredFile{OriginalName: "stale.png"})
+	cache.Add("zzz99", &StoredFile{OriginalName: "other.png"})
+
+	var copyInput *s3.CopyObjectInput
+	var taggingInput *s3.PutObjectTaggingInput
 
 	mockS3 := &mockS3Client{
 		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
-			// File already exists
 			return &s3.ListObjectsV2Output{
 				KeyCount: aws.Int32(1),
 				Contents: []types.Object{
-					{Key: aws.String(*params.Prefix + "/existing.txt")},
+					{Key: aws.String("abc123/my diagram.png")},
 				},
 			}, nil
 		},
 		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
 			return &s3.HeadObjectOutput{
-				ContentType: aws.String("text/plain"),
+				ContentType:  aws.String("image/png"),
+				LastModified: aws.Time(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)),
+				Metadata:     map[string]string{"description": "old", "other": "kept"},
 			}, nil
 		},
-		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
-			t.Error("PutObject should not be called for existing file")
-			return nil, nil
+		copyObjectFunc: func(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+			copyInput = params
+			return &s3.CopyObjectOutput{}, nil
+		},
+		putTaggingFunc: func(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+			taggingInput = params
+			return &s3.PutObjectTaggingOutput{}, nil
 		},
 	}
 
@@ -606,65 +864,88 @@ func TestUploadFileAlreadyExists(t *testing.T) {
 		cache:    cache,
 	}
 
-	fileHeader, _ := createMockFileHeader("test.txt", []byte("test content"), "text/plain")
-	file, _ := fileHeader.Open()
-	defer file.Close()
-
-	url, err := client.UploadFile(file, *fileHeader)
+	err := client.UpdateFile(context.Background(), "abc12", FileDetails{Tags: []string{"Work", " diagrams "}, Description: "new"})
 
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 
-	if url == "" {
-		t.Error("Expected URL, got empty string")
+	if aws.ToString(copyInput.CopySource) != "test-bucket/abc123%2Fmy%20diagram.png" {
+		t.Errorf("Expected object to be copied over itself, got source %s", aws.ToString(copyInput.CopySource))
+	}
+	if copyInput.MetadataDirective != types.MetadataDirectiveReplace {
+		t.Errorf("Expected metadata to be replaced, got %s", copyInput.MetadataDirective)
+	}
+	if aws.ToString(copyInput.ContentType) != "image/png" {
+		t.Errorf("Expected content type to be preserved, got %s", aws.ToString(copyInput.ContentType))
+	}
+	if copyInput.Metadata["description"] != "new" || copyInput.Metadata["other"] != "kept" {
+		t.Errorf("Expected description replaced and other metadata kept, got %v", copyInput.Metadata)
+	}
+	if copyInput.Metadata["uploaded"] != "2024-01-02T03:04:05Z" {
+		t.Errorf("Expected the upload time to be kept, got %v", copyInput.Metadata)
+	}
+
+	if strings.Join(tagsFromTagSet(taggingInput.Tagging.TagSet), ",") != "diagrams,work" {
+		t.Errorf("Expected normalized tags, got %v", taggingInput.Tagging.TagSet)
+	}
+
+	if _, found := cache.Get("abc12"); found {
+		t.Error("Expected cached lookup to be invalidated")
+	}
+	if _, found := cache.Get("zzz99"); !found {
+		t.Error("Expected unrelated cache entries to be kept")
 	}
 }
 
-func TestUploadFilePutObjectError(t *testing.T) {
+func TestUpdateFileTagsOnly(t *testing.T) {
 	mockS3 := &mockS3Client{
 		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
 			return &s3.ListObjectsV2Output{
-				KeyCount: aws.Int32(0),
-				Contents: []types.Object{},
+				KeyCount: aws.Int32(1),
+				Contents: []types.Object{{Key: aws.String("abc123/my diagram.png")}},
 			}, nil
 		},
-		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
-			return nil, errors.New("S3 put error")
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			return &s3.HeadObjectOutput{
+				ContentType: aws.String("image/png"),
+				Metadata:    map[string]string{"description": encodeDescription("same old")},
+			}, nil
+		},
+		copyObjectFunc: func(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+			t.Error("Expected the object not to be copied when the description hasn't changed")
+			return &s3.CopyObjectOutput{}, nil
+		},
+		putTaggingFunc: func(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+			return &s3.PutObjectTaggingOutput{}, nil
 		},
 	}
 
 	client := &AWSClient{
 		Bucket:   "test-bucket",
-		CDN:      "https://cdn.example.com",
 		s3Client: mockS3,
-		cache:    nil,
 	}
 
-	fileHeader, _ := createMockFileHeader("test.txt", []byte("test content"), "text/plain")
-	file, _ := fileHeader.Open()
-	defer file.Close()
-
-	_, err := client.UploadFile(file, *fileHeader)
-
-	if err == nil {
-		t.Error("Expected error, got nil")
+	err := client.UpdateFile(context.Background(), "abc12", FileDetails{Tags: []string{"work"}, Description: "same old"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
 	}
 }
 
-func TestUploadFileVerifiesContentType(t *testing.T) {
-	var capturedContentType string
-
+func TestLookupFileKeepsUploadTime(t *testing.T) {
 	mockS3 := &mockS3Client{
 		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
 			return &s3.ListObjectsV2Output{
-				KeyCount: aws.Int32(0),
-				Contents: []types.Object{},
+				KeyCount: aws.Int32(1),
+				Contents: []types.Object{{Key: aws.String("abc123/notes.txt")}},
 			}, nil
 		},
-		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
-			capturedContentType = *params.ContentType
-			return &s3.PutObjectOutput{}, nil
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			return &s3.HeadObjectOutput{
+				ContentType:  aws.String("text/plain"),
+				LastModified: aws.Time(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)),
+				Metadata:     map[string]string{"uploaded": "2024-01-02T03:04:05Z"},
+			}, nil
 		},
 	}
 
@@ -672,64 +953,965 @@ func TestUploadFileVerifiesContentType(t *testing.T) {
 		Bucket:   "test-bucket",
 		CDN:      "https://cdn.example.com",
 		s3Client: mockS3,
-		cache:    nil,
 	}
 
-	fileHeader, _ := createMockFileHeader("image.png", []byte("fake png"), "image/png")
-	file, _ := fileHeader.Open()
-	defer file.Close()
-
-	_, err := client.UploadFile(file, *fileHeader)
-
+	file, err := client.LookupFile(context.Background(), "abc12")
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 
-	if capturedContentType != "image/png" {
-		t.Errorf("Expected content type 'image/png', got '%s'", capturedContentType)
+	if !file.UploadedAt.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("Expected the original upload time, got %s", file.UploadedAt)
 	}
 }
 
-// Test cache operations with actual cache
-
-func TestCacheGetAndSet(t *testing.T) {
-	cache, _ := lru.New[string, *StoredFile](128)
+func TestUpdateFileInvalidDetails(t *testing.T) {
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			t.Error("S3 should not be called with invalid details")
+			return nil, nil
+		},
+	}
 
 	client := &AWSClient{
-		cache: cache,
+		Bucket:   "test-bucket",
+		s3Client: mockS3,
 	}
 
-	testFile := &StoredFile{
-		OriginalName: "test.txt",
-		Url:          "https://example.com/test.txt",
-	}
+	err := client.UpdateFile(context.Background(), "abc12", FileDetails{Tags: []string{"<script>"}})
 
-	// Test set
-	err := client.cacheSet("testkey", testFile)
-	if err != nil {
-		t.Fatalf("Expected no error from cacheSet, got %v", err)
+	if !errors.Is(err, ErrorInvalidDetails) {
+		t.Errorf("Expected ErrorInvalidDetails, got %v", err)
 	}
+}
 
-	// Test get
-	retrieved, found := client.cacheGet("testkey")
-	if !found {
-		t.Fatal("Expected to find cached item")
-	}
+// ListFiles tests
 
-	if retrieved.OriginalName != testFile.OriginalName {
-		t.Errorf("Expected OriginalName '%s', got '%s'", testFile.OriginalName, retrieved.OriginalName)
-	}
-}
+func TestListFiles(t *testing.T) {
+	uploadedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	var capturedToken *string
 
-func TestCacheMiss(t *testing.T) {
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			capturedToken = params.ContinuationToken
+			return &s3.ListObjectsV2Output{
+				KeyCount: aws.Int32(3),
+				Contents: []types.Object{
+					{Key: aws.String("abc123/cat.png"), Size: aws.Int64(1024), LastModified: aws.Time(uploadedAt)},
+					{Key: aws.String("invalidkey")},
+					{Key: aws.String("def456/notes.txt"), Size: aws.Int64(12), LastModified: aws.Time(uploadedAt)},
+				},
+				IsTruncated:           aws.Bool(true),
+				NextContinuationToken: aws.String("next-page"),
+			}, nil
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+		cache:    nil,
+	}
+
+	listing, err := client.ListFiles(context.Background(), "this-page", 10)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if aws.ToString(capturedToken) != "this-page" {
+		t.Errorf("Expected continuation token to be passed through, got %v", capturedToken)
+	}
+
+	if listing.NextToken != "next-page" {
+		t.Errorf("Expected next token 'next-page', got '%s'", listing.NextToken)
+	}
+
+	if len(listing.Files) != 2 {
+		t.Fatalf("Expected invalid keys to be skipped, got %d files", len(listing.Files))
+	}
+
+	image := listing.Files[0]
+	if image.Key != "abc12" || image.OriginalName != "cat.png" || image.Kind != KindImage ||
+		image.Size != 1024 || !image.UploadedAt.Equal(uploadedAt) {
+		t.Errorf("Unexpected first file: %+v", image)
+	}
+
+	if image.Url != "https://cdn.example.com/abc123%2Fcat.png" {
+		t.Errorf("Expected CDN URL, got '%s'", image.Url)
+	}
+
+	if listing.Files[1].Kind != KindText {
+		t.Errorf("Expected KindText for .txt, got %q", listing.Files[1].Kind)
+	}
+}
+
+func TestListFilesLastPage(t *testing.T) {
+	var capturedToken *string
+
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			capturedToken = params.ContinuationToken
+			return &s3.ListObjectsV2Output{
+				KeyCount:    aws.Int32(0),
+				IsTruncated: aws.Bool(false),
+			}, nil
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+		cache:    nil,
+	}
+
+	listing, err := client.ListFiles(context.Background(), "", 10)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if capturedToken != nil {
+		t.Errorf("Expected no continuation token on first page, got %s", *capturedToken)
+	}
+
+	if listing.NextToken != "" {
+		t.Errorf("Expected no next token on last page, got '%s'", listing.NextToken)
+	}
+}
+
+// UploadFile tests
+
+func TestUploadFileSuccess(t *testing.T) {
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			// File doesn't exist yet
+			return &s3.ListObjectsV2Output{
+				KeyCount: aws.Int32(0),
+				Contents: []types.Object{},
+			}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+		cache:    nil,
+	}
+
+	fileHeader, _ := createMockFileHeader("test.txt", []byte("test content"), "text/plain")
+	file, _ := fileHeader.Open()
+	defer file.Close()
+
+	url, stored, err := client.UploadFile(context.Background(), file, *fileHeader, FileDetails{})
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !stored {
+		t.Error("Expected a new file to be stored")
+	}
+
+	// URL should be /keyLength characters (5)
+	if len(url) != 6 { // "/" + 5 chars
+		t.Errorf("Expected URL length 6, got %d: %s", len(url), url)
+	}
+
+	if url[0] != '/' {
+		t.Errorf("Expected URL to start with '/', got '%s'", url)
+	}
+}
+
+func TestUploadFileAlreadyExists(t *testing.T) {
 	cache, _ := lru.New[string, *StoredFile](128)
 
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			// File already exists
+			return &s3.ListObjectsV2Output{
+				KeyCount: aws.Int32(1),
+				Contents: []types.Object{
+					{Key: aws.String(*params.Prefix + "/existing.txt")},
+				},
+			}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			return &s3.HeadObjectOutput{
+				ContentType: aws.String("text/plain"),
+			}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			t.Error("PutObject should not be called for existing file")
+			return nil, nil
+		},
+	}
+
 	client := &AWSClient{
-		cache: cache,
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+		cache:    cache,
 	}
 
-	_, found := client.cacheGet("nonexistent")
-	if found {
-		t.Error("Expected cache miss for nonexistent key")
+	fileHeader, _ := createMockFileHeader("test.txt", []byte("test content"), "text/plain")
+	file, _ := fileHeader.Open()
+	defer file.Close()
+
+	hits := uploadDedupeHits.Value()
+
+	url, stored, err := client.UploadFile(context.Background(), file, *fileHeader, FileDetails{})
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if url == "" {
+		t.Error("Expected URL, got empty string")
+	}
+
+	if stored {
+		t.Error("Expected a duplicate not to be stored again")
+	}
+
+	if uploadDedupeHits.Value() != hits+1 {
+		t.Error("Expected dedupe hit to be counted")
+	}
+}
+
+func TestUploadFilePutObjectError(t *testing.T) {
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{
+				KeyCount: aws.Int32(0),
+				Contents: []types.Object{},
+			}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			return nil, errors.New("S3 put error")
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+		cache:    nil,
+	}
+
+	fileHeader, _ := createMockFileHeader("test.txt", []byte("test content"), "text/plain")
+	file, _ := fileHeader.Open()
+	defer file.Close()
+
+	_, _, err := client.UploadFile(context.Background(), file, *fileHeader, FileDetails{})
+
+	if err == nil {
+		t.Error("Expected error, got nil")
+	}
+}
+
+func TestUploadFileVerifiesContentType(t *testing.T) {
+	var capturedContentType string
+
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{
+				KeyCount: aws.Int32(0),
+				Contents: []types.Object{},
+			}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			capturedContentType = *params.ContentType
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+		cache:    nil,
+	}
+
+	fileHeader, _ := createMockFileHeader("image.png", []byte("fake png"), "image/png")
+	file, _ := fileHeader.Open()
+	defer file.Close()
+
+	_, _, err := client.UploadFile(context.Background(), file, *fileHeader, FileDetails{})
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Without PNG magic numbers, it's not a PNG
+	if capturedContentType != "text/plain; charset=utf-8" {
+		t.Errorf("Expected content type 'text/plain; charset=utf-8', got '%s'", capturedContentType)
+	}
+}
+
+func TestUploadFileSniffsContentType(t *testing.T) {
+	var capturedContentType string
+
+	mockS3 := &mockS3Client{
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			capturedContentType = *params.ContentType
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+		cache:    nil,
+	}
+
+	gif, _ := os.ReadFile("testdata/smol.gif")
+	fileHeader, _ := createMockFileHeader("smol.gif", gif, "application/octet-stream")
+	file, _ := fileHeader.Open()
+	defer file.Close()
+
+	_, _, err := client.UploadFile(context.Background(), file, *fileHeader, FileDetails{})
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if capturedContentType != "image/gif" {
+		t.Errorf("Expected content type 'image/gif', got '%s'", capturedContentType)
+	}
+}
+
+func TestUploadFileRejectsContentTypeMismatch(t *testing.T) {
+	mockS3 := &mockS3Client{
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			t.Error("PutObject should not be called for mismatched content")
+			return nil, nil
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+		cache:    nil,
+	}
+
+	fileHeader, _ := createMockFileHeader("cat.jpg", []byte("<html><script>alert(1)</script></html>"), "image/jpeg")
+	file, _ := fileHeader.Open()
+	defer file.Close()
+
+	_, _, err := client.UploadFile(context.Background(), file, *fileHeader, FileDetails{})
+
+	if !errors.Is(err, ErrorContentTypeMismatch) {
+		t.Errorf("Expected ErrorContentTypeMismatch, got %v", err)
+	}
+}
+
+func TestUploadFileWithDetails(t *testing.T) {
+	var putInput *s3.PutObjectInput
+
+	mockS3 := &mockS3Client{
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			putInput = params
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+		cache:    nil,
+	}
+
+	fileHeader, _ := createMockFileHeader("test.txt", []byte("test content"), "text/plain")
+	file, _ := fileHeader.Open()
+	defer file.Close()
+
+	_, _, err := client.UploadFile(context.Background(), file, *fileHeader, FileDetails{
+		Tags:        []string{"notes", "meeting notes"},
+		Description: "Notes from Monday's meeting",
+	})
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if aws.ToString(putInput.Tagging) != "meeting+notes=&notes=" {
+		t.Errorf("Expected tags to be URL encoded, got '%s'", aws.ToString(putInput.Tagging))
+	}
+
+	if decodeDescription(putInput.Metadata["description"]) != "Notes from Monday's meeting" {
+		t.Errorf("Expected description metadata, got %v", putInput.Metadata)
+	}
+}
+
+// Test cache operations with actual cache
+
+func TestCacheGetAndSet(t *testing.T) {
+	cache, _ := lru.New[string, *StoredFile](128)
+
+	client := &AWSClient{
+		cache: cache,
+	}
+
+	testFile := &StoredFile{
+		OriginalName: "test.txt",
+		Url:          "https://example.com/test.txt",
+	}
+
+	// Test set
+	err := client.cacheSet("testkey", testFile)
+	if err != nil {
+		t.Fatalf("Expected no error from cacheSet, got %v", err)
+	}
+
+	// Test get
+	retrieved, found := client.cacheGet(context.Background(), "testkey")
+	if !found {
+		t.Fatal("Expected to find cached item")
+	}
+
+	if retrieved.OriginalName != testFile.OriginalName {
+		t.Errorf("Expected OriginalName '%s', got '%s'", testFile.OriginalName, retrieved.OriginalName)
+	}
+}
+
+func TestCacheMiss(t *testing.T) {
+	cache, _ := lru.New[string, *StoredFile](128)
+
+	client := &AWSClient{
+		cache: cache,
+	}
+
+	misses := cacheLookups.Value("miss")
+
+	_, found := client.cacheGet(context.Background(), "nonexistent")
+	if found {
+		t.Error("Expected cache miss for nonexistent key")
+	}
+
+	if cacheLookups.Value("miss") != misses+1 {
+		t.Error("Expected cache miss to be counted")
+	}
+}
+
+func TestLookupFileCancelled(t *testing.T) {
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{
+				KeyCount: aws.Int32(1),
+				Contents: []types.Object{
+					{Key: aws.String("abc123/testfile.txt")},
+				},
+			}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			return nil, ctx.Err()
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := client.LookupFile(ctx, "abc12")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled rather than a missing file, got %v", err)
+	}
+}
+
+func TestLookupFileTimeout(t *testing.T) {
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			// Hang until we're given up on
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		Timeouts: Timeouts{Lookup: 10 * time.Millisecond},
+		s3Client: mockS3,
+	}
+
+	_, err := client.LookupFile(context.Background(), "abc12")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestLookupFileCancelledDuringTagsNotCached(t *testing.T) {
+	cache, _ := lru.New[string, *StoredFile](128)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{
+				KeyCount: aws.Int32(1),
+				Contents: []types.Object{
+					{Key: aws.String("abc123/testfile.txt")},
+				},
+			}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			return &s3.HeadObjectOutput{ContentType: aws.String("image/png")}, nil
+		},
+		getTaggingFunc: func(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+			cancel()
+			return nil, ctx.Err()
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+		cache:    cache,
+	}
+
+	_, err := client.LookupFile(ctx, "abc12")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	if _, found := client.cacheGet(context.Background(), "abc12"); found {
+		t.Error("Expected a cancelled lookup not to be cached")
+	}
+}
+
+func TestUploadFilePassesContext(t *testing.T) {
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{KeyCount: aws.Int32(0)}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			if RequestID(ctx) != "upload-1" {
+				t.Errorf("Expected request context to reach PutObject, got request ID %q", RequestID(ctx))
+			}
+			if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+				t.Error("Expected upload timeout to be applied")
+			}
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		Timeouts: DefaultTimeouts,
+		s3Client: mockS3,
+	}
+
+	fileHeader, _ := createMockFileHeader("test.txt", []byte("test content"), "text/plain")
+	file, _ := fileHeader.Open()
+	defer file.Close()
+
+	_, _, err := client.UploadFile(withRequestID(context.Background(), "upload-1"), file, *fileHeader, FileDetails{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
+
+func TestCheckBucket(t *testing.T) {
+	calls := 0
+	mockS3 := &mockS3Client{
+		headBucketFunc: func(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+			calls++
+			if aws.ToString(params.Bucket) != "test-bucket" {
+				t.Errorf("Expected bucket test-bucket, got %s", aws.ToString(params.Bucket))
+			}
+			return nil, errors.New("forbidden")
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		s3Client: mockS3,
+	}
+
+	err := client.CheckBucket(context.Background())
+	if !errors.Is(err, ErrorBucketUnavailable) {
+		t.Errorf("Expected ErrorBucketUnavailable, got %v", err)
+	}
+
+	err = client.CheckBucket(context.Background())
+	if !errors.Is(err, ErrorBucketUnavailable) {
+		t.Errorf("Expected cached ErrorBucketUnavailable, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected the result to be cached, but HeadBucket was called %d times", calls)
+	}
+
+	// Once the cached result is stale, the bucket is checked again
+	client.bucketCheckedAt = time.Now().Add(-bucketCheckInterval)
+	_ = client.CheckBucket(context.Background())
+	if calls != 2 {
+		t.Errorf("Expected a stale result to be rechecked, but HeadBucket was called %d times", calls)
+	}
+}
+
+func TestCheckBucketCancelledNotCached(t *testing.T) {
+	calls := 0
+	mockS3 := &mockS3Client{
+		headBucketFunc: func(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+			calls++
+			return nil, ctx.Err()
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		s3Client: mockS3,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := client.CheckBucket(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if err := client.CheckBucket(context.Background()); err != nil {
+		t.Errorf("Expected a fresh check to succeed, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected the cancelled check not to be cached, got %d calls", calls)
+	}
+}
+
+func TestCheckBucketConcurrent(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	mockS3 := &mockS3Client{
+		headBucketFunc: func(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+			calls.Add(1)
+			<-release
+			return &s3.HeadBucketOutput{}, nil
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		s3Client: mockS3,
+	}
+
+	var wait sync.WaitGroup
+	for range 5 {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if err := client.CheckBucket(context.Background()); err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		}()
+	}
+
+	// Waiting on a slow check shouldn't stop anyone giving up on it
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.CheckBucket(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled while a check is in flight, got %v", err)
+	}
+
+	close(release)
+	wait.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("Expected concurrent checks to share one HeadBucket, got %d", calls.Load())
+	}
+}
+
+func TestUploadFileRecordsUploader(t *testing.T) {
+	var putInput *s3.PutObjectInput
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{KeyCount: aws.Int32(0)}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			putInput = params
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+
+	quotas, _ := NewQuotas("", Quota{}, nil)
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		s3Client: mockS3,
+		Quotas:   quotas,
+	}
+
+	fileHeader, _ := createMockFileHeader("test.txt", []byte("test content"), "text/plain")
+	file, _ := fileHeader.Open()
+	defer file.Close()
+
+	_, _, err := client.UploadFile(withUser(context.Background(), "skalnik"), file, *fileHeader, FileDetails{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if decodeDescription(putInput.Metadata["uploader"]) != "skalnik" {
+		t.Errorf("Expected uploader in metadata, got %v", putInput.Metadata)
+	}
+	if usage := quotas.Usage("skalnik"); usage != (Usage{Bytes: fileHeader.Size, Files: 1}) {
+		t.Errorf("Expected upload to count towards usage, got %+v", usage)
+	}
+}
+
+func TestUploadFileMetadataTooBig(t *testing.T) {
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{KeyCount: aws.Int32(0)}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			t.Error("S3 should not be sent more metadata than it stores")
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+
+	quotas, _ := NewQuotas("", Quota{}, nil)
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		s3Client: mockS3,
+		Quotas:   quotas,
+	}
+
+	fileHeader, _ := createMockFileHeader("test.txt", []byte("test content"), "text/plain")
+	file, _ := fileHeader.Open()
+	defer file.Close()
+
+	// Each fits alone, but not together
+	uploader := strings.Repeat("u", maxMetadataSize-maxDescriptionLength)
+	details := FileDetails{Description: strings.Repeat("d", maxDescriptionLength)}
+	_, _, err := client.UploadFile(withUser(context.Background(), uploader), file, *fileHeader, details)
+	if !errors.Is(err, ErrorInvalidDetails) {
+		t.Errorf("Expected ErrorInvalidDetails, got %v", err)
+	}
+	if usage := quotas.Usage(uploader); usage != (Usage{}) {
+		t.Errorf("Expected nothing to count towards usage, got %+v", usage)
+	}
+}
+
+func TestUploadFileOverQuota(t *testing.T) {
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{KeyCount: aws.Int32(0)}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			t.Error("PutObject should not be called over quota")
+			return nil, nil
+		},
+	}
+
+	quotas, _ := NewQuotas("", Quota{Bytes: 4}, nil)
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		s3Client: mockS3,
+		Quotas:   quotas,
+	}
+
+	fileHeader, _ := createMockFileHeader("test.txt", []byte("test content"), "text/plain")
+	file, _ := fileHeader.Open()
+	defer file.Close()
+
+	_, _, err := client.UploadFile(withUser(context.Background(), "skalnik"), file, *fileHeader, FileDetails{})
+	if !errors.Is(err, ErrorQuotaExceeded) {
+		t.Errorf("Expected ErrorQuotaExceeded, got %v", err)
+	}
+}
+
+func TestUploadFilePutErrorReleasesQuota(t *testing.T) {
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{KeyCount: aws.Int32(0)}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			return nil, errors.New("S3 is on fire")
+		},
+	}
+
+	quotas, _ := NewQuotas("", Quota{Files: 1}, nil)
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		s3Client: mockS3,
+		Quotas:   quotas,
+	}
+
+	fileHeader, _ := createMockFileHeader("test.txt", []byte("test content"), "text/plain")
+	file, _ := fileHeader.Open()
+	defer file.Close()
+
+	_, _, _ = client.UploadFile(context.Background(), file, *fileHeader, FileDetails{})
+
+	if usage := quotas.Usage(""); usage != (Usage{}) {
+		t.Errorf("Expected a failed upload not to count, got %+v", usage)
+	}
+	if _, err := quotas.Reserve("", 1); err != nil {
+		t.Errorf("Expected the reservation to be released, got %v", err)
+	}
+}
+
+func TestUploadFileDuplicateSkipsQuota(t *testing.T) {
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{
+				KeyCount: aws.Int32(1),
+				Contents: []types.Object{{Key: aws.String(*params.Prefix + "/existing.txt")}},
+			}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			return &s3.HeadObjectOutput{ContentType: aws.String("text/plain")}, nil
+		},
+	}
+
+	// Already full, but a duplicate doesn't take up any more space
+	quotas, _ := NewQuotas("", Quota{Bytes: 1}, nil)
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+		Quotas:   quotas,
+	}
+
+	fileHeader, _ := createMockFileHeader("test.txt", []byte("test content"), "text/plain")
+	file, _ := fileHeader.Open()
+	defer file.Close()
+
+	_, _, err := client.UploadFile(context.Background(), file, *fileHeader, FileDetails{})
+	if err != nil {
+		t.Errorf("Expected duplicate to be allowed, got %v", err)
+	}
+}
+
+func TestLookupFileUploader(t *testing.T) {
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{
+				KeyCount: aws.Int32(1),
+				Contents: []types.Object{{Key: aws.String("ABCDE12345/file.txt")}},
+			}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			return &s3.HeadObjectOutput{
+				ContentType: aws.String("application/octet-stream"),
+				Metadata:    map[string]string{"uploader": encodeDescription("zoë")},
+			}, nil
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+	}
+
+	file, err := client.LookupFile(context.Background(), "ABCDE")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if file.Uploader != "zoë" {
+		t.Errorf("Expected uploader from metadata, got %q", file.Uploader)
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	cache, _ := lru.New[string, *StoredFile](128)
+	cache.Add("abc12", &StoredFile{OriginalName: "stale.png"})
+
+	quotas, _ := NewQuotas("", Quota{}, nil)
+	settle, _ := quotas.Reserve("guest", 300)
+	settle(true)
+
+	var deleteInput *s3.DeleteObjectInput
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{
+				KeyCount: aws.Int32(1),
+				Contents: []types.Object{{Key: aws.String("abc123/my diagram.png")}},
+			}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			return &s3.HeadObjectOutput{
+				ContentLength: aws.Int64(300),
+				Metadata:      map[string]string{uploaderMetadataKey: "guest"},
+			}, nil
+		},
+		deleteObjectFunc: func(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+			deleteInput = params
+			return &s3.DeleteObjectOutput{}, nil
+		},
+	}
+
+	client := &AWSClient{Bucket: "test-bucket", s3Client: mockS3, cache: cache, Quotas: quotas}
+
+	if err := client.DeleteFile(context.Background(), "abc12"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if aws.ToString(deleteInput.Key) != "abc123/my diagram.png" {
+		t.Errorf("Expected the full object key to be deleted, got %s", aws.ToString(deleteInput.Key))
+	}
+	if cache.Contains("abc12") {
+		t.Error("Expected cached lookups to be dropped")
+	}
+	if usage := quotas.Usage("guest"); usage != (Usage{}) {
+		t.Errorf("Expected the uploader's quota to be released, got %+v", usage)
+	}
+}
+
+func TestDeleteFileError(t *testing.T) {
+	quotas, _ := NewQuotas("", Quota{}, nil)
+	settle, _ := quotas.Reserve("", 300)
+	settle(true)
+
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{
+				KeyCount: aws.Int32(1),
+				Contents: []types.Object{{Key: aws.String("abc123/my diagram.png")}},
+			}, nil
+		},
+		deleteObjectFunc: func(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+			return nil, errors.New("access denied")
+		},
+	}
+
+	client := &AWSClient{Bucket: "test-bucket", s3Client: mockS3, Quotas: quotas}
+
+	if err := client.DeleteFile(context.Background(), "abc12"); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if usage := quotas.Usage(""); usage.Files != 1 {
+		t.Errorf("Expected quota to be untouched when the delete fails, got %+v", usage)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	if stats := (&AWSClient{}).CacheStats(); stats != nil {
+		t.Errorf("Expected no stats without a cache, got %+v", stats)
+	}
+
+	cache, _ := lru.New[string, *StoredFile](lookupCacheSize)
+	cache.Add("abc12", &StoredFile{})
+	client := &AWSClient{cache: cache}
+
+	stats := client.CacheStats()
+	if stats == nil || stats.Size != 1 || stats.Capacity != lookupCacheSize {
+		t.Errorf("Expected one cached lookup, got %+v", stats)
 	}
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+)
+
+var ErrorInvalidConfig = errors.New("invalid config file")
+
+// ConfigFile fills in settings from a TOML file. Keys are the same as the
+// flag names, and can be grouped into tables, so these are equivalent:
+//
+//	log-level = "info"
+//
+//	[log]
+//	level = "info"
+//
+// Flags beat environment variables, which beat the file, which beats the
+// defaults. Anything set by a flag or environment variable is pinned and
+// never touched by the file, even on reload.
+type ConfigFile struct {
+	path   string
+	flags  *flag.FlagSet
+	pinned map[string]bool
+}
+
+// LoadConfigFile applies a config file to flags that have already been
+// parsed. With no path there's nothing to apply.
+func LoadConfigFile(flags *flag.FlagSet, path string) (*ConfigFile, error) {
+	config := &ConfigFile{
+		path:   path,
+		flags:  flags,
+		pinned: map[string]bool{},
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		config.pinned[f.Name] = true
+	})
+	flags.VisitAll(func(f *flag.Flag) {
+		if _, set := os.LookupEnv(envName(f.Name)); set {
+			config.pinned[f.Name] = true
+		}
+	})
+
+	values, err := config.read()
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range values {
+		if config.pinned[name] {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrorInvalidConfig, name, err)
+		}
+	}
+
+	return config, nil
+}
+
+// Values re-reads the file and returns what every setting would be now,
+// without changing the flags
+func (config *ConfigFile) Values() (map[string]string, error) {
+	values, err := config.read()
+	if err != nil {
+		return nil, err
+	}
+
+	current := map[string]string{}
+	config.flags.VisitAll(func(f *flag.Flag) {
+		switch value, inFile := values[f.Name]; {
+		case config.pinned[f.Name]:
+			current[f.Name] = f.Value.String()
+		case inFile:
+			current[f.Name] = value
+		default:
+			current[f.Name] = f.DefValue
+		}
+	})
+
+	return current, nil
+}
+
+// read parses the file into flag names and values, rejecting anything that
+// isn't a flag so typos don't go unnoticed
+func (config *ConfigFile) read() (map[string]string, error) {
+	values := map[string]string{}
+	if config.path == "" {
+		return values, nil
+	}
+
+	var raw map[string]any
+	if _, err := toml.DecodeFile(config.path, &raw); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrorInvalidConfig, err)
+	}
+
+	if err := flattenConfig("", raw, values); err != nil {
+		return nil, err
+	}
+
+	var unknown []string
+	for name := range values {
+		if config.flags.Lookup(name) == nil {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return nil, fmt.Errorf("%w: unknown settings %s", ErrorInvalidConfig, strings.Join(unknown, ", "))
+	}
+
+	return values, nil
+}
+
+func flattenConfig(prefix string, raw map[string]any, values map[string]string) error {
+	for key, value := range raw {
+		name := key
+		if prefix != "" {
+			name = prefix + "-" + key
+		}
+
+		switch value := value.(type) {
+		case map[string]any:
+			if err := flattenConfig(name, value, values); err != nil {
+				return err
+			}
+		case string:
+			values[name] = value
+		case bool, int64, float64:
+			values[name] = fmt.Sprint(value)
+		default:
+			return fmt.Errorf("%w: %s must be a string, number or boolean", ErrorInvalidConfig, name)
+		}
+	}
+
+	return nil
+}
+
+// envName is the environment variable for a flag, e.g. log-level is LOG_LEVEL
+func envName(flagName string) string {
+	return strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// handleReloads calls reload every time we get a SIGHUP
+func handleReloads(reload func() error) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	for range hangups {
+		slog.Info("Reloading config")
+		if err := reload(); err != nil {
+			slog.Error("Failed to reload config, keeping current settings", "error", err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testFlags(args ...string) (*flag.FlagSet, *string, *string, *string) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	bucket := flags.String("bucket", LookupEnvDefault("BUCKET", "file-cloud"), "")
+	logLevel := flags.String("log-level", LookupEnvDefault("LOG_LEVEL", "debug"), "")
+	plausible := flags.String("plausible", LookupEnvDefault("PLAUSIBLE", ""), "")
+	_ = flags.Parse(args)
+	return flags, bucket, logLevel, plausible
+}
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Couldn't write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfig(t, `
+bucket = "from-file"
+
+[log]
+level = "warn"
+`)
+	flags, bucket, logLevel, plausible := testFlags()
+
+	_, err := LoadConfigFile(flags, path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if *bucket != "from-file" {
+		t.Errorf("Expected bucket from file, got %s", *bucket)
+	}
+	if *logLevel != "warn" {
+		t.Errorf("Expected log level from [log] table, got %s", *logLevel)
+	}
+	if *plausible != "" {
+		t.Errorf("Expected default for settings not in the file, got %s", *plausible)
+	}
+}
+
+func TestLoadConfigFilePrecedence(t *testing.T) {
+	path := writeConfig(t, `
+bucket = "from-file"
+log-level = "warn"
+`)
+	t.Setenv("LOG_LEVEL", "error")
+	flags, bucket, logLevel, _ := testFlags("-bucket", "from-flag")
+
+	_, err := LoadConfigFile(flags, path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if *bucket != "from-flag" {
+		t.Errorf("Expected flag to beat the file, got %s", *bucket)
+	}
+	if *logLevel != "error" {
+		t.Errorf("Expected environment to beat the file, got %s", *logLevel)
+	}
+}
+
+func TestLoadConfigFileUnknownSetting(t *testing.T) {
+	path := writeConfig(t, `buckte = "typo"`)
+	flags, _, _, _ := testFlags()
+
+	_, err := LoadConfigFile(flags, path)
+	if !errors.Is(err, ErrorInvalidConfig) {
+		t.Errorf("Expected ErrorInvalidConfig, got %v", err)
+	}
+}
+
+func TestLoadConfigFileMalformed(t *testing.T) {
+	path := writeConfig(t, `bucket = `)
+	flags, _, _, _ := testFlags()
+
+	_, err := LoadConfigFile(flags, path)
+	if !errors.Is(err, ErrorInvalidConfig) {
+		t.Errorf("Expected ErrorInvalidConfig, got %v", err)
+	}
+}
+
+func TestLoadConfigFileWithoutPath(t *testing.T) {
+	flags, bucket, _, _ := testFlags()
+
+	config, err := LoadConfigFile(flags, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if *bucket != "file-cloud" {
+		t.Errorf("Expected default bucket, got %s", *bucket)
+	}
+
+	values, err := config.Values()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if values["bucket"] != "file-cloud" {
+		t.Errorf("Expected default bucket, got %s", values["bucket"])
+	}
+}
+
+func TestConfigFileValues(t *testing.T) {
+	path := writeConfig(t, `
+log-level = "warn"
+plausible = "example.com"
+`)
+	flags, _, _, _ := testFlags("-plausible", "pinned.example.com")
+
+	config, err := LoadConfigFile(flags, path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Edit the file, as if before a SIGHUP
+	_ = os.WriteFile(path, []byte(`
+log-level = "error"
+plausible = "changed.example.com"
+`), 0644)
+
+	values, err := config.Values()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if values["log-level"] != "error" {
+		t.Errorf("Expected reloaded log level, got %s", values["log-level"])
+	}
+	if values["plausible"] != "pinned.example.com" {
+		t.Errorf("Expected flag to stay pinned over the file, got %s", values["plausible"])
+	}
+	if values["bucket"] != "file-cloud" {
+		t.Errorf("Expected default bucket, got %s", values["bucket"])
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if name := envName("access-log-format"); name != "ACCESS_LOG_FORMAT" {
+		t.Errorf("Expected ACCESS_LOG_FORMAT, got %s", name)
+	}
+}
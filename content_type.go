@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+var ErrorContentTypeMismatch = errors.New("file content does not match its declared type")
+
+// Number of bytes needed to sniff a content type, matching http.DetectContentType
+const sniffLength = 512
+
+// Extensions that Go's mime package either doesn't know about or gets wrong
+// on systems without a mime.types file
+var extensionContentTypes = map[string]string{
+	".md":   "text/markdown; charset=utf-8",
+	".log":  "text/plain; charset=utf-8",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+	".toml": "application/toml",
+	".csv":  "text/csv; charset=utf-8",
+	".mov":  "video/quicktime",
+	".mkv":  "video/x-matroska",
+	".m4a":  "audio/mp4",
+	".flac": "audio/flac",
+	".opus": "audio/ogg",
+	".ogg":  "audio/ogg",
+	".heic": "image/heic",
+	".7z":   "application/x-7z-compressed",
+	".xz":   "application/x-xz",
+	".bz2":  "application/x-bzip2",
+	".tar":  "application/x-tar",
+	".gz":   "application/gzip",
+	".zst":  "application/zstd",
+	".rar":  "application/vnd.rar",
+}
+
+type magicNumber struct {
+	offset      int
+	magic       []byte
+	contentType string
+}
+
+// Signatures http.DetectContentType doesn't recognise, or recognises too
+// broadly (it calls anything with an ftyp box video/mp4). Checked first.
+var magicNumbers = []magicNumber{
+	{0, []byte("7z\xBC\xAF\x27\x1C"), "application/x-7z-compressed"},
+	{0, []byte("\xFD7zXZ\x00"), "application/x-xz"},
+	{0, []byte("BZh"), "application/x-bzip2"},
+	{0, []byte("\x28\xB5\x2F\xFD"), "application/zstd"},
+	{0, []byte("fLaC"), "audio/flac"},
+	{4, []byte("ftypM4A "), "audio/mp4"},
+	{4, []byte("ftypqt  "), "video/quicktime"},
+	{4, []byte("ftypheic"), "image/heic"},
+	{257, []byte("ustar"), "application/x-tar"},
+}
+
+// Sniffed types that can't tell similar formats apart, mapped to the
+// prefixes of declared types we'll accept as a more specific answer
+var ambiguousContentTypes = map[string][]string{
+	"application/octet-stream": {""},
+	"text/plain":               {""},
+	"text/xml":                 {"text/", "application/"},
+	"text/html":                {"text/"},
+	"application/ogg":          {"audio/", "video/"},
+	"video/webm":               {"audio/", "video/"},
+	"video/mp4":                {"audio/", "video/"},
+	"application/zip": {
+		"application/vnd.openxmlformats-officedocument.",
+		"application/vnd.oasis.opendocument.",
+		"application/epub+zip",
+		"application/java-archive",
+		"application/vnd.android.package-archive",
+	},
+}
+
+// Types a browser will run scripts in, including plain XML, which can pull
+// in XHTML or a stylesheet. These are only stored as declared when that's
+// what the file sniffs as, otherwise they're served as text.
+var activeContentTypes = map[string]bool{
+	"text/html":             true,
+	"application/xhtml+xml": true,
+	"image/svg+xml":         true,
+	"text/xml":              true,
+	"application/xml":       true,
+}
+
+// DetectContentType works out what to store a file as, given its name, the
+// Content-Type the client sent, and the first few bytes of the file. The
+// sniffed type wins unless it's ambiguous, in which case a compatible
+// declared (or extension derived) type is used, as long as it isn't a type
+// scripts can run in, or media without the magic numbers to back it up.
+// HTML or XML masquerading as anything other than text is refused outright.
+func DetectContentType(filename string, declared string, head []byte) (string, error) {
+	sniffed := sniffContentType(head)
+
+	claimed := declared
+	if isGenericContentType(claimed) {
+		claimed = extensionContentType(filename)
+	}
+
+	if claimed == "" {
+		return sniffed, nil
+	}
+
+	sniffedType := mediaType(sniffed)
+	claimedType := mediaType(claimed)
+
+	if activeContentTypes[sniffedType] && !strings.HasPrefix(claimedType, "text/") && !activeContentTypes[claimedType] {
+		return "", fmt.Errorf("%w: %s looks like %s but was sent as %s", ErrorContentTypeMismatch, filename, sniffedType, claimedType)
+	}
+
+	if sniffedType == claimedType {
+		return claimed, nil
+	}
+
+	if activeContentTypes[claimedType] {
+		if strings.HasPrefix(sniffedType, "text/") {
+			return "text/plain; charset=utf-8", nil
+		}
+		return sniffed, nil
+	}
+
+	if isMediaContentType(claimedType) && !isMediaContentType(sniffedType) {
+		return sniffed, nil
+	}
+
+	for _, prefix := range ambiguousContentTypes[sniffedType] {
+		if strings.HasPrefix(claimedType, prefix) {
+			return claimed, nil
+		}
+	}
+
+	return sniffed, nil
+}
+
+func sniffContentType(head []byte) string {
+	for _, number := range magicNumbers {
+		end := number.offset + len(number.magic)
+		if len(head) >= end && bytes.Equal(head[number.offset:end], number.magic) {
+			return number.contentType
+		}
+	}
+
+	return http.DetectContentType(head)
+}
+
+func extensionContentType(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == "" {
+		return ""
+	}
+
+	if contentType, ok := extensionContentTypes[ext]; ok {
+		return contentType
+	}
+
+	return mime.TypeByExtension(ext)
+}
+
+// isMediaContentType is whether contentType is an image, video or audio, or
+// a container that could hold either
+func isMediaContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "image/") || strings.HasPrefix(contentType, "video/") ||
+		strings.HasPrefix(contentType, "audio/") || contentType == "application/ogg"
+}
+
+func isGenericContentType(contentType string) bool {
+	switch mediaType(contentType) {
+	case "", "application/octet-stream", "binary/octet-stream":
+		return true
+	}
+	return false
+}
+
+func mediaType(contentType string) string {
+	parsed, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return parsed
+}
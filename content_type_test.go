@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestDetectContentTypeSniffsOverGenericDeclaration(t *testing.T) {
+	gif, _ := os.ReadFile("testdata/smol.gif")
+
+	contentType, err := DetectContentType("smol.gif", "application/octet-stream", gif)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if contentType != "image/gif" {
+		t.Errorf("Expected image/gif, got %s", contentType)
+	}
+}
+
+func TestDetectContentTypeSniffsOverWrongDeclaration(t *testing.T) {
+	gif, _ := os.ReadFile("testdata/smol.gif")
+
+	contentType, err := DetectContentType("smol.mp4", "video/mp4", gif)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if contentType != "image/gif" {
+		t.Errorf("Expected image/gif, got %s", contentType)
+	}
+}
+
+func TestDetectContentTypeFallsBackToExtension(t *testing.T) {
+	contentType, err := DetectContentType("notes.md", "", []byte("# Hello\n\nworld"))
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if contentType != "text/markdown; charset=utf-8" {
+		t.Errorf("Expected text/markdown, got %s", contentType)
+	}
+}
+
+func TestDetectContentTypeKeepsDeclaredForAmbiguousSniff(t *testing.T) {
+	cases := []struct {
+		filename string
+		declared string
+		head     []byte
+	}{
+		{"song.ogg", "audio/ogg", []byte("OggS\x00\x02")},
+		{"report.docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", []byte("PK\x03\x04")},
+		{"data.json", "application/json", []byte(`{"hello": "world"}`)},
+	}
+
+	for _, c := range cases {
+		contentType, err := DetectContentType(c.filename, c.declared, c.head)
+		if err != nil {
+			t.Errorf("DetectContentType(%s) returned error: %v", c.filename, err)
+		}
+		if contentType != c.declared {
+			t.Errorf("DetectContentType(%s) = %s, want %s", c.filename, contentType, c.declared)
+		}
+	}
+}
+
+func TestDetectContentTypeExtraMagicNumbers(t *testing.T) {
+	cases := map[string][]byte{
+		"application/x-7z-compressed": []byte("7z\xBC\xAF\x27\x1C\x00\x04"),
+		"audio/flac":                  []byte("fLaC\x00\x00\x00\x22"),
+		"audio/mp4":                   []byte("\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00"),
+	}
+
+	for expected, head := range cases {
+		contentType, err := DetectContentType("upload", "", head)
+		if err != nil {
+			t.Errorf("Expected no error for %s, got %v", expected, err)
+		}
+		if contentType != expected {
+			t.Errorf("Expected %s, got %s", expected, contentType)
+		}
+	}
+}
+
+func TestDetectContentTypeRefusesHTMLAsImage(t *testing.T) {
+	html := []byte("<!DOCTYPE html><html><script>alert(1)</script></html>")
+
+	_, err := DetectContentType("cat.png", "image/png", html)
+	if !errors.Is(err, ErrorContentTypeMismatch) {
+		t.Errorf("Expected ErrorContentTypeMismatch for declared image, got %v", err)
+	}
+
+	_, err = DetectContentType("cat.png", "", html)
+	if !errors.Is(err, ErrorContentTypeMismatch) {
+		t.Errorf("Expected ErrorContentTypeMismatch for image extension, got %v", err)
+	}
+
+	xhtml := []byte(`<?xml version="1.0"?><x:script xmlns:x="http://www.w3.org/1999/xhtml">alert(1)</x:script>`)
+	_, err = DetectContentType("cat.png", "image/png", xhtml)
+	if !errors.Is(err, ErrorContentTypeMismatch) {
+		t.Errorf("Expected ErrorContentTypeMismatch for XML declared as an image, got %v", err)
+	}
+}
+
+func TestDetectContentTypeAllowsHTMLAsText(t *testing.T) {
+	html := []byte("<html><body>snippet</body></html>")
+
+	contentType, err := DetectContentType("snippet.txt", "text/plain", html)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if contentType != "text/plain" {
+		t.Errorf("Expected HTML sent as text to stay text/plain, got %s", contentType)
+	}
+
+	contentType, err = DetectContentType("page.html", "text/html", html)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if contentType != "text/html" {
+		t.Errorf("Expected text/html, got %s", contentType)
+	}
+}
+
+func TestDetectContentTypeDowngradesActiveContent(t *testing.T) {
+	cases := []struct {
+		filename string
+		declared string
+		head     []byte
+	}{
+		{"drawing.svg", "image/svg+xml", []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"></svg>`)},
+		{"page.xhtml", "application/xhtml+xml", []byte(`<?xml version="1.0"?><html xmlns="http://www.w3.org/1999/xhtml"></html>`)},
+		{"page.html", "text/html", []byte("just some text")},
+		{"drawing.svg", "", []byte("just some text")},
+		{"feed.xml", "application/xml", []byte(`<?xml version="1.0"?><?xml-stylesheet href="evil.xsl"?><feed/>`)},
+		{"notes.xml", "text/xml", []byte("just some text")},
+		{"notes.xml", "", []byte("just some text")},
+	}
+
+	for _, c := range cases {
+		contentType, err := DetectContentType(c.filename, c.declared, c.head)
+		if err != nil {
+			t.Errorf("DetectContentType(%s) returned error: %v", c.filename, err)
+		}
+		if contentType != "text/plain; charset=utf-8" {
+			t.Errorf("DetectContentType(%s) = %s, want text/plain", c.filename, contentType)
+		}
+	}
+}
+
+func TestDetectContentTypeRequiresMagicNumbersForMedia(t *testing.T) {
+	cases := []struct {
+		filename string
+		declared string
+		head     []byte
+		expected string
+	}{
+		{"cat.png", "image/png", []byte("fake png"), "text/plain; charset=utf-8"},
+		{"song.mp3", "audio/mpeg", []byte("\x00\x01\x02\x03"), "application/octet-stream"},
+		{"clip.mp4", "", []byte("not a video"), "text/plain; charset=utf-8"},
+		{"song.webm", "audio/webm", []byte("\x1A\x45\xDF\xA3"), "audio/webm"},
+	}
+
+	for _, c := range cases {
+		contentType, err := DetectContentType(c.filename, c.declared, c.head)
+		if err != nil {
+			t.Errorf("DetectContentType(%s) returned error: %v", c.filename, err)
+		}
+		if contentType != c.expected {
+			t.Errorf("DetectContentType(%s) = %s, want %s", c.filename, contentType, c.expected)
+		}
+	}
+}
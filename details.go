@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+var ErrorInvalidDetails = errors.New("invalid tags or description")
+
+// S3 allows 10 tags per object, each key up to 128 characters
+const (
+	maxTags              = 10
+	maxTagLength         = 128
+	maxDescriptionLength = 500
+)
+
+// S3 limits user metadata to 2KB, counting the bytes of every key and value.
+// Descriptions are encoded first, which can make them several times longer.
+const maxMetadataSize = 2 * 1024
+
+// Tag keys starting with this are reserved by AWS
+const reservedTagPrefix = "aws:"
+
+// Metadata key the description is stored under (x-amz-meta-description)
+const descriptionMetadataKey = "description"
+
+// Metadata key the original upload time is kept under (x-amz-meta-uploaded),
+// as copying an object to change its description resets LastModified
+const uploadedMetadataKey = "uploaded"
+
+// FileDetails are the user editable parts of a stored file
+type FileDetails struct {
+	Tags        []string `json:"tags"`
+	Description string   `json:"description"`
+}
+
+// ParseTags splits a comma separated list of tags, as typed into a form
+func ParseTags(raw string) []string {
+	if strings.TrimSpace(raw) == "" {
+		return nil
+	}
+
+	return strings.Split(raw, ",")
+}
+
+// Normalize lower cases and deduplicates tags and trims the description, then
+// checks everything fits within what S3 will store
+func (details FileDetails) Normalize() (FileDetails, error) {
+	normalized := FileDetails{
+		Tags:        []string{},
+		Description: strings.TrimSpace(details.Description),
+	}
+
+	for _, tag := range details.Tags {
+		tag = strings.ToLower(strings.Join(strings.Fields(tag), " "))
+		if tag == "" || slices.Contains(normalized.Tags, tag) {
+			continue
+		}
+
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return FileDetails{}, fmt.Errorf("%w: tags can be at most %d characters", ErrorInvalidDetails, maxTagLength)
+		}
+		if strings.IndexFunc(tag, isInvalidTagRune) >= 0 {
+			return FileDetails{}, fmt.Errorf("%w: tag %q may only contain letters, numbers, spaces and + - = . _ : / @", ErrorInvalidDetails, tag)
+		}
+		if strings.HasPrefix(tag, reservedTagPrefix) {
+			return FileDetails{}, fmt.Errorf("%w: tags can't start with %q", ErrorInvalidDetails, reservedTagPrefix)
+		}
+
+		normalized.Tags = append(normalized.Tags, tag)
+	}
+
+	if len(normalized.Tags) > maxTags {
+		return FileDetails{}, fmt.Errorf("%w: at most %d tags are allowed", ErrorInvalidDetails, maxTags)
+	}
+
+	if utf8.RuneCountInString(normalized.Description) > maxDescriptionLength {
+		return FileDetails{}, fmt.Errorf("%w: descriptions can be at most %d characters", ErrorInvalidDetails, maxDescriptionLength)
+	}
+	if err := checkMetadataSize(map[string]string{descriptionMetadataKey: encodeDescription(normalized.Description)}); err != nil {
+		return FileDetails{}, err
+	}
+
+	return normalized, nil
+}
+
+// The characters S3 accepts in tag keys
+func isInvalidTagRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r) && !strings.ContainsRune(" +-=._:/@", r)
+}
+
+// Tags are stored as S3 object tags with empty values, since they're free
+// form labels rather than key/value pairs
+func encodeTagging(tags []string) string {
+	values := url.Values{}
+	for _, tag := range tags {
+		values.Set(tag, "")
+	}
+	return values.Encode()
+}
+
+func tagSet(tags []string) []types.Tag {
+	set := make([]types.Tag, 0, len(tags))
+	for _, tag := range tags {
+		set = append(set, types.Tag{Key: aws.String(tag), Value: aws.String("")})
+	}
+	return set
+}
+
+func tagsFromTagSet(set []types.Tag) []string {
+	tags := make([]string, 0, len(set))
+	for _, tag := range set {
+		if tag.Key != nil {
+			tags = append(tags, *tag.Key)
+		}
+	}
+	slices.Sort(tags)
+	return tags
+}
+
+// S3 metadata travels as HTTP headers, so anything outside printable ASCII
+// has to be RFC 2047 encoded
+func encodeDescription(description string) string {
+	return mime.QEncoding.Encode("utf-8", description)
+}
+
+// checkMetadataSize makes sure all of an object's metadata fits within what
+// S3 will store
+func checkMetadataSize(metadata map[string]string) error {
+	size := 0
+	for key, value := range metadata {
+		size += len(key) + len(value)
+	}
+
+	if size > maxMetadataSize {
+		return fmt.Errorf("%w: the description is too long to store, at %d bytes of metadata out of %d", ErrorInvalidDetails, size, maxMetadataSize)
+	}
+
+	return nil
+}
+
+func decodeDescription(encoded string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(encoded)
+	if err != nil {
+		return encoded
+	}
+	return decoded
+}
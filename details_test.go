@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	if tags := ParseTags("  "); tags != nil {
+		t.Errorf("Expected no tags for blank input, got %v", tags)
+	}
+
+	tags := ParseTags("work, diagrams,,network")
+	if len(tags) != 4 {
+		t.Errorf("Expected raw comma separated tags, got %v", tags)
+	}
+}
+
+func TestNormalizeDetails(t *testing.T) {
+	details, err := FileDetails{
+		Tags:        []string{" Work ", "work", "", "big   diagram", "user@example.com"},
+		Description: "  A diagram  ",
+	}.Normalize()
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if strings.Join(details.Tags, ",") != "work,big diagram,user@example.com" {
+		t.Errorf("Expected lower cased, deduplicated tags, got %v", details.Tags)
+	}
+
+	if details.Description != "A diagram" {
+		t.Errorf("Expected trimmed description, got '%s'", details.Description)
+	}
+}
+
+func TestNormalizeDetailsLimits(t *testing.T) {
+	tooMany := make([]string, maxTags+1)
+	for i := range tooMany {
+		tooMany[i] = strings.Repeat("a", i+1)
+	}
+
+	invalid := []FileDetails{
+		{Tags: tooMany},
+		{Tags: []string{strings.Repeat("a", maxTagLength+1)}},
+		{Tags: []string{"semi;colon"}},
+		{Tags: []string{"AWS:Reserved"}},
+		{Description: strings.Repeat("é", maxDescriptionLength+1)},
+		// Short enough, but not once it's encoded
+		{Description: strings.Repeat("✨", maxDescriptionLength)},
+	}
+
+	for _, details := range invalid {
+		_, err := details.Normalize()
+		if !errors.Is(err, ErrorInvalidDetails) {
+			t.Errorf("Expected ErrorInvalidDetails for %+v, got %v", details, err)
+		}
+	}
+}
+
+func TestDescriptionEncoding(t *testing.T) {
+	for _, description := range []string{"plain ascii", "Ünïcödé ✨", "two\nlines"} {
+		encoded := encodeDescription(description)
+
+		for _, r := range encoded {
+			if r < ' ' || r > '~' {
+				t.Errorf("Expected encoded description to be printable ASCII, got %q", encoded)
+				break
+			}
+		}
+
+		if decoded := decodeDescription(encoded); decoded != description {
+			t.Errorf("Expected %q to round trip, got %q", description, decoded)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+type componentStatus struct {
+	Status string `json:"status"`
+	Files  *int   `json:"files,omitempty"`
+}
+
+type readiness struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentStatus `json:"components"`
+}
+
+// ReadyHandler reports whether we can actually serve files, unlike /ping
+// which only says the process is up. It's a 503 if any component isn't.
+// Anyone can see it, so why a component isn't ready is only logged, as S3
+// errors name the bucket, region and endpoint.
+func (webServer *WebServer) ReadyHandler(writer http.ResponseWriter, request *http.Request) {
+	report := readiness{
+		Status:     "ok",
+		Components: map[string]componentStatus{},
+	}
+
+	storage := componentStatus{Status: "ok"}
+	if err := webServer.storage.CheckBucket(request.Context()); err != nil {
+		slog.ErrorContext(request.Context(), "Storage isn't ready", "error", err)
+		storage = componentStatus{Status: "unavailable"}
+		report.Status = "unavailable"
+	}
+	report.Components["storage"] = storage
+
+	// Every upload is turned away while clamd is down
+	if webServer.scanner != nil {
+		scanner := componentStatus{Status: "ok"}
+		if err := webServer.scanner.Ping(request.Context()); err != nil {
+			slog.ErrorContext(request.Context(), "clamd isn't ready", "error", err)
+			scanner = componentStatus{Status: "unavailable"}
+			report.Status = "unavailable"
+		}
+		report.Components["scanner"] = scanner
+	}
+
+	// The index can be empty while it's rebuilt, which isn't worth failing
+	// over since search is the only thing that needs it
+	files := webServer.Search.Len()
+	report.Components["search"] = componentStatus{Status: "ok", Files: &files}
+
+	writer.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ok" {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	webServer.ServeJSON(writer, request, report)
+}
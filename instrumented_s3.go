@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentedS3 wraps the S3 clients to record call counts, errors and
+// latency for every operation, and a span for each call
+type instrumentedS3 struct {
+	S3API
+}
+
+type instrumentedPresign struct {
+	S3PresignAPI
+}
+
+func instrument[T any](ctx context.Context, operation string, call func(context.Context) (T, error)) (T, error) {
+	ctx, span := tracer().Start(ctx, "S3."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "aws-api"),
+			attribute.String("rpc.service", "S3"),
+			attribute.String("rpc.method", operation),
+		),
+	)
+
+	start := time.Now()
+	output, err := call(ctx)
+	endSpan(span, err)
+
+	s3Duration.Observe(time.Since(start).Seconds(), operation)
+	s3Requests.Inc(operation)
+	if err != nil {
+		s3Errors.Inc(operation)
+	}
+
+	return output, err
+}
+
+func (client *instrumentedS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	return instrument(ctx, "PutObject", func(ctx context.Context) (*s3.PutObjectOutput, error) {
+		return client.S3API.PutObject(ctx, params, optFns...)
+	})
+}
+
+func (client *instrumentedS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	return instrument(ctx, "ListObjectsV2", func(ctx context.Context) (*s3.ListObjectsV2Output, error) {
+		return client.S3API.ListObjectsV2(ctx, params, optFns...)
+	})
+}
+
+func (client *instrumentedS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	return instrument(ctx, "HeadObject", func(ctx context.Context) (*s3.HeadObjectOutput, error) {
+		return client.S3API.HeadObject(ctx, params, optFns...)
+	})
+}
+
+func (client *instrumentedS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return instrument(ctx, "GetObject", func(ctx context.Context) (*s3.GetObjectOutput, error) {
+		return client.S3API.GetObject(ctx, params, optFns...)
+	})
+}
+
+func (client *instrumentedS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	return instrument(ctx, "CopyObject", func(ctx context.Context) (*s3.CopyObjectOutput, error) {
+		return client.S3API.CopyObject(ctx, params, optFns...)
+	})
+}
+
+func (client *instrumentedS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	return instrument(ctx, "DeleteObject", func(ctx context.Context) (*s3.DeleteObjectOutput, error) {
+		return client.S3API.DeleteObject(ctx, params, optFns...)
+	})
+}
+
+func (client *instrumentedS3) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	return instrument(ctx, "GetObjectTagging", func(ctx context.Context) (*s3.GetObjectTaggingOutput, error) {
+		return client.S3API.GetObjectTagging(ctx, params, optFns...)
+	})
+}
+
+func (client *instrumentedS3) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	return instrument(ctx, "PutObjectTagging", func(ctx context.Context) (*s3.PutObjectTaggingOutput, error) {
+		return client.S3API.PutObjectTagging(ctx, params, optFns...)
+	})
+}
+
+func (client *instrumentedS3) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	return instrument(ctx, "HeadBucket", func(ctx context.Context) (*s3.HeadBucketOutput, error) {
+		return client.S3API.HeadBucket(ctx, params, optFns...)
+	})
+}
+
+func (client *instrumentedPresign) PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	return instrument(ctx, "PresignGetObject", func(ctx context.Context) (*v4.PresignedHTTPRequest, error) {
+		return client.S3PresignAPI.PresignGetObject(ctx, params, optFns...)
+	})
+}
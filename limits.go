@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrorUploadTooLarge = errors.New("upload too large")
+	ErrorInvalidSize    = errors.New("invalid size")
+)
+
+// The multipart boundaries, headers, tags and description all come on top of
+// the file itself, so the request body is allowed this much more than the
+// limit before we cut it off
+const uploadFormOverhead = 1 << 20
+
+// Same as net/http uses for FormFile. Anything bigger goes to a temp file.
+const defaultUploadMemory = 32 << 20
+
+// UploadLimits caps how big an upload can be, either for everyone or for a
+// particular user. Zero means no limit.
+type UploadLimits struct {
+	MaxSize int64
+	PerUser map[string]int64
+
+	// How much of a form is held in memory before spilling to disk
+	Memory int64
+}
+
+// For returns the limit for a user, who's blank without auth
+func (limits UploadLimits) For(user string) int64 {
+	if limit, ok := limits.PerUser[user]; ok {
+		return limit
+	}
+	return limits.MaxSize
+}
+
+// ParseUploadLimits reads the global limit, per user limits like
+// "alice=5GB,bob=100MB" and the memory cap, all as sizes for ParseSize
+func ParseUploadLimits(maxSize, perUser, memory string) (UploadLimits, error) {
+	limits := UploadLimits{PerUser: map[string]int64{}}
+
+	var err error
+	if limits.MaxSize, err = ParseSize(maxSize); err != nil {
+		return UploadLimits{}, err
+	}
+
+	if limits.Memory, err = ParseSize(memory); err != nil {
+		return UploadLimits{}, err
+	}
+	if limits.Memory == 0 {
+		limits.Memory = defaultUploadMemory
+	}
+
+	for _, pair := range strings.Split(perUser, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		user, rawSize, found := strings.Cut(pair, "=")
+		if !found || strings.TrimSpace(user) == "" {
+			return UploadLimits{}, fmt.Errorf("%w: expected user=size, got %q", ErrorInvalidSize, pair)
+		}
+
+		size, err := ParseSize(rawSize)
+		if err != nil {
+			return UploadLimits{}, err
+		}
+		limits.PerUser[strings.TrimSpace(user)] = size
+	}
+
+	return limits, nil
+}
+
+// ParseSize reads sizes like "500", "100KB", "1.5GB". Units are powers of
+// 1024 to match how sizes are shown.
+func ParseSize(input string) (int64, error) {
+	raw := strings.ToUpper(strings.TrimSpace(input))
+	if raw == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for i, unit := range []string{"KB", "MB", "GB", "TB"} {
+		if strings.HasSuffix(raw, unit) {
+			multiplier = int64(1) << (10 * (i + 1))
+			raw = strings.TrimSuffix(raw, unit)
+			break
+		}
+	}
+	raw = strings.TrimSpace(strings.TrimSuffix(raw, "B"))
+
+	number, err := strconv.ParseFloat(raw, 64)
+	if err != nil || !(number >= 0) || math.IsInf(number, 0) {
+		return 0, fmt.Errorf("%w: %q", ErrorInvalidSize, input)
+	}
+
+	return int64(number * float64(multiplier)), nil
+}
+
+type userKey struct{}
+
+// AuthenticatedUser returns who a request logged in as with basic auth, or
+// blank if auth is off
+func AuthenticatedUser(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
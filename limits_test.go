@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for raw, expected := range map[string]int64{
+		"":       0,
+		"0":      0,
+		"500":    500,
+		"500B":   500,
+		"100KB":  100 << 10,
+		"1.5 gb": 3 << 29,
+		"2TB":    2 << 40,
+	} {
+		size, err := ParseSize(raw)
+		if err != nil {
+			t.Errorf("%q: expected no error, got %v", raw, err)
+		}
+		if size != expected {
+			t.Errorf("%q: expected %d, got %d", raw, expected, size)
+		}
+	}
+}
+
+func TestParseSizeInvalid(t *testing.T) {
+	for _, raw := range []string{"lots", "-1MB", "NaN", "Inf", "10XB"} {
+		if _, err := ParseSize(raw); !errors.Is(err, ErrorInvalidSize) {
+			t.Errorf("%q: expected ErrorInvalidSize, got %v", raw, err)
+		}
+	}
+}
+
+func TestParseUploadLimits(t *testing.T) {
+	limits, err := ParseUploadLimits("1GB", "skalnik=5GB, guest=10MB", "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if limits.For("skalnik") != 5<<30 {
+		t.Errorf("Expected per user limit, got %d", limits.For("skalnik"))
+	}
+	if limits.For("guest") != 10<<20 {
+		t.Errorf("Expected per user limit, got %d", limits.For("guest"))
+	}
+	if limits.For("") != 1<<30 {
+		t.Errorf("Expected global limit without a user, got %d", limits.For(""))
+	}
+	if limits.Memory != defaultUploadMemory {
+		t.Errorf("Expected default memory cap, got %d", limits.Memory)
+	}
+}
+
+func TestParseUploadLimitsInvalid(t *testing.T) {
+	if _, err := ParseUploadLimits("1GB", "skalnik", ""); !errors.Is(err, ErrorInvalidSize) {
+		t.Errorf("Expected ErrorInvalidSize for a missing size, got %v", err)
+	}
+	if _, err := ParseUploadLimits("1GB", "=5GB", ""); !errors.Is(err, ErrorInvalidSize) {
+		t.Errorf("Expected ErrorInvalidSize for a missing user, got %v", err)
+	}
+	if _, err := ParseUploadLimits("big", "", ""); !errors.Is(err, ErrorInvalidSize) {
+		t.Errorf("Expected ErrorInvalidSize for a bad global limit, got %v", err)
+	}
+}
+
+// uploadRequest builds a multipart upload of size bytes
+func uploadRequest(t *testing.T, size int) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", "big.bin")
+	if err != nil {
+		t.Fatalf("Failed to create form file: %v", err)
+	}
+	_, _ = part.Write(bytes.Repeat([]byte("a"), size))
+	_ = writer.Close()
+
+	request := httptest.NewRequest(http.MethodPost, "/", &body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	return request
+}
+
+func expectTooLarge(t *testing.T, responseRecorder *httptest.ResponseRecorder, limit int64) {
+	response := responseRecorder.Result()
+	if response.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf(`Expected 413, but instead got %s`, response.Status)
+	}
+	if response.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected a JSON error, got %s", response.Header.Get("Content-Type"))
+	}
+
+	var body uploadTooLarge
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		t.Fatalf("Expected JSON body, got %v", err)
+	}
+	if body.MaxSize != limit {
+		t.Errorf("Expected the limit of %d in the error, got %d", limit, body.MaxSize)
+	}
+}
+
+func TestUploadHandlerTooLarge(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockStorage{})
+	server.SetUploadLimits(UploadLimits{MaxSize: 1024, Memory: defaultUploadMemory})
+
+	// Small enough to fit in the form overhead, so it's only caught by the
+	// file's own size
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, uploadRequest(t, 2048))
+	expectTooLarge(t, responseRecorder, 1024)
+}
+
+func TestUploadHandlerTooLargeContentLength(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockStorage{})
+	server.SetUploadLimits(UploadLimits{MaxSize: 1024, Memory: defaultUploadMemory})
+
+	request := uploadRequest(t, 2048)
+	request.ContentLength = 10 << 30
+
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	expectTooLarge(t, responseRecorder, 1024)
+}
+
+func TestUploadHandlerTooLargeStreaming(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockStorage{})
+	server.SetUploadLimits(UploadLimits{MaxSize: 1024, Memory: 1024})
+
+	// Without a Content-Length we only find out while reading it
+	request := uploadRequest(t, uploadFormOverhead+4096)
+	request.Body = io.NopCloser(request.Body)
+	request.ContentLength = -1
+
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	expectTooLarge(t, responseRecorder, 1024)
+}
+
+func TestUploadHandlerUnderLimit(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockStorage{})
+	server.SetUploadLimits(UploadLimits{MaxSize: 1024, Memory: defaultUploadMemory})
+
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, uploadRequest(t, 1024))
+
+	if responseRecorder.Code != http.StatusOK {
+		t.Errorf(`Expected 200 OK, but instead got %d`, responseRecorder.Code)
+	}
+}
+
+func TestUploadHandlerPerUserLimit(t *testing.T) {
+	server := NewWebServer("skalnik", "hunter2", "", "", &mockStorage{})
+	server.SetUploadLimits(UploadLimits{
+		MaxSize: 1024,
+		PerUser: map[string]int64{"skalnik": 4096},
+		Memory:  defaultUploadMemory,
+	})
+
+	request := uploadRequest(t, 2048)
+	request.SetBasicAuth("skalnik", "hunter2")
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Code != http.StatusOK {
+		t.Errorf(`Expected 200 OK under the user's own limit, but instead got %d`, responseRecorder.Code)
+	}
+
+	request = uploadRequest(t, 8192)
+	request.SetBasicAuth("skalnik", "hunter2")
+	responseRecorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	expectTooLarge(t, responseRecorder, 4096)
+}
+
+func TestIndexShowsUploadLimit(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockStorage{})
+	server.SetUploadLimits(UploadLimits{MaxSize: 5 << 20, Memory: defaultUploadMemory})
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	body := responseRecorder.Body.String()
+
+	if !strings.Contains(body, `data-max-size="5242880"`) {
+		t.Error("Expected the limit to be passed to app.js")
+	}
+	if !strings.Contains(body, "Files can be up to 5.0 MB") {
+		t.Error("Expected the limit to be shown")
+	}
+}
+
+func TestIndexWithoutUploadLimit(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockStorage{})
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	if strings.Contains(responseRecorder.Body.String(), "data-max-size") {
+		t.Error("Expected no limit without one set")
+	}
+}
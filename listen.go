@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ErrorInvalidListen = errors.New("invalid listen address")
+
+// systemd passes sockets starting at file descriptor 3. It's a variable so
+// tests can hand over sockets of their own.
+var listenFDsStart = 3
+
+// ListenAddress is where to accept connections from. It's one of:
+//
+//	""                        TCP on PORT, the default
+//	"127.0.0.1:8080"          TCP on a specific address
+//	"unix:/run/file-cloud.sock"
+//	"systemd" or "systemd:name" for a socket handed over by systemd, picked
+//	                          by its FileDescriptorName if there's several
+type ListenAddress struct {
+	Network string // tcp, unix or systemd
+	Address string // host:port, socket path or systemd socket name
+}
+
+func ParseListen(listen, port string) (ListenAddress, error) {
+	switch {
+	case listen == "":
+		if port == "" {
+			return ListenAddress{}, fmt.Errorf("%w: either a port or a listen address is required", ErrorInvalidListen)
+		}
+		return ListenAddress{Network: "tcp", Address: ":" + port}, nil
+	case listen == "systemd":
+		return ListenAddress{Network: "systemd"}, nil
+	case strings.HasPrefix(listen, "systemd:"):
+		return ListenAddress{Network: "systemd", Address: strings.TrimPrefix(listen, "systemd:")}, nil
+	case strings.HasPrefix(listen, "unix:"):
+		path := strings.TrimPrefix(listen, "unix:")
+		if path == "" {
+			return ListenAddress{}, fmt.Errorf("%w: unix socket needs a path", ErrorInvalidListen)
+		}
+		return ListenAddress{Network: "unix", Address: path}, nil
+	default:
+		address := strings.TrimPrefix(listen, "tcp:")
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return ListenAddress{}, fmt.Errorf("%w: %w", ErrorInvalidListen, err)
+		}
+		return ListenAddress{Network: "tcp", Address: address}, nil
+	}
+}
+
+func (address ListenAddress) String() string {
+	if address.Address == "" {
+		return address.Network
+	}
+	return address.Network + ":" + address.Address
+}
+
+func (address ListenAddress) Listen() (net.Listener, error) {
+	switch address.Network {
+	case "systemd":
+		return systemdListener(address.Address)
+	case "unix":
+		return listenUnix(address.Address)
+	default:
+		return net.Listen("tcp", address.Address)
+	}
+}
+
+// listenUnix listens on a unix socket, clearing out one left behind by a
+// previous run. Only the owner and group can connect, so put whatever's
+// proxying to us in our group.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%w: %s exists and isn't a socket", ErrorInvalidListen, path)
+		}
+		slog.Debug("Removing stale socket", "path", path)
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0660); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// systemdListener picks up a socket from systemd socket activation, using
+// the LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES variables described in
+// sd_listen_fds(3). With no name it takes the first one.
+func systemdListener(name string) (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("%w: no sockets passed by systemd", ErrorInvalidListen)
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("%w: no sockets passed by systemd", ErrorInvalidListen)
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Don't let anything we start think these are meant for it
+	for _, variable := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(variable)
+	}
+
+	index := 0
+	if name != "" {
+		index = -1
+		for i := 0; i < count && i < len(names); i++ {
+			if names[i] == name {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("%w: systemd didn't pass a socket named %q", ErrorInvalidListen, name)
+		}
+	}
+
+	file := os.NewFile(uintptr(listenFDsStart+index), "systemd:"+name)
+	// FileListener dups the descriptor, so closing ours is fine
+	defer func() {
+		if err := file.Close(); err != nil {
+			slog.Warn("Error closing systemd socket descriptor", "name", name, "error", err)
+		}
+	}()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrorInvalidListen, err)
+	}
+
+	return listener, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseListen(t *testing.T) {
+	for listen, expected := range map[string]ListenAddress{
+		"":                          {Network: "tcp", Address: ":8080"},
+		"127.0.0.1:9000":            {Network: "tcp", Address: "127.0.0.1:9000"},
+		"tcp:[::1]:9000":            {Network: "tcp", Address: "[::1]:9000"},
+		"unix:/run/file-cloud.sock": {Network: "unix", Address: "/run/file-cloud.sock"},
+		"systemd":                   {Network: "systemd"},
+		"systemd:web":               {Network: "systemd", Address: "web"},
+	} {
+		address, err := ParseListen(listen, "8080")
+		if err != nil {
+			t.Errorf("%q: expected no error, got %v", listen, err)
+		}
+		if address != expected {
+			t.Errorf("%q: expected %+v, got %+v", listen, expected, address)
+		}
+	}
+}
+
+func TestParseListenInvalid(t *testing.T) {
+	for _, listen := range []string{"unix:", "8080", "nonsense"} {
+		if _, err := ParseListen(listen, "8080"); !errors.Is(err, ErrorInvalidListen) {
+			t.Errorf("%q: expected ErrorInvalidListen, got %v", listen, err)
+		}
+	}
+
+	if _, err := ParseListen("", ""); !errors.Is(err, ErrorInvalidListen) {
+		t.Errorf("Expected ErrorInvalidListen without a port, got %v", err)
+	}
+}
+
+// getOverSocket makes a request to the server behind listener
+func getOverSocket(t *testing.T, network, address, path string) *http.Response {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, address)
+			},
+		},
+	}
+
+	response, err := client.Get("http://file-cloud" + path)
+	if err != nil {
+		t.Fatalf("Expected request to work, got %v", err)
+	}
+	t.Cleanup(func() { _ = response.Body.Close() })
+	return response
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file-cloud.sock")
+
+	// A socket left behind by a crash shouldn't stop us starting
+	stale, _ := net.Listen("unix", path)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	listener, err := ListenAddress{Network: "unix", Address: path}.Listen()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("Expected socket to be 0660, got %v", info.Mode().Perm())
+	}
+
+	server := NewWebServer("", "", "", "", &mockStorage{})
+	go func() { _ = http.Serve(listener, server.Router) }()
+	t.Cleanup(func() { _ = listener.Close() })
+
+	response := getOverSocket(t, "unix", path, "/ping")
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || string(body) != "." {
+		t.Errorf("Expected ping over the socket, got %s %q", response.Status, body)
+	}
+}
+
+func TestListenUnixNotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "important.txt")
+	_ = os.WriteFile(path, []byte("don't delete me"), 0644)
+
+	_, err := ListenAddress{Network: "unix", Address: path}.Listen()
+	if !errors.Is(err, ErrorInvalidListen) {
+		t.Errorf("Expected ErrorInvalidListen, got %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error("Expected existing file to be left alone")
+	}
+}
+
+// passSockets sets things up as systemd would, with listeners starting at
+// listenFDsStart. The descriptors have to be consecutive so this dups them.
+func passSockets(t *testing.T, names string, listeners ...*net.TCPListener) {
+	var files []*os.File
+	for _, listener := range listeners {
+		file, err := listener.File()
+		if err != nil {
+			t.Fatalf("Couldn't get listener file: %v", err)
+		}
+		files = append(files, file)
+	}
+
+	// F_DUPFD takes the lowest free descriptor from where we ask, so they
+	// only line up if nothing's in the way
+	start := -1
+	for i, file := range files {
+		fd, err := unix.FcntlInt(file.Fd(), unix.F_DUPFD_CLOEXEC, max(start+i, 100))
+		if err != nil {
+			t.Fatalf("Couldn't dup listener: %v", err)
+		}
+		if start < 0 {
+			start = fd
+		} else if fd != start+i {
+			t.Fatalf("Couldn't get consecutive descriptors, got %d after %d", fd, start)
+		}
+		_ = file.Close()
+	}
+
+	original := listenFDsStart
+	listenFDsStart = start
+	t.Cleanup(func() { listenFDsStart = original })
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(len(listeners)))
+	t.Setenv("LISTEN_FDNAMES", names)
+}
+
+func TestListenSystemd(t *testing.T) {
+	first, _ := net.Listen("tcp", "127.0.0.1:0")
+	second, _ := net.Listen("tcp", "127.0.0.1:0")
+	t.Cleanup(func() { _ = first.Close(); _ = second.Close() })
+	passSockets(t, "redirect:web", first.(*net.TCPListener), second.(*net.TCPListener))
+
+	listener, err := ListenAddress{Network: "systemd", Address: "web"}.Listen()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	if listener.Addr().String() != second.Addr().String() {
+		t.Errorf("Expected the socket named web at %s, got %s", second.Addr(), listener.Addr())
+	}
+
+	server := NewWebServer("", "", "", "", &mockStorage{})
+	go func() { _ = http.Serve(listener, server.Router) }()
+
+	response := getOverSocket(t, "tcp", second.Addr().String(), "/ping")
+	if response.StatusCode != http.StatusOK {
+		t.Errorf(`Expected 200 OK, but instead got %s`, response.Status)
+	}
+
+	if _, set := os.LookupEnv("LISTEN_FDS"); set {
+		t.Error("Expected systemd variables to be cleared once used")
+	}
+}
+
+func TestListenSystemdMissingName(t *testing.T) {
+	first, _ := net.Listen("tcp", "127.0.0.1:0")
+	t.Cleanup(func() { _ = first.Close() })
+	passSockets(t, "web", first.(*net.TCPListener))
+
+	_, err := ListenAddress{Network: "systemd", Address: "admin"}.Listen()
+	if !errors.Is(err, ErrorInvalidListen) {
+		t.Errorf("Expected ErrorInvalidListen, got %v", err)
+	}
+}
+
+func TestListenSystemdWrongProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+
+	_, err := ListenAddress{Network: "systemd"}.Listen()
+	if !errors.Is(err, ErrorInvalidListen) {
+		t.Errorf("Expected ErrorInvalidListen for another process's sockets, got %v", err)
+	}
+}
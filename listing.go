@@ -0,0 +1,153 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Every kind a listing can be filtered by, in the order they're offered
+var fileKinds = []FileKind{KindImage, KindVideo, KindAudio, KindPDF, KindText, KindArchive, KindOther}
+
+// listingPage is a filtered and sorted page of files, plus the query state
+// needed to link to other pages
+type listingPage struct {
+	Files     []StoredFile
+	NextToken string
+	Sort      string
+	Order     string
+	Kind      string
+	Tag       string
+	Query     string // Only set for search results, which are ordered by relevance
+}
+
+// SortURL links to this listing sorted by field, flipping the order if
+// it's already sorted that way
+func (page *listingPage) SortURL(field string) string {
+	order := "asc"
+	if page.Sort == field && page.Order == "asc" {
+		order = "desc"
+	}
+
+	return page.url(url.Values{"sort": {field}, "order": {order}})
+}
+
+// NextURL links to the following page with the same sort and filter
+func (page *listingPage) NextURL() string {
+	if page.NextToken == "" {
+		return ""
+	}
+
+	return page.url(url.Values{"cursor": {page.NextToken}})
+}
+
+func (page *listingPage) url(overrides url.Values) string {
+	values := url.Values{}
+	values.Set("sort", page.Sort)
+	values.Set("order", page.Order)
+	if page.Kind != "" {
+		values.Set("kind", page.Kind)
+	}
+	if page.Tag != "" {
+		values.Set("tag", page.Tag)
+	}
+
+	for key, value := range overrides {
+		values[key] = value
+	}
+
+	return "?" + values.Encode()
+}
+
+func (page *listingPage) Kinds() []FileKind {
+	return fileKinds
+}
+
+// kindName is how a kind appears in URLs and on the page, since KindOther is
+// an empty string
+func kindName(kind FileKind) string {
+	if kind == KindOther {
+		return "other"
+	}
+	return string(kind)
+}
+
+// parseKindFilter returns nil when no filter was given
+func parseKindFilter(name string) (*FileKind, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	for _, kind := range fileKinds {
+		if kindName(kind) == name {
+			return &kind, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: unknown kind %q", ErrorBadRequest, name)
+}
+
+// filtered is whether the page only shows some files
+func (page *listingPage) filtered() bool {
+	return page.Kind != "" || page.Tag != ""
+}
+
+// filterFiles keeps files matching the page's kind and tag filters
+func (page *listingPage) filterFiles(files []StoredFile) ([]StoredFile, error) {
+	kindFilter, err := parseKindFilter(page.Kind)
+	if err != nil {
+		return nil, err
+	}
+
+	tag := strings.ToLower(strings.TrimSpace(page.Tag))
+
+	filtered := make([]StoredFile, 0, len(files))
+	for _, file := range files {
+		if kindFilter != nil && file.Kind != *kindFilter {
+			continue
+		}
+		if tag != "" && !slices.Contains(file.Tags, tag) {
+			continue
+		}
+		filtered = append(filtered, file)
+	}
+
+	return filtered, nil
+}
+
+func sortFiles(files []StoredFile, field string, order string) {
+	slices.SortStableFunc(files, func(a, b StoredFile) int {
+		var result int
+		switch field {
+		case "name":
+			result = cmp.Compare(strings.ToLower(a.OriginalName), strings.ToLower(b.OriginalName))
+		case "size":
+			result = cmp.Compare(a.Size, b.Size)
+		default:
+			result = a.UploadedAt.Compare(b.UploadedAt)
+		}
+
+		if order == "desc" {
+			return -result
+		}
+		return result
+	})
+}
+
+// humanSize formats a byte count for display, e.g. 1.5 MB
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
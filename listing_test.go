@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHumanSize(t *testing.T) {
+	cases := map[int64]string{
+		0:                      "0 B",
+		1023:                   "1023 B",
+		1024:                   "1.0 KB",
+		1536:                   "1.5 KB",
+		5 * 1024 * 1024:        "5.0 MB",
+		3 * 1024 * 1024 * 1024: "3.0 GB",
+	}
+
+	for size, expected := range cases {
+		if formatted := humanSize(size); formatted != expected {
+			t.Errorf("humanSize(%d) = %s, want %s", size, formatted, expected)
+		}
+	}
+}
+
+func TestParseKindFilter(t *testing.T) {
+	kind, err := parseKindFilter("")
+	if kind != nil || err != nil {
+		t.Errorf("Expected no filter for empty kind, got %v, %v", kind, err)
+	}
+
+	kind, err = parseKindFilter("other")
+	if err != nil || kind == nil || *kind != KindOther {
+		t.Errorf("Expected KindOther for 'other', got %v, %v", kind, err)
+	}
+
+	kind, err = parseKindFilter("pdf")
+	if err != nil || kind == nil || *kind != KindPDF {
+		t.Errorf("Expected KindPDF for 'pdf', got %v, %v", kind, err)
+	}
+
+	_, err = parseKindFilter("spreadsheet")
+	if err == nil {
+		t.Error("Expected error for unknown kind")
+	}
+}
+
+func TestSortURLTogglesOrder(t *testing.T) {
+	page := &listingPage{Sort: "name", Order: "asc", Kind: "image"}
+
+	if url := page.SortURL("name"); url != "?kind=image&order=desc&sort=name" {
+		t.Errorf("Expected sorting by the current field to flip order, got %s", url)
+	}
+
+	if url := page.SortURL("size"); url != "?kind=image&order=asc&sort=size" {
+		t.Errorf("Expected sorting by a new field to start ascending, got %s", url)
+	}
+}
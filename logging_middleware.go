@@ -3,6 +3,10 @@ package main
 import (
 	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,7 +29,66 @@ func (rw *responseWriter) Write(b []byte) (int, error) {
 }
 
 type LoggingMiddleware struct {
-	handler http.Handler
+	handler   http.Handler
+	AccessLog *AccessLog // optional
+
+	statsMutex sync.Mutex
+	stats      map[string]*RouteStats
+}
+
+// RouteStats counts requests to a route pattern since startup, and how many
+// of them failed
+type RouteStats struct {
+	Route        string
+	Requests     int64
+	ClientErrors int64 // 4xx
+	ServerErrors int64 // 5xx
+}
+
+// ErrorRate is the fraction of requests that failed on our end
+func (stats RouteStats) ErrorRate() float64 {
+	if stats.Requests == 0 {
+		return 0
+	}
+	return float64(stats.ServerErrors) / float64(stats.Requests)
+}
+
+func (l *LoggingMiddleware) record(route string, status int) {
+	l.statsMutex.Lock()
+	defer l.statsMutex.Unlock()
+
+	if l.stats == nil {
+		l.stats = map[string]*RouteStats{}
+	}
+	stats, found := l.stats[route]
+	if !found {
+		stats = &RouteStats{Route: route}
+		l.stats[route] = stats
+	}
+
+	stats.Requests++
+	switch {
+	case status >= 500:
+		stats.ServerErrors++
+	case status >= 400:
+		stats.ClientErrors++
+	}
+}
+
+// Stats returns the counts for every route that's been hit, by route
+func (l *LoggingMiddleware) Stats() []RouteStats {
+	l.statsMutex.Lock()
+	defer l.statsMutex.Unlock()
+
+	stats := make([]RouteStats, 0, len(l.stats))
+	for _, route := range l.stats {
+		stats = append(stats, *route)
+	}
+	slices.SortFunc(stats, func(a, b RouteStats) int {
+		return strings.Compare(a.Route, b.Route)
+	})
+
+	return stats
 }
 
 func (l *LoggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -39,6 +102,15 @@ func (l *LoggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	requestSize := max(r.ContentLength, 0)
 
+	// Keep an ID from a proxy in front of us if there is one, so logs from
+	// both can be matched up
+	requestID := r.Header.Get(requestIDHeader)
+	if !validRequestID(requestID) {
+		requestID = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, requestID)
+	r = r.WithContext(withRequestID(r.Context(), requestID))
+
 	clientIP := r.Header.Get("X-Forwarded-For")
 	if clientIP == "" {
 		clientIP = r.Header.Get("X-Real-IP")
@@ -51,7 +123,16 @@ func (l *LoggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	duration := time.Since(start)
 
-	slog.Info("Request",
+	// The mux fills in the matched pattern on the request as it routes it
+	route := r.Pattern
+	if route == "" {
+		route = "unmatched"
+	}
+	httpRequests.Inc(r.Method, route, strconv.Itoa(wrapped.statusCode))
+	httpDuration.Observe(duration.Seconds(), r.Method, route)
+	l.record(route, wrapped.statusCode)
+
+	slog.InfoContext(r.Context(), "Request",
 		"method", r.Method,
 		"path", r.URL.Path,
 		"status", wrapped.statusCode,
@@ -61,8 +142,28 @@ func (l *LoggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"clientIP", clientIP,
 	)
 
+	if l.AccessLog != nil {
+		user, _, _ := r.BasicAuth()
+		l.AccessLog.Log(accessLogEntry{
+			Time:         start,
+			RequestID:    requestID,
+			ClientIP:     clientIP,
+			User:         user,
+			Method:       r.Method,
+			Path:         r.URL.RequestURI(),
+			Protocol:     r.Proto,
+			Route:        r.Pattern,
+			Status:       wrapped.statusCode,
+			RequestSize:  requestSize,
+			ResponseSize: wrapped.responseSize,
+			Duration:     duration,
+			Referrer:     r.Referer(),
+			UserAgent:    r.UserAgent(),
+		})
+	}
+
 	if duration > time.Second {
-		slog.Warn("Slow request",
+		slog.WarnContext(r.Context(), "Slow request",
 			"method", r.Method,
 			"path", r.URL.Path,
 			"duration", duration,
@@ -70,7 +171,7 @@ func (l *LoggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if wrapped.statusCode >= 400 {
-		slog.Warn("Error response",
+		slog.WarnContext(r.Context(), "Error response",
 			"method", r.Method,
 			"path", r.URL.Path,
 			"status", wrapped.statusCode,
@@ -80,5 +181,5 @@ func (l *LoggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func NewLogger(handlerToWrap http.Handler) *LoggingMiddleware {
-	return &LoggingMiddleware{handlerToWrap}
+	return &LoggingMiddleware{handler: handlerToWrap}
 }
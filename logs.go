@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrorUnknownLogFormat = errors.New("unknown log format")
+
+// NewLogHandler builds the app log handler, wrapped so request IDs are added
+// to anything logged with a context
+func NewLogHandler(format string, writer io.Writer, level slog.Leveler) (slog.Handler, error) {
+	options := &slog.HandlerOptions{Level: level}
+
+	switch format {
+	case "", "text":
+		return &ContextHandler{slog.NewTextHandler(writer, options)}, nil
+	case "json":
+		return &ContextHandler{slog.NewJSONHandler(writer, options)}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrorUnknownLogFormat, format)
+	}
+}
+
+// RotatingFile is a log file that's moved aside once it grows past maxSize,
+// keeping up to maxBackups old files as path.1 (newest) to path.N (oldest)
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rotating := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := rotating.open(); err != nil {
+		return nil, err
+	}
+
+	return rotating, nil
+}
+
+func (rotating *RotatingFile) open() error {
+	file, err := os.OpenFile(rotating.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't open log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("couldn't stat log file: %w", err)
+	}
+
+	rotating.file = file
+	rotating.size = info.Size()
+	return nil
+}
+
+func (rotating *RotatingFile) Write(p []byte) (int, error) {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+
+	// A single write bigger than the limit still has to go somewhere, so it
+	// only triggers a rotation if there's already something in the file
+	if rotating.maxSize > 0 && rotating.size > 0 && rotating.size+int64(len(p)) > rotating.maxSize {
+		if err := rotating.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rotating.file.Write(p)
+	rotating.size += int64(n)
+	return n, err
+}
+
+// rotate shifts each backup along one, dropping the oldest, and starts a
+// fresh file. Callers must hold the mutex.
+func (rotating *RotatingFile) rotate() error {
+	if err := rotating.file.Close(); err != nil {
+		return err
+	}
+
+	if rotating.maxBackups > 0 {
+		for i := rotating.maxBackups - 1; i > 0; i-- {
+			err := os.Rename(rotating.backupPath(i), rotating.backupPath(i+1))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		if err := os.Rename(rotating.path, rotating.backupPath(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rotating.path); err != nil {
+		return err
+	}
+
+	return rotating.open()
+}
+
+func (rotating *RotatingFile) backupPath(n int) string {
+	return rotating.path + "." + strconv.Itoa(n)
+}
+
+func (rotating *RotatingFile) Close() error {
+	rotating.mutex.Lock()
+	defer rotating.mutex.Unlock()
+
+	return rotating.file.Close()
+}
+
+// accessLogEntry is everything we record about a request for the access log
+type accessLogEntry struct {
+	Time         time.Time     `json:"time"`
+	RequestID    string        `json:"requestID,omitempty"`
+	ClientIP     string        `json:"clientIP"`
+	User         string        `json:"user,omitempty"`
+	Method       string        `json:"method"`
+	Path         string        `json:"path"`
+	Protocol     string        `json:"protocol"`
+	Route        string        `json:"route,omitempty"`
+	Status       int           `json:"status"`
+	RequestSize  int64         `json:"requestSize"`
+	ResponseSize int64         `json:"responseSize"`
+	Duration     time.Duration `json:"durationNs"`
+	Referrer     string        `json:"referrer,omitempty"`
+	UserAgent    string        `json:"userAgent,omitempty"`
+}
+
+// AccessLog writes one line per request, separately from the app logs, in
+// either Combined Log Format or JSON
+type AccessLog struct {
+	writer io.Writer
+	format string
+	mutex  sync.Mutex
+}
+
+func NewAccessLog(writer io.Writer, format string) (*AccessLog, error) {
+	switch format {
+	case "", "combined":
+		format = "combined"
+	case "json":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrorUnknownLogFormat, format)
+	}
+
+	return &AccessLog{writer: writer, format: format}, nil
+}
+
+func (accessLog *AccessLog) Log(entry accessLogEntry) {
+	var line []byte
+	if accessLog.format == "json" {
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			slog.Error("Error encoding access log entry", "error", err)
+			return
+		}
+		line = append(encoded, '\n')
+	} else {
+		line = []byte(combinedLogLine(entry))
+	}
+
+	accessLog.mutex.Lock()
+	defer accessLog.mutex.Unlock()
+
+	if _, err := accessLog.writer.Write(line); err != nil {
+		slog.Error("Error writing access log", "error", err)
+	}
+}
+
+// combinedLogLine formats an entry like Apache and nginx do:
+// host ident user [time] "request" status bytes "referrer" "user agent"
+func combinedLogLine(entry accessLogEntry) string {
+	size := "-"
+	if entry.ResponseSize > 0 {
+		size = strconv.FormatInt(entry.ResponseSize, 10)
+	}
+
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		combinedField(entry.ClientIP),
+		combinedField(entry.User),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method, escapeCombined(entry.Path), entry.Protocol,
+		entry.Status,
+		size,
+		escapeCombined(entry.Referrer),
+		escapeCombined(entry.UserAgent),
+	)
+}
+
+// combinedField formats an unquoted field, which can't be empty or contain
+// spaces without adding extra fields (X-Forwarded-For can hold a list)
+func combinedField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(escapeCombined(value), " ", "")
+}
+
+// escapeCombined stops client supplied values from breaking out of their
+// quotes or onto a new line
+func escapeCombined(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`).Replace(value)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLogHandlerJSON(t *testing.T) {
+	var output bytes.Buffer
+	handler, err := NewLogHandler("json", &output, slog.LevelInfo)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	slog.New(handler).InfoContext(withRequestID(context.Background(), "abc-123"), "Hello", "key", "value")
+
+	var record map[string]any
+	if err := json.Unmarshal(output.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a JSON log line, got %s", output.String())
+	}
+	if record["msg"] != "Hello" || record["key"] != "value" || record["requestID"] != "abc-123" {
+		t.Errorf("Expected message, attributes and request ID, got %v", record)
+	}
+}
+
+func TestNewLogHandlerUnknownFormat(t *testing.T) {
+	_, err := NewLogHandler("xml", &bytes.Buffer{}, slog.LevelInfo)
+	if !errors.Is(err, ErrorUnknownLogFormat) {
+		t.Errorf("Expected ErrorUnknownLogFormat, got %v", err)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	rotating, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer rotating.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := rotating.Write([]byte(line)); err != nil {
+			t.Fatalf("Expected no error writing, got %v", err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for file, content := range expected {
+		actual, err := os.ReadFile(file)
+		if err != nil {
+			t.Errorf("Expected %s to exist, got %v", file, err)
+			continue
+		}
+		if string(actual) != content {
+			t.Errorf("Expected %s to contain %q, got %q", file, content, actual)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !errors.Is(err, os.ErrNotExist) {
+		t.Error("Expected only 2 backups to be kept")
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	_ = os.WriteFile(path, []byte("existing\n"), 0644)
+
+	rotating, err := NewRotatingFile(path, 1024, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, _ = rotating.Write([]byte("new\n"))
+	_ = rotating.Close()
+
+	content, _ := os.ReadFile(path)
+	if string(content) != "existing\nnew\n" {
+		t.Errorf("Expected existing log to be appended to, got %q", content)
+	}
+}
+
+func TestCombinedLogLine(t *testing.T) {
+	entry := accessLogEntry{
+		Time:         time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		ClientIP:     "203.0.113.1, 10.0.0.1",
+		Method:       http.MethodGet,
+		Path:         "/ABCDE?x=1",
+		Protocol:     "HTTP/1.1",
+		Status:       200,
+		ResponseSize: 512,
+		Referrer:     "https://example.com/",
+		UserAgent:    `curl/8.0 "quoted"`,
+	}
+
+	expected := `203.0.113.1,10.0.0.1 - - [01/Mar/2024:12:30:00 +0000] "GET /ABCDE?x=1 HTTP/1.1" 200 512 "https://example.com/" "curl/8.0 \"quoted\""` + "\n"
+	if line := combinedLogLine(entry); line != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, line)
+	}
+}
+
+func TestAccessLogFromMiddleware(t *testing.T) {
+	var output bytes.Buffer
+	accessLog, err := NewAccessLog(&output, "json")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	mockClient := &mockStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+	server.SetAccessLog(accessLog)
+
+	request := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	request.Header.Set("X-Request-ID", "access-1")
+	request.Header.Set("User-Agent", "golang test")
+	server.Router.ServeHTTP(httptest.NewRecorder(), request)
+
+	var entry accessLogEntry
+	if err := json.Unmarshal(output.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a JSON access log line, got %s", output.String())
+	}
+
+	if entry.RequestID != "access-1" || entry.Route != "GET /ping" || entry.Status != 200 || entry.UserAgent != "golang test" {
+		t.Errorf("Expected request details in access log, got %+v", entry)
+	}
+	if !strings.HasSuffix(output.String(), "}\n") {
+		t.Errorf("Expected one entry per line, got %q", output.String())
+	}
+}
+
+func TestNewAccessLogUnknownFormat(t *testing.T) {
+	_, err := NewAccessLog(&bytes.Buffer{}, "common")
+	if !errors.Is(err, ErrorUnknownLogFormat) {
+		t.Errorf("Expected ErrorUnknownLogFormat, got %v", err)
+	}
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const keyLength = 5
@@ -20,10 +27,56 @@ func main() {
 		region   string
 		logLevel string
 
+		logFormat       string
+		logFile         string
+		logMaxSize      string
+		logMaxBackups   string
+		accessLog       string
+		accessLogFormat string
+
 		user      string
 		pass      string
+		usersFile string
 		port      string // https://twitter.com/keith_duncan/status/638582305917833217
 		plausible string
+
+		plausibleAPI  string
+		umamiURL      string
+		umamiWebsite  string
+		analyticsFile string
+		statsFile     string
+		geoIPDB       string
+
+		webhooks      string
+		webhookSecret string
+		publicURL     string
+
+		searchIndex   string
+		fileControls  string
+		maxUpload     string
+		uploadLimits  string
+		uploadMemory  string
+		rateLimits    string
+		quota         string
+		userQuotas    string
+		quotaUsage    string
+		proxies       string
+		traceExporter string
+		s3Timeouts    string
+		clamd         string
+		checkBucket   bool
+
+		configPath string
+		listen     string
+
+		tlsCert      string
+		tlsKey       string
+		tlsDomains   string
+		tlsCacheDir  string
+		tlsEmail     string
+		acmeURL      string
+		redirectPort string
+		hstsMaxAge   string
 	)
 
 	flag.StringVar(&bucket, "bucket", LookupEnvDefault("BUCKET", "file-cloud"), "AWS S3 Bucket name to store files in")
@@ -32,31 +85,463 @@ func main() {
 	flag.StringVar(&cdn, "cdn", LookupEnvDefault("CDN", ""), "CDN URL to use for with object keys. Leave blank to use presigned S3 URLs")
 	flag.StringVar(&region, "region", LookupEnvDefault("REGION", "us-west-1"), "AWS S3 region")
 	flag.StringVar(&logLevel, "log-level", LookupEnvDefault("LOG_LEVEL", "debug"), "Log level (debug, info, warn, error)")
+	flag.StringVar(&logFormat, "log-format", LookupEnvDefault("LOG_FORMAT", "text"), "Log format (text, json)")
+	flag.StringVar(&logFile, "log-file", LookupEnvDefault("LOG_FILE", ""), "File to write logs to. Leave blank for stdout")
+	flag.StringVar(&logMaxSize, "log-max-size", LookupEnvDefault("LOG_MAX_SIZE", "100"), "Size in MB log files are rotated at. 0 disables rotation")
+	flag.StringVar(&logMaxBackups, "log-max-backups", LookupEnvDefault("LOG_MAX_BACKUPS", "5"), "How many rotated log files to keep")
+	flag.StringVar(&accessLog, "access-log", LookupEnvDefault("ACCESS_LOG", ""), "File to write an access log to, or - for stdout. Leave blank to disable")
+	flag.StringVar(&accessLogFormat, "access-log-format", LookupEnvDefault("ACCESS_LOG_FORMAT", "combined"), "Access log format (combined, json)")
 
 	flag.StringVar(&port, "port", LookupEnvDefault("PORT", "8080"), "Port to listen on")
+	flag.StringVar(&listen, "listen", LookupEnvDefault("LISTEN", ""), "Where to listen instead of port: host:port, unix:/path/to.sock, or systemd[:name] for socket activation")
 	flag.StringVar(&user, "username", LookupEnvDefault("USERNAME", ""), "A username for basic auth. Leave blank (along with pass) to disable")
 	flag.StringVar(&pass, "password", LookupEnvDefault("PASSWORD", ""), "A password for basic auth. Leave blank (along with user) to disable")
+	flag.StringVar(&usersFile, "users-file", LookupEnvDefault("USERS_FILE", ""), "JSON file of user accounts, managed with the add-user and remove-user commands. Leave blank for just username and password")
 	flag.StringVar(&plausible, "plausible", LookupEnvDefault("PLAUSIBLE", ""), "The domain setup for Plausible. Leave blank to disable")
+	flag.StringVar(&plausibleAPI, "plausible-api", LookupEnvDefault("PLAUSIBLE_API", plausibleAPIURL), "Plausible events API to send to, for self hosted Plausible")
+	flag.StringVar(&umamiURL, "umami-url", LookupEnvDefault("UMAMI_URL", ""), "Umami API to send events to, e.g. https://umami.example.com/api/send. Needs umami-website too")
+	flag.StringVar(&umamiWebsite, "umami-website", LookupEnvDefault("UMAMI_WEBSITE", ""), "Umami website ID to send events as")
+	flag.StringVar(&analyticsFile, "analytics-file", LookupEnvDefault("ANALYTICS_FILE", ""), "File to write analytics events to as JSON lines, or - for stdout. Leave blank to disable")
+	flag.StringVar(&statsFile, "stats-file", LookupEnvDefault("STATS_FILE", ""), "File to persist per file view and download stats to. Leave blank to keep them in memory")
+	flag.StringVar(&geoIPDB, "geoip-db", LookupEnvDefault("GEOIP_DB", ""), "MaxMind database, like GeoLite2-Country.mmdb, to break stats down by country. Leave blank to disable")
+	flag.StringVar(&webhooks, "webhooks", LookupEnvDefault("WEBHOOKS", ""), "Comma separated URLs to POST upload, delete and expiry events to. Leave blank to disable")
+	flag.StringVar(&webhookSecret, "webhook-secret", LookupEnvDefault("WEBHOOK_SECRET", ""), "Secret to sign webhook bodies with, sent as an HMAC-SHA256 in X-File-Cloud-Signature")
+	flag.StringVar(&publicURL, "public-url", LookupEnvDefault("PUBLIC_URL", ""), "Base URL File Cloud is reached at, e.g. https://files.example.com, for links in webhooks and embeds. Leave blank to use the request's host")
+	flag.StringVar(&searchIndex, "search-index", LookupEnvDefault("SEARCH_INDEX", ""), "File to persist the search index to. Leave blank to keep it in memory")
+	flag.StringVar(&fileControls, "file-controls", LookupEnvDefault("FILE_CONTROLS", "file-controls.json"), "File to persist blocked and expiring files to. Blank keeps them in memory, so they're lost on restart")
+	flag.StringVar(&maxUpload, "max-upload-size", LookupEnvDefault("MAX_UPLOAD_SIZE", "1GB"), "Biggest file that can be uploaded, e.g. 500MB. 0 for no limit")
+	flag.StringVar(&uploadLimits, "upload-limits", LookupEnvDefault("UPLOAD_LIMITS", ""), "Per user upload size limits overriding max-upload-size, e.g. alice=5GB,bob=100MB")
+	flag.StringVar(&uploadMemory, "upload-memory", LookupEnvDefault("UPLOAD_MEMORY", "32MB"), "How much of an upload to hold in memory before spilling to a temp file")
+	flag.StringVar(&quota, "quota", LookupEnvDefault("QUOTA", ""), "How much each user can store, as size[/files], e.g. 10GB/1000. Leave blank (along with user-quotas) to disable quotas")
+	flag.StringVar(&userQuotas, "user-quotas", LookupEnvDefault("USER_QUOTAS", ""), "Per user quotas overriding quota, e.g. alice=50GB,bob=1GB/100")
+	flag.StringVar(&quotaUsage, "quota-usage", LookupEnvDefault("QUOTA_USAGE", ""), "File to persist quota usage to. Leave blank to keep it in memory")
+	flag.StringVar(&rateLimits, "rate-limits", LookupEnvDefault("RATE_LIMITS", ""), "Per client rate limits, e.g. lookup=120/m,upload=30/m (routes: lookup, upload). 0 disables one")
+	flag.StringVar(&proxies, "trusted-proxies", LookupEnvDefault("TRUSTED_PROXIES", ""), "Addresses or CIDR ranges of proxies whose X-Forwarded-For and X-Real-IP headers are trusted")
+	flag.StringVar(&s3Timeouts, "s3-timeouts", LookupEnvDefault("S3_TIMEOUTS", ""), "Per operation S3 timeouts, e.g. lookup=10s,upload=5m (operations: lookup, list, update, upload)")
+	flag.StringVar(&clamd, "clamd", LookupEnvDefault("CLAMD", ""), "Address of a ClamAV daemon to scan uploads with, host:port or unix:/path/to/clamd.sock. Leave blank to disable")
+	flag.BoolVar(&checkBucket, "check-bucket", LookupEnvDefault("CHECK_BUCKET", "") == "true", "Refuse to start if the S3 bucket, or clamd if it's set, can't be reached")
+	flag.StringVar(&traceExporter, "trace-exporter", LookupEnvDefault("TRACE_EXPORTER", ""), "Where to send traces (stdout, otlp). Leave blank to disable")
+	flag.StringVar(&configPath, "config", LookupEnvDefault("CONFIG", ""), "TOML file to read settings from. Flags and environment variables take precedence")
+	flag.StringVar(&tlsCert, "tls-cert", LookupEnvDefault("TLS_CERT", ""), "Certificate file to serve TLS with. Needs tls-key too")
+	flag.StringVar(&tlsKey, "tls-key", LookupEnvDefault("TLS_KEY", ""), "Private key file for tls-cert")
+	flag.StringVar(&tlsDomains, "tls-domains", LookupEnvDefault("TLS_DOMAINS", ""), "Comma separated domains to get certificates for over ACME. Leave blank (along with tls-cert) to disable TLS")
+	flag.StringVar(&tlsCacheDir, "tls-cache-dir", LookupEnvDefault("TLS_CACHE_DIR", "certs"), "Directory to keep ACME certificates in")
+	flag.StringVar(&tlsEmail, "tls-email", LookupEnvDefault("TLS_EMAIL", ""), "Contact email for the ACME account")
+	flag.StringVar(&acmeURL, "acme-directory", LookupEnvDefault("ACME_DIRECTORY", ""), "ACME directory URL. Leave blank for Let's Encrypt")
+	flag.StringVar(&redirectPort, "http-redirect-port", LookupEnvDefault("HTTP_REDIRECT_PORT", ""), "Port to redirect plain HTTP to HTTPS from when serving TLS. Leave blank to disable")
+	flag.StringVar(&hstsMaxAge, "hsts-max-age", LookupEnvDefault("HSTS_MAX_AGE", "8760h"), "How long browsers should stick to HTTPS when serving TLS. 0 to disable")
 	flag.Parse()
 
-	setupLogger(logLevel)
+	config, err := LoadConfigFile(flag.CommandLine, configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Configuration error:", err)
+		os.Exit(1)
+	}
+
+	rotation, err := parseRotation(logMaxSize, logMaxBackups)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Configuration error:", err)
+		os.Exit(1)
+	}
+
+	logWriter, err := openLog(logFile, rotation)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to open log file:", err)
+		os.Exit(1)
+	}
+
+	if err := setupLogger(logLevel, logFormat, logWriter); err != nil {
+		fmt.Fprintln(os.Stderr, "Configuration error:", err)
+		os.Exit(1)
+	}
 	slog.Info("File Cloud starting up...")
 
+	var access *AccessLog
+	if accessLog != "" {
+		accessWriter, err := openLog(accessLog, rotation)
+		if err != nil {
+			slog.Error("Failed to open access log", "error", err)
+			os.Exit(1)
+		}
+
+		access, err = NewAccessLog(accessWriter, accessLogFormat)
+		if err != nil {
+			slog.Error("Configuration error", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	if err := ValidateConfig(bucket, secret, key, cdn, port, user, pass); err != nil {
 		slog.Error("Configuration error", "error", err)
 		os.Exit(1)
 	}
 
+	shutdownTracing, err := SetupTracing(context.Background(), traceExporter)
+	if err != nil {
+		slog.Error("Failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		err := shutdownTracing(context.Background())
+		if err != nil {
+			slog.Error("Error flushing traces", "error", err)
+		}
+	}()
+
+	timeouts, err := ParseTimeouts(s3Timeouts)
+	if err != nil {
+		slog.Error("Configuration error", "error", err)
+		os.Exit(1)
+	}
+
+	limits, err := ParseUploadLimits(maxUpload, uploadLimits, uploadMemory)
+	if err != nil {
+		slog.Error("Configuration error", "error", err)
+		os.Exit(1)
+	}
+
+	routeLimits, err := ParseRateLimits(rateLimits)
+	if err != nil {
+		slog.Error("Configuration error", "error", err)
+		os.Exit(1)
+	}
+
+	trustedProxies, err := ParseTrustedProxies(proxies)
+	if err != nil {
+		slog.Error("Configuration error", "error", err)
+		os.Exit(1)
+	}
+
+	webhookURLs, err := ParseWebhookURLs(webhooks)
+	if err != nil {
+		slog.Error("Configuration error", "error", err)
+		os.Exit(1)
+	}
+
 	client, err := NewAWSClient(bucket, secret, key, cdn, region)
 	if err != nil {
 		slog.Error("Failed to create AWS client", "error", err)
 		os.Exit(1)
 	}
+	client.Timeouts = timeouts
+
+	quotas, err := setupQuotas(quota, userQuotas, quotaUsage)
+	if err != nil {
+		slog.Error("Configuration error", "error", err)
+		os.Exit(1)
+	}
+	client.Quotas = quotas
+
+	scanner, err := ParseClamd(clamd)
+	if err != nil {
+		slog.Error("Configuration error", "error", err)
+		os.Exit(1)
+	}
+	if scanner != nil {
+		slog.Info("Scanning uploads with clamd", "address", scanner.Address)
+		client.Scanner = scanner
+	}
+
+	var users *UserStore
+	if usersFile != "" {
+		users, err = LoadUsers(usersFile)
+		if err != nil {
+			slog.Error("Failed to load users", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	switch command := flag.Arg(0); command {
+	case "":
+	case "add-user", "remove-user":
+		if users == nil {
+			slog.Error("Managing users needs a users file")
+			os.Exit(1)
+		}
+		if err := manageUsers(users, flag.Args(), os.Stdin); err != nil {
+			slog.Error("Failed to update users", "error", err)
+			os.Exit(1)
+		}
+		return
+	case "reconcile-usage":
+		if quotas == nil || quotaUsage == "" {
+			slog.Error("Reconciling needs quotas and a quota usage file to write to")
+			os.Exit(1)
+		}
+		if err := quotas.Reconcile(context.Background(), client); err != nil {
+			slog.Error("Failed to reconcile quota usage", "error", err)
+			os.Exit(1)
+		}
+		return
+	case "rebuild-index":
+		if searchIndex == "" {
+			slog.Error("Rebuilding needs a search index file to write to")
+			os.Exit(1)
+		}
+		// Start from nothing so files gone from the bucket are dropped. The
+		// old index is only replaced once the rebuild has finished.
+		if err := emptySearchIndex(searchIndex).Rebuild(context.Background(), client); err != nil {
+			slog.Error("Failed to rebuild search index", "error", err)
+			os.Exit(1)
+		}
+		return
+	default:
+		slog.Error("Unknown command", "command", command)
+		os.Exit(1)
+	}
+
+	if checkBucket {
+		if err := client.CheckBucket(context.Background()); err != nil {
+			slog.Error("Can't reach S3 bucket", "bucket", bucket, "error", err)
+			os.Exit(1)
+		}
+		slog.Info("S3 bucket is reachable", "bucket", bucket)
+
+		if scanner != nil {
+			if err := scanner.Ping(context.Background()); err != nil {
+				slog.Error("Can't reach clamd", "address", scanner.Address, "error", err)
+				os.Exit(1)
+			}
+			slog.Info("clamd is reachable", "address", scanner.Address)
+		}
+	}
+
+	index, err := NewSearchIndex(searchIndex)
+	if err != nil {
+		slog.Error("Failed to load search index", "error", err)
+		os.Exit(1)
+	}
+
+	controls, err := NewFileControls(fileControls)
+	if err != nil {
+		slog.Error("Failed to load file controls", "error", err)
+		os.Exit(1)
+	}
+
+	// An empty index means a fresh start or a lost index file, so fill it
+	// from the bucket without holding up startup
+	if index.Len() == 0 {
+		go func() {
+			err := index.Rebuild(context.Background(), client)
+			if err != nil {
+				slog.Error("Failed to rebuild search index", "error", err)
+			}
+		}()
+	}
+
+	// Like the search index, no usage means we've nothing to go on, so work
+	// it out from the bucket
+	if quotas != nil && !quotas.Loaded() {
+		go func() {
+			err := quotas.Reconcile(context.Background(), client)
+			if err != nil {
+				slog.Error("Failed to reconcile quota usage", "error", err)
+			}
+		}()
+	}
+
+	geoIP, err := OpenGeoIP(geoIPDB)
+	if err != nil {
+		slog.Error("Configuration error", "error", err)
+		os.Exit(1)
+	}
+
+	stats, err := NewFileStats(statsFile, geoIP)
+	if err != nil {
+		slog.Error("Failed to load file stats", "error", err)
+		os.Exit(1)
+	}
+
+	analytics, err := setupAnalytics(plausibleAPI, umamiURL, umamiWebsite, analyticsFile, rotation)
+	if err != nil {
+		slog.Error("Configuration error", "error", err)
+		os.Exit(1)
+	}
 
 	web := NewWebServer(user, pass, port, plausible, client)
+	web.Search = index
+	web.Controls = controls
+	web.Stats = stats
+	web.SetUploadLimits(limits)
+	web.SetRateLimits(routeLimits, trustedProxies)
+	web.SetQuotas(quotas)
+	web.SetUsers(users)
+	web.SetScanner(scanner)
+	web.SetWebhooks(NewWebhooks(webhookURLs, webhookSecret), publicURL)
+	web.SetAnalytics(analytics, plausibleScriptURL(plausibleAPI))
+	if access != nil {
+		web.SetAccessLog(access)
+	}
+
+	address, err := ParseListen(listen, port)
+	if err != nil {
+		slog.Error("Configuration error", "error", err)
+		os.Exit(1)
+	}
+	web.Listener, err = address.Listen()
+	if err != nil {
+		slog.Error("Failed to listen", "address", address, "error", err)
+		os.Exit(1)
+	}
+
+	tlsSettings, err := parseTLSSettings(tlsCert, tlsKey, tlsDomains, tlsCacheDir, tlsEmail, acmeURL, redirectPort, hstsMaxAge)
+	if err != nil {
+		slog.Error("Configuration error", "error", err)
+		os.Exit(1)
+	}
+	if tlsSettings.Enabled() {
+		if err := web.EnableTLS(tlsSettings); err != nil {
+			slog.Error("Failed to set up TLS", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if configPath != "" || usersFile != "" {
+		go handleReloads(func() error {
+			return reloadConfig(config, web)
+		})
+	}
+
 	web.Start()
 }
 
+// Settings that can change without a restart. Everything else is either
+// needed to listen or baked into clients at startup.
+var reloadableSettings = []string{"username", "password", "plausible", "log-level"}
+
+func reloadConfig(config *ConfigFile, web *WebServer) error {
+	values, err := config.Values()
+	if err != nil {
+		return err
+	}
+
+	err = ValidateConfig(values["bucket"], values["secret"], values["key"], values["cdn"], values["port"], values["username"], values["password"])
+	if err != nil {
+		return err
+	}
+
+	for name, value := range values {
+		if slices.Contains(reloadableSettings, name) {
+			continue
+		}
+		if current := flag.Lookup(name); current != nil && current.Value.String() != value {
+			slog.Warn("Setting changed but needs a restart to take effect", "setting", name)
+		}
+	}
+
+	if err := web.users.Reload(); err != nil {
+		return err
+	}
+
+	web.Reload(values["username"], values["password"], values["plausible"])
+	logLevelVar.Set(parseLogLevel(values["log-level"]))
+
+	return nil
+}
+
+// setupQuotas returns nil if there aren't any quotas to enforce
+func setupQuotas(quota, userQuotas, usagePath string) (*Quotas, error) {
+	if quota == "" && userQuotas == "" {
+		return nil, nil
+	}
+
+	defaultQuota, err := ParseQuota(quota)
+	if err != nil {
+		return nil, err
+	}
+
+	perUser, err := ParseUserQuotas(userQuotas)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewQuotas(usagePath, defaultQuota, perUser)
+}
+
+// setupAnalytics picks analytics sinks. Plausible is always one, as its
+// domain can be set by a reload, and it sends nothing without one.
+func setupAnalytics(plausibleAPI, umamiURL, umamiWebsite, analyticsFile string, rotation logRotation) (*Analytics, error) {
+	sinks := []AnalyticsSink{NewPlausibleSink(plausibleAPI)}
+
+	if umamiURL != "" || umamiWebsite != "" {
+		if umamiURL == "" || umamiWebsite == "" {
+			return nil, fmt.Errorf("umami needs both umami-url and umami-website")
+		}
+		sinks = append(sinks, NewUmamiSink(umamiURL, umamiWebsite))
+	}
+
+	if analyticsFile != "" {
+		writer, err := openLog(analyticsFile, rotation)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't open analytics file: %w", err)
+		}
+		sinks = append(sinks, NewFileSink(writer))
+	}
+
+	return NewAnalytics(sinks...), nil
+}
+
+// manageUsers runs add-user or remove-user. New passwords are read from the
+// first line of input, so they don't end up in shell history:
+//
+//	file-cloud add-user skalnik [admin] < password.txt
+func manageUsers(users *UserStore, args []string, input io.Reader) error {
+	if len(args) < 2 {
+		return fmt.Errorf("%w: usage: %s <username>", ErrorInvalidUsers, args[0])
+	}
+	command, name := args[0], args[1]
+
+	if command == "remove-user" {
+		if err := users.Remove(name); err != nil {
+			return err
+		}
+		slog.Info("Removed user", "user", name)
+		return nil
+	}
+
+	role := RoleUser
+	if len(args) > 2 {
+		role = Role(args[2])
+	}
+
+	fmt.Fprintf(os.Stderr, "Password for %s: ", name)
+	password, err := bufio.NewReader(input).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("couldn't read password: %w", err)
+	}
+
+	if err := users.SetPassword(name, strings.TrimRight(password, "\r\n"), role); err != nil {
+		return err
+	}
+	slog.Info("Saved user", "user", name, "role", role)
+
+	return nil
+}
+
+func parseTLSSettings(cert, key, domains, cacheDir, email, directoryURL, redirectPort, hstsMaxAge string) (TLSSettings, error) {
+	maxAge, err := time.ParseDuration(hstsMaxAge)
+	if err != nil {
+		return TLSSettings{}, fmt.Errorf("%w: bad HSTS max age %q", ErrorInvalidTLS, hstsMaxAge)
+	}
+
+	if redirectPort != "" {
+		if _, err := strconv.Atoi(redirectPort); err != nil {
+			return TLSSettings{}, fmt.Errorf("%w: redirect port must be a number", ErrorInvalidTLS)
+		}
+	}
+
+	return TLSSettings{
+		CertFile:     cert,
+		KeyFile:      key,
+		Domains:      ParseDomains(domains),
+		CacheDir:     cacheDir,
+		Email:        email,
+		DirectoryURL: directoryURL,
+		RedirectPort: redirectPort,
+		HSTSMaxAge:   maxAge,
+	}, nil
+}
+
 func LookupEnvDefault(envKey, defaultValue string) string {
 	value, exists := os.LookupEnv(envKey)
 
@@ -67,25 +552,64 @@ func LookupEnvDefault(envKey, defaultValue string) string {
 	return defaultValue
 }
 
-func setupLogger(level string) {
-	var logLevel slog.Level
+// logLevelVar can be changed on the fly when the config is reloaded
+var logLevelVar = new(slog.LevelVar)
+
+func parseLogLevel(level string) slog.Level {
 	switch level {
 	case "debug":
-		logLevel = slog.LevelDebug
+		return slog.LevelDebug
 	case "info":
-		logLevel = slog.LevelInfo
+		return slog.LevelInfo
 	case "warn":
-		logLevel = slog.LevelWarn
+		return slog.LevelWarn
 	case "error":
-		logLevel = slog.LevelError
+		return slog.LevelError
 	default:
-		logLevel = slog.LevelInfo
+		return slog.LevelInfo
 	}
+}
+
+func setupLogger(level string, format string, writer io.Writer) error {
+	logLevelVar.Set(parseLogLevel(level))
 
-	handler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: logLevel,
-	})
+	handler, err := NewLogHandler(format, writer, logLevelVar)
+	if err != nil {
+		return err
+	}
 	slog.SetDefault(slog.New(handler))
+
+	return nil
+}
+
+type logRotation struct {
+	maxSize    int64
+	maxBackups int
+}
+
+// parseRotation reads the log rotation settings, with the size in megabytes
+func parseRotation(maxSize string, maxBackups string) (logRotation, error) {
+	size, err := strconv.ParseInt(maxSize, 10, 64)
+	if err != nil || size < 0 {
+		return logRotation{}, fmt.Errorf("log max size must be a number of megabytes, got %q", maxSize)
+	}
+
+	backups, err := strconv.Atoi(maxBackups)
+	if err != nil || backups < 0 {
+		return logRotation{}, fmt.Errorf("log max backups must be a number, got %q", maxBackups)
+	}
+
+	return logRotation{maxSize: size * 1024 * 1024, maxBackups: backups}, nil
+}
+
+// openLog opens a log destination: stdout for "" or "-", otherwise a
+// rotating file
+func openLog(path string, rotation logRotation) (io.Writer, error) {
+	if path == "" || path == "-" {
+		return os.Stdout, nil
+	}
+
+	return NewRotatingFile(path, rotation.maxSize, rotation.maxBackups)
 }
 
 func ValidateConfig(bucket, secret, key, cdn, port, user, pass string) error {
@@ -101,12 +625,15 @@ func ValidateConfig(bucket, secret, key, cdn, port, user, pass string) error {
 		return fmt.Errorf("AWS key is required")
 	}
 
-	portNum, err := strconv.Atoi(port)
-	if err != nil {
-		return fmt.Errorf("port must be a number: %w", err)
-	}
-	if portNum < 1 || portNum > 65535 {
-		return fmt.Errorf("port must be between 1 and 65535")
+	// No port is fine when listening somewhere else, which ParseListen checks
+	if port != "" {
+		portNum, err := strconv.Atoi(port)
+		if err != nil {
+			return fmt.Errorf("port must be a number: %w", err)
+		}
+		if portNum < 1 || portNum > 65535 {
+			return fmt.Errorf("port must be between 1 and 65535")
+		}
 	}
 
 	if cdn != "" {
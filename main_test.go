@@ -4,6 +4,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestLookupEnvDefault(t *testing.T) {
@@ -113,6 +114,13 @@ func TestValidateConfigPortTooHigh(t *testing.T) {
 	}
 }
 
+func TestValidateConfigNoPort(t *testing.T) {
+	err := ValidateConfig("bucket", "secret", "key", "", "", "", "")
+	if err != nil {
+		t.Errorf("Expected no error without a port when listening elsewhere, got %v", err)
+	}
+}
+
 func TestValidateConfigInvalidCDNURL(t *testing.T) {
 	err := ValidateConfig("bucket", "secret", "key", "not-a-url", "8080", "", "")
 	if err == nil {
@@ -146,3 +154,76 @@ func TestValidateConfigPassWithoutUser(t *testing.T) {
 		t.Error("Expected error when password provided without username")
 	}
 }
+
+func TestParseRotation(t *testing.T) {
+	rotation, err := parseRotation("10", "3")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if rotation.maxSize != 10*1024*1024 || rotation.maxBackups != 3 {
+		t.Errorf("Expected 10MB and 3 backups, got %+v", rotation)
+	}
+}
+
+func TestParseRotationInvalid(t *testing.T) {
+	if _, err := parseRotation("lots", "3"); err == nil {
+		t.Error("Expected error for non-numeric size")
+	}
+	if _, err := parseRotation("10", "-1"); err == nil {
+		t.Error("Expected error for negative backups")
+	}
+}
+
+func TestSetupLoggerUnknownFormat(t *testing.T) {
+	err := setupLogger("info", "yaml", os.Stdout)
+	if err == nil {
+		t.Error("Expected error for unknown log format")
+	}
+}
+
+func TestParseTLSSettings(t *testing.T) {
+	settings, err := parseTLSSettings("", "", "files.example.com", "certs", "", "", "80", "24h")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !settings.Enabled() || settings.HSTSMaxAge != 24*time.Hour || settings.RedirectPort != "80" {
+		t.Errorf("Expected ACME settings, got %+v", settings)
+	}
+
+	settings, _ = parseTLSSettings("", "", "", "certs", "", "", "", "8760h")
+	if settings.Enabled() {
+		t.Error("Expected TLS to be off without a cert or domains")
+	}
+}
+
+func TestParseTLSSettingsInvalid(t *testing.T) {
+	if _, err := parseTLSSettings("", "", "", "certs", "", "", "", "forever"); err == nil {
+		t.Error("Expected error for a bad HSTS max age")
+	}
+	if _, err := parseTLSSettings("", "", "", "certs", "", "", "http", "0"); err == nil {
+		t.Error("Expected error for a non-numeric redirect port")
+	}
+}
+
+func TestManageUsers(t *testing.T) {
+	users := newTestUsers(t)
+
+	err := manageUsers(users, []string{"add-user", "alice", "admin"}, strings.NewReader("correct horse\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if account, ok := users.Authenticate("alice", "correct horse"); !ok || account.Role != RoleAdmin {
+		t.Errorf("Expected alice to be added as an admin, got %+v", account)
+	}
+
+	if err := manageUsers(users, []string{"remove-user", "alice"}, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, ok := users.Authenticate("alice", "correct horse"); ok {
+		t.Error("Expected alice to be removed")
+	}
+
+	if err := manageUsers(users, []string{"add-user"}, nil); err == nil {
+		t.Error("Expected an error without a username")
+	}
+}
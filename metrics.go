@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A tiny Prometheus text format implementation, so we don't need to pull in
+// the whole client library for a handful of counters
+
+var registry = &MetricsRegistry{}
+
+var (
+	httpRequests = registry.NewCounter("filecloud_http_requests_total",
+		"HTTP requests served, by route pattern and status", "method", "route", "status")
+	httpDuration = registry.NewHistogram("filecloud_http_request_duration_seconds",
+		"Time taken to serve HTTP requests, by route pattern", defaultBuckets, "method", "route")
+	uploadBytes = registry.NewCounter("filecloud_upload_bytes_total",
+		"Bytes of new files uploaded to S3")
+	uploadDedupeHits = registry.NewCounter("filecloud_upload_dedupe_hits_total",
+		"Uploads skipped because the file was already stored")
+	cacheLookups = registry.NewCounter("filecloud_cache_lookups_total",
+		"Lookup cache hits and misses", "result")
+	s3Requests = registry.NewCounter("filecloud_s3_requests_total",
+		"S3 API calls, by operation", "operation")
+	s3Errors = registry.NewCounter("filecloud_s3_errors_total",
+		"S3 API calls that returned an error, by operation", "operation")
+	s3Duration = registry.NewHistogram("filecloud_s3_request_duration_seconds",
+		"Time taken by S3 API calls, by operation", defaultBuckets, "operation")
+	analyticsFailures = registry.NewCounter("filecloud_analytics_failures_total",
+		"Batches of analytics events a sink couldn't send, by sink", "sink")
+	analyticsDropped = registry.NewCounter("filecloud_analytics_dropped_total",
+		"Analytics events dropped because the queue was full")
+	rateLimitedRequests = registry.NewCounter("filecloud_rate_limited_requests_total",
+		"Requests turned away for going over a rate limit, by route", "route")
+	webhookDeliveries = registry.NewCounter("filecloud_webhook_deliveries_total",
+		"Webhook events delivered, failed after retries, or dropped from a full queue", "result")
+	scanResults = registry.NewCounter("filecloud_scan_results_total",
+		"Uploads scanned for malware, by whether they were clean, infected or couldn't be scanned", "result")
+)
+
+// Same as the Prometheus client's defaults, in seconds
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(writer io.Writer) error
+}
+
+type MetricsRegistry struct {
+	mutex   sync.Mutex
+	metrics []metric
+}
+
+func (registry *MetricsRegistry) register(m metric) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.metrics = append(registry.metrics, m)
+}
+
+// Write writes every registered metric in the Prometheus text format
+func (registry *MetricsRegistry) Write(writer io.Writer) error {
+	registry.mutex.Lock()
+	metrics := slices.Clone(registry.metrics)
+	registry.mutex.Unlock()
+
+	for _, m := range metrics {
+		if err := m.write(writer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (registry *MetricsRegistry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	// Nothing useful can be done about a failed write to the scraper
+	_ = registry.Write(writer)
+}
+
+// series holds everything shared between metric types: a name, help text
+// and values keyed by their label values
+type series[T any] struct {
+	name       string
+	help       string
+	labelNames []string
+
+	mutex  sync.Mutex
+	values map[string]T
+}
+
+func (s *series[T]) key(labelValues []string) string {
+	if len(labelValues) != len(s.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", s.name, len(s.labelNames), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// sortedKeys returns the label value keys in a stable order. Callers must
+// hold the mutex.
+func (s *series[T]) sortedKeys() []string {
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// labels renders label pairs, e.g. {method="GET",route="/"}, with any extra
+// pairs (like a histogram's le) appended
+func (s *series[T]) labels(key string, extra ...string) string {
+	var pairs []string
+	if len(s.labelNames) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, s.labelNames[i], escapeLabel(value)))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (s *series[T]) header(writer io.Writer, kind string) error {
+	_, err := fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, kind)
+	return err
+}
+
+type Counter struct {
+	series[float64]
+}
+
+func (registry *MetricsRegistry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	counter := &Counter{series[float64]{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     map[string]float64{},
+	}}
+
+	// Unlabelled counters should report zero rather than be missing
+	if len(labelNames) == 0 {
+		counter.values[""] = 0
+	}
+
+	registry.register(counter)
+	return counter
+}
+
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+func (counter *Counter) Add(value float64, labelValues ...string) {
+	key := counter.key(labelValues)
+
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	counter.values[key] += value
+}
+
+// Value is the current count for a set of label values
+func (counter *Counter) Value(labelValues ...string) float64 {
+	key := counter.key(labelValues)
+
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	return counter.values[key]
+}
+
+func (counter *Counter) write(writer io.Writer) error {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	if err := counter.header(writer, "counter"); err != nil {
+		return err
+	}
+
+	for _, key := range counter.sortedKeys() {
+		_, err := fmt.Fprintf(writer, "%s%s %s\n", counter.name, counter.labels(key), formatFloat(counter.values[key]))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type histogramValue struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+type Histogram struct {
+	series[*histogramValue]
+	buckets []float64
+}
+
+func (registry *MetricsRegistry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	histogram := &Histogram{
+		series: series[*histogramValue]{
+			name:       name,
+			help:       help,
+			labelNames: labelNames,
+			values:     map[string]*histogramValue{},
+		},
+		buckets: buckets,
+	}
+	registry.register(histogram)
+	return histogram
+}
+
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+	key := histogram.key(labelValues)
+
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	observed, found := histogram.values[key]
+	if !found {
+		observed = &histogramValue{counts: make([]uint64, len(histogram.buckets))}
+		histogram.values[key] = observed
+	}
+
+	observed.count++
+	observed.sum += value
+
+	if i, _ := slices.BinarySearch(histogram.buckets, value); i < len(histogram.buckets) {
+		observed.counts[i]++
+	}
+}
+
+// Count is how many observations there have been for a set of label values
+func (histogram *Histogram) Count(labelValues ...string) uint64 {
+	key := histogram.key(labelValues)
+
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	if observed, found := histogram.values[key]; found {
+		return observed.count
+	}
+	return 0
+}
+
+func (histogram *Histogram) write(writer io.Writer) error {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	if err := histogram.header(writer, "histogram"); err != nil {
+		return err
+	}
+
+	for _, key := range histogram.sortedKeys() {
+		observed := histogram.values[key]
+
+		var cumulative uint64
+		for i, bound := range histogram.buckets {
+			cumulative += observed.counts[i]
+			_, err := fmt.Fprintf(writer, "%s_bucket%s %d\n", histogram.name, histogram.labels(key, "le", formatFloat(bound)), cumulative)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := fmt.Fprintf(writer, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			histogram.name, histogram.labels(key, "le", "+Inf"), observed.count,
+			histogram.name, histogram.labels(key), formatFloat(observed.sum),
+			histogram.name, histogram.labels(key), observed.count,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestCounter(t *testing.T) {
+	registry := &MetricsRegistry{}
+	counter := registry.NewCounter("test_total", "A test counter", "result")
+
+	counter.Inc("hit")
+	counter.Inc("hit")
+	counter.Add(3, "miss")
+
+	var output bytes.Buffer
+	if err := registry.Write(&output); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := `# HELP test_total A test counter
+# TYPE test_total counter
+test_total{result="hit"} 2
+test_total{result="miss"} 3
+`
+	if output.String() != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, output.String())
+	}
+}
+
+func TestCounterWithoutLabels(t *testing.T) {
+	registry := &MetricsRegistry{}
+	registry.NewCounter("test_total", "A test counter")
+
+	var output bytes.Buffer
+	_ = registry.Write(&output)
+
+	if !strings.Contains(output.String(), "\ntest_total 0\n") {
+		t.Errorf("Expected unlabelled counter to start at zero, got %s", output.String())
+	}
+}
+
+func TestCounterEscapesLabels(t *testing.T) {
+	registry := &MetricsRegistry{}
+	counter := registry.NewCounter("test_total", "A test counter", "route")
+	counter.Inc("say \"hi\"\n")
+
+	var output bytes.Buffer
+	_ = registry.Write(&output)
+
+	if !strings.Contains(output.String(), `test_total{route="say \"hi\"\n"} 1`) {
+		t.Errorf("Expected escaped label, got %s", output.String())
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	registry := &MetricsRegistry{}
+	histogram := registry.NewHistogram("test_seconds", "A test histogram", []float64{0.1, 1}, "operation")
+
+	histogram.Observe(0.05, "get")
+	histogram.Observe(0.1, "get")
+	histogram.Observe(0.5, "get")
+	histogram.Observe(5, "get")
+
+	var output bytes.Buffer
+	_ = registry.Write(&output)
+
+	expected := `# HELP test_seconds A test histogram
+# TYPE test_seconds histogram
+test_seconds_bucket{operation="get",le="0.1"} 2
+test_seconds_bucket{operation="get",le="1"} 3
+test_seconds_bucket{operation="get",le="+Inf"} 4
+test_seconds_sum{operation="get"} 5.65
+test_seconds_count{operation="get"} 4
+`
+	if output.String() != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, output.String())
+	}
+
+	if histogram.Count("get") != 4 {
+		t.Errorf("Expected 4 observations, got %d", histogram.Count("get"))
+	}
+}
+
+func TestInstrumentedS3(t *testing.T) {
+	client := &instrumentedS3{&mockS3Client{
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			return nil, errors.New("not found")
+		},
+	}}
+
+	requests := s3Requests.Value("HeadObject")
+	failures := s3Errors.Value("HeadObject")
+	observations := s3Duration.Count("HeadObject")
+
+	_, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{})
+	if err == nil {
+		t.Fatal("Expected error to be passed through")
+	}
+
+	if s3Requests.Value("HeadObject") != requests+1 {
+		t.Error("Expected HeadObject call to be counted")
+	}
+	if s3Errors.Value("HeadObject") != failures+1 {
+		t.Error("Expected HeadObject error to be counted")
+	}
+	if s3Duration.Count("HeadObject") != observations+1 {
+		t.Error("Expected HeadObject latency to be observed")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrorNoVideoTrack = errors.New("no video track found")
+
+// MP4 and QuickTime videos, whose dimensions we can read from their headers
+var mp4VideoTypes = map[string]bool{
+	"video/mp4":       true,
+	"video/quicktime": true,
+}
+
+// How much of a track header we need, for the newer 64 bit version
+const tkhdSize = 96
+
+// mp4Dimensions finds a video's size from the header of its first video
+// track. The headers can come after the video itself, so boxes are skipped
+// over rather than read, and the file has to be seekable.
+func mp4Dimensions(file io.ReadSeeker) (int, int, error) {
+	end, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return findTrackDimensions(file, 0, end)
+}
+
+// findTrackDimensions looks through the boxes between start and end for a
+// video track, descending into the movie and its tracks
+func findTrackDimensions(file io.ReadSeeker, start, end int64) (int, int, error) {
+	for offset := start; offset+8 <= end; {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return 0, 0, err
+		}
+
+		var header [8]byte
+		if _, err := io.ReadFull(file, header[:]); err != nil {
+			return 0, 0, err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:])
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			// Runs to the end of its parent
+			size = end - offset
+		case 1:
+			var largeSize [8]byte
+			if _, err := io.ReadFull(file, largeSize[:]); err != nil {
+				return 0, 0, err
+			}
+			size = int64(binary.BigEndian.Uint64(largeSize[:]))
+			headerSize = 16
+		}
+		if size < headerSize || size > end-offset {
+			return 0, 0, fmt.Errorf("malformed %q box at %d", boxType, offset)
+		}
+
+		switch boxType {
+		case "moov", "trak":
+			width, height, err := findTrackDimensions(file, offset+headerSize, offset+size)
+			if !errors.Is(err, ErrorNoVideoTrack) {
+				return width, height, err
+			}
+		case "tkhd":
+			body := make([]byte, min(size-headerSize, tkhdSize))
+			if _, err := io.ReadFull(file, body); err != nil {
+				return 0, 0, err
+			}
+			// Audio tracks have a header too, but no size
+			if width, height := tkhdDimensions(body); width > 0 && height > 0 {
+				return width, height, nil
+			}
+		}
+
+		offset += size
+	}
+
+	return 0, 0, ErrorNoVideoTrack
+}
+
+// tkhdDimensions reads the size a track is shown at from its header, turned
+// sideways if it's rotated, as videos from phones often are
+func tkhdDimensions(body []byte) (int, int) {
+	if len(body) == 0 {
+		return 0, 0
+	}
+
+	// Versions differ in whether times are 32 or 64 bits, then have 16
+	// bytes of volume and such before the matrix
+	matrix := 40
+	if body[0] == 1 {
+		matrix = 52
+	}
+	if len(body) < matrix+44 {
+		return 0, 0
+	}
+
+	// 16.16 fixed point
+	width := int(binary.BigEndian.Uint32(body[matrix+36:]) >> 16)
+	height := int(binary.BigEndian.Uint32(body[matrix+40:]) >> 16)
+
+	// Rotated a quarter turn either way when the matrix starts 0, ±1
+	if a, b := int32(binary.BigEndian.Uint32(body[matrix:])), int32(binary.BigEndian.Uint32(body[matrix+4:])); a == 0 && b != 0 {
+		width, height = height, width
+	}
+
+	return width, height
+}
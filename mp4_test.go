@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func mp4Box(boxType string, children ...[]byte) []byte {
+	body := bytes.Join(children, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(box, boxType...), body...)
+}
+
+// mp4TrackHeader is a version 0 tkhd, rotated a quarter turn if asked
+func mp4TrackHeader(width, height int, rotated bool) []byte {
+	body := make([]byte, 84)
+	matrix := body[40:]
+	if rotated {
+		binary.BigEndian.PutUint32(matrix[4:], 1<<16)
+		binary.BigEndian.PutUint32(matrix[12:], 0xFFFF0000)
+	} else {
+		binary.BigEndian.PutUint32(matrix[0:], 1<<16)
+		binary.BigEndian.PutUint32(matrix[16:], 1<<16)
+	}
+	binary.BigEndian.PutUint32(body[76:], uint32(width)<<16)
+	binary.BigEndian.PutUint32(body[80:], uint32(height)<<16)
+
+	return mp4Box("tkhd", body)
+}
+
+func testMP4(rotated bool) []byte {
+	return bytes.Join([][]byte{
+		mp4Box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2mp41")),
+		// The movie header can come after the video
+		mp4Box("mdat", bytes.Repeat([]byte{0xAB}, 4096)),
+		mp4Box("moov",
+			mp4Box("mvhd", make([]byte, 100)),
+			mp4Box("trak", mp4TrackHeader(0, 0, false), mp4Box("mdia")),
+			mp4Box("trak", mp4TrackHeader(1920, 1080, rotated), mp4Box("mdia")),
+		),
+	}, nil)
+}
+
+func TestMP4Dimensions(t *testing.T) {
+	width, height, err := mp4Dimensions(bytes.NewReader(testMP4(false)))
+	if err != nil || width != 1920 || height != 1080 {
+		t.Errorf("Expected 1920x1080, got %dx%d %v", width, height, err)
+	}
+
+	// Filmed on its side
+	width, height, err = mp4Dimensions(bytes.NewReader(testMP4(true)))
+	if err != nil || width != 1080 || height != 1920 {
+		t.Errorf("Expected 1080x1920 when rotated, got %dx%d %v", width, height, err)
+	}
+}
+
+func TestMP4DimensionsInvalid(t *testing.T) {
+	audioOnly := mp4Box("moov", mp4Box("trak", mp4TrackHeader(0, 0, false)))
+	if _, _, err := mp4Dimensions(bytes.NewReader(audioOnly)); !errors.Is(err, ErrorNoVideoTrack) {
+		t.Errorf("Expected ErrorNoVideoTrack without a video track, got %v", err)
+	}
+
+	// Claims to be bigger than the file
+	truncated := testMP4(false)
+	truncated = truncated[:len(truncated)-20]
+	if _, _, err := mp4Dimensions(bytes.NewReader(truncated)); err == nil {
+		t.Error("Expected an error for a truncated file")
+	}
+
+	if _, _, err := mp4Dimensions(bytes.NewReader([]byte("not a video at all"))); err == nil {
+		t.Error("Expected an error for something that isn't an MP4")
+	}
+}
+
+func TestMediaDimensionsVideo(t *testing.T) {
+	video := bytes.NewReader(testMP4(false))
+
+	dimensions, err := mediaDimensions(context.Background(), video, "video/mp4")
+	if err != nil || dimensions != "1920x1080" {
+		t.Errorf("Expected 1920x1080, got %q %v", dimensions, err)
+	}
+
+	if position, _ := video.Seek(0, io.SeekCurrent); position != 0 {
+		t.Errorf("Expected the video to be left at the start, got %d", position)
+	}
+}
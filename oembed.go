@@ -0,0 +1,168 @@
+package main
+
+import (
+	"cmp"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var ErrorUnsupportedFormat = errors.New("unsupported oEmbed format")
+
+// OEmbed describes how to embed a file, for anything that turns links into
+// previews, like Slack, Discord and Notion. See https://oembed.com.
+type OEmbed struct {
+	XMLName      xml.Name `json:"-" xml:"oembed"`
+	Version      string   `json:"version" xml:"version"`
+	Type         string   `json:"type" xml:"type"` // photo, video or link
+	Title        string   `json:"title" xml:"title"`
+	ProviderName string   `json:"provider_name" xml:"provider_name"`
+	ProviderURL  string   `json:"provider_url" xml:"provider_url"`
+
+	// Photos have a URL and videos have HTML, both with dimensions
+	URL    string `json:"url,omitempty" xml:"url,omitempty"`
+	HTML   string `json:"html,omitempty" xml:"html,omitempty"`
+	Width  int    `json:"width,omitempty" xml:"width,omitempty"`
+	Height int    `json:"height,omitempty" xml:"height,omitempty"`
+}
+
+// newOEmbed picks how to embed a file, scaled down to fit within maxWidth
+// and maxHeight if they're set. Images and videos we couldn't get the
+// dimensions of, and anything else that can't be shown inline, are plain
+// links.
+func (webServer *WebServer) newOEmbed(request *http.Request, file StoredFile, maxWidth, maxHeight int) OEmbed {
+	embed := OEmbed{
+		Version:      "1.0",
+		Type:         "link",
+		Title:        file.OriginalName,
+		ProviderName: "File Cloud",
+		ProviderURL:  webServer.baseURL(request),
+	}
+
+	if file.Width == 0 || file.Height == 0 {
+		return embed
+	}
+
+	// The direct link rather than the file's URL, which is presigned and
+	// would expire while the embed is still cached
+	switch file.Kind {
+	case KindImage:
+		embed.Type = "photo"
+		embed.URL = webServer.directURL(request, file)
+		embed.Width, embed.Height = fitWithin(file.Width, file.Height, maxWidth, maxHeight)
+	case KindVideo:
+		embed.Type = "video"
+		embed.Width, embed.Height = fitWithin(file.Width, file.Height, maxWidth, maxHeight)
+		embed.HTML = fmt.Sprintf(`<video controls preload="metadata" src="%s" width="%d" height="%d"></video>`,
+			html.EscapeString(webServer.directURL(request, file)), embed.Width, embed.Height)
+	}
+
+	return embed
+}
+
+// fitWithin scales width and height down to fit within maxWidth and
+// maxHeight, keeping their aspect ratio. A zero max doesn't limit that side.
+func fitWithin(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = min(scale, float64(maxWidth)/float64(width))
+	}
+	if maxHeight > 0 && height > maxHeight {
+		scale = min(scale, float64(maxHeight)/float64(height))
+	}
+
+	return max(1, int(math.Round(float64(width)*scale))), max(1, int(math.Round(float64(height)*scale)))
+}
+
+// oEmbedKey finds the file a link points at, either its page or a direct
+// link. Links to anywhere else aren't ours to embed.
+func (webServer *WebServer) oEmbedKey(request *http.Request, link string) (string, error) {
+	parsed, err := url.Parse(link)
+	if err != nil || parsed.Host == "" {
+		return "", fmt.Errorf("%w: can't embed %q", ErrorObjectMissing, link)
+	}
+
+	host := request.Host
+	if webServer.publicURL != "" {
+		if public, err := url.Parse(webServer.publicURL); err == nil {
+			host = public.Host
+		}
+	}
+	if !strings.EqualFold(parsed.Host, host) {
+		return "", fmt.Errorf("%w: %s isn't one of our links", ErrorObjectMissing, link)
+	}
+
+	key, _, _ := strings.Cut(strings.TrimPrefix(parsed.Path, "/"), ".")
+	if len(key) != keyLength || strings.Contains(key, "/") {
+		return "", fmt.Errorf("%w: %s isn't a link to a file", ErrorObjectMissing, link)
+	}
+
+	return key, nil
+}
+
+// oEmbedURL is where a file page's embed can be found, for discovery. The
+// format is left off, to be added by the page.
+func (webServer *WebServer) oEmbedURL(request *http.Request, key string) string {
+	query := url.Values{"url": {webServer.shortURL(request, key)}}
+	return fmt.Sprintf("%s/oembed?%s", webServer.baseURL(request), query.Encode())
+}
+
+// OEmbedHandler serves GET /oembed?url=...&format=json|xml, with optional
+// maxwidth and maxheight
+func (webServer *WebServer) OEmbedHandler(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+
+	format := cmp.Or(query.Get("format"), "json")
+	if format != "json" && format != "xml" {
+		http.Error(writer, fmt.Sprintf("%s: %q", ErrorUnsupportedFormat, format), http.StatusNotImplemented)
+		return
+	}
+
+	var maxSize [2]int
+	for i, name := range []string{"maxwidth", "maxheight"} {
+		if raw := query.Get(name); raw != "" {
+			size, err := strconv.Atoi(raw)
+			if err != nil || size < 0 {
+				webServer.ServeError(writer, request, fmt.Errorf("%w: bad %s %q", ErrorBadRequest, name, raw))
+				return
+			}
+			maxSize[i] = size
+		}
+	}
+
+	key, err := webServer.oEmbedKey(request, query.Get("url"))
+	if err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	if err := webServer.Controls.Available(key); err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	file, err := webServer.storage.LookupFile(request.Context(), key)
+	if err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	embed := webServer.newOEmbed(request, *file, maxSize[0], maxSize[1])
+	if format == "json" {
+		webServer.ServeJSON(writer, request, embed)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	_, _ = writer.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(writer).Encode(embed); err != nil {
+		slog.ErrorContext(request.Context(), "Error writing oEmbed XML response", "error", err)
+	}
+}
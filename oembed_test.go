@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockEmbedStorage struct {
+	StorageClient
+	file StoredFile
+}
+
+func (c *mockEmbedStorage) LookupFile(ctx context.Context, prefix string) (*StoredFile, error) {
+	return &c.file, nil
+}
+
+func oEmbedRequest(t *testing.T, server *WebServer, query url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodGet, "/oembed?"+query.Encode(), nil)
+	request.Host = "files.example.com"
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	return responseRecorder
+}
+
+func TestOEmbedPhoto(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockEmbedStorage{file: StoredFile{
+		Key:          "ABCDE",
+		OriginalName: "cat.png",
+		Url:          "http://cdn.example.com/cat.png",
+		Kind:         KindImage,
+		Width:        1200,
+		Height:       800,
+	}})
+
+	responseRecorder := oEmbedRequest(t, server, url.Values{"url": {"https://files.example.com/ABCDE"}, "maxwidth": {"600"}})
+	if responseRecorder.Code != http.StatusOK {
+		t.Fatalf(`Expected 200 OK, but instead got %d`, responseRecorder.Code)
+	}
+
+	var embed OEmbed
+	if err := json.Unmarshal(responseRecorder.Body.Bytes(), &embed); err != nil {
+		t.Fatalf("Expected JSON, got %s", responseRecorder.Body.String())
+	}
+	if embed.Version != "1.0" || embed.Type != "photo" || embed.URL != "https://files.example.com/ABCDE.png" || embed.Title != "cat.png" {
+		t.Errorf("Expected the image as a photo, got %+v", embed)
+	}
+	if embed.Width != 600 || embed.Height != 400 {
+		t.Errorf("Expected the photo scaled down to 600x400, got %dx%d", embed.Width, embed.Height)
+	}
+	if embed.ProviderName != "File Cloud" || embed.ProviderURL != "https://files.example.com" {
+		t.Errorf("Expected us as the provider, got %+v", embed)
+	}
+
+	// Direct links embed the same way
+	responseRecorder = oEmbedRequest(t, server, url.Values{"url": {"https://files.example.com/ABCDE.png"}})
+	if err := json.Unmarshal(responseRecorder.Body.Bytes(), &embed); err != nil || embed.Width != 1200 {
+		t.Errorf("Expected the full size photo for a direct link, got %s", responseRecorder.Body.String())
+	}
+}
+
+func TestOEmbedXML(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockEmbedStorage{file: StoredFile{
+		Key:          "ABCDE",
+		OriginalName: "Cat.PNG",
+		Url:          "http://cdn.example.com/Cat.PNG?a=1&b=2",
+		Kind:         KindImage,
+		Width:        1200,
+		Height:       800,
+	}})
+
+	responseRecorder := oEmbedRequest(t, server, url.Values{"url": {"https://files.example.com/ABCDE"}, "format": {"xml"}, "maxheight": {"200"}})
+	if responseRecorder.Code != http.StatusOK || !strings.HasPrefix(responseRecorder.Header().Get("Content-Type"), "text/xml") {
+		t.Fatalf(`Expected 200 OK with XML, but instead got %d %s`, responseRecorder.Code, responseRecorder.Header().Get("Content-Type"))
+	}
+
+	var embed OEmbed
+	if err := xml.Unmarshal(responseRecorder.Body.Bytes(), &embed); err != nil {
+		t.Fatalf("Expected XML, got %s", responseRecorder.Body.String())
+	}
+	if embed.Type != "photo" || embed.Width != 300 || embed.Height != 200 {
+		t.Errorf("Expected a 300x200 photo, got %+v", embed)
+	}
+	// Direct links have lowercase extensions
+	if embed.URL != "https://files.example.com/ABCDE.png" {
+		t.Errorf("Expected the direct link, got %s", embed.URL)
+	}
+}
+
+func TestOEmbedVideo(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockEmbedStorage{file: StoredFile{
+		Key:          "ABCDE",
+		OriginalName: "clip.mp4",
+		Url:          "http://cdn.example.com/clip.mp4?a=1&b=2",
+		Kind:         KindVideo,
+		Width:        1920,
+		Height:       1080,
+	}})
+
+	responseRecorder := oEmbedRequest(t, server, url.Values{"url": {"https://files.example.com/ABCDE"}, "maxheight": {"180"}})
+
+	var embed OEmbed
+	if err := json.Unmarshal(responseRecorder.Body.Bytes(), &embed); err != nil {
+		t.Fatalf("Expected JSON, got %s", responseRecorder.Body.String())
+	}
+	if embed.Type != "video" || embed.Width != 320 || embed.Height != 180 || embed.URL != "" {
+		t.Errorf("Expected a 320x180 video, got %+v", embed)
+	}
+	expected := `<video controls preload="metadata" src="https://files.example.com/ABCDE.mp4" width="320" height="180"></video>`
+	if embed.HTML != expected {
+		t.Errorf("Expected %s, got %s", expected, embed.HTML)
+	}
+}
+
+func TestOEmbedLink(t *testing.T) {
+	for _, file := range []StoredFile{
+		{Key: "ABCDE", OriginalName: "notes.txt", Kind: KindText},
+		// Nor a video, which needs one for its player
+		{Key: "ABCDE", OriginalName: "clip.webm", Kind: KindVideo, Url: "http://cdn.example.com/clip.webm"},
+		// Without dimensions it can't be a photo
+		{Key: "ABCDE", OriginalName: "drawing.svg", Kind: KindImage},
+	} {
+		server := NewWebServer("", "", "", "", &mockEmbedStorage{file: file})
+		responseRecorder := oEmbedRequest(t, server, url.Values{"url": {"https://files.example.com/ABCDE"}})
+
+		var embed OEmbed
+		_ = json.Unmarshal(responseRecorder.Body.Bytes(), &embed)
+		if embed.Type != "link" || embed.Title != file.OriginalName || embed.URL != "" || embed.Width != 0 {
+			t.Errorf("Expected a link for %s, got %+v", file.OriginalName, embed)
+		}
+	}
+}
+
+func TestOEmbedErrors(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockEmbedStorage{file: StoredFile{Key: "ABCDE", OriginalName: "cat.png"}})
+	server.SetWebhooks(nil, "https://share.example.com")
+
+	tests := []struct {
+		query  url.Values
+		status int
+	}{
+		{url.Values{"url": {"https://share.example.com/ABCDE"}}, http.StatusOK},
+		{url.Values{"url": {"https://share.example.com/ABCDE"}, "format": {"yaml"}}, http.StatusNotImplemented},
+		{url.Values{"url": {"https://share.example.com/ABCDE"}, "maxwidth": {"wide"}}, http.StatusBadRequest},
+		// With a public URL, that's the only host that's ours
+		{url.Values{"url": {"https://files.example.com/ABCDE"}}, http.StatusNotFound},
+		{url.Values{"url": {"https://share.example.com/browse"}}, http.StatusNotFound},
+		{url.Values{"url": {"https://share.example.com/ABCDE/edit"}}, http.StatusNotFound},
+		{url.Values{"url": {"/ABCDE"}}, http.StatusNotFound},
+		{url.Values{}, http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		if responseRecorder := oEmbedRequest(t, server, test.query); responseRecorder.Code != test.status {
+			t.Errorf(`Expected %d for %v, but instead got %d`, test.status, test.query, responseRecorder.Code)
+		}
+	}
+
+	server.Controls.Block("ABCDE", true)
+	if responseRecorder := oEmbedRequest(t, server, url.Values{"url": {"https://share.example.com/ABCDE"}}); responseRecorder.Code != http.StatusGone {
+		t.Errorf(`Expected blocked files not to be embedded, but instead got %d`, responseRecorder.Code)
+	}
+}
+
+func TestLookupHandlerOEmbedDiscovery(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockEmbedStorage{file: StoredFile{
+		Key:          "ABCDE",
+		OriginalName: "cat.png",
+		Kind:         KindImage,
+		Width:        1200,
+		Height:       800,
+		UploadedAt:   time.Now(),
+	}})
+
+	request := httptest.NewRequest(http.MethodGet, "/ABCDE", nil)
+	request.Host = "files.example.com"
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	body := responseRecorder.Body.String()
+	discovery := `<link rel="alternate" type="application/json+oembed" href="https://files.example.com/oembed?url=https%3A%2F%2Ffiles.example.com%2FABCDE&amp;format=json" title="cat.png" />`
+	if !strings.Contains(body, discovery) {
+		t.Errorf(`Could not find oEmbed discovery link in body: %s`, body)
+	}
+	if !strings.Contains(body, `<meta property="og:image:width" content="1200" />`) {
+		t.Errorf(`Could not find og:image:width in body: %s`, body)
+	}
+}
+
+func TestFitWithin(t *testing.T) {
+	tests := []struct {
+		width, height, maxWidth, maxHeight int
+		expectedWidth, expectedHeight      int
+	}{
+		{1200, 800, 0, 0, 1200, 800},
+		{1200, 800, 600, 0, 600, 400},
+		{1200, 800, 600, 100, 150, 100},
+		{100, 50, 600, 400, 100, 50},
+		{5000, 1, 100, 0, 100, 1},
+	}
+
+	for _, test := range tests {
+		width, height := fitWithin(test.width, test.height, test.maxWidth, test.maxHeight)
+		if width != test.expectedWidth || height != test.expectedHeight {
+			t.Errorf("Expected %dx%d within %dx%d to be %dx%d, got %dx%d", test.width, test.height, test.maxWidth, test.maxHeight,
+				test.expectedWidth, test.expectedHeight, width, height)
+		}
+	}
+}
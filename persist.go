@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// jsonFile is where state is persisted as JSON, rewriting the whole file on
+// each save. Saves are serialized from taking a snapshot until it's on disk,
+// so an older snapshot can never be renamed over a newer one.
+type jsonFile struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// save writes out what snapshot returns, unless there's no path to save to.
+// snapshot should copy the state under its own lock, and can return nil if
+// there's nothing new to save.
+func (file *jsonFile) save(snapshot func() any) error {
+	if file.path == "" {
+		return nil
+	}
+
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+
+	data := snapshot()
+	if data == nil {
+		return nil
+	}
+
+	return writeFileAtomic(file.path, data)
+}
+
+// writeFileAtomic writes data as JSON via a temporary file, so a crash can't
+// leave it half written
+func writeFileAtomic(path string, data any) error {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Already renamed on success, so this only cleans up after failures
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
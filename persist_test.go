@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJSONFileSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	file := &jsonFile{path: path}
+
+	if err := file.save(func() any { return map[string]int{"a": 1} }); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != `{"a":1}` {
+		t.Errorf("Expected the snapshot to be saved, got %s", content)
+	}
+
+	// Nothing new to save leaves it alone
+	if err := file.save(func() any { return nil }); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != `{"a":1}` {
+		t.Errorf("Expected the last save to be kept, got %s", content)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected no temporary files left behind, got %v", entries)
+	}
+}
+
+func TestJSONFileWithoutPath(t *testing.T) {
+	file := &jsonFile{}
+
+	err := file.save(func() any {
+		t.Error("Expected no snapshot without a path")
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
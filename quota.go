@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrorQuotaExceeded = errors.New("storage quota exceeded")
+
+// Metadata key the uploading user is stored under (x-amz-meta-uploader)
+const uploaderMetadataKey = "uploader"
+
+// Quota caps how much a user can store. Zero means no limit.
+type Quota struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+type Usage struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+// Quotas tracks how much each uploader has stored, so uploads over their
+// quota can be turned away. Like the search index it can be persisted to a
+// JSON file, and the bucket is the source of truth it can be reconciled
+// against. Users are whoever uploaded with basic auth, or blank without it.
+type Quotas struct {
+	Default Quota
+	PerUser map[string]Quota
+
+	persisted jsonFile
+	mutex     sync.Mutex
+	usage     map[string]Usage
+	pending   map[string]Usage // uploads in flight, so they can't race past a quota
+}
+
+func NewQuotas(path string, defaultQuota Quota, perUser map[string]Quota) (*Quotas, error) {
+	quotas := &Quotas{
+		Default:   defaultQuota,
+		PerUser:   perUser,
+		persisted: jsonFile{path: path},
+		usage:     map[string]Usage{},
+		pending:   map[string]Usage{},
+	}
+
+	if path == "" {
+		return quotas, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return quotas, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read quota usage: %w", err)
+	}
+
+	if err := json.Unmarshal(content, &quotas.usage); err != nil {
+		return nil, fmt.Errorf("couldn't parse quota usage: %w", err)
+	}
+
+	return quotas, nil
+}
+
+// Loaded is whether there's any usage recorded, either from the file or
+// since starting
+func (quotas *Quotas) Loaded() bool {
+	quotas.mutex.Lock()
+	defer quotas.mutex.Unlock()
+
+	return len(quotas.usage) > 0
+}
+
+func (quotas *Quotas) Limit(user string) Quota {
+	if quota, ok := quotas.PerUser[user]; ok {
+		return quota
+	}
+	return quotas.Default
+}
+
+func (quotas *Quotas) Usage(user string) Usage {
+	quotas.mutex.Lock()
+	defer quotas.mutex.Unlock()
+
+	return quotas.usage[user]
+}
+
+// Reserve checks a new file of size bytes fits in a user's quota, and holds
+// the space until the returned function is called with whether the file was
+// actually stored. A nil Quotas allows everything.
+func (quotas *Quotas) Reserve(user string, size int64) (func(stored bool), error) {
+	if quotas == nil {
+		return func(bool) {}, nil
+	}
+
+	quotas.mutex.Lock()
+	defer quotas.mutex.Unlock()
+
+	limit := quotas.Limit(user)
+	used := quotas.usage[user]
+	pending := quotas.pending[user]
+
+	if limit.Bytes > 0 && used.Bytes+pending.Bytes+size > limit.Bytes {
+		return nil, fmt.Errorf("%w: %s of %s used", ErrorQuotaExceeded, humanSize(used.Bytes), humanSize(limit.Bytes))
+	}
+	if limit.Files > 0 && used.Files+pending.Files+1 > limit.Files {
+		return nil, fmt.Errorf("%w: %d of %d files used", ErrorQuotaExceeded, used.Files, limit.Files)
+	}
+
+	quotas.pending[user] = Usage{Bytes: pending.Bytes + size, Files: pending.Files + 1}
+
+	var once sync.Once
+	return func(stored bool) {
+		once.Do(func() { quotas.settle(user, size, stored) })
+	}, nil
+}
+
+func (quotas *Quotas) settle(user string, size int64, stored bool) {
+	quotas.mutex.Lock()
+	pending := quotas.pending[user]
+	pending.Bytes -= size
+	pending.Files--
+	if pending == (Usage{}) {
+		delete(quotas.pending, user)
+	} else {
+		quotas.pending[user] = pending
+	}
+
+	if stored {
+		used := quotas.usage[user]
+		quotas.usage[user] = Usage{Bytes: used.Bytes + size, Files: used.Files + 1}
+	}
+	quotas.mutex.Unlock()
+
+	if stored {
+		quotas.persist()
+	}
+}
+
+// Release gives back the space of a file that's been deleted
+func (quotas *Quotas) Release(user string, size int64) {
+	if quotas == nil {
+		return
+	}
+
+	quotas.mutex.Lock()
+	used := quotas.usage[user]
+	used = Usage{Bytes: max(used.Bytes-size, 0), Files: max(used.Files-1, 0)}
+	if used == (Usage{}) {
+		delete(quotas.usage, user)
+	} else {
+		quotas.usage[user] = used
+	}
+	quotas.mutex.Unlock()
+
+	quotas.persist()
+}
+
+// Reconcile recomputes everyone's usage from what's actually in the bucket.
+// Listings don't include who uploaded a file, so each one is looked up.
+func (quotas *Quotas) Reconcile(ctx context.Context, storage StorageClient) error {
+	quotas.mutex.Lock()
+	before := maps.Clone(quotas.usage)
+	quotas.mutex.Unlock()
+
+	usage := map[string]Usage{}
+	token := ""
+	count := 0
+
+	for {
+		listing, err := storage.ListFiles(ctx, token, maxPageSize)
+		if err != nil {
+			return fmt.Errorf("couldn't list files for quotas: %w", err)
+		}
+
+		for _, file := range listing.Files {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			details, err := storage.LookupFile(ctx, file.Key)
+			if err != nil {
+				// Counting it against nobody is better than not counting it
+				// at all, as it still takes up space
+				slog.WarnContext(ctx, "Error looking up file for quotas", "key", file.Key, "error", err)
+			} else {
+				file = *details
+			}
+
+			used := usage[file.Uploader]
+			usage[file.Uploader] = Usage{Bytes: used.Bytes + file.Size, Files: used.Files + 1}
+		}
+		count += len(listing.Files)
+
+		if listing.NextToken == "" {
+			break
+		}
+		token = listing.NextToken
+	}
+
+	// Uploads and deletes carry on while we list, so rather than replacing
+	// everyone's usage, only apply how far it was off when we started. An
+	// upload that was also listed counts twice until the next reconcile,
+	// which errs on the side of the quota.
+	quotas.mutex.Lock()
+	users := slices.Concat(slices.Collect(maps.Keys(before)), slices.Collect(maps.Keys(usage)))
+	for _, user := range slices.Compact(slices.Sorted(slices.Values(users))) {
+		current, listed, previous := quotas.usage[user], usage[user], before[user]
+		adjusted := Usage{
+			Bytes: max(current.Bytes+listed.Bytes-previous.Bytes, 0),
+			Files: max(current.Files+listed.Files-previous.Files, 0),
+		}
+		if adjusted == (Usage{}) {
+			delete(quotas.usage, user)
+		} else {
+			quotas.usage[user] = adjusted
+		}
+	}
+	quotas.mutex.Unlock()
+
+	quotas.persist()
+	slog.InfoContext(ctx, "Reconciled quota usage", "files", count, "users", len(usage))
+
+	return nil
+}
+
+func (quotas *Quotas) persist() {
+	err := quotas.persisted.save(func() any {
+		quotas.mutex.Lock()
+		defer quotas.mutex.Unlock()
+
+		return maps.Clone(quotas.usage)
+	})
+	if err != nil {
+		slog.Error("Error saving quota usage", "path", quotas.persisted.path, "error", err)
+	}
+}
+
+// ParseQuota reads a quota like "10GB" or "10GB/500", where the second part
+// is a number of files. Either can be 0 for no limit.
+func ParseQuota(raw string) (Quota, error) {
+	rawBytes, rawFiles, _ := strings.Cut(strings.TrimSpace(raw), "/")
+
+	bytes, err := ParseSize(rawBytes)
+	if err != nil {
+		return Quota{}, err
+	}
+
+	var files int64
+	if rawFiles = strings.TrimSpace(rawFiles); rawFiles != "" {
+		files, err = strconv.ParseInt(rawFiles, 10, 64)
+		if err != nil || files < 0 {
+			return Quota{}, fmt.Errorf("%w: bad file count %q", ErrorInvalidSize, rawFiles)
+		}
+	}
+
+	return Quota{Bytes: bytes, Files: files}, nil
+}
+
+// ParseUserQuotas reads per user quotas like "skalnik=50GB,guest=1GB/100"
+func ParseUserQuotas(raw string) (map[string]Quota, error) {
+	quotas := map[string]Quota{}
+
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		user, rawQuota, found := strings.Cut(pair, "=")
+		if !found || strings.TrimSpace(user) == "" {
+			return nil, fmt.Errorf("%w: expected user=quota, got %q", ErrorInvalidSize, pair)
+		}
+
+		quota, err := ParseQuota(rawQuota)
+		if err != nil {
+			return nil, err
+		}
+		quotas[strings.TrimSpace(user)] = quota
+	}
+
+	return quotas, nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseQuota(t *testing.T) {
+	for raw, expected := range map[string]Quota{
+		"":          {},
+		"10GB":      {Bytes: 10 << 30},
+		"1GB/100":   {Bytes: 1 << 30, Files: 100},
+		"0/50":      {Files: 50},
+		" 5MB / 2 ": {Bytes: 5 << 20, Files: 2},
+	} {
+		quota, err := ParseQuota(raw)
+		if err != nil {
+			t.Errorf("%q: expected no error, got %v", raw, err)
+		}
+		if quota != expected {
+			t.Errorf("%q: expected %+v, got %+v", raw, expected, quota)
+		}
+	}
+
+	if _, err := ParseQuota("1GB/lots"); !errors.Is(err, ErrorInvalidSize) {
+		t.Errorf("Expected ErrorInvalidSize, got %v", err)
+	}
+}
+
+func TestParseUserQuotas(t *testing.T) {
+	quotas, err := ParseUserQuotas("skalnik=50GB, guest=1GB/100")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if quotas["guest"] != (Quota{Bytes: 1 << 30, Files: 100}) {
+		t.Errorf("Expected guest quota, got %+v", quotas["guest"])
+	}
+
+	if _, err := ParseUserQuotas("skalnik"); !errors.Is(err, ErrorInvalidSize) {
+		t.Errorf("Expected ErrorInvalidSize, got %v", err)
+	}
+}
+
+func TestQuotasReserve(t *testing.T) {
+	quotas, _ := NewQuotas("", Quota{Bytes: 100, Files: 2}, map[string]Quota{"skalnik": {}})
+
+	settle, err := quotas.Reserve("guest", 60)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Space held by an upload in flight can't be taken by another
+	if _, err := quotas.Reserve("guest", 60); !errors.Is(err, ErrorQuotaExceeded) {
+		t.Errorf("Expected ErrorQuotaExceeded while the first upload is in flight, got %v", err)
+	}
+
+	settle(true)
+	settle(true)
+	if usage := quotas.Usage("guest"); usage != (Usage{Bytes: 60, Files: 1}) {
+		t.Errorf("Expected one upload counted once, got %+v", usage)
+	}
+
+	settle, _ = quotas.Reserve("guest", 10)
+	settle(true)
+	if _, err := quotas.Reserve("guest", 1); !errors.Is(err, ErrorQuotaExceeded) {
+		t.Errorf("Expected ErrorQuotaExceeded over the file limit, got %v", err)
+	}
+
+	if _, err := quotas.Reserve("skalnik", 1<<40); err != nil {
+		t.Errorf("Expected no limit for a user with an empty quota, got %v", err)
+	}
+}
+
+func TestQuotasNil(t *testing.T) {
+	var quotas *Quotas
+	settle, err := quotas.Reserve("anyone", 1<<40)
+	if err != nil {
+		t.Errorf("Expected no quotas to allow everything, got %v", err)
+	}
+	settle(true)
+}
+
+func TestQuotasPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+
+	quotas, _ := NewQuotas(path, Quota{}, nil)
+	if quotas.Loaded() {
+		t.Error("Expected nothing loaded without a usage file")
+	}
+	settle, _ := quotas.Reserve("skalnik", 42)
+	settle(true)
+
+	reloaded, err := NewQuotas(path, Quota{}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reloaded.Loaded() {
+		t.Error("Expected usage to be loaded from the file")
+	}
+	if usage := reloaded.Usage("skalnik"); usage != (Usage{Bytes: 42, Files: 1}) {
+		t.Errorf("Expected usage to survive a restart, got %+v", usage)
+	}
+}
+
+type mockUploaderStorage struct {
+	StorageClient
+}
+
+func (c *mockUploaderStorage) ListFiles(ctx context.Context, continuationToken string, limit int32) (*FileListing, error) {
+	if continuationToken == "" {
+		return &FileListing{
+			Files: []StoredFile{
+				{Key: "AAAAA", Size: 100},
+				{Key: "BBBBB", Size: 200},
+			},
+			NextToken: "next",
+		}, nil
+	}
+	return &FileListing{Files: []StoredFile{{Key: "CCCCC", Size: 400}}}, nil
+}
+
+func (c *mockUploaderStorage) LookupFile(ctx context.Context, prefix string) (*StoredFile, error) {
+	switch prefix {
+	case "AAAAA":
+		return &StoredFile{Key: prefix, Size: 100, Uploader: "skalnik"}, nil
+	case "BBBBB":
+		return &StoredFile{Key: prefix, Size: 200, Uploader: "skalnik"}, nil
+	default:
+		return nil, ErrorObjectMissing
+	}
+}
+
+func TestQuotasReconcile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	quotas, _ := NewQuotas(path, Quota{}, nil)
+
+	// Whatever was there before is replaced
+	settle, _ := quotas.Reserve("guest", 1000)
+	settle(true)
+
+	err := quotas.Reconcile(context.Background(), &mockUploaderStorage{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if usage := quotas.Usage("skalnik"); usage != (Usage{Bytes: 300, Files: 2}) {
+		t.Errorf("Expected skalnik's files to be counted, got %+v", usage)
+	}
+	if usage := quotas.Usage(""); usage != (Usage{Bytes: 400, Files: 1}) {
+		t.Errorf("Expected files that couldn't be looked up to count for nobody, got %+v", usage)
+	}
+	if usage := quotas.Usage("guest"); usage != (Usage{}) {
+		t.Errorf("Expected stale usage to be dropped, got %+v", usage)
+	}
+
+	reloaded, _ := NewQuotas(path, Quota{}, nil)
+	if usage := reloaded.Usage("skalnik"); usage != (Usage{Bytes: 300, Files: 2}) {
+		t.Errorf("Expected reconciled usage to be saved, got %+v", usage)
+	}
+}
+
+// mockBusyStorage has an upload finish partway through being listed
+type mockBusyStorage struct {
+	mockUploaderStorage
+	duringListing func()
+}
+
+func (c *mockBusyStorage) ListFiles(ctx context.Context, continuationToken string, limit int32) (*FileListing, error) {
+	if continuationToken != "" {
+		c.duringListing()
+	}
+	return c.mockUploaderStorage.ListFiles(ctx, continuationToken, limit)
+}
+
+func TestQuotasReconcileKeepsUploadsWhileListing(t *testing.T) {
+	quotas, _ := NewQuotas("", Quota{}, nil)
+
+	// Off by a file to start with
+	settle, _ := quotas.Reserve("skalnik", 100)
+	settle(true)
+
+	storage := &mockBusyStorage{duringListing: func() {
+		settle, _ := quotas.Reserve("guest", 50)
+		settle(true)
+	}}
+	if err := quotas.Reconcile(context.Background(), storage); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if usage := quotas.Usage("skalnik"); usage != (Usage{Bytes: 300, Files: 2}) {
+		t.Errorf("Expected skalnik's usage to be corrected, got %+v", usage)
+	}
+	if usage := quotas.Usage("guest"); usage != (Usage{Bytes: 50, Files: 1}) {
+		t.Errorf("Expected an upload while listing to be kept, got %+v", usage)
+	}
+}
+
+type mockOverQuotaStorage struct {
+	StorageClient
+}
+
+func (c *mockOverQuotaStorage) UploadFile(ctx context.Context, file multipart.File, fileHeader multipart.FileHeader, details FileDetails) (string, bool, error) {
+	return "", false, ErrorQuotaExceeded
+}
+
+func TestUploadHandlerOverQuota(t *testing.T) {
+	server := NewWebServer("skalnik", "hunter2", "", "", &mockOverQuotaStorage{})
+	quotas, _ := NewQuotas("", Quota{Bytes: 1 << 20}, nil)
+	server.SetQuotas(quotas)
+
+	request := uploadRequest(t, 16)
+	request.SetBasicAuth("skalnik", "hunter2")
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	if responseRecorder.Code != http.StatusForbidden {
+		t.Fatalf(`Expected 403, but instead got %d`, responseRecorder.Code)
+	}
+
+	var body struct {
+		Error string `json:"error"`
+		User  string `json:"user"`
+		Quota Quota  `json:"quota"`
+	}
+	if err := json.NewDecoder(responseRecorder.Body).Decode(&body); err != nil {
+		t.Fatalf("Expected JSON body, got %v", err)
+	}
+	if body.Error == "" || body.User != "skalnik" || body.Quota.Bytes != 1<<20 {
+		t.Errorf("Expected usage in the error, got %+v", body)
+	}
+}
+
+func TestUsageHandler(t *testing.T) {
+	server := NewWebServer("skalnik", "hunter2", "", "", &mockStorage{})
+	quotas, _ := NewQuotas("", Quota{Bytes: 10 << 30, Files: 500}, nil)
+	settle, _ := quotas.Reserve("skalnik", 3<<20)
+	settle(true)
+	server.SetQuotas(quotas)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/usage", nil)
+	request.SetBasicAuth("skalnik", "hunter2")
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	expected := `{"user":"skalnik","used":{"bytes":3145728,"files":1},"quota":{"bytes":10737418240,"files":500}}`
+	if strings.TrimSpace(responseRecorder.Body.String()) != expected {
+		t.Errorf("Expected %s, got %s", expected, responseRecorder.Body.String())
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/", nil)
+	request.SetBasicAuth("skalnik", "hunter2")
+	responseRecorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	body := strings.Join(strings.Fields(responseRecorder.Body.String()), " ")
+	if !strings.Contains(body, "Using 3.0 MB of 10.0 GB, 1 of 500 files") {
+		t.Errorf("Expected usage on the index page, got %s", body)
+	}
+}
+
+func TestUsageHandlerWithoutQuotas(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockStorage{})
+
+	request := httptest.NewRequest(http.MethodGet, "/api/usage", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	if responseRecorder.Code != http.StatusNotFound {
+		t.Errorf(`Expected 404, but instead got %d`, responseRecorder.Code)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrorRateLimited      = errors.New("too many requests")
+	ErrorInvalidRateLimit = errors.New("invalid rate limit")
+)
+
+// RateLimit allows Requests every Period, in bursts of up to Requests
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// Lookups cost a couple of S3 calls each, and uploads a lot more than that
+var DefaultRateLimits = map[string]RateLimit{
+	"lookup": {Requests: 120, Period: time.Minute},
+	"upload": {Requests: 30, Period: time.Minute},
+}
+
+// ParseRateLimits overrides the defaults with a list like
+// "lookup=60/m,upload=10/h". A limit of 0 turns that one off.
+func ParseRateLimits(raw string) (map[string]RateLimit, error) {
+	limits := map[string]RateLimit{}
+	for route, limit := range DefaultRateLimits {
+		limits[route] = limit
+	}
+
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		route, rawLimit, found := strings.Cut(pair, "=")
+		route = strings.ToLower(strings.TrimSpace(route))
+		if !found {
+			return nil, fmt.Errorf("%w: expected route=requests/period, got %q", ErrorInvalidRateLimit, pair)
+		}
+		if _, known := DefaultRateLimits[route]; !known {
+			return nil, fmt.Errorf("%w: unknown route %q", ErrorInvalidRateLimit, route)
+		}
+
+		limit, err := parseRateLimit(strings.TrimSpace(rawLimit))
+		if err != nil {
+			return nil, err
+		}
+		limits[route] = limit
+	}
+
+	return limits, nil
+}
+
+func parseRateLimit(raw string) (RateLimit, error) {
+	if raw == "0" {
+		return RateLimit{}, nil
+	}
+
+	rawRequests, unit, found := strings.Cut(raw, "/")
+	requests, err := strconv.Atoi(rawRequests)
+	if !found || err != nil || requests < 0 {
+		return RateLimit{}, fmt.Errorf("%w: expected requests/period like 60/m, got %q", ErrorInvalidRateLimit, raw)
+	}
+
+	periods := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+	period, ok := periods[unit]
+	if !ok {
+		return RateLimit{}, fmt.Errorf("%w: period must be s, m or h, got %q", ErrorInvalidRateLimit, unit)
+	}
+
+	return RateLimit{Requests: requests, Period: period}, nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter hands out tokens from a bucket per key, refilling at a steady
+// rate. A key that's run dry has to wait for the next token.
+type RateLimiter struct {
+	limit RateLimit
+	now   func() time.Time
+
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{
+		limit:   limit,
+		now:     time.Now,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// Allow takes a token for key if there is one. If not, it says how long
+// until there will be.
+func (limiter *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if limiter.limit.Requests <= 0 {
+		return true, 0
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := limiter.now()
+	limiter.sweep(now)
+
+	capacity := float64(limiter.limit.Requests)
+	perToken := limiter.limit.Period / time.Duration(limiter.limit.Requests)
+
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, last: now}
+		limiter.buckets[key] = bucket
+	}
+
+	bucket.tokens = min(capacity, bucket.tokens+float64(now.Sub(bucket.last))/float64(perToken))
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) * float64(perToken))
+	}
+
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep drops buckets that would have refilled by now, since they're no
+// different to a fresh one. It only runs once a period so it's cheap.
+// Callers must hold the mutex.
+func (limiter *RateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < limiter.limit.Period {
+		return
+	}
+	limiter.lastSweep = now
+
+	for key, bucket := range limiter.buckets {
+		if now.Sub(bucket.last) >= limiter.limit.Period {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// TrustedProxies are the addresses allowed to tell us who the client is
+// with X-Forwarded-For or X-Real-IP. Anyone else could just make it up.
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies reads a list of addresses or CIDR ranges like
+// "10.0.0.0/8,::1"
+func ParseTrustedProxies(raw string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			address, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad trusted proxy %q", ErrorInvalidRateLimit, entry)
+			}
+			proxies = append(proxies, netip.PrefixFrom(address, address.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad trusted proxy %q", ErrorInvalidRateLimit, entry)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+
+	return proxies, nil
+}
+
+func (proxies TrustedProxies) trusts(address netip.Addr) bool {
+	address = address.Unmap()
+	for _, prefix := range proxies {
+		if prefix.Contains(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP works out who sent a request. Headers are only believed when
+// they come from a trusted proxy, and X-Forwarded-For is read from the
+// right, skipping over our own proxies, as the left is whatever the client
+// sent.
+func (proxies TrustedProxies) ClientIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+
+	remote, err := netip.ParseAddr(host)
+	if err != nil || !proxies.trusts(remote) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(request.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			// Anything past junk could have been made up
+			break
+		}
+		if !proxies.trusts(address) || i == 0 {
+			return address.Unmap().String()
+		}
+	}
+
+	if address, err := netip.ParseAddr(strings.TrimSpace(request.Header.Get("X-Real-IP"))); err == nil {
+		return address.Unmap().String()
+	}
+
+	return host
+}
+
+// rateLimited limits how often a client can hit a route. Clients are who
+// they logged in as, or their IP without auth, so wrap this in
+// authenticated to limit by user.
+func (webServer *WebServer) rateLimited(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		limiter := webServer.rateLimiters[route]
+		if limiter == nil {
+			next(writer, request)
+			return
+		}
+
+		key := "ip:" + webServer.trustedProxies.ClientIP(request)
+		if user := AuthenticatedUser(request.Context()); user != "" {
+			key = "user:" + user
+		}
+
+		allowed, retryAfter := limiter.Allow(key)
+		if !allowed {
+			rateLimitedRequests.Inc(route)
+			writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			webServer.ServeError(writer, request, ErrorRateLimited)
+			return
+		}
+
+		next(writer, request)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits("lookup=60/s, upload=0")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if limits["lookup"] != (RateLimit{Requests: 60, Period: time.Second}) {
+		t.Errorf("Expected 60/s for lookups, got %+v", limits["lookup"])
+	}
+	if limits["upload"].Requests != 0 {
+		t.Errorf("Expected uploads to be unlimited, got %+v", limits["upload"])
+	}
+
+	limits, _ = ParseRateLimits("")
+	if limits["upload"] != DefaultRateLimits["upload"] {
+		t.Errorf("Expected default upload limit, got %+v", limits["upload"])
+	}
+}
+
+func TestParseRateLimitsInvalid(t *testing.T) {
+	for _, raw := range []string{"lookup", "search=10/m", "lookup=ten/m", "lookup=10/d", "lookup=-1/m"} {
+		if _, err := ParseRateLimits(raw); !errors.Is(err, ErrorInvalidRateLimit) {
+			t.Errorf("%q: expected ErrorInvalidRateLimit, got %v", raw, err)
+		}
+	}
+}
+
+// fakeClock lets tests move time along by hand
+type fakeClock struct{ now time.Time }
+
+func (clock *fakeClock) Now() time.Time { return clock.now }
+
+func (clock *fakeClock) Advance(d time.Duration) { clock.now = clock.now.Add(d) }
+
+func newTestLimiter(limit RateLimit) (*RateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	limiter := NewRateLimiter(limit)
+	limiter.now = clock.Now
+	return limiter, clock
+}
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	limiter, clock := newTestLimiter(RateLimit{Requests: 3, Period: 3 * time.Second})
+
+	for i := range 3 {
+		if allowed, _ := limiter.Allow("client"); !allowed {
+			t.Fatalf("Expected request %d of the burst to be allowed", i+1)
+		}
+	}
+
+	allowed, retryAfter := limiter.Allow("client")
+	if allowed {
+		t.Fatal("Expected request past the burst to be limited")
+	}
+	if retryAfter != time.Second {
+		t.Errorf("Expected to wait a second for the next token, got %v", retryAfter)
+	}
+
+	if allowed, _ := limiter.Allow("someone-else"); !allowed {
+		t.Error("Expected other clients to have their own bucket")
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if _, retryAfter := limiter.Allow("client"); retryAfter != 500*time.Millisecond {
+		t.Errorf("Expected to wait the rest of the second, got %v", retryAfter)
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if allowed, _ := limiter.Allow("client"); !allowed {
+		t.Error("Expected a token to have refilled")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	limiter, clock := newTestLimiter(RateLimit{Requests: 1, Period: time.Minute})
+
+	limiter.Allow("first")
+	limiter.Allow("second")
+
+	clock.Advance(2 * time.Minute)
+	limiter.Allow("third")
+
+	if len(limiter.buckets) != 1 {
+		t.Errorf("Expected refilled buckets to be dropped, got %d", len(limiter.buckets))
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{})
+	for range 1000 {
+		if allowed, _ := limiter.Allow("client"); !allowed {
+			t.Fatal("Expected no limit")
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 127.0.0.1")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		expected   string
+	}{
+		{"direct", "203.0.113.7:1234", "", "", "203.0.113.7"},
+		{"untrusted proxy", "203.0.113.7:1234", "198.51.100.1", "198.51.100.2", "203.0.113.7"},
+		{"trusted proxy", "10.0.0.5:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"spoofed", "10.0.0.5:1234", "1.2.3.4, 198.51.100.1", "", "198.51.100.1"},
+		{"proxy chain", "127.0.0.1:1234", "198.51.100.1, 10.0.0.9", "", "198.51.100.1"},
+		{"only proxies", "10.0.0.5:1234", "10.0.0.1, 10.0.0.2", "", "10.0.0.1"},
+		{"real IP", "10.0.0.5:1234", "", "198.51.100.3", "198.51.100.3"},
+		{"junk", "10.0.0.5:1234", "nonsense", "", "10.0.0.5"},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			request.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if test.realIP != "" {
+			request.Header.Set("X-Real-IP", test.realIP)
+		}
+
+		if ip := proxies.ClientIP(request); ip != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, ip)
+		}
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); !errors.Is(err, ErrorInvalidRateLimit) {
+		t.Errorf("Expected ErrorInvalidRateLimit, got %v", err)
+	}
+	if _, err := ParseTrustedProxies("proxy.internal"); !errors.Is(err, ErrorInvalidRateLimit) {
+		t.Errorf("Expected ErrorInvalidRateLimit, got %v", err)
+	}
+}
+
+func TestLookupRateLimited(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockStorage{})
+	server.SetRateLimits(map[string]RateLimit{"lookup": {Requests: 2, Period: time.Minute}}, nil)
+
+	lookup := func(forwardedFor string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/ABCDE", nil)
+		request.Header.Set("X-Forwarded-For", forwardedFor)
+		responseRecorder := httptest.NewRecorder()
+		server.Router.ServeHTTP(responseRecorder, request)
+		return responseRecorder
+	}
+
+	for range 2 {
+		if response := lookup("198.51.100.1"); response.Code != http.StatusOK {
+			t.Fatalf(`Expected 200 OK, but instead got %d`, response.Code)
+		}
+	}
+
+	// Without trusted proxies a made up header doesn't get a fresh bucket
+	response := lookup("198.51.100.2")
+	if response.Code != http.StatusTooManyRequests {
+		t.Fatalf(`Expected 429, but instead got %d`, response.Code)
+	}
+	if response.Header().Get("Retry-After") != "30" {
+		t.Errorf("Expected Retry-After of 30 seconds, got %q", response.Header().Get("Retry-After"))
+	}
+	if response.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected a JSON error, got %s", response.Header().Get("Content-Type"))
+	}
+}
+
+func TestUploadRateLimitedPerUser(t *testing.T) {
+	server := NewWebServer("skalnik", "hunter2", "", "", &mockStorage{})
+	server.SetRateLimits(map[string]RateLimit{"upload": {Requests: 1, Period: time.Minute}}, nil)
+
+	upload := func(remoteAddr string) int {
+		request := uploadRequest(t, 16)
+		request.RemoteAddr = remoteAddr
+		request.SetBasicAuth("skalnik", "hunter2")
+		responseRecorder := httptest.NewRecorder()
+		server.Router.ServeHTTP(responseRecorder, request)
+		return responseRecorder.Code
+	}
+
+	if status := upload("198.51.100.1:1234"); status != http.StatusOK {
+		t.Fatalf(`Expected 200 OK, but instead got %d`, status)
+	}
+
+	// Same user from somewhere else shares the limit
+	if status := upload("198.51.100.2:1234"); status != http.StatusTooManyRequests {
+		t.Errorf(`Expected 429, but instead got %d`, status)
+	}
+
+	// Failed logins aren't counted against the user
+	request := uploadRequest(t, 16)
+	request.SetBasicAuth("skalnik", "wrong")
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Code != http.StatusUnauthorized {
+		t.Errorf(`Expected 401, but instead got %d`, responseRecorder.Code)
+	}
+}
+
+func TestRateLimitedMetric(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockStorage{})
+	server.SetRateLimits(map[string]RateLimit{"lookup": {Requests: 1, Period: time.Minute}}, nil)
+	before := rateLimitedRequests.Value("lookup")
+
+	for range 3 {
+		request := httptest.NewRequest(http.MethodGet, "/ABCDE", nil)
+		server.Router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	if delta := rateLimitedRequests.Value("lookup") - before; delta != 2 {
+		t.Errorf("Expected 2 rate limited requests counted, got %v", delta)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"log/slog"
+)
+
+const (
+	requestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 128
+)
+
+type requestIDKey struct{}
+
+// RequestID returns the ID of the request a context belongs to, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func newRequestID() string {
+	return rand.Text()
+}
+
+// validRequestID checks an ID passed in by a client or proxy is something we
+// can safely echo back and log: not too long, and nothing but letters,
+// numbers and a little punctuation
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// ContextHandler adds the request ID from the context to every record, so
+// anything logged with slog's ...Context functions can be tied back to the
+// request that caused it
+type ContextHandler struct {
+	slog.Handler
+}
+
+func (handler *ContextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("requestID", id))
+	}
+	return handler.Handler.Handle(ctx, record)
+}
+
+func (handler *ContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &ContextHandler{handler.Handler.WithAttrs(attrs)}
+}
+
+func (handler *ContextHandler) WithGroup(name string) slog.Handler {
+	return &ContextHandler{handler.Handler.WithGroup(name)}
+}
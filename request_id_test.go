@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type mockFailingStorage struct {
+	StorageClient
+	requestID string
+}
+
+func (c *mockFailingStorage) LookupFile(ctx context.Context, prefix string) (*StoredFile, error) {
+	c.requestID = RequestID(ctx)
+	return nil, errors.New("S3 is on fire")
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	request := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	requestID := responseRecorder.Header().Get("X-Request-ID")
+	if !validRequestID(requestID) {
+		t.Errorf("Expected a generated request ID, got %q", requestID)
+	}
+}
+
+func TestRequestIDAccepted(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	request := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	request.Header.Set("X-Request-ID", "from-the-proxy-123")
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	if responseRecorder.Header().Get("X-Request-ID") != "from-the-proxy-123" {
+		t.Errorf("Expected incoming request ID to be echoed, got %q", responseRecorder.Header().Get("X-Request-ID"))
+	}
+}
+
+func TestRequestIDInvalidReplaced(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	request := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	request.Header.Set("X-Request-ID", "<script>alert(1)</script>")
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	requestID := responseRecorder.Header().Get("X-Request-ID")
+	if requestID == "<script>alert(1)</script>" || !validRequestID(requestID) {
+		t.Errorf("Expected invalid request ID to be replaced, got %q", requestID)
+	}
+}
+
+func TestRequestIDOn404Page(t *testing.T) {
+	mockClient := &mockEmptyStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	request := httptest.NewRequest(http.MethodGet, "/ACAB1", nil)
+	request.Header.Set("X-Request-ID", "missing-1")
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	if !strings.Contains(responseRecorder.Body.String(), "<code>missing-1</code>") {
+		t.Errorf("Expected request ID on 404 page, got %s", responseRecorder.Body.String())
+	}
+}
+
+func TestRequestIDOn500Page(t *testing.T) {
+	mockClient := &mockFailingStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	request := httptest.NewRequest(http.MethodGet, "/ACAB1", nil)
+	request.Header.Set("X-Request-ID", "broken-1")
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	response := responseRecorder.Result()
+
+	if response.StatusCode != http.StatusInternalServerError {
+		t.Errorf(`Expected 500, but instead got %s`, response.Status)
+	}
+	if !strings.Contains(responseRecorder.Body.String(), "<code>broken-1</code>") {
+		t.Errorf("Expected request ID on 500 page, got %s", responseRecorder.Body.String())
+	}
+	if mockClient.requestID != "broken-1" {
+		t.Errorf("Expected request ID to reach storage, got %q", mockClient.requestID)
+	}
+}
+
+func TestContextHandler(t *testing.T) {
+	var output bytes.Buffer
+	logger := slog.New(&ContextHandler{slog.NewTextHandler(&output, nil)})
+
+	logger.InfoContext(withRequestID(context.Background(), "abc-123"), "Hello")
+	if !strings.Contains(output.String(), "requestID=abc-123") {
+		t.Errorf("Expected request ID in log line, got %s", output.String())
+	}
+
+	output.Reset()
+	logger.With("key", "value").Info("No request")
+	if strings.Contains(output.String(), "requestID") {
+		t.Errorf("Expected no request ID without one in the context, got %s", output.String())
+	}
+}
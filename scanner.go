@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	ErrorInfected     = errors.New("upload is infected")
+	ErrorScanFailed   = errors.New("couldn't scan upload")
+	ErrorInvalidClamd = errors.New("invalid clamd address")
+)
+
+// Infected uploads are kept under this prefix instead of being thrown away,
+// so they can be looked at later. Short keys are base64url, which has no dots,
+// so nothing here can be looked up or listed as a file.
+const quarantinePrefix = ".quarantine/"
+
+// Metadata key a quarantined file's scan result is stored under
+// (x-amz-meta-scan-result)
+const scanResultMetadataKey = "scan-result"
+
+// How much of a file is sent to clamd at once
+const clamdChunkSize = 64 * 1024
+
+// How long we'll wait to connect to clamd, on top of any deadline the upload
+// already has
+const clamdDialTimeout = 5 * time.Second
+
+// How long clamd has to answer a ping, all told
+const clamdPingTimeout = 5 * time.Second
+
+// Scanner checks uploads before they're stored. Scan returns nil for a clean
+// file, ErrorInfected for an infected one, and ErrorScanFailed if it couldn't
+// tell, in which case the upload is turned away rather than let through.
+type Scanner interface {
+	Scan(ctx context.Context, file io.Reader) error
+}
+
+// ClamdScanner streams files to a ClamAV daemon with INSTREAM. clamd turns
+// away streams over its StreamMaxLength, 25MB by default, so that should be
+// raised to at least MAX_UPLOAD_SIZE.
+type ClamdScanner struct {
+	Network string // tcp or unix
+	Address string // host:port or socket path
+}
+
+// ParseClamd reads where clamd is listening, as host:port, tcp:host:port or
+// unix:/path/to/clamd.sock. A blank address means no scanning.
+func ParseClamd(raw string) (*ClamdScanner, error) {
+	switch {
+	case raw == "":
+		return nil, nil
+	case strings.HasPrefix(raw, "unix:"):
+		path := strings.TrimPrefix(raw, "unix:")
+		if path == "" {
+			return nil, fmt.Errorf("%w: unix socket needs a path", ErrorInvalidClamd)
+		}
+		return &ClamdScanner{Network: "unix", Address: path}, nil
+	default:
+		address := strings.TrimPrefix(raw, "tcp:")
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrorInvalidClamd, err)
+		}
+		return &ClamdScanner{Network: "tcp", Address: address}, nil
+	}
+}
+
+func (scanner *ClamdScanner) Scan(ctx context.Context, file io.Reader) (err error) {
+	ctx, span := tracer().Start(ctx, "clamd.INSTREAM",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("server.address", scanner.Address)))
+	defer func() {
+		switch {
+		case err == nil:
+			scanResults.Inc("clean")
+		case errors.Is(err, ErrorInfected):
+			scanResults.Inc("infected")
+		default:
+			scanResults.Inc("error")
+		}
+		endSpan(span, err)
+	}()
+
+	reply, err := scanner.command(ctx, "INSTREAM", func(conn net.Conn) error {
+		chunk := make([]byte, clamdChunkSize)
+		for {
+			n, err := io.ReadFull(file, chunk)
+			if n > 0 {
+				if err := writeClamdChunk(conn, chunk[:n]); err != nil {
+					return err
+				}
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				// A zero length chunk ends the stream
+				return writeClamdChunk(conn, nil)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Replies look like "stream: OK", "stream: Eicar-Signature FOUND" or
+	// "INSTREAM size limit exceeded. ERROR"
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return nil
+	case strings.HasSuffix(result, " FOUND"):
+		return fmt.Errorf("%w with %s", ErrorInfected, strings.TrimSuffix(result, " FOUND"))
+	default:
+		return fmt.Errorf("%w: clamd said %q", ErrorScanFailed, reply)
+	}
+}
+
+// Ping checks clamd is up
+func (scanner *ClamdScanner) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, clamdPingTimeout)
+	defer cancel()
+
+	reply, err := scanner.command(ctx, "PING", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("%w: clamd said %q to a ping", ErrorScanFailed, reply)
+	}
+	return nil
+}
+
+// command sends a null terminated command, anything else it needs with send,
+// and returns the null terminated reply
+func (scanner *ClamdScanner) command(ctx context.Context, name string, send func(net.Conn) error) (string, error) {
+	dialer := net.Dialer{Timeout: clamdDialTimeout}
+	conn, err := dialer.DialContext(ctx, scanner.Network, scanner.Address)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrorScanFailed, err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	// Unblock reads and writes if the upload is cancelled
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if _, err := conn.Write([]byte("z" + name + "\x00")); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrorScanFailed, err)
+	}
+	var sendErr error
+	if send != nil {
+		sendErr = send(conn)
+	}
+	if sendErr != nil {
+		// Tell clamd we're done so it replies rather than waiting for more
+		if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+			_ = closer.CloseWrite()
+		}
+	}
+
+	// clamd replies and hangs up part way through a stream that's too big,
+	// so its reply says more than a failed write does
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrorScanFailed, cmp.Or(sendErr, err))
+	}
+
+	return string(bytes.TrimSuffix(reply, []byte{0})), nil
+}
+
+func writeClamdChunk(writer io.Writer, chunk []byte) error {
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(chunk)))
+	if _, err := writer.Write(size); err != nil {
+		return err
+	}
+
+	_, err := writer.Write(chunk)
+	return err
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// A harmless string that's flagged by the fake clamd, like the EICAR test
+// file is by the real one
+const fakeVirus = "X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*"
+
+// fakeClamd answers PING and INSTREAM like clamd does, flagging anything
+// containing fakeVirus and refusing streams over maxStream bytes
+func fakeClamd(t *testing.T, network string, address string, maxStream int) *ClamdScanner {
+	t.Helper()
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeClamd(conn, maxStream)
+		}
+	}()
+
+	return &ClamdScanner{Network: network, Address: listener.Addr().String()}
+}
+
+func serveFakeClamd(conn net.Conn, maxStream int) {
+	defer func() { _ = conn.Close() }()
+	reader := bufio.NewReader(conn)
+
+	command, err := reader.ReadString(0)
+	if err != nil {
+		return
+	}
+
+	switch command {
+	case "zPING\x00":
+		_, _ = conn.Write([]byte("PONG\x00"))
+	case "zINSTREAM\x00":
+		var stream []byte
+		for {
+			size := make([]byte, 4)
+			if _, err := io.ReadFull(reader, size); err != nil {
+				return
+			}
+			length := binary.BigEndian.Uint32(size)
+			if length == 0 {
+				break
+			}
+			if len(stream)+int(length) > maxStream {
+				_, _ = conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+				return
+			}
+
+			chunk := make([]byte, length)
+			if _, err := io.ReadFull(reader, chunk); err != nil {
+				return
+			}
+			stream = append(stream, chunk...)
+		}
+
+		if bytes.Contains(stream, []byte(fakeVirus)) {
+			_, _ = conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		} else {
+			_, _ = conn.Write([]byte("stream: OK\x00"))
+		}
+	default:
+		_, _ = conn.Write([]byte("UNKNOWN COMMAND\x00"))
+	}
+}
+
+func TestParseClamd(t *testing.T) {
+	tests := []struct {
+		raw     string
+		network string
+		address string
+	}{
+		{"localhost:3310", "tcp", "localhost:3310"},
+		{"tcp:10.0.0.1:3310", "tcp", "10.0.0.1:3310"},
+		{"unix:/run/clamav/clamd.ctl", "unix", "/run/clamav/clamd.ctl"},
+	}
+
+	for _, test := range tests {
+		scanner, err := ParseClamd(test.raw)
+		if err != nil {
+			t.Errorf("Expected no error for %q, got %v", test.raw, err)
+			continue
+		}
+		if scanner.Network != test.network || scanner.Address != test.address {
+			t.Errorf("Expected %s %s for %q, got %+v", test.network, test.address, test.raw, scanner)
+		}
+	}
+
+	if scanner, err := ParseClamd(""); scanner != nil || err != nil {
+		t.Errorf("Expected no scanner without an address, got %+v, %v", scanner, err)
+	}
+	for _, raw := range []string{"unix:", "localhost"} {
+		if _, err := ParseClamd(raw); !errors.Is(err, ErrorInvalidClamd) {
+			t.Errorf("Expected ErrorInvalidClamd for %q, got %v", raw, err)
+		}
+	}
+}
+
+func TestClamdScan(t *testing.T) {
+	scanner := fakeClamd(t, "tcp", "127.0.0.1:0", 1<<20)
+
+	if err := scanner.Ping(context.Background()); err != nil {
+		t.Errorf("Expected clamd to answer a ping, got %v", err)
+	}
+
+	// Bigger than a chunk, with the virus straddling two of them
+	infected := strings.Repeat("a", clamdChunkSize-10) + fakeVirus
+	if err := scanner.Scan(context.Background(), strings.NewReader(infected)); !errors.Is(err, ErrorInfected) {
+		t.Errorf("Expected ErrorInfected, got %v", err)
+	} else if !strings.Contains(err.Error(), "Eicar-Test-Signature") {
+		t.Errorf("Expected the signature in the error, got %v", err)
+	}
+
+	if err := scanner.Scan(context.Background(), strings.NewReader("all good")); err != nil {
+		t.Errorf("Expected a clean file to pass, got %v", err)
+	}
+	if err := scanner.Scan(context.Background(), strings.NewReader("")); err != nil {
+		t.Errorf("Expected an empty file to pass, got %v", err)
+	}
+}
+
+func TestClamdScanUnixSocket(t *testing.T) {
+	scanner := fakeClamd(t, "unix", filepath.Join(t.TempDir(), "clamd.sock"), 1<<20)
+
+	if err := scanner.Scan(context.Background(), strings.NewReader(fakeVirus)); !errors.Is(err, ErrorInfected) {
+		t.Errorf("Expected ErrorInfected, got %v", err)
+	}
+}
+
+func TestClamdScanFailed(t *testing.T) {
+	scanner := fakeClamd(t, "tcp", "127.0.0.1:0", 10)
+
+	err := scanner.Scan(context.Background(), strings.NewReader(strings.Repeat("a", clamdChunkSize*4)))
+	if !errors.Is(err, ErrorScanFailed) || !strings.Contains(err.Error(), "size limit exceeded") {
+		t.Errorf("Expected clamd's size limit error, got %v", err)
+	}
+
+	// Nothing listening
+	down := &ClamdScanner{Network: "unix", Address: filepath.Join(t.TempDir(), "missing.sock")}
+	if err := down.Scan(context.Background(), strings.NewReader("all good")); !errors.Is(err, ErrorScanFailed) {
+		t.Errorf("Expected ErrorScanFailed without clamd, got %v", err)
+	}
+}
+
+func TestUploadFileQuarantinesInfected(t *testing.T) {
+	var putKeys []string
+	var putMetadata map[string]string
+
+	mockS3 := &mockS3Client{
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			body, _ := io.ReadAll(params.Body)
+			if !bytes.Contains(body, []byte(fakeVirus)) {
+				t.Error("Expected the whole file to be quarantined")
+			}
+			putKeys = append(putKeys, aws.ToString(params.Key))
+			putMetadata = params.Metadata
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+		Scanner:  fakeClamd(t, "tcp", "127.0.0.1:0", 1<<20),
+	}
+
+	fileHeader, _ := createMockFileHeader("eicar.txt", []byte(fakeVirus), "text/plain")
+	file, _ := fileHeader.Open()
+	defer file.Close()
+
+	ctx := withUser(context.Background(), "skalnik")
+	_, _, err := client.UploadFile(ctx, file, *fileHeader, FileDetails{})
+	if !errors.Is(err, ErrorInfected) {
+		t.Fatalf("Expected ErrorInfected, got %v", err)
+	}
+
+	if len(putKeys) != 1 || !strings.HasPrefix(putKeys[0], quarantinePrefix) || !strings.HasSuffix(putKeys[0], "/eicar.txt") {
+		t.Errorf("Expected the upload to be quarantined, got %v", putKeys)
+	}
+	if putMetadata[uploaderMetadataKey] != "skalnik" || !strings.Contains(putMetadata[scanResultMetadataKey], "Eicar-Test-Signature") {
+		t.Errorf("Expected the uploader and scan result to be kept, got %v", putMetadata)
+	}
+}
+
+func TestUploadFileScannedClean(t *testing.T) {
+	var putKeys []string
+	mockS3 := &mockS3Client{
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			body, _ := io.ReadAll(params.Body)
+			if string(body) != "test content" {
+				t.Errorf("Expected the file to be stored from the start after scanning, got %q", body)
+			}
+			putKeys = append(putKeys, aws.ToString(params.Key))
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+
+	client := &AWSClient{
+		Bucket:   "test-bucket",
+		CDN:      "https://cdn.example.com",
+		s3Client: mockS3,
+		Scanner:  fakeClamd(t, "tcp", "127.0.0.1:0", 1<<20),
+	}
+
+	fileHeader, _ := createMockFileHeader("test.txt", []byte("test content"), "text/plain")
+	file, _ := fileHeader.Open()
+	defer file.Close()
+
+	if _, _, err := client.UploadFile(context.Background(), file, *fileHeader, FileDetails{}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(putKeys) != 1 || strings.HasPrefix(putKeys[0], quarantinePrefix) {
+		t.Errorf("Expected the file to be stored normally, got %v", putKeys)
+	}
+}
+
+func TestQuarantinedFilesHidden(t *testing.T) {
+	quarantined := quarantinePrefix + "ABCDEFG/eicar.txt"
+	mockS3 := &mockS3Client{
+		listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{
+				KeyCount: aws.Int32(2),
+				Contents: []types.Object{
+					{Key: aws.String(quarantined), Size: aws.Int64(68)},
+					{Key: aws.String("FGHIJKL/file.txt"), Size: aws.Int64(10)},
+				},
+			}, nil
+		},
+	}
+
+	client := &AWSClient{Bucket: "test-bucket", CDN: "https://cdn.example.com", s3Client: mockS3}
+
+	listing, err := client.ListFiles(context.Background(), "", 10)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(listing.Files) != 1 || listing.Files[0].Key != "FGHIJ" {
+		t.Errorf("Expected quarantined files not to be listed, got %+v", listing.Files)
+	}
+
+	if _, err := client.findObjectKey(context.Background(), ".quar"); !errors.Is(err, ErrorObjectMissing) {
+		t.Errorf("Expected quarantined files not to be found, got %v", err)
+	}
+}
+
+type mockInfectedStorage struct {
+	mockStorage
+}
+
+func (c *mockInfectedStorage) UploadFile(ctx context.Context, file multipart.File, fileHeader multipart.FileHeader, details FileDetails) (string, bool, error) {
+	return "", false, fmt.Errorf("%w with Eicar-Test-Signature", ErrorInfected)
+}
+
+func TestUploadHandlerInfected(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockInfectedStorage{})
+
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, uploadRequest(t, 10))
+
+	if responseRecorder.Code != http.StatusUnprocessableEntity {
+		t.Errorf(`Expected 422, but instead got %d`, responseRecorder.Code)
+	}
+
+	// The upload page shows whatever error it's sent
+	var response errorResponse
+	if err := json.Unmarshal(responseRecorder.Body.Bytes(), &response); err != nil || !strings.Contains(response.Error, "Eicar-Test-Signature") {
+		t.Errorf(`Expected a JSON error, but instead got %s`, responseRecorder.Body.String())
+	}
+}
+
+func TestReadyHandlerScanner(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockStorage{})
+	server.SetScanner(fakeClamd(t, "tcp", "127.0.0.1:0", 1<<20))
+
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, "/healthz/ready", nil))
+
+	var report readiness
+	_ = json.Unmarshal(responseRecorder.Body.Bytes(), &report)
+	if responseRecorder.Code != http.StatusOK || report.Components["scanner"].Status != "ok" {
+		t.Errorf(`Expected clamd to be ready, but instead got %d %s`, responseRecorder.Code, responseRecorder.Body.String())
+	}
+
+	// Nothing's listening once it's closed
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	_ = listener.Close()
+	server.SetScanner(&ClamdScanner{Network: "tcp", Address: listener.Addr().String()})
+
+	responseRecorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, "/healthz/ready", nil))
+
+	report = readiness{}
+	_ = json.Unmarshal(responseRecorder.Body.Bytes(), &report)
+	if responseRecorder.Code != http.StatusServiceUnavailable || report.Components["scanner"] != (componentStatus{Status: "unavailable"}) {
+		t.Errorf(`Expected clamd to be unavailable, but instead got %d %s`, responseRecorder.Code, responseRecorder.Body.String())
+	}
+}
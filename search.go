@@ -0,0 +1,375 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// How much a query term matching a token is worth, best first
+const (
+	scoreExact  = 3
+	scorePrefix = 2
+	scoreFuzzy  = 1
+)
+
+// SearchIndex is an in-memory inverted index over stored file metadata. It
+// can optionally be persisted to a JSON file, but the bucket is always the
+// source of truth and the index can be rebuilt from it at any time.
+type SearchIndex struct {
+	persisted jsonFile
+
+	mutex  sync.RWMutex
+	files  map[string]StoredFile      // keyed by short key
+	tokens map[string]map[string]bool // token -> short keys
+}
+
+func NewSearchIndex(path string) (*SearchIndex, error) {
+	index := emptySearchIndex(path)
+
+	if path == "" {
+		return index, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read search index: %w", err)
+	}
+
+	var files []StoredFile
+	if err := json.Unmarshal(content, &files); err != nil {
+		return nil, fmt.Errorf("couldn't parse search index: %w", err)
+	}
+
+	for _, file := range files {
+		index.add(file)
+	}
+
+	return index, nil
+}
+
+// emptySearchIndex is an index that will be persisted to path, without
+// loading what's already there
+func emptySearchIndex(path string) *SearchIndex {
+	return &SearchIndex{
+		persisted: jsonFile{path: path},
+		files:     map[string]StoredFile{},
+		tokens:    map[string]map[string]bool{},
+	}
+}
+
+// Len is the number of files in the index
+func (index *SearchIndex) Len() int {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	return len(index.files)
+}
+
+// Get returns the indexed copy of a file, which carries details that S3
+// listings don't include, like tags
+func (index *SearchIndex) Get(key string) (StoredFile, bool) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	file, found := index.files[key]
+	return file, found
+}
+
+// Recent returns up to limit of the most recently uploaded files
+func (index *SearchIndex) Recent(limit int) []StoredFile {
+	index.mutex.RLock()
+	files := make([]StoredFile, 0, len(index.files))
+	for _, file := range index.files {
+		files = append(files, file)
+	}
+	index.mutex.RUnlock()
+
+	slices.SortFunc(files, func(a, b StoredFile) int {
+		return cmp.Or(b.UploadedAt.Compare(a.UploadedAt), cmp.Compare(a.Key, b.Key))
+	})
+
+	return files[:min(limit, len(files))]
+}
+
+// Totals is how many files are indexed and how big they are altogether
+func (index *SearchIndex) Totals() (files int, bytes int64) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	for _, file := range index.files {
+		bytes += file.Size
+	}
+
+	return len(index.files), bytes
+}
+
+// Add indexes a file, replacing anything already indexed under its key, and
+// persists the index if it has a path
+func (index *SearchIndex) Add(file StoredFile) {
+	index.mutex.Lock()
+	index.add(file)
+	index.mutex.Unlock()
+
+	index.persist()
+}
+
+// Remove drops a file from the index
+func (index *SearchIndex) Remove(key string) {
+	index.mutex.Lock()
+	index.remove(key)
+	index.mutex.Unlock()
+
+	index.persist()
+}
+
+func (index *SearchIndex) add(file StoredFile) {
+	index.remove(file.Key)
+
+	// URLs may be presigned and expire, and previews are too big to keep around
+	file.Url = ""
+	file.Preview = ""
+	file.PreviewTruncated = false
+
+	index.files[file.Key] = file
+	for _, token := range documentTokens(file) {
+		if index.tokens[token] == nil {
+			index.tokens[token] = map[string]bool{}
+		}
+		index.tokens[token][file.Key] = true
+	}
+}
+
+func (index *SearchIndex) remove(key string) {
+	file, found := index.files[key]
+	if !found {
+		return
+	}
+
+	delete(index.files, key)
+	for _, token := range documentTokens(file) {
+		delete(index.tokens[token], key)
+		if len(index.tokens[token]) == 0 {
+			delete(index.tokens, token)
+		}
+	}
+}
+
+// Search finds files where every term in the query exactly, prefix or
+// fuzzily matches a token from the file's metadata. Results are ordered by
+// how well they match, then by upload date.
+func (index *SearchIndex) Search(query string, limit int) []StoredFile {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return []StoredFile{}
+	}
+
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	var scores map[string]int
+	for _, term := range terms {
+		termScores := index.scoreTerm(term)
+
+		// Every term has to match something
+		if scores == nil {
+			scores = termScores
+			continue
+		}
+		for key, score := range scores {
+			if termScore, matched := termScores[key]; matched {
+				scores[key] = score + termScore
+			} else {
+				delete(scores, key)
+			}
+		}
+	}
+
+	results := make([]StoredFile, 0, len(scores))
+	for key := range scores {
+		results = append(results, index.files[key])
+	}
+
+	slices.SortFunc(results, func(a, b StoredFile) int {
+		if byScore := cmp.Compare(scores[b.Key], scores[a.Key]); byScore != 0 {
+			return byScore
+		}
+		return b.UploadedAt.Compare(a.UploadedAt)
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results
+}
+
+// scoreTerm returns the best score for a single query term for each file
+func (index *SearchIndex) scoreTerm(term string) map[string]int {
+	scores := map[string]int{}
+	maxDistance := fuzzyDistance(term)
+
+	for token, keys := range index.tokens {
+		var score int
+		switch {
+		case token == term:
+			score = scoreExact
+		case strings.HasPrefix(token, term):
+			score = scorePrefix
+		case maxDistance > 0 && editDistance(term, token) <= maxDistance:
+			score = scoreFuzzy
+		default:
+			continue
+		}
+
+		for key := range keys {
+			scores[key] = max(scores[key], score)
+		}
+	}
+
+	return scores
+}
+
+// Rebuild pages through everything in storage and indexes it. Listings don't
+// include tags or descriptions, so each file is looked up individually. Files
+// are added as they're found so uploads during a rebuild aren't lost.
+func (index *SearchIndex) Rebuild(ctx context.Context, storage StorageClient) error {
+	token := ""
+	count := 0
+
+	for {
+		listing, err := storage.ListFiles(ctx, token, maxPageSize)
+		if err != nil {
+			return fmt.Errorf("couldn't list files for search index: %w", err)
+		}
+
+		for _, file := range listing.Files {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			details, err := storage.LookupFile(ctx, file.Key)
+			if err != nil {
+				slog.WarnContext(ctx, "Error looking up file for search index", "key", file.Key, "error", err)
+			} else {
+				file = *details
+			}
+
+			index.mutex.Lock()
+			index.add(file)
+			index.mutex.Unlock()
+		}
+		count += len(listing.Files)
+
+		if listing.NextToken == "" {
+			break
+		}
+		token = listing.NextToken
+	}
+
+	index.persist()
+	slog.InfoContext(ctx, "Rebuilt search index", "files", count)
+
+	return nil
+}
+
+func (index *SearchIndex) persist() {
+	err := index.persisted.save(func() any {
+		index.mutex.RLock()
+		defer index.mutex.RUnlock()
+
+		files := make([]StoredFile, 0, len(index.files))
+		for _, file := range index.files {
+			files = append(files, file)
+		}
+		return files
+	})
+	if err != nil {
+		slog.Error("Error saving search index", "path", index.persisted.path, "error", err)
+	}
+}
+
+func documentTokens(file StoredFile) []string {
+	fields := []string{file.OriginalName, file.ContentType, kindName(file.Kind), file.Description, file.Uploader}
+	fields = append(fields, file.Tags...)
+
+	var tokens []string
+	for _, field := range fields {
+		tokens = append(tokens, tokenize(field)...)
+	}
+
+	slices.Sort(tokens)
+	return slices.Compact(tokens)
+}
+
+// tokenize lower cases text and splits it on anything that isn't a letter or
+// a number, so "Big Diagram-v2.png" becomes big, diagram, v2 and png
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// fuzzyDistance is how many typos we'll tolerate for a term. Short terms get
+// none, otherwise everything matches everything.
+func fuzzyDistance(term string) int {
+	length := len([]rune(term))
+	switch {
+	case length < 4:
+		return 0
+	case length < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance is the optimal string alignment distance between two strings:
+// the number of insertions, deletions, substitutions and transpositions of
+// adjacent characters needed to turn one into the other. Swapped letters are
+// the most common typo, so they only count once.
+func editDistance(a, b string) int {
+	source := []rune(a)
+	target := []rune(b)
+
+	distances := make([][]int, len(source)+1)
+	for i := range distances {
+		distances[i] = make([]int, len(target)+1)
+		distances[i][0] = i
+	}
+	for j := range distances[0] {
+		distances[0][j] = j
+	}
+
+	for i := 1; i <= len(source); i++ {
+		for j := 1; j <= len(target); j++ {
+			cost := 1
+			if source[i-1] == target[j-1] {
+				cost = 0
+			}
+
+			distances[i][j] = min(
+				distances[i-1][j]+1,
+				distances[i][j-1]+1,
+				distances[i-1][j-1]+cost,
+			)
+
+			if i > 1 && j > 1 && source[i-1] == target[j-2] && source[i-2] == target[j-1] {
+				distances[i][j] = min(distances[i][j], distances[i-2][j-2]+1)
+			}
+		}
+	}
+
+	return distances[len(source)][len(target)]
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestIndex(t *testing.T) *SearchIndex {
+	index, _ := NewSearchIndex("")
+
+	index.Add(StoredFile{Key: "AAAAA", OriginalName: "network diagram.png", ContentType: "image/png", Kind: KindImage, UploadedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)})
+	index.Add(StoredFile{Key: "BBBBB", OriginalName: "diagram-v2.svg", ContentType: "image/svg+xml", Kind: KindImage, UploadedAt: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)})
+	index.Add(StoredFile{Key: "CCCCC", OriginalName: "meeting notes.txt", ContentType: "text/plain; charset=utf-8", Kind: KindText, UploadedAt: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)})
+
+	return index
+}
+
+func resultKeys(files []StoredFile) []string {
+	keys := make([]string, len(files))
+	for i, file := range files {
+		keys[i] = file.Key
+	}
+	return keys
+}
+
+func TestSearchExactAndPrefix(t *testing.T) {
+	index := newTestIndex(t)
+
+	results := resultKeys(index.Search("diagram", 0))
+	if len(results) != 2 || results[0] != "BBBBB" || results[1] != "AAAAA" {
+		t.Errorf("Expected both diagrams, newest first, got %v", results)
+	}
+
+	results = resultKeys(index.Search("meet", 0))
+	if len(results) != 1 || results[0] != "CCCCC" {
+		t.Errorf("Expected prefix to match meeting notes, got %v", results)
+	}
+}
+
+func TestSearchFuzzy(t *testing.T) {
+	index := newTestIndex(t)
+
+	results := resultKeys(index.Search("diagarm", 0))
+	if len(results) != 2 {
+		t.Errorf("Expected a typo to still match both diagrams, got %v", results)
+	}
+
+	// Short terms don't get any typo tolerance
+	results = resultKeys(index.Search("pnf", 0))
+	if len(results) != 0 {
+		t.Errorf("Expected no fuzzy matches for short terms, got %v", results)
+	}
+}
+
+func TestSearchRequiresEveryTerm(t *testing.T) {
+	index := newTestIndex(t)
+
+	results := resultKeys(index.Search("network diagram", 0))
+	if len(results) != 1 || results[0] != "AAAAA" {
+		t.Errorf("Expected only the network diagram, got %v", results)
+	}
+}
+
+func TestSearchRanksExactMatchesFirst(t *testing.T) {
+	index := newTestIndex(t)
+
+	// "png" matches the first file's extension exactly, but is only a prefix
+	// of the newer file's name
+	index.Add(StoredFile{Key: "DDDDD", OriginalName: "pngcrush.log", UploadedAt: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)})
+
+	results := resultKeys(index.Search("png", 0))
+	if len(results) != 2 || results[0] != "AAAAA" {
+		t.Errorf("Expected the exact match to outrank the newer prefix match, got %v", results)
+	}
+}
+
+func TestSearchByContentTypeAndKind(t *testing.T) {
+	index := newTestIndex(t)
+
+	results := resultKeys(index.Search("text", 0))
+	if len(results) != 1 || results[0] != "CCCCC" {
+		t.Errorf("Expected content type to be searchable, got %v", results)
+	}
+}
+
+func TestSearchByUploader(t *testing.T) {
+	index := newTestIndex(t)
+	index.Add(StoredFile{Key: "DDDDD", OriginalName: "holiday.jpg", Kind: KindImage, Uploader: "skalnik"})
+
+	results := resultKeys(index.Search("skalnik", 0))
+	if len(results) != 1 || results[0] != "DDDDD" {
+		t.Errorf("Expected uploads to be searchable by uploader, got %v", results)
+	}
+}
+
+func TestSearchLimitAndEmptyQuery(t *testing.T) {
+	index := newTestIndex(t)
+
+	if results := index.Search("image", 1); len(results) != 1 {
+		t.Errorf("Expected limit to be applied, got %d results", len(results))
+	}
+
+	if results := index.Search("  ", 0); len(results) != 0 {
+		t.Errorf("Expected no results for an empty query, got %d", len(results))
+	}
+}
+
+func TestSearchRemoveAndReplace(t *testing.T) {
+	index := newTestIndex(t)
+
+	index.Remove("AAAAA")
+	if results := resultKeys(index.Search("network", 0)); len(results) != 0 {
+		t.Errorf("Expected removed file to be gone, got %v", results)
+	}
+
+	index.Add(StoredFile{Key: "BBBBB", OriginalName: "flowchart.svg"})
+	if results := resultKeys(index.Search("diagram", 0)); len(results) != 0 {
+		t.Errorf("Expected re-added file to lose its old tokens, got %v", results)
+	}
+	if index.Len() != 2 {
+		t.Errorf("Expected 2 files in the index, got %d", index.Len())
+	}
+}
+
+func TestSearchIndexPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+
+	index, err := NewSearchIndex(path)
+	if err != nil {
+		t.Fatalf("Expected no error for a missing index file, got %v", err)
+	}
+	index.Add(StoredFile{Key: "AAAAA", OriginalName: "holiday.jpg", Url: "https://presigned.example.com/holiday.jpg"})
+
+	reloaded, err := NewSearchIndex(path)
+	if err != nil {
+		t.Fatalf("Expected no error loading index, got %v", err)
+	}
+
+	results := reloaded.Search("holiday", 0)
+	if len(results) != 1 {
+		t.Fatalf("Expected persisted file to be searchable, got %v", results)
+	}
+	if results[0].Url != "" {
+		t.Errorf("Expected URLs not to be persisted, got %s", results[0].Url)
+	}
+}
+
+type mockPagedStorage struct {
+	StorageClient
+	pages map[string]*FileListing
+}
+
+func (c *mockPagedStorage) ListFiles(ctx context.Context, continuationToken string, limit int32) (*FileListing, error) {
+	return c.pages[continuationToken], nil
+}
+
+func (c *mockPagedStorage) LookupFile(ctx context.Context, prefix string) (*StoredFile, error) {
+	if prefix == "BBBBB" {
+		return nil, ErrorObjectMissing
+	}
+	return &StoredFile{Key: prefix, OriginalName: "first.txt", Tags: []string{"important"}}, nil
+}
+
+func TestSearchIndexRebuildCancelled(t *testing.T) {
+	storage := &mockPagedStorage{
+		pages: map[string]*FileListing{
+			"": {Files: []StoredFile{{Key: "AAAAA", OriginalName: "first.txt"}}},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	index, _ := NewSearchIndex("")
+	err := index.Rebuild(ctx, storage)
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if index.Len() != 0 {
+		t.Errorf("Expected nothing to be indexed, got %d files", index.Len())
+	}
+}
+
+func TestSearchIndexRebuild(t *testing.T) {
+	storage := &mockPagedStorage{
+		pages: map[string]*FileListing{
+			"": {
+				Files:     []StoredFile{{Key: "AAAAA", OriginalName: "first.txt"}},
+				NextToken: "page-2",
+			},
+			"page-2": {
+				Files: []StoredFile{{Key: "BBBBB", OriginalName: "second.txt"}},
+			},
+		},
+	}
+
+	index, _ := NewSearchIndex("")
+	err := index.Rebuild(context.Background(), storage)
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if index.Len() != 2 {
+		t.Errorf("Expected every page to be indexed, got %d files", index.Len())
+	}
+
+	if results := index.Search("important", 0); len(results) != 1 {
+		t.Errorf("Expected details from lookups to be indexed, got %v", results)
+	}
+
+	if results := index.Search("second", 0); len(results) != 1 {
+		t.Errorf("Expected failed lookups to fall back to the listing, got %v", results)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		distance int
+	}{
+		{"", "", 0},
+		{"diagram", "diagram", 0},
+		{"diagram", "diagarm", 1},
+		{"kitten", "sitting", 3},
+		{"café", "cafe", 1},
+	}
+
+	for _, c := range cases {
+		if distance := editDistance(c.a, c.b); distance != c.distance {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", c.a, c.b, distance, c.distance)
+		}
+	}
+}
+
+func TestSearchIndexRecentAndTotals(t *testing.T) {
+	index, _ := NewSearchIndex("")
+	index.Add(StoredFile{Key: "AAAAA", Size: 100, UploadedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)})
+	index.Add(StoredFile{Key: "BBBBB", Size: 200, UploadedAt: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)})
+	index.Add(StoredFile{Key: "CCCCC", Size: 300, UploadedAt: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)})
+
+	recent := index.Recent(2)
+	if len(recent) != 2 || recent[0].Key != "BBBBB" || recent[1].Key != "CCCCC" {
+		t.Errorf("Expected the two newest files, got %+v", recent)
+	}
+
+	if files, bytes := index.Totals(); files != 3 || bytes != 600 {
+		t.Errorf("Expected 3 files and 600 bytes, got %d and %d", files, bytes)
+	}
+}
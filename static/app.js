@@ -28,17 +28,61 @@ function dropHandler(event) {
 }
 
 function uploadFile(file, busyElement) {
+  const maxSize = Number(document.getElementById(id).dataset.maxSize || 0);
+  if (maxSize > 0 && file.size > maxSize) {
+    showError(`${file.name} is too big, files can be up to ${humanSize(maxSize)}`);
+    return;
+  }
+  showError("");
+
   const formData = new FormData();
   formData.append("file", file);
+  formData.append("tags", document.getElementById("upload-tags").value);
+  formData.append("description", document.getElementById("upload-description").value);
   document.getElementById(id).setAttribute('aria-busy', true);
   fetch("/", {
     method: "POST",
     body: formData,
   }).then(r => r.json())
     .then(data => {
+      if (data.error) {
+        document.getElementById(id).removeAttribute('aria-busy');
+        if (data.maxSize) {
+          showError(`${file.name} is too big, files can be up to ${humanSize(data.maxSize)}`);
+        } else {
+          showError(data.error);
+        }
+        return;
+      }
+
       const url = data.url;
       window.location.href = url;
-  });
+    })
+    .catch(() => {
+      document.getElementById(id).removeAttribute('aria-busy');
+      showError(`Couldn't upload ${file.name}, try again later`);
+    });
+}
+
+function showError(message) {
+  const error = document.getElementById("upload-error");
+  error.textContent = message;
+  error.hidden = message == "";
+}
+
+// Matches humanSize on the server
+function humanSize(size) {
+  const units = "KMGTPE";
+  if (size < 1024) {
+    return `${size} B`;
+  }
+
+  let exp = -1;
+  while (size >= 1024 && exp < units.length - 1) {
+    size /= 1024;
+    exp++;
+  }
+  return `${size.toFixed(1)} ${units[exp]}B`;
 }
 
 function dragoverHandler(event) {
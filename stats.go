@@ -0,0 +1,448 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	// How long daily stats are kept before they're dropped
+	statsRetentionDays = 90
+
+	// How many days the stats page charts
+	statsPageDays = 30
+
+	// How many referrers, countries and browsers the stats page lists
+	statsTopSize = 10
+
+	// How often stats are saved, if they've changed
+	statsSaveInterval = time.Minute
+)
+
+// Buckets for views we can't say more about
+const (
+	statsDirect  = "direct"
+	statsUnknown = "unknown"
+)
+
+const statsDayFormat = "2006-01-02"
+
+// DailyStats is what happened to a file on one day. Where views came from is
+// broken down by referrer host, country and browser, rather than keeping
+// every event, so the stats file stays small and doesn't hold onto anyone's
+// IP or user agent.
+type DailyStats struct {
+	Views     int64            `json:"views,omitempty"`
+	Downloads int64            `json:"downloads,omitempty"`
+	Referrers map[string]int64 `json:"referrers,omitempty"`
+	Countries map[string]int64 `json:"countries,omitempty"`
+	Browsers  map[string]int64 `json:"browsers,omitempty"`
+}
+
+// FileStats is first party download stats. Page views and downloads are
+// counted as they happen, from the same events as analytics but without
+// going through its queue, so a slow analytics service can't lose them.
+// Like file controls it can be persisted to a JSON file, keyed by short key
+// then day, which is saved in the background every statsSaveInterval.
+// Without one it's lost on restart.
+type FileStats struct {
+	persisted jsonFile
+	geoIP     *GeoIP
+	now       func() time.Time
+
+	mutex sync.Mutex
+	files map[string]map[string]*DailyStats
+	dirty bool // changed since it was last saved
+}
+
+// NewFileStats loads stats from path, looking up countries in geoIP if
+// there is one
+func NewFileStats(path string, geoIP *GeoIP) (*FileStats, error) {
+	stats := &FileStats{
+		persisted: jsonFile{path: path},
+		geoIP:     geoIP,
+		now:       time.Now,
+		files:     map[string]map[string]*DailyStats{},
+	}
+
+	if path == "" {
+		return stats, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return stats, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read file stats: %w", err)
+	}
+
+	if err := json.Unmarshal(content, &stats.files); err != nil {
+		return nil, fmt.Errorf("couldn't parse file stats: %w", err)
+	}
+
+	return stats, nil
+}
+
+// Record counts a page view or download. Anything else is ignored.
+func (stats *FileStats) Record(event AnalyticsEvent) {
+	if event.Key == "" || (event.Name != EventPageview && event.Name != EventDownload) {
+		return
+	}
+
+	// Work out where it came from before taking the lock, which requests
+	// wait on
+	referrer := cmp.Or(event.Props["referrer"], statsDirect)
+	browser := browserFamily(event.UserAgent)
+	country := ""
+	if stats.geoIP != nil {
+		country = cmp.Or(stats.geoIP.Country(event.ClientIP), statsUnknown)
+	}
+
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	stats.dirty = true
+
+	days, ok := stats.files[event.Key]
+	if !ok {
+		days = map[string]*DailyStats{}
+		stats.files[event.Key] = days
+	}
+	day := cmp.Or(event.Time, stats.now()).UTC().Format(statsDayFormat)
+	daily, ok := days[day]
+	if !ok {
+		daily = &DailyStats{}
+		days[day] = daily
+	}
+
+	if event.Name == EventDownload {
+		daily.Downloads++
+		return
+	}
+
+	// Direct links send a download along with their page view, so only
+	// views are broken down to count each visit once
+	daily.Views++
+	countStat(&daily.Referrers, referrer)
+	countStat(&daily.Browsers, browser)
+	if country != "" {
+		countStat(&daily.Countries, country)
+	}
+}
+
+func (daily *DailyStats) clone() *DailyStats {
+	return &DailyStats{
+		Views:     daily.Views,
+		Downloads: daily.Downloads,
+		Referrers: maps.Clone(daily.Referrers),
+		Countries: maps.Clone(daily.Countries),
+		Browsers:  maps.Clone(daily.Browsers),
+	}
+}
+
+func countStat(counts *map[string]int64, name string) {
+	if *counts == nil {
+		*counts = map[string]int64{}
+	}
+	(*counts)[name]++
+}
+
+// Run saves stats every statsSaveInterval until ctx is done, then saves them
+// one last time
+func (stats *FileStats) Run(ctx context.Context) {
+	ticker := time.NewTicker(statsSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := stats.Save(); err != nil {
+				slog.Error("Error saving file stats", "path", stats.persisted.path, "error", err)
+			}
+			return
+		case <-ticker.C:
+			if err := stats.Save(); err != nil {
+				slog.ErrorContext(ctx, "Error saving file stats", "path", stats.persisted.path, "error", err)
+			}
+		}
+	}
+}
+
+// Save drops stats that are too old, and writes them to disk if there's a
+// path and they've changed
+func (stats *FileStats) Save() error {
+	stats.mutex.Lock()
+	stats.prune()
+	stats.mutex.Unlock()
+
+	// Requests wait on the mutex to count, so only hold it long enough to
+	// copy everything
+	err := stats.persisted.save(func() any {
+		stats.mutex.Lock()
+		defer stats.mutex.Unlock()
+
+		if !stats.dirty {
+			return nil
+		}
+		stats.dirty = false
+
+		files := make(map[string]map[string]*DailyStats, len(stats.files))
+		for key, days := range stats.files {
+			files[key] = make(map[string]*DailyStats, len(days))
+			for day, daily := range days {
+				files[key][day] = daily.clone()
+			}
+		}
+		return files
+	})
+	if err != nil {
+		stats.mutex.Lock()
+		stats.dirty = true
+		stats.mutex.Unlock()
+		return fmt.Errorf("couldn't save file stats: %w", err)
+	}
+
+	return nil
+}
+
+// prune drops days past statsRetentionDays, and files left without any. The
+// mutex must be held.
+func (stats *FileStats) prune() {
+	cutoff := stats.now().UTC().AddDate(0, 0, -statsRetentionDays).Format(statsDayFormat)
+
+	for key, days := range stats.files {
+		for day := range days {
+			// Days sort as strings
+			if day < cutoff {
+				delete(days, day)
+			}
+		}
+		if len(days) == 0 {
+			delete(stats.files, key)
+		}
+	}
+}
+
+// Forget drops a file's stats, once it's been deleted
+func (stats *FileStats) Forget(key string) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	if _, found := stats.files[key]; found {
+		delete(stats.files, key)
+		stats.dirty = true
+	}
+}
+
+// Downloads is how many times a file's been downloaded, over the days kept
+func (stats *FileStats) Downloads(key string) int64 {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	var downloads int64
+	for _, daily := range stats.files[key] {
+		downloads += daily.Downloads
+	}
+
+	return downloads
+}
+
+// TopDownloads returns the limit most downloaded files over the days kept,
+// most first, named by their short keys
+func (stats *FileStats) TopDownloads(limit int) []StatsCount {
+	downloads := map[string]int64{}
+
+	stats.mutex.Lock()
+	for key, days := range stats.files {
+		for _, daily := range days {
+			if daily.Downloads > 0 {
+				downloads[key] += daily.Downloads
+			}
+		}
+	}
+	stats.mutex.Unlock()
+
+	return topStats(downloads, limit)
+}
+
+// StatsDay is a day on the stats page's chart
+type StatsDay struct {
+	Date      time.Time
+	Views     int64
+	Downloads int64
+}
+
+// StatsCount is a referrer, country or browser and how many views it had
+type StatsCount struct {
+	Name  string
+	Count int64
+}
+
+// StatsReport is a file's stats over the last few days
+type StatsReport struct {
+	Days      []StatsDay // oldest first, including days without anything
+	Views     int64
+	Downloads int64
+	Referrers []StatsCount
+	Countries []StatsCount
+	Browsers  []StatsCount
+	GeoIP     bool // whether countries are looked up at all
+
+	busiest int64
+}
+
+// Report sums up a file's stats over the last days days, today included
+func (stats *FileStats) Report(key string, days int) *StatsReport {
+	report := &StatsReport{GeoIP: stats.geoIP != nil}
+	referrers, countries, browsers := map[string]int64{}, map[string]int64{}, map[string]int64{}
+
+	today := stats.now().UTC().Truncate(24 * time.Hour)
+
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	for offset := days - 1; offset >= 0; offset-- {
+		date := today.AddDate(0, 0, -offset)
+		day := StatsDay{Date: date}
+
+		if daily, ok := stats.files[key][date.Format(statsDayFormat)]; ok {
+			day.Views, day.Downloads = daily.Views, daily.Downloads
+			addStats(referrers, daily.Referrers)
+			addStats(countries, daily.Countries)
+			addStats(browsers, daily.Browsers)
+		}
+
+		report.Days = append(report.Days, day)
+		report.Views += day.Views
+		report.Downloads += day.Downloads
+		report.busiest = max(report.busiest, day.Views, day.Downloads)
+	}
+
+	report.Referrers = topStats(referrers, statsTopSize)
+	report.Countries = topStats(countries, statsTopSize)
+	report.Browsers = topStats(browsers, statsTopSize)
+
+	return report
+}
+
+func addStats(total map[string]int64, counts map[string]int64) {
+	for name, count := range counts {
+		total[name] += count
+	}
+}
+
+// topStats returns the limit biggest counts, biggest first
+func topStats(counts map[string]int64, limit int) []StatsCount {
+	top := make([]StatsCount, 0, len(counts))
+	for _, name := range slices.Sorted(maps.Keys(counts)) {
+		top = append(top, StatsCount{Name: name, Count: counts[name]})
+	}
+	slices.SortStableFunc(top, func(a, b StatsCount) int {
+		return cmp.Compare(b.Count, a.Count)
+	})
+
+	return top[:min(limit, len(top))]
+}
+
+// Height is how tall a bar for count is on the chart, relative to the
+// busiest day
+func (report *StatsReport) Height(count int64) string {
+	if report.busiest == 0 {
+		return "0%"
+	}
+	return percent(float64(count) / float64(report.busiest))
+}
+
+// browserFamily buckets a user agent into the browser, or bot, behind it.
+// Most browsers claim to be several others, so the order matters.
+func browserFamily(userAgent string) string {
+	agent := strings.ToLower(userAgent)
+
+	switch {
+	case agent == "":
+		return statsUnknown
+	case strings.Contains(agent, "bot"), strings.Contains(agent, "crawler"), strings.Contains(agent, "spider"),
+		strings.Contains(agent, "preview"), strings.HasPrefix(agent, "curl/"), strings.HasPrefix(agent, "wget/"):
+		// Link unfurlers like Slackbot and Discordbot count here too
+		return "Bot"
+	case strings.Contains(agent, "edg/"):
+		return "Edge"
+	case strings.Contains(agent, "opr/"):
+		return "Opera"
+	case strings.Contains(agent, "firefox/"), strings.Contains(agent, "fxios/"):
+		return "Firefox"
+	case strings.Contains(agent, "chrome/"), strings.Contains(agent, "crios/"):
+		return "Chrome"
+	case strings.Contains(agent, "safari/"):
+		return "Safari"
+	default:
+		return "Other"
+	}
+}
+
+// GeoIP looks up which country an IP is in, from a local MaxMind database
+// like GeoLite2-Country.mmdb, so nobody's IP is sent anywhere
+type GeoIP struct {
+	reader *maxminddb.Reader
+}
+
+// OpenGeoIP opens the database at path. A blank path means no lookups.
+func OpenGeoIP(path string) (*GeoIP, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open GeoIP database: %w", err)
+	}
+
+	return &GeoIP{reader: reader}, nil
+}
+
+// Country returns the ISO code for where ip is, or "" if it's not known
+func (geoIP *GeoIP) Country(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := geoIP.reader.Lookup(parsed, &record); err != nil {
+		return ""
+	}
+
+	return record.Country.ISOCode
+}
+
+func (webServer *WebServer) StatsHandler(writer http.ResponseWriter, request *http.Request) {
+	file, err := webServer.ownedFile(request, request.PathValue("key"))
+	if err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	webServer.ServePage(writer, request, "stats", templateData{
+		StoredFile: *file,
+		Stats:      webServer.Stats.Report(file.Key, statsPageDays),
+	})
+}
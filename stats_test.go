@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	chromeUserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+	slackUserAgent  = "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"
+)
+
+func newTestStats(t *testing.T, path string, geoIP *GeoIP) (*FileStats, *fakeClock) {
+	t.Helper()
+
+	stats, err := NewFileStats(path, geoIP)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	clock := &fakeClock{now: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)}
+	stats.now = clock.Now
+
+	return stats, clock
+}
+
+func TestFileStatsReport(t *testing.T) {
+	stats, clock := newTestStats(t, "", nil)
+	yesterday := clock.now.AddDate(0, 0, -1)
+
+	events := []AnalyticsEvent{
+		{Name: EventPageview, Key: "ABCDE", Time: yesterday, UserAgent: chromeUserAgent, Props: map[string]string{"referrer": "chat.example.com"}},
+		{Name: EventPageview, Key: "ABCDE", Time: clock.now, UserAgent: slackUserAgent, Props: map[string]string{"referrer": "chat.example.com"}},
+		{Name: EventPageview, Key: "ABCDE", Time: clock.now, UserAgent: chromeUserAgent},
+		{Name: EventDownload, Key: "ABCDE", Time: clock.now, UserAgent: chromeUserAgent},
+		// Neither of these are counted
+		{Name: EventPreview, Key: "ABCDE", Time: clock.now},
+		{Name: EventPageview, Time: clock.now},
+	}
+	for _, event := range events {
+		stats.Record(event)
+	}
+
+	report := stats.Report("ABCDE", 7)
+	if len(report.Days) != 7 || !report.Days[6].Date.Equal(time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expected a week up to today, got %+v", report.Days)
+	}
+	if today := report.Days[6]; today.Views != 2 || today.Downloads != 1 || report.Days[5].Views != 1 {
+		t.Errorf("Expected 2 views and a download today and a view yesterday, got %+v", report.Days)
+	}
+	if report.Views != 3 || report.Downloads != 1 {
+		t.Errorf("Expected 3 views and a download in total, got %d and %d", report.Views, report.Downloads)
+	}
+
+	if len(report.Referrers) != 2 || report.Referrers[0] != (StatsCount{"chat.example.com", 2}) || report.Referrers[1] != (StatsCount{statsDirect, 1}) {
+		t.Errorf("Expected views by referrer, most first, got %+v", report.Referrers)
+	}
+	if len(report.Browsers) != 2 || report.Browsers[0] != (StatsCount{"Chrome", 2}) || report.Browsers[1] != (StatsCount{"Bot", 1}) {
+		t.Errorf("Expected views by browser, got %+v", report.Browsers)
+	}
+	if report.GeoIP || len(report.Countries) != 0 {
+		t.Errorf("Expected no countries without a GeoIP database, got %+v", report.Countries)
+	}
+
+	if height := report.Height(1); height != "50.0%" {
+		t.Errorf("Expected half the busiest day's height, got %s", height)
+	}
+}
+
+func TestFileStatsTopDownloads(t *testing.T) {
+	stats, clock := newTestStats(t, "", nil)
+	for _, key := range []string{"AAAAA", "BBBBB", "BBBBB", "CCCCC", "CCCCC", "CCCCC"} {
+		stats.Record(AnalyticsEvent{Name: EventDownload, Key: key, Time: clock.now})
+	}
+	// Yesterday counts too, but views don't
+	stats.Record(AnalyticsEvent{Name: EventDownload, Key: "BBBBB", Time: clock.now.AddDate(0, 0, -1)})
+	stats.Record(AnalyticsEvent{Name: EventPageview, Key: "DDDDD", Time: clock.now})
+
+	top := stats.TopDownloads(2)
+	if len(top) != 2 || top[0] != (StatsCount{Name: "BBBBB", Count: 3}) || top[1] != (StatsCount{Name: "CCCCC", Count: 3}) {
+		t.Errorf("Expected the two most downloaded, got %+v", top)
+	}
+	if downloads := stats.Downloads("BBBBB"); downloads != 3 {
+		t.Errorf("Expected 3 downloads, got %d", downloads)
+	}
+	if top := stats.TopDownloads(10); len(top) != 3 {
+		t.Errorf("Expected only downloaded files, got %+v", top)
+	}
+}
+
+func TestFileStatsPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	stats, clock := newTestStats(t, path, nil)
+
+	events := []AnalyticsEvent{
+		{Name: EventPageview, Key: "ABCDE", Time: clock.now.AddDate(0, 0, -statsRetentionDays-1)},
+		{Name: EventPageview, Key: "ABCDE", Time: clock.now},
+		{Name: EventPageview, Key: "FGHIJ", Time: clock.now},
+	}
+	for _, event := range events {
+		stats.Record(event)
+	}
+	if err := stats.Save(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	reloaded, _ := newTestStats(t, path, nil)
+	if report := reloaded.Report("ABCDE", statsRetentionDays*2); report.Views != 1 {
+		t.Errorf("Expected today's view to be saved and the old one dropped, got %d", report.Views)
+	}
+
+	reloaded.Forget("ABCDE")
+	_ = reloaded.Save()
+	reloaded, _ = newTestStats(t, path, nil)
+	if reloaded.Report("ABCDE", 1).Views != 0 || reloaded.Report("FGHIJ", 1).Views != 1 {
+		t.Error("Expected only the forgotten file's stats to be dropped")
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStats(path, nil); err == nil {
+		t.Error("Expected broken stats to fail to load")
+	}
+}
+
+func TestFileStatsSavedOnShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	stats, clock := newTestStats(t, path, nil)
+	stats.Record(AnalyticsEvent{Name: EventDownload, Key: "ABCDE", Time: clock.now})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stats.Run(ctx)
+
+	reloaded, _ := newTestStats(t, path, nil)
+	if report := reloaded.Report("ABCDE", 1); report.Downloads != 1 {
+		t.Errorf("Expected the download to be saved on the way out, got %d", report.Downloads)
+	}
+}
+
+func TestBrowserFamily(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		family    string
+	}{
+		{chromeUserAgent, "Chrome"},
+		{slackUserAgent, "Bot"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0", "Edge"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0", "Firefox"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1", "Safari"},
+		{"Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)", "Bot"},
+		{"curl/8.4.0", "Bot"},
+		{"Lynx/2.9.0", "Other"},
+		{"", statsUnknown},
+	}
+
+	for _, test := range tests {
+		if family := browserFamily(test.userAgent); family != test.family {
+			t.Errorf("Expected %s for %q, got %s", test.family, test.userAgent, family)
+		}
+	}
+}
+
+// writeTestGeoIP writes a MaxMind database that only knows 203.0.113.0/24 is
+// in country. It's just enough of the format for the reader: a search tree
+// with a node per bit of the network, the record it leads to, and metadata.
+func writeTestGeoIP(t *testing.T, country string) string {
+	t.Helper()
+
+	const nodeCount = 24
+	network := []byte{203, 0, 113}
+
+	var database bytes.Buffer
+	for node := range nodeCount {
+		bit := network[node/8] >> (7 - node%8) & 1
+
+		// Off the network is nodeCount, meaning nothing's there. The last
+		// bit leads to the record at the start of the data section.
+		next := node + 1
+		if node == nodeCount-1 {
+			next = nodeCount + 16
+		}
+		records := [2]int{nodeCount, nodeCount}
+		records[bit] = next
+
+		for _, record := range records {
+			database.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+	database.Write(make([]byte, 16))
+
+	mmdbString := func(value string) []byte {
+		return append([]byte{0x40 | byte(len(value))}, value...)
+	}
+	mmdbUint16 := func(value byte) []byte {
+		return []byte{0xa1, value}
+	}
+
+	// {"country": {"iso_code": country}}
+	database.WriteByte(0xe1)
+	database.Write(mmdbString("country"))
+	database.WriteByte(0xe1)
+	database.Write(mmdbString("iso_code"))
+	database.Write(mmdbString(country))
+
+	database.WriteString("\xab\xcd\xefMaxMind.com")
+	database.WriteByte(0xe5)
+	database.Write(mmdbString("node_count"))
+	database.Write([]byte{0xc1, nodeCount})
+	database.Write(mmdbString("record_size"))
+	database.Write(mmdbUint16(24))
+	database.Write(mmdbString("ip_version"))
+	database.Write(mmdbUint16(4))
+	database.Write(mmdbString("database_type"))
+	database.Write(mmdbString("Test-Country"))
+	database.Write(mmdbString("binary_format_major_version"))
+	database.Write(mmdbUint16(2))
+
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, database.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoIP(t *testing.T) {
+	geoIP, err := OpenGeoIP(writeTestGeoIP(t, "NZ"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if country := geoIP.Country("203.0.113.7"); country != "NZ" {
+		t.Errorf("Expected NZ, got %q", country)
+	}
+	for _, ip := range []string{"198.51.100.1", "not an ip", ""} {
+		if country := geoIP.Country(ip); country != "" {
+			t.Errorf("Expected no country for %q, got %q", ip, country)
+		}
+	}
+
+	stats, clock := newTestStats(t, "", geoIP)
+	events := []AnalyticsEvent{
+		{Name: EventPageview, Key: "ABCDE", Time: clock.now, ClientIP: "203.0.113.7"},
+		{Name: EventPageview, Key: "ABCDE", Time: clock.now, ClientIP: "198.51.100.1"},
+	}
+	for _, event := range events {
+		stats.Record(event)
+	}
+
+	report := stats.Report("ABCDE", 1)
+	if !report.GeoIP || len(report.Countries) != 2 || report.Countries[0] != (StatsCount{"NZ", 1}) || report.Countries[1] != (StatsCount{statsUnknown, 1}) {
+		t.Errorf("Expected views by country, got %+v", report.Countries)
+	}
+
+	if geoIP, err := OpenGeoIP(""); geoIP != nil || err != nil {
+		t.Errorf("Expected no GeoIP without a database, got %v, %v", geoIP, err)
+	}
+	if _, err := OpenGeoIP(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("Expected an error for a missing database")
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockOwnedStorage{})
+	server.SetUsers(newTestUsers(t))
+	_ = server.users.SetPassword("someone", "password2", RoleUser)
+
+	event := AnalyticsEvent{Name: EventPageview, Key: "ABCDE", Time: time.Now(), Props: map[string]string{"referrer": "chat.example.com"}}
+	server.Stats.Record(event)
+
+	for user, expected := range map[string]int{"someone": http.StatusForbidden, "guest": http.StatusOK, "skalnik": http.StatusOK} {
+		request := httptest.NewRequest(http.MethodGet, "/ABCDE/stats", nil)
+		request.SetBasicAuth(user, map[string]string{"someone": "password2", "guest": "password1", "skalnik": "hunter2"}[user])
+		responseRecorder := httptest.NewRecorder()
+		server.Router.ServeHTTP(responseRecorder, request)
+
+		if responseRecorder.Code != expected {
+			t.Errorf(`Expected %d for %s, but instead got %d`, expected, user, responseRecorder.Code)
+			continue
+		}
+		if expected != http.StatusOK {
+			continue
+		}
+
+		body := responseRecorder.Body.String()
+		if !strings.Contains(body, "1 views, 0 downloads") || !strings.Contains(body, "chat.example.com") {
+			t.Errorf(`Expected today's view in body: %s`, body)
+		}
+		if !strings.Contains(body, `class="chart-views" style="height: 100.0%"`) {
+			t.Errorf(`Expected a full height bar for today in body: %s`, body)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/ABCDE/stats", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Code != http.StatusUnauthorized {
+		t.Errorf(`Expected stats to need a login, but instead got %d`, responseRecorder.Code)
+	}
+}
+
+func TestDirectHandlerRecordsStats(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockOwnedStorage{})
+
+	// Stats are counted straight away, with or without analytics
+	server.Router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ABCDE.txt", nil))
+
+	if report := server.Stats.Report("ABCDE", 1); report.Views != 1 || report.Downloads != 1 {
+		t.Errorf("Expected a view and a download, got %d and %d", report.Views, report.Downloads)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/ABCDE.txt", nil)
+	request.Header.Set("DNT", "1")
+	server.Router.ServeHTTP(httptest.NewRecorder(), request)
+	if report := server.Stats.Report("ABCDE", 1); report.Views != 1 {
+		t.Errorf("Expected Do Not Track to be respected, got %d views", report.Views)
+	}
+
+	// Deleted files don't keep their stats around
+	server.forgetFile("ABCDE")
+	if server.Stats.Report("ABCDE", 1).Views != 0 {
+		t.Error("Expected stats to be forgotten with the file")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrorInvalidTimeouts = errors.New("invalid S3 timeouts")
+
+// Timeouts bounds how long each storage operation can spend talking to S3,
+// on top of any deadline the request already has. Zero means no limit of
+// our own.
+type Timeouts struct {
+	Lookup time.Duration
+	List   time.Duration
+	Update time.Duration
+	Upload time.Duration
+}
+
+// Uploads get far longer since they're bound by the size of the file
+var DefaultTimeouts = Timeouts{
+	Lookup: 30 * time.Second,
+	List:   30 * time.Second,
+	Update: 30 * time.Second,
+	Upload: 10 * time.Minute,
+}
+
+// ParseTimeouts overrides the defaults with a list like
+// "lookup=10s,upload=5m". Operations that aren't listed keep their default.
+func ParseTimeouts(raw string) (Timeouts, error) {
+	timeouts := DefaultTimeouts
+
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		operation, rawDuration, found := strings.Cut(pair, "=")
+		if !found {
+			return Timeouts{}, fmt.Errorf("%w: expected operation=duration, got %q", ErrorInvalidTimeouts, pair)
+		}
+
+		duration, err := time.ParseDuration(strings.TrimSpace(rawDuration))
+		if err != nil || duration < 0 {
+			return Timeouts{}, fmt.Errorf("%w: bad duration for %s: %q", ErrorInvalidTimeouts, operation, rawDuration)
+		}
+
+		switch strings.ToLower(strings.TrimSpace(operation)) {
+		case "lookup":
+			timeouts.Lookup = duration
+		case "list":
+			timeouts.List = duration
+		case "update":
+			timeouts.Update = duration
+		case "upload":
+			timeouts.Upload = duration
+		default:
+			return Timeouts{}, fmt.Errorf("%w: unknown operation %q", ErrorInvalidTimeouts, operation)
+		}
+	}
+
+	return timeouts, nil
+}
+
+// withTimeout is context.WithTimeout, except a zero timeout leaves the
+// context as it is
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
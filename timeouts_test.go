@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseTimeoutsDefaults(t *testing.T) {
+	timeouts, err := ParseTimeouts("")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if timeouts != DefaultTimeouts {
+		t.Errorf("Expected defaults, got %+v", timeouts)
+	}
+}
+
+func TestParseTimeoutsOverrides(t *testing.T) {
+	timeouts, err := ParseTimeouts("lookup=5s, upload=1h,list=0s")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if timeouts.Lookup != 5*time.Second {
+		t.Errorf("Expected lookup timeout of 5s, got %s", timeouts.Lookup)
+	}
+	if timeouts.Upload != time.Hour {
+		t.Errorf("Expected upload timeout of 1h, got %s", timeouts.Upload)
+	}
+	if timeouts.List != 0 {
+		t.Errorf("Expected list timeout to be disabled, got %s", timeouts.List)
+	}
+	if timeouts.Update != DefaultTimeouts.Update {
+		t.Errorf("Expected update timeout to keep its default, got %s", timeouts.Update)
+	}
+}
+
+func TestParseTimeoutsInvalid(t *testing.T) {
+	for _, raw := range []string{"lookup", "lookup=soon", "lookup=-1s", "delete=5s"} {
+		_, err := ParseTimeouts(raw)
+		if !errors.Is(err, ErrorInvalidTimeouts) {
+			t.Errorf("Expected ErrorInvalidTimeouts for %q, got %v", raw, err)
+		}
+	}
+}
+
+func TestWithTimeoutZero(t *testing.T) {
+	ctx, cancel := withTimeout(context.Background(), 0)
+	defer cancel()
+
+	if _, hasDeadline := ctx.Deadline(); hasDeadline {
+		t.Error("Expected no deadline for a zero timeout")
+	}
+}
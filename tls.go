@@ -0,0 +1,172 @@
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var ErrorInvalidTLS = errors.New("invalid TLS settings")
+
+// TLSSettings turns on serving HTTPS ourselves, for when there's no proxy
+// in front to do it. Either give a certificate and key, or some domains to
+// get certificates for over ACME (Let's Encrypt by default).
+type TLSSettings struct {
+	CertFile string
+	KeyFile  string
+
+	Domains      []string
+	CacheDir     string // where ACME accounts and certificates are kept
+	Email        string // optional contact for the ACME account
+	DirectoryURL string // ACME directory, blank for Let's Encrypt
+
+	RedirectPort string        // plain HTTP port to redirect from, blank to disable
+	HSTSMaxAge   time.Duration // zero to not send HSTS at all
+}
+
+func (settings TLSSettings) Enabled() bool {
+	return settings.CertFile != "" || settings.KeyFile != "" || len(settings.Domains) > 0
+}
+
+// ParseDomains splits a comma separated list of domains, ignoring blanks
+func ParseDomains(raw string) []string {
+	var domains []string
+	for _, domain := range strings.Split(raw, ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// EnableTLS makes Start serve HTTPS with the given settings. It should be
+// called before Start.
+func (webServer *WebServer) EnableTLS(settings TLSSettings) error {
+	switch {
+	case settings.CertFile != "" && len(settings.Domains) > 0:
+		return fmt.Errorf("%w: use either a certificate or ACME domains, not both", ErrorInvalidTLS)
+	case (settings.CertFile == "") != (settings.KeyFile == ""):
+		return fmt.Errorf("%w: a certificate needs both a cert and a key file", ErrorInvalidTLS)
+	case len(settings.Domains) > 0 && settings.CacheDir == "":
+		return fmt.Errorf("%w: ACME needs a cache directory", ErrorInvalidTLS)
+	case settings.HSTSMaxAge < 0:
+		return fmt.Errorf("%w: HSTS max age can't be negative", ErrorInvalidTLS)
+	}
+
+	redirect := httpsRedirect(webServer.httpsPort)
+
+	if settings.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrorInvalidTLS, err)
+		}
+
+		webServer.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+		}
+		slog.Info("Serving TLS with a static certificate", "cert", settings.CertFile)
+	} else {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(settings.CacheDir),
+			HostPolicy: autocert.HostWhitelist(settings.Domains...),
+			Email:      settings.Email,
+		}
+		if settings.DirectoryURL != "" {
+			manager.Client = &acme.Client{DirectoryURL: settings.DirectoryURL}
+		}
+
+		// TLS-ALPN-01 challenges are answered on the TLS listener itself.
+		// HTTP-01 is only offered if there's a redirect listener to answer.
+		if settings.RedirectPort != "" {
+			redirect = manager.HTTPHandler(redirect)
+		}
+		webServer.tlsConfig = manager.TLSConfig()
+		webServer.tlsConfig.MinVersion = tls.VersionTLS12
+		slog.Info("Serving TLS with ACME certificates", "domains", settings.Domains)
+	}
+
+	if settings.RedirectPort != "" {
+		webServer.redirectPort = settings.RedirectPort
+		webServer.redirect = redirect
+	}
+
+	if settings.HSTSMaxAge > 0 {
+		webServer.Router = NewHSTS(webServer.Router, settings.HSTSMaxAge)
+	}
+
+	return nil
+}
+
+// httpsRedirect sends plain HTTP requests to the same place over HTTPS on
+// the port port returns, which is asked each time as the redirect is set up
+// before we're listening. Only GET and HEAD get a 301, since anything else
+// would be replayed as a GET and lose its body, so those get a 308.
+func httpsRedirect(port func() string) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		host := request.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if host == "" {
+			http.Error(writer, "Missing host", http.StatusBadRequest)
+			return
+		}
+		if port := port(); port != "443" && port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		target := "https://" + host + request.URL.RequestURI()
+
+		status := http.StatusMovedPermanently
+		if request.Method != http.MethodGet && request.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(writer, request, target, status)
+	})
+}
+
+// httpsPort is the port we're serving HTTPS on, from the listener if we're
+// listening. Anything that isn't TCP, like a unix socket, must have something
+// in front of it, which we assume is on the usual port.
+func (webServer *WebServer) httpsPort() string {
+	if webServer.Listener != nil {
+		if address, ok := webServer.Listener.Addr().(*net.TCPAddr); ok {
+			return strconv.Itoa(address.Port)
+		}
+		return "443"
+	}
+	return cmp.Or(webServer.Port, "443")
+}
+
+// HSTSMiddleware tells browsers to only ever use HTTPS for us. It's only
+// sent over TLS, as browsers ignore it otherwise.
+type HSTSMiddleware struct {
+	handler http.Handler
+	header  string
+}
+
+func NewHSTS(handlerToWrap http.Handler, maxAge time.Duration) *HSTSMiddleware {
+	return &HSTSMiddleware{
+		handler: handlerToWrap,
+		header:  "max-age=" + strconv.Itoa(int(maxAge.Seconds())),
+	}
+}
+
+func (hsts *HSTSMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS != nil {
+		w.Header().Set("Strict-Transport-Security", hsts.header)
+	}
+	hsts.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeACME is just enough of an ACME server to issue a certificate for one
+// domain. It checks the HTTP-01 challenge against challengeURL, signs with
+// its own CA and doesn't bother verifying any JWS signatures.
+type fakeACME struct {
+	*httptest.Server
+	domain       string
+	challengeURL string
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mutex       sync.Mutex
+	authzStatus string
+	orderStatus string
+	certificate []byte
+}
+
+func newFakeACME(t *testing.T, domain string) *fakeACME {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Couldn't create CA: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+
+	acme := &fakeACME{
+		domain:      domain,
+		caKey:       caKey,
+		caCert:      caCert,
+		authzStatus: "pending",
+		orderStatus: "pending",
+	}
+	acme.Server = httptest.NewServer(http.HandlerFunc(acme.serve))
+	t.Cleanup(acme.Close)
+	return acme
+}
+
+func (acme *fakeACME) serve(writer http.ResponseWriter, request *http.Request) {
+	acme.mutex.Lock()
+	defer acme.mutex.Unlock()
+
+	writer.Header().Set("Replay-Nonce", rand.Text())
+	url := acme.URL
+
+	var payload []byte
+	if request.Method == http.MethodPost {
+		var jws struct{ Payload string }
+		_ = json.NewDecoder(request.Body).Decode(&jws)
+		payload, _ = base64.RawURLEncoding.DecodeString(jws.Payload)
+	}
+
+	switch request.URL.Path {
+	case "/directory":
+		writeACME(writer, http.StatusOK, map[string]any{
+			"newNonce":   url + "/nonce",
+			"newAccount": url + "/account",
+			"newOrder":   url + "/order",
+			"revokeCert": url + "/revoke",
+			"keyChange":  url + "/key",
+		})
+	case "/nonce":
+		writer.WriteHeader(http.StatusOK)
+	case "/account":
+		writer.Header().Set("Location", url+"/account/1")
+		writeACME(writer, http.StatusCreated, map[string]any{"status": "valid"})
+	case "/order":
+		writer.Header().Set("Location", url+"/order/1")
+		writeACME(writer, http.StatusCreated, acme.order())
+	case "/order/1":
+		writeACME(writer, http.StatusOK, acme.order())
+	case "/authz/1":
+		writeACME(writer, http.StatusOK, map[string]any{
+			"status":     acme.authzStatus,
+			"identifier": map[string]string{"type": "dns", "value": acme.domain},
+			"challenges": []map[string]string{acme.challenge()},
+		})
+	case "/challenge/1":
+		if err := acme.validate(); err != nil {
+			writeACME(writer, http.StatusForbidden, map[string]string{
+				"type":   "urn:ietf:params:acme:error:unauthorized",
+				"detail": err.Error(),
+			})
+			return
+		}
+		acme.authzStatus = "valid"
+		acme.orderStatus = "ready"
+		writeACME(writer, http.StatusOK, acme.challenge())
+	case "/finalize/1":
+		var finalize struct{ CSR string }
+		_ = json.Unmarshal(payload, &finalize)
+		if err := acme.issue(finalize.CSR); err != nil {
+			writeACME(writer, http.StatusBadRequest, map[string]string{
+				"type":   "urn:ietf:params:acme:error:badCSR",
+				"detail": err.Error(),
+			})
+			return
+		}
+		acme.orderStatus = "valid"
+		writeACME(writer, http.StatusOK, acme.order())
+	case "/cert/1":
+		writer.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = writer.Write(acme.certificate)
+	default:
+		http.NotFound(writer, request)
+	}
+}
+
+func (acme *fakeACME) order() map[string]any {
+	order := map[string]any{
+		"status":         acme.orderStatus,
+		"identifiers":    []map[string]string{{"type": "dns", "value": acme.domain}},
+		"authorizations": []string{acme.URL + "/authz/1"},
+		"finalize":       acme.URL + "/finalize/1",
+	}
+	if acme.orderStatus == "valid" {
+		order["certificate"] = acme.URL + "/cert/1"
+	}
+	return order
+}
+
+func (acme *fakeACME) challenge() map[string]string {
+	return map[string]string{
+		"type":   "http-01",
+		"url":    acme.URL + "/challenge/1",
+		"token":  "fake-token",
+		"status": acme.authzStatus,
+	}
+}
+
+// validate fetches the HTTP-01 response from challengeURL the way a real
+// CA would, with the domain as the Host
+func (acme *fakeACME) validate() error {
+	request, _ := http.NewRequest(http.MethodGet, acme.challengeURL+"/.well-known/acme-challenge/fake-token", nil)
+	request.Host = acme.domain
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), "fake-token.") {
+		return fmt.Errorf("bad challenge response %d: %s", response.StatusCode, body)
+	}
+	return nil
+}
+
+func (acme *fakeACME) issue(encodedCSR string) error {
+	der, err := base64.RawURLEncoding.DecodeString(encodedCSR)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: acme.domain},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, acme.caCert, csr.PublicKey, acme.caKey)
+	if err != nil {
+		return err
+	}
+
+	acme.certificate = append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: acme.caCert.Raw})...,
+	)
+	return nil
+}
+
+func writeACME(writer http.ResponseWriter, status int, body any) {
+	if status >= 400 {
+		writer.Header().Set("Content-Type", "application/problem+json")
+	} else {
+		writer.Header().Set("Content-Type", "application/json")
+	}
+	writer.WriteHeader(status)
+	_ = json.NewEncoder(writer).Encode(body)
+}
+
+// writeSelfSigned writes a certificate and key for localhost into dir
+func writeSelfSigned(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Couldn't create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	return certFile, keyFile, cert
+}
+
+// serveTLS runs the web server's router with its TLS config, returning a
+// client that trusts roots and sends serverName
+func serveTLS(t *testing.T, server *WebServer, roots *x509.CertPool, serverName string) (*httptest.Server, *http.Client) {
+	tlsServer := httptest.NewUnstartedServer(server.Router)
+	tlsServer.TLS = server.tlsConfig
+	tlsServer.StartTLS()
+	t.Cleanup(tlsServer.Close)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: serverName},
+		},
+	}
+	return tlsServer, client
+}
+
+func TestEnableTLSStaticCertificate(t *testing.T) {
+	certFile, keyFile, cert := writeSelfSigned(t, t.TempDir())
+
+	server := NewWebServer("", "", "443", "", &mockStorage{})
+	err := server.EnableTLS(TLSSettings{CertFile: certFile, KeyFile: keyFile, HSTSMaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	tlsServer, client := serveTLS(t, server, roots, "localhost")
+
+	response, err := client.Get(tlsServer.URL + "/ping")
+	if err != nil {
+		t.Fatalf("Expected TLS request to work, got %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf(`Expected 200 OK, but instead got %s`, response.Status)
+	}
+	if hsts := response.Header.Get("Strict-Transport-Security"); hsts != "max-age=3600" {
+		t.Errorf("Expected HSTS header, got %q", hsts)
+	}
+}
+
+func TestEnableTLSWithACME(t *testing.T) {
+	acme := newFakeACME(t, "files.example.com")
+
+	server := NewWebServer("", "", "443", "", &mockStorage{})
+	err := server.EnableTLS(TLSSettings{
+		Domains:      []string{"files.example.com"},
+		CacheDir:     t.TempDir(),
+		DirectoryURL: acme.URL + "/directory",
+		RedirectPort: "80",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	redirectServer := httptest.NewServer(server.redirect)
+	t.Cleanup(redirectServer.Close)
+	acme.challengeURL = redirectServer.URL
+
+	roots := x509.NewCertPool()
+	roots.AddCert(acme.caCert)
+	tlsServer, client := serveTLS(t, server, roots, "files.example.com")
+
+	response, err := client.Get(tlsServer.URL + "/ping")
+	if err != nil {
+		t.Fatalf("Expected a certificate from the ACME server, got %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf(`Expected 200 OK, but instead got %s`, response.Status)
+	}
+	if response.Header.Get("Strict-Transport-Security") != "" {
+		t.Error("Expected no HSTS header with a zero max age")
+	}
+}
+
+func TestEnableTLSWithACMEUnknownDomain(t *testing.T) {
+	acme := newFakeACME(t, "files.example.com")
+
+	server := NewWebServer("", "", "443", "", &mockStorage{})
+	_ = server.EnableTLS(TLSSettings{
+		Domains:      []string{"files.example.com"},
+		CacheDir:     t.TempDir(),
+		DirectoryURL: acme.URL + "/directory",
+	})
+
+	tlsServer, client := serveTLS(t, server, x509.NewCertPool(), "evil.example.com")
+
+	_, err := client.Get(tlsServer.URL + "/ping")
+	if err == nil {
+		t.Error("Expected handshake for an unlisted domain to fail")
+	}
+	acme.mutex.Lock()
+	defer acme.mutex.Unlock()
+	if acme.orderStatus != "pending" {
+		t.Error("Expected no certificate to be ordered for an unlisted domain")
+	}
+}
+
+func TestEnableTLSInvalid(t *testing.T) {
+	certFile, keyFile, _ := writeSelfSigned(t, t.TempDir())
+
+	for name, settings := range map[string]TLSSettings{
+		"cert without key": {CertFile: certFile},
+		"key without cert": {KeyFile: keyFile},
+		"cert and domains": {CertFile: certFile, KeyFile: keyFile, Domains: []string{"files.example.com"}, CacheDir: "certs"},
+		"no cache":         {Domains: []string{"files.example.com"}},
+		"missing files":    {CertFile: "nope.pem", KeyFile: "nope.key"},
+		"negative HSTS":    {CertFile: certFile, KeyFile: keyFile, HSTSMaxAge: -time.Second},
+	} {
+		server := NewWebServer("", "", "443", "", &mockStorage{})
+		err := server.EnableTLS(settings)
+		if !errors.Is(err, ErrorInvalidTLS) {
+			t.Errorf("%s: expected ErrorInvalidTLS, got %v", name, err)
+		}
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	redirect := httpsRedirect(func() string { return "443" })
+
+	request := httptest.NewRequest(http.MethodGet, "http://files.example.com:8080/ABCDE/details?x=1", nil)
+	responseRecorder := httptest.NewRecorder()
+	redirect.ServeHTTP(responseRecorder, request)
+
+	if responseRecorder.Code != http.StatusMovedPermanently {
+		t.Errorf("Expected 301, got %d", responseRecorder.Code)
+	}
+	if location := responseRecorder.Header().Get("Location"); location != "https://files.example.com/ABCDE/details?x=1" {
+		t.Errorf("Expected redirect to HTTPS, got %s", location)
+	}
+}
+
+func TestHTTPSRedirectKeepsMethod(t *testing.T) {
+	redirect := httpsRedirect(func() string { return "8443" })
+
+	request := httptest.NewRequest(http.MethodPost, "http://files.example.com/", nil)
+	responseRecorder := httptest.NewRecorder()
+	redirect.ServeHTTP(responseRecorder, request)
+
+	if responseRecorder.Code != http.StatusPermanentRedirect {
+		t.Errorf("Expected 308 for a POST, got %d", responseRecorder.Code)
+	}
+	if location := responseRecorder.Header().Get("Location"); location != "https://files.example.com:8443/" {
+		t.Errorf("Expected redirect to the TLS port, got %s", location)
+	}
+}
+
+func TestHTTPSPort(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockStorage{})
+	if port := server.httpsPort(); port != "443" {
+		t.Errorf("Expected 443 without a port, got %q", port)
+	}
+
+	server.Port = "8443"
+	if port := server.httpsPort(); port != "8443" {
+		t.Errorf("Expected the configured port, got %q", port)
+	}
+
+	// Listening on a socket we were given wins over the port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server.Listener = listener
+
+	expected := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	if port := server.httpsPort(); port != expected {
+		t.Errorf("Expected the listener's port %s, got %q", expected, port)
+	}
+
+	unixListener, err := net.Listen("unix", filepath.Join(t.TempDir(), "file-cloud.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixListener.Close()
+	server.Listener = unixListener
+
+	if port := server.httpsPort(); port != "443" {
+		t.Errorf("Expected 443 behind a unix socket, got %q", port)
+	}
+}
+
+func TestHSTSOnlyOverTLS(t *testing.T) {
+	server := NewWebServer("", "", "443", "", &mockStorage{})
+	server.Router = NewHSTS(server.Router, 24*time.Hour)
+
+	request := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("Expected no HSTS header over plain HTTP")
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "https://files.example.com/ping", nil)
+	responseRecorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if hsts := responseRecorder.Header().Get("Strict-Transport-Security"); hsts != "max-age=86400" {
+		t.Errorf("Expected HSTS header over TLS, got %q", hsts)
+	}
+}
+
+func TestParseDomains(t *testing.T) {
+	domains := ParseDomains(" Files.example.com, ,cdn.example.com")
+	if strings.Join(domains, ",") != "files.example.com,cdn.example.com" {
+		t.Errorf("Expected cleaned up domains, got %v", domains)
+	}
+}
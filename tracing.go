@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "file-cloud"
+
+var ErrorUnknownExporter = errors.New("unknown trace exporter")
+
+// W3C trace context, plus baggage so anything upstream sets comes along too
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// tracer looks up the global provider every time, rather than holding on to
+// one, so swapping providers (like tests do) takes effect straight away
+func tracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
+
+// SetupTracing installs a global tracer provider exporting spans to stdout or
+// over OTLP. OTLP is configured with the standard OTEL_EXPORTER_OTLP_*
+// environment variables. With no exporter tracing stays a no-op.
+func SetupTracing(ctx context.Context, exporterName string) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch exporterName {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrorUnknownExporter, exporterName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", tracerName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+
+	return provider.Shutdown, nil
+}
+
+type TracingMiddleware struct {
+	handler http.Handler
+}
+
+// ServeHTTP starts a server span for each request, continuing any trace the
+// client passed along in its traceparent header
+func (tm *TracingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer().Start(ctx, r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+		),
+	)
+	defer span.End()
+
+	wrapped := &responseWriter{
+		ResponseWriter: w,
+		statusCode:     200,
+	}
+
+	if id := RequestID(ctx); id != "" {
+		span.SetAttributes(attribute.String("http.request.id", id))
+	}
+
+	traced := r.WithContext(ctx)
+	tm.handler.ServeHTTP(wrapped, traced)
+
+	// The mux sets the matched pattern on the copy it was given, so pass it
+	// back up for the logging middleware's metrics
+	r.Pattern = traced.Pattern
+
+	// Like the metrics, spans are named after the route rather than the path
+	// so they can be grouped
+	if r.Pattern != "" {
+		span.SetName(r.Pattern)
+		span.SetAttributes(attribute.String("http.route", r.Pattern))
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", wrapped.statusCode))
+	if wrapped.statusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(wrapped.statusCode))
+	}
+}
+
+func NewTracing(handlerToWrap http.Handler) *TracingMiddleware {
+	return &TracingMiddleware{handlerToWrap}
+}
+
+// endSpan records an error, if there was one, before ending the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
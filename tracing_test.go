@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans swaps in a tracer provider that keeps finished spans in memory
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+	})
+	return recorder
+}
+
+func findSpan(spans []sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+	for _, span := range spans {
+		if span.Name() == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	recorder := recordSpans(t)
+
+	mockClient := &mockStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	server.Router.ServeHTTP(httptest.NewRecorder(), request)
+
+	spans := recorder.Ended()
+	span := findSpan(spans, "GET /")
+	if span == nil {
+		t.Fatalf("Expected a span named after the route, got %d spans", len(spans))
+	}
+
+	if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected trace to continue from traceparent, got trace %s", span.SpanContext().TraceID())
+	}
+	if span.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("Expected remote parent span, got %s", span.Parent().SpanID())
+	}
+
+	template := findSpan(spans, "ServeTemplate")
+	if template == nil {
+		t.Fatal("Expected a span for template rendering")
+	}
+	if template.Parent().SpanID() != span.SpanContext().SpanID() {
+		t.Error("Expected template span to be a child of the request span")
+	}
+}
+
+func TestTracingMiddlewareServerError(t *testing.T) {
+	recorder := recordSpans(t)
+
+	handler := NewTracing(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.Error(writer, "broken", http.StatusInternalServerError)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/broken", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	if spans[0].Status().Code != codes.Error {
+		t.Errorf("Expected error status for a 500, got %v", spans[0].Status())
+	}
+}
+
+func TestLookupFileSpans(t *testing.T) {
+	recorder := recordSpans(t)
+
+	client := &AWSClient{
+		Bucket: "test-bucket",
+		CDN:    "https://cdn.example.com",
+		s3Client: &instrumentedS3{&mockS3Client{
+			listObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+				return &s3.ListObjectsV2Output{
+					KeyCount: aws.Int32(1),
+					Contents: []types.Object{
+						{Key: aws.String("abc123/testfile.txt")},
+					},
+				}, nil
+			},
+			headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+				return nil, errors.New("gone")
+			},
+		}},
+	}
+
+	_, err := client.LookupFile(context.Background(), "abc12")
+	if !errors.Is(err, ErrorObjectMissing) {
+		t.Fatalf("Expected ErrorObjectMissing, got %v", err)
+	}
+
+	spans := recorder.Ended()
+	lookup := findSpan(spans, "AWSClient.LookupFile")
+	if lookup == nil {
+		t.Fatal("Expected a span for LookupFile")
+	}
+
+	for _, name := range []string{"S3.ListObjectsV2", "S3.HeadObject"} {
+		span := findSpan(spans, name)
+		if span == nil {
+			t.Errorf("Expected a span for %s", name)
+			continue
+		}
+		if span.Parent().SpanID() != lookup.SpanContext().SpanID() {
+			t.Errorf("Expected %s to be a child of LookupFile", name)
+		}
+	}
+
+	if head := findSpan(spans, "S3.HeadObject"); head != nil && head.Status().Code != codes.Error {
+		t.Errorf("Expected HeadObject span to record its error, got %v", head.Status())
+	}
+}
+
+func TestPlausibleEventDoesNotPropagateTrace(t *testing.T) {
+	recorder := recordSpans(t)
+
+	traceparent := "unset"
+	plausible := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		traceparent = request.Header.Get("traceparent")
+	}))
+	defer plausible.Close()
+
+	mockClient := &mockStorage{}
+	server := NewWebServer("", "", "", "example.com", mockClient)
+
+	request, _ := http.NewRequest(http.MethodGet, "/acab1.txt", nil)
+	event := server.newAnalyticsEvent(request, "pageview")
+	_ = NewPlausibleSink(plausible.URL).Send(context.Background(), []AnalyticsEvent{event})
+
+	if span := findSpan(recorder.Ended(), "Plausible event"); span == nil {
+		t.Error("Expected a span for the Plausible event")
+	}
+
+	if traceparent != "" {
+		t.Errorf("Expected no traceparent to be sent to a third party, got %q", traceparent)
+	}
+}
+
+func TestSetupTracingUnknownExporter(t *testing.T) {
+	_, err := SetupTracing(context.Background(), "carrier-pigeon")
+	if !errors.Is(err, ErrorUnknownExporter) {
+		t.Errorf("Expected ErrorUnknownExporter, got %v", err)
+	}
+}
+
+func TestSetupTracingDisabled(t *testing.T) {
+	shutdown, err := SetupTracing(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("Expected no error shutting down, got %v", err)
+	}
+}
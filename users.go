@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrorForbidden    = errors.New("not allowed")
+	ErrorInvalidUsers = errors.New("invalid users")
+)
+
+type Role string
+
+const (
+	RoleUser  Role = "user"
+	RoleAdmin Role = "admin"
+)
+
+// Account is someone who can log in. Passwords are only ever kept as bcrypt
+// hashes.
+type Account struct {
+	Name         string `json:"-"`
+	PasswordHash string `json:"password"`
+	Role         Role   `json:"role"`
+}
+
+// Compared against when a user doesn't exist, so that takes as long as a
+// wrong password and doesn't give away who has an account
+var missingUserHash, _ = bcrypt.GenerateFromPassword([]byte("file-cloud"), bcrypt.DefaultCost)
+
+// UserStore is the set of accounts, kept in a JSON file keyed by username
+// like:
+//
+//	{"skalnik": {"password": "$2a$10$...", "role": "admin"}}
+//
+// The file can be edited by hand or with the add-user and remove-user
+// commands, and is re-read on SIGHUP.
+type UserStore struct {
+	persisted jsonFile
+	mutex     sync.RWMutex
+	accounts  map[string]Account
+}
+
+// LoadUsers reads the accounts in path. A missing file is fine, and is
+// created when the first user is added.
+func LoadUsers(path string) (*UserStore, error) {
+	users := &UserStore{persisted: jsonFile{path: path}, accounts: map[string]Account{}}
+	if err := users.Reload(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Reload re-reads the file, keeping the current accounts if it's broken. A
+// nil store has nothing to reload.
+func (users *UserStore) Reload() error {
+	if users == nil {
+		return nil
+	}
+
+	content, err := os.ReadFile(users.persisted.path)
+	if errors.Is(err, os.ErrNotExist) {
+		content = []byte("{}")
+	} else if err != nil {
+		return fmt.Errorf("couldn't read users: %w", err)
+	}
+
+	accounts := map[string]Account{}
+	if err := json.Unmarshal(content, &accounts); err != nil {
+		return fmt.Errorf("%w: %w", ErrorInvalidUsers, err)
+	}
+
+	for name, account := range accounts {
+		if err := validateAccount(name, account.Role); err != nil {
+			return err
+		}
+		if _, err := bcrypt.Cost([]byte(account.PasswordHash)); err != nil {
+			return fmt.Errorf("%w: %s's password isn't a bcrypt hash", ErrorInvalidUsers, name)
+		}
+		account.Name = name
+		accounts[name] = account
+	}
+
+	users.mutex.Lock()
+	users.accounts = accounts
+	users.mutex.Unlock()
+
+	return nil
+}
+
+func validateAccount(name string, role Role) error {
+	if name == "" || strings.ContainsAny(name, ": \t\n") {
+		return fmt.Errorf("%w: bad username %q", ErrorInvalidUsers, name)
+	}
+	if role != RoleUser && role != RoleAdmin {
+		return fmt.Errorf("%w: %s's role must be %s or %s, got %q", ErrorInvalidUsers, name, RoleUser, RoleAdmin, role)
+	}
+	return nil
+}
+
+// Len is how many accounts there are. Without any, the store doesn't turn
+// on auth.
+func (users *UserStore) Len() int {
+	if users == nil {
+		return 0
+	}
+
+	users.mutex.RLock()
+	defer users.mutex.RUnlock()
+
+	return len(users.accounts)
+}
+
+// Accounts lists everyone, sorted by name
+func (users *UserStore) Accounts() []Account {
+	if users == nil {
+		return nil
+	}
+
+	users.mutex.RLock()
+	defer users.mutex.RUnlock()
+
+	accounts := make([]Account, 0, len(users.accounts))
+	for _, account := range users.accounts {
+		accounts = append(accounts, account)
+	}
+	slices.SortFunc(accounts, func(a, b Account) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return accounts
+}
+
+// Authenticate checks a username and password, returning the account if
+// they match
+func (users *UserStore) Authenticate(name, password string) (Account, bool) {
+	if users == nil {
+		return Account{}, false
+	}
+
+	users.mutex.RLock()
+	account, found := users.accounts[name]
+	users.mutex.RUnlock()
+
+	if !found {
+		_ = bcrypt.CompareHashAndPassword(missingUserHash, []byte(password))
+		return Account{}, false
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password)) != nil {
+		return Account{}, false
+	}
+
+	return account, true
+}
+
+// SetPassword adds a user, or changes an existing user's password and role,
+// and saves the file
+func (users *UserStore) SetPassword(name, password string, role Role) error {
+	if err := validateAccount(name, role); err != nil {
+		return err
+	}
+	if password == "" {
+		return fmt.Errorf("%w: %s needs a password", ErrorInvalidUsers, name)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrorInvalidUsers, err)
+	}
+
+	users.mutex.Lock()
+	users.accounts[name] = Account{Name: name, PasswordHash: string(hash), Role: role}
+	users.mutex.Unlock()
+
+	return users.save()
+}
+
+// Remove deletes a user and saves the file. Their uploads are left alone.
+func (users *UserStore) Remove(name string) error {
+	users.mutex.Lock()
+	_, found := users.accounts[name]
+	delete(users.accounts, name)
+	users.mutex.Unlock()
+
+	if !found {
+		return fmt.Errorf("%w: no user called %q", ErrorInvalidUsers, name)
+	}
+
+	return users.save()
+}
+
+func (users *UserStore) save() error {
+	err := users.persisted.save(func() any {
+		users.mutex.RLock()
+		defer users.mutex.RUnlock()
+
+		return maps.Clone(users.accounts)
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't save users: %w", err)
+	}
+
+	return nil
+}
+
+type adminKey struct{}
+
+// IsAdmin is whether the user behind a request can manage everyone's
+// uploads, not just their own
+func IsAdmin(ctx context.Context) bool {
+	admin, _ := ctx.Value(adminKey{}).(bool)
+	return admin
+}
+
+func withAccount(ctx context.Context, account Account) context.Context {
+	ctx = withUser(ctx, account.Name)
+	return context.WithValue(ctx, adminKey{}, account.Role == RoleAdmin)
+}
+
+// CanModify is whether the user behind ctx can edit or delete a file: its
+// uploader, or an admin. Files from before uploaders were recorded belong to
+// nobody, so only admins can touch them.
+func CanModify(ctx context.Context, file StoredFile) bool {
+	if IsAdmin(ctx) {
+		return true
+	}
+
+	user := AuthenticatedUser(ctx)
+	return user != "" && user == file.Uploader
+}
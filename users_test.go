@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestUsers makes a store with an admin and a regular user
+func newTestUsers(t *testing.T) *UserStore {
+	t.Helper()
+
+	users, err := LoadUsers(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := users.SetPassword("skalnik", "hunter2", RoleAdmin); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := users.SetPassword("guest", "password1", RoleUser); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	return users
+}
+
+func TestUserStoreAuthenticate(t *testing.T) {
+	users := newTestUsers(t)
+
+	account, ok := users.Authenticate("guest", "password1")
+	if !ok || account.Name != "guest" || account.Role != RoleUser {
+		t.Errorf("Expected guest to log in, got %+v", account)
+	}
+
+	if _, ok := users.Authenticate("guest", "hunter2"); ok {
+		t.Error("Expected someone else's password to be rejected")
+	}
+	if _, ok := users.Authenticate("nobody", "hunter2"); ok {
+		t.Error("Expected a missing user to be rejected")
+	}
+}
+
+func TestUserStorePersisted(t *testing.T) {
+	users := newTestUsers(t)
+
+	content, _ := os.ReadFile(users.persisted.path)
+	if strings.Contains(string(content), "hunter2") {
+		t.Error("Expected only password hashes to be saved")
+	}
+
+	if err := users.Remove("guest"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	reloaded, err := LoadUsers(users.persisted.path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	accounts := reloaded.Accounts()
+	if len(accounts) != 1 || accounts[0].Name != "skalnik" || accounts[0].Role != RoleAdmin {
+		t.Errorf("Expected just skalnik after a reload, got %+v", accounts)
+	}
+
+	if err := reloaded.Remove("guest"); !errors.Is(err, ErrorInvalidUsers) {
+		t.Errorf("Expected ErrorInvalidUsers removing a missing user, got %v", err)
+	}
+}
+
+func TestUserStoreInvalid(t *testing.T) {
+	users := newTestUsers(t)
+
+	if err := users.SetPassword("guest", "password1", "superuser"); !errors.Is(err, ErrorInvalidUsers) {
+		t.Errorf("Expected ErrorInvalidUsers for a bad role, got %v", err)
+	}
+	if err := users.SetPassword("a:b", "password1", RoleUser); !errors.Is(err, ErrorInvalidUsers) {
+		t.Errorf("Expected ErrorInvalidUsers for a bad username, got %v", err)
+	}
+	if err := users.SetPassword("guest", "", RoleUser); !errors.Is(err, ErrorInvalidUsers) {
+		t.Errorf("Expected ErrorInvalidUsers without a password, got %v", err)
+	}
+
+	// A hand edited file with a plain text password is refused, and the
+	// accounts we already had are kept
+	_ = os.WriteFile(users.persisted.path, []byte(`{"guest": {"password": "password1", "role": "user"}}`), 0600)
+	if err := users.Reload(); !errors.Is(err, ErrorInvalidUsers) {
+		t.Errorf("Expected ErrorInvalidUsers for an unhashed password, got %v", err)
+	}
+	if _, ok := users.Authenticate("skalnik", "hunter2"); !ok {
+		t.Error("Expected existing accounts to survive a bad reload")
+	}
+}
+
+func TestCanModify(t *testing.T) {
+	file := StoredFile{Key: "ABCDE", Uploader: "guest"}
+
+	owner := withAccount(context.Background(), Account{Name: "guest", Role: RoleUser})
+	other := withAccount(context.Background(), Account{Name: "someone", Role: RoleUser})
+	admin := withAccount(context.Background(), Account{Name: "skalnik", Role: RoleAdmin})
+
+	if !CanModify(owner, file) {
+		t.Error("Expected the uploader to be able to change their file")
+	}
+	if CanModify(other, file) {
+		t.Error("Expected other users not to be able to change the file")
+	}
+	if !CanModify(admin, file) {
+		t.Error("Expected admins to be able to change anything")
+	}
+	if CanModify(owner, StoredFile{Key: "ABCDE"}) {
+		t.Error("Expected files without an uploader to be admin only")
+	}
+}
+
+type mockOwnedStorage struct {
+	mockStorage
+	deleted string
+}
+
+func (c *mockOwnedStorage) LookupFile(ctx context.Context, prefix string) (*StoredFile, error) {
+	return &StoredFile{Key: "ABCDE", OriginalName: "file.txt", Uploader: "guest"}, nil
+}
+
+func (c *mockOwnedStorage) DeleteFile(ctx context.Context, prefix string) error {
+	c.deleted = prefix
+	return nil
+}
+
+func TestUserAccountsLogin(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockStorage{})
+	server.SetUsers(newTestUsers(t))
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Code != http.StatusUnauthorized {
+		t.Errorf(`Expected accounts to turn on auth, but instead got %d`, responseRecorder.Code)
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/", nil)
+	request.SetBasicAuth("guest", "password1")
+	responseRecorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Code != http.StatusOK {
+		t.Errorf(`Expected 200 OK, but instead got %d`, responseRecorder.Code)
+	}
+
+	// Share links stay public
+	request = httptest.NewRequest(http.MethodGet, "/ABCDE", nil)
+	responseRecorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Code != http.StatusOK {
+		t.Errorf(`Expected 200 OK viewing a file anonymously, but instead got %d`, responseRecorder.Code)
+	}
+}
+
+func TestUpdateAPIHandlerNotOwner(t *testing.T) {
+	storage := &mockOwnedStorage{}
+	server := NewWebServer("", "", "", "", storage)
+	server.SetUsers(newTestUsers(t))
+	if err := server.users.SetPassword("someone", "password2", RoleUser); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	request := httptest.NewRequest(http.MethodPatch, "/api/files/ABCDE", strings.NewReader(`{"tags": ["mine"]}`))
+	request.SetBasicAuth("someone", "password2")
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	if responseRecorder.Code != http.StatusForbidden {
+		t.Errorf(`Expected 403, but instead got %d`, responseRecorder.Code)
+	}
+	if storage.updated != nil {
+		t.Error("Expected the file not to be updated")
+	}
+
+	request = httptest.NewRequest(http.MethodPatch, "/api/files/ABCDE", strings.NewReader(`{"tags": ["mine"]}`))
+	request.SetBasicAuth("guest", "password1")
+	responseRecorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	if responseRecorder.Code != http.StatusOK {
+		t.Errorf(`Expected the uploader to get 200 OK, but instead got %d`, responseRecorder.Code)
+	}
+}
+
+func TestEditHandlerNotOwner(t *testing.T) {
+	server := NewWebServer("", "", "", "", &mockOwnedStorage{})
+	server.SetUsers(newTestUsers(t))
+	_ = server.users.SetPassword("someone", "password2", RoleUser)
+
+	request := httptest.NewRequest(http.MethodGet, "/ABCDE/edit", nil)
+	request.SetBasicAuth("someone", "password2")
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	if responseRecorder.Code != http.StatusForbidden {
+		t.Errorf(`Expected 403, but instead got %d`, responseRecorder.Code)
+	}
+}
+
+func TestDeleteAPIHandler(t *testing.T) {
+	storage := &mockOwnedStorage{}
+	server := NewWebServer("", "", "", "", storage)
+	server.SetUsers(newTestUsers(t))
+	server.Search.Add(StoredFile{Key: "ABCDE", OriginalName: "file.txt"})
+
+	request := httptest.NewRequest(http.MethodDelete, "/api/files/ABCDE", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Code != http.StatusUnauthorized {
+		t.Errorf(`Expected 401, but instead got %d`, responseRecorder.Code)
+	}
+
+	// An admin can delete anyone's file
+	request = httptest.NewRequest(http.MethodDelete, "/api/files/ABCDE", nil)
+	request.SetBasicAuth("skalnik", "hunter2")
+	responseRecorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	if responseRecorder.Code != http.StatusNoContent {
+		t.Errorf(`Expected 204, but instead got %d`, responseRecorder.Code)
+	}
+	if storage.deleted != "ABCDE" {
+		t.Errorf("Expected ABCDE to be deleted, got %q", storage.deleted)
+	}
+	if _, found := server.Search.Get("ABCDE"); found {
+		t.Error("Expected the file to be dropped from search")
+	}
+}
+
+func TestDeleteHandlerWithoutAuth(t *testing.T) {
+	storage := &mockOwnedStorage{}
+	server := NewWebServer("", "", "", "", storage)
+
+	request := httptest.NewRequest(http.MethodPost, "/ABCDE/delete", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	if responseRecorder.Code != http.StatusSeeOther {
+		t.Errorf(`Expected 303, but instead got %d`, responseRecorder.Code)
+	}
+	if storage.deleted != "ABCDE" {
+		t.Errorf("Expected anyone to be able to delete without auth, got %q", storage.deleted)
+	}
+}
+
+func TestSharedLoginIsAdmin(t *testing.T) {
+	storage := &mockOwnedStorage{}
+	server := NewWebServer("owner", "sekrit", "", "", storage)
+	server.SetUsers(newTestUsers(t))
+
+	request := httptest.NewRequest(http.MethodDelete, "/api/files/ABCDE", nil)
+	request.SetBasicAuth("owner", "sekrit")
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	if responseRecorder.Code != http.StatusNoContent {
+		t.Errorf(`Expected 204, but instead got %d`, responseRecorder.Code)
+	}
+}
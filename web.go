@@ -1,22 +1,30 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/subtle"
+	"crypto/tls"
 	"embed"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //go:embed templates/*
@@ -31,78 +39,301 @@ type Router interface {
 }
 
 type WebServer struct {
-	User       string
-	Pass       string
-	Port       string
-	Plausible  string // Plausible domain
-	Router     Router
-	storage    StorageClient
-	httpClient *http.Client
+	// User, Pass and Plausible can be swapped out by Reload while we're
+	// serving, so read them through credentials and plausibleDomain
+	User      string
+	Pass      string
+	Plausible string // Plausible domain
+	settings  sync.RWMutex
+
+	Port     string
+	Listener net.Listener // optional, defaults to TCP on Port
+	Router   Router
+	Search   *SearchIndex
+	Controls *FileControls
+	Stats    *FileStats
+	storage  StorageClient
+	logger   *LoggingMiddleware
+
+	uploadLimits   UploadLimits
+	rateLimiters   map[string]*RateLimiter
+	trustedProxies TrustedProxies
+	quotas         *Quotas
+	users          *UserStore
+	webhooks       *Webhooks
+	scanner        *ClamdScanner // only checked for readiness, storage scans
+	publicURL      string
+	crossOrigin    *http.CrossOriginProtection
+
+	analytics       *Analytics
+	plausibleScript string
+
+	// Set up by EnableTLS
+	tlsConfig    *tls.Config
+	redirect     http.Handler
+	redirectPort string
 }
 
-const plausibleAPIURL = "https://plausible.io/api/event"
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+
+	// How many pages of S3 listing one filtered page can go through before
+	// handing back a cursor to carry on from
+	maxFilteredListings = 10
+)
+
+var ErrorBadRequest = errors.New("bad request")
+
+// Not a real status, but nginx's convention for a client that hung up before
+// we could respond
+const statusClientClosedRequest = 499
 
 func NewWebServer(user string, pass string, port string, plausible string, storage StorageClient) *WebServer {
 	webServer := &WebServer{
-		User:      user,
-		Pass:      pass,
-		Port:      port,
-		Plausible: plausible,
-		storage:   storage,
-		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
-		},
+		User:            user,
+		Pass:            pass,
+		Port:            port,
+		Plausible:       plausible,
+		storage:         storage,
+		uploadLimits:    UploadLimits{Memory: defaultUploadMemory},
+		plausibleScript: plausibleScriptURL(plausibleAPIURL),
 	}
 
+	// Without a path these can't fail to load
+	webServer.Search, _ = NewSearchIndex("")
+	webServer.Controls, _ = NewFileControls("")
+	webServer.Stats, _ = NewFileStats("", nil)
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /ping", webServer.Heartbeat)
 	mux.HandleFunc("HEAD /ping", webServer.Heartbeat)
+	mux.Handle("GET /metrics", registry)
+	mux.HandleFunc("GET /healthz/ready", webServer.ReadyHandler)
 
-	mux.Handle("GET /static/", http.FileServer(http.FS(static)))
-	mux.HandleFunc("GET /{key}", webServer.LookupHandler)
+	mux.Handle("GET /static/{file}", http.FileServer(http.FS(static)))
+	mux.HandleFunc("GET /{key}", webServer.rateLimited("lookup", webServer.LookupHandler))
+	mux.HandleFunc("GET /{key}/{action}", webServer.rateLimited("lookup", webServer.FileActionHandler))
+	mux.HandleFunc("GET /oembed", webServer.rateLimited("lookup", webServer.OEmbedHandler))
 
 	if webServer.User == "" && webServer.Pass == "" {
 		slog.Info("Setting up without auth")
-		mux.HandleFunc("GET /", webServer.IndexHandler)
-		mux.HandleFunc("POST /", webServer.UploadHandler)
 	} else {
 		slog.Info("Setting up with basic auth")
-		mux.HandleFunc("GET /", webServer.BasicAuthWrapper(webServer.IndexHandler))
-		mux.HandleFunc("POST /", webServer.BasicAuthWrapper(webServer.UploadHandler))
 	}
 
-	webServer.Router = NewLogger(mux)
+	mux.HandleFunc("GET /", webServer.authenticated(webServer.IndexHandler))
+	mux.HandleFunc("POST /", webServer.authenticated(webServer.rateLimited("upload", webServer.UploadHandler)))
+	mux.HandleFunc("GET /browse", webServer.authenticated(webServer.BrowseHandler))
+	mux.HandleFunc("GET /api/files", webServer.authenticated(webServer.ListFilesHandler))
+	mux.HandleFunc("GET /api/usage", webServer.authenticated(webServer.UsageHandler))
+	mux.HandleFunc("GET /search", webServer.authenticated(webServer.SearchHandler))
+	mux.HandleFunc("GET /api/search", webServer.authenticated(webServer.SearchAPIHandler))
+	mux.HandleFunc("POST /{key}/edit", webServer.authenticated(webServer.UpdateHandler))
+	mux.HandleFunc("PATCH /api/files/{key}", webServer.authenticated(webServer.UpdateAPIHandler))
+	mux.HandleFunc("POST /{key}/delete", webServer.authenticated(webServer.DeleteHandler))
+	mux.HandleFunc("DELETE /api/files/{key}", webServer.authenticated(webServer.DeleteAPIHandler))
+	mux.HandleFunc("POST /{key}/expire", webServer.authenticated(webServer.ExpireHandler))
+	mux.HandleFunc("GET /admin", webServer.adminOnly(webServer.AdminHandler))
+	mux.HandleFunc("POST /admin/files/{key}/{action}", webServer.adminOnly(webServer.AdminFileActionHandler))
+
+	// Browsers send basic auth along with forms posted from other sites, so
+	// anything that changes something has to come from one of our own pages
+	webServer.crossOrigin = http.NewCrossOriginProtection()
+	webServer.crossOrigin.SetDenyHandler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		webServer.ServeError(writer, request, fmt.Errorf("%w: cross origin %s", ErrorForbidden, request.Method))
+	}))
+
+	webServer.logger = NewLogger(NewTracing(webServer.crossOrigin.Handler(mux)))
+	webServer.Router = webServer.logger
 
 	return webServer
 }
 
+// SetAccessLog sends a line per request to an access log, on top of the app
+// logs. It should be called before Start.
+func (webServer *WebServer) SetAccessLog(accessLog *AccessLog) {
+	webServer.logger.AccessLog = accessLog
+}
+
+// SetUploadLimits caps upload sizes. It should be called before Start.
+func (webServer *WebServer) SetUploadLimits(limits UploadLimits) {
+	webServer.uploadLimits = limits
+}
+
+// SetRateLimits limits how often each client can hit a route, with clients
+// behind trustedProxies told apart by the headers those proxies add. It
+// should be called before Start.
+func (webServer *WebServer) SetRateLimits(limits map[string]RateLimit, trustedProxies TrustedProxies) {
+	webServer.rateLimiters = map[string]*RateLimiter{}
+	for route, limit := range limits {
+		webServer.rateLimiters[route] = NewRateLimiter(limit)
+	}
+	webServer.trustedProxies = trustedProxies
+}
+
+// SetQuotas shows users how much of their quota they've used. The quotas are
+// enforced by storage. It should be called before Start.
+func (webServer *WebServer) SetQuotas(quotas *Quotas) {
+	webServer.quotas = quotas
+}
+
+// SetScanner reports whether clamd is up in readiness checks, as uploads
+// can't be stored without it
+func (webServer *WebServer) SetScanner(scanner *ClamdScanner) {
+	webServer.scanner = scanner
+}
+
+// SetUsers lets everyone in users log in, on top of the shared username and
+// password if there is one. It should be called before Start.
+func (webServer *WebServer) SetUsers(users *UserStore) {
+	webServer.users = users
+	if users.Len() > 0 {
+		slog.Info("Setting up with user accounts", "users", users.Len())
+	}
+}
+
+// SetWebhooks sends file events to webhooks, with links to publicURL, or to
+// whichever host the request came in on without one. It should be called
+// before Start.
+func (webServer *WebServer) SetWebhooks(webhooks *Webhooks, publicURL string) {
+	webServer.webhooks = webhooks
+	webServer.publicURL = strings.TrimSuffix(publicURL, "/")
+	if webServer.publicURL != "" {
+		// A proxy in front may not pass the public host along
+		if err := webServer.crossOrigin.AddTrustedOrigin(webServer.publicURL); err != nil {
+			slog.Warn("Public URL can't be trusted as an origin", "url", webServer.publicURL, "error", err)
+		}
+	}
+	if webhooks != nil {
+		slog.Info("Setting up with webhooks", "webhooks", len(webhooks.URLs))
+	}
+}
+
+// SetAnalytics sends page views to analytics sinks, with the Plausible
+// tracking script loaded from plausibleScript. It should be called before
+// Start.
+func (webServer *WebServer) SetAnalytics(analytics *Analytics, plausibleScript string) {
+	webServer.analytics = analytics
+	webServer.plausibleScript = plausibleScript
+}
+
+// usageReport is how much the user behind a request has stored, or nil
+// without quotas
+func (webServer *WebServer) usageReport(request *http.Request) *usageReport {
+	if webServer.quotas == nil {
+		return nil
+	}
+
+	user := AuthenticatedUser(request.Context())
+	return &usageReport{
+		User:  user,
+		Used:  webServer.quotas.Usage(user),
+		Quota: webServer.quotas.Limit(user),
+	}
+}
+
+// uploadLimit is the most the user behind a request can upload, or zero for
+// no limit
+func (webServer *WebServer) uploadLimit(request *http.Request) int64 {
+	return webServer.uploadLimits.For(AuthenticatedUser(request.Context()))
+}
+
 func (webServer *WebServer) Start() {
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%s", webServer.Port),
-		Handler: webServer.Router,
+		Addr:      fmt.Sprintf(":%s", webServer.Port),
+		Handler:   webServer.Router,
+		TLSConfig: webServer.tlsConfig,
 	}
 
 	// Channel to listen for shutdown signals
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
 
+	if webServer.Listener == nil {
+		var err error
+		webServer.Listener, err = net.Listen("tcp", server.Addr)
+		if err != nil {
+			slog.Error("Failed to listen", "address", server.Addr, "error", err)
+			os.Exit(1)
+		}
+	}
+	listener := webServer.Listener
+
 	// Start server in a goroutine
 	go func() {
-		slog.Info("Listening", "port", webServer.Port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if server.TLSConfig != nil {
+			slog.Info("Listening with TLS", "address", listener.Addr())
+			// Certificates come from the TLS config
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			slog.Info("Listening", "address", listener.Addr())
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			slog.Error("Server error", "error", err)
 			os.Exit(1)
 		}
 	}()
 
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	var backgroundWork sync.WaitGroup
+	backgroundWork.Go(func() { webServer.sweepExpired(background, expirySweepInterval) })
+	backgroundWork.Go(func() { webServer.webhooks.Run(background) })
+	backgroundWork.Go(func() { webServer.analytics.Run(background) })
+	backgroundWork.Go(func() { webServer.Stats.Run(background) })
+
+	var redirectServer *http.Server
+	if webServer.redirect != nil {
+		redirectServer = &http.Server{
+			Addr:              fmt.Sprintf(":%s", webServer.redirectPort),
+			Handler:           webServer.redirect,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		go func() {
+			slog.Info("Redirecting HTTP to HTTPS", "port", webServer.redirectPort)
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("Redirect server error", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
 	<-shutdown
 	slog.Info("Shutting down...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	if err := server.Shutdown(ctx); err != nil {
-		slog.Error("Shutdown error", "error", err)
+	if redirectServer != nil {
+		if err := redirectServer.Shutdown(ctx); err != nil {
+			slog.Error("Redirect server shutdown error", "error", err)
+		}
+	}
+
+	shutdownErr := server.Shutdown(ctx)
+	if shutdownErr != nil {
+		slog.Error("Shutdown error", "error", shutdownErr)
+	}
+
+	// Requests are done so nothing more will be queued, and the analytics
+	// and webhooks still queued get the rest of ctx to be sent
+	stopBackground()
+	drained := make(chan struct{})
+	go func() {
+		backgroundWork.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		slog.Error("Gave up waiting for analytics and webhooks to be sent")
+	}
+
+	if shutdownErr != nil {
 		os.Exit(1)
 	}
 
@@ -111,23 +342,91 @@ func (webServer *WebServer) Start() {
 
 // validateBasicAuth performs constant-time comparison of credentials to prevent timing attacks
 func (webServer *WebServer) validateBasicAuth(user, pass string) bool {
-	userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(webServer.User))
-	passMatch := subtle.ConstantTimeCompare([]byte(pass), []byte(webServer.Pass))
+	expectedUser, expectedPass := webServer.credentials()
+	userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(expectedUser))
+	passMatch := subtle.ConstantTimeCompare([]byte(pass), []byte(expectedPass))
 	return userMatch == 1 && passMatch == 1
 }
 
+// authenticated puts a handler behind basic auth, if any credentials are
+// configured. That's checked per request since a reload can turn auth on or
+// off.
+func (webServer *WebServer) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	protected := webServer.BasicAuthWrapper(next)
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if !webServer.authEnabled() {
+			next(writer, request)
+			return
+		}
+		protected(writer, request)
+	}
+}
+
+// authEnabled is whether there's a shared username and password or any user
+// accounts to log in with
+func (webServer *WebServer) authEnabled() bool {
+	user, pass := webServer.credentials()
+	return user != "" || pass != "" || webServer.users.Len() > 0
+}
+
+// login checks basic auth credentials against the shared username and
+// password, then the user accounts. The shared login predates accounts and
+// could always do anything, so it's an admin.
+func (webServer *WebServer) login(user, pass string) (Account, bool) {
+	if expectedUser, expectedPass := webServer.credentials(); expectedUser != "" || expectedPass != "" {
+		if webServer.validateBasicAuth(user, pass) {
+			return Account{Name: user, Role: RoleAdmin}, true
+		}
+	}
+
+	return webServer.users.Authenticate(user, pass)
+}
+
+func (webServer *WebServer) credentials() (string, string) {
+	webServer.settings.RLock()
+	defer webServer.settings.RUnlock()
+
+	return webServer.User, webServer.Pass
+}
+
+func (webServer *WebServer) plausibleDomain() string {
+	webServer.settings.RLock()
+	defer webServer.settings.RUnlock()
+
+	return webServer.Plausible
+}
+
+// Reload swaps in new credentials and Plausible domain without restarting,
+// so requests in flight aren't dropped
+func (webServer *WebServer) Reload(user string, pass string, plausible string) {
+	webServer.settings.Lock()
+	defer webServer.settings.Unlock()
+
+	if user != webServer.User || pass != webServer.Pass {
+		slog.Info("Reloaded basic auth credentials", "enabled", user != "" || pass != "")
+	}
+	if plausible != webServer.Plausible {
+		slog.Info("Reloaded Plausible domain", "domain", plausible)
+	}
+
+	webServer.User = user
+	webServer.Pass = pass
+	webServer.Plausible = plausible
+}
+
 func (webServer *WebServer) BasicAuthWrapper(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		user, pass, ok := request.BasicAuth()
 
 		if !ok {
-			slog.Debug("Couldn't parse basic auth")
+			slog.DebugContext(request.Context(), "Couldn't parse basic auth")
 		} else {
-			if webServer.validateBasicAuth(user, pass) {
-				next.ServeHTTP(writer, request)
+			if account, ok := webServer.login(user, pass); ok {
+				next.ServeHTTP(writer, request.WithContext(withAccount(request.Context(), account)))
 				return
 			}
-			slog.Warn("Incorrect authentication provided")
+			slog.WarnContext(request.Context(), "Incorrect authentication provided")
 		}
 
 		writer.Header().Set("WWW-Authenticate", `Basic realm="File Cloud", charset="UTF-8"`)
@@ -141,46 +440,451 @@ func (webServer *WebServer) Heartbeat(writer http.ResponseWriter, request *http.
 	if request.Method != http.MethodHead {
 		_, err := writer.Write([]byte("."))
 		if err != nil {
-			slog.Error("Error writing heartbeat response", "error", err)
+			slog.ErrorContext(request.Context(), "Error writing heartbeat response", "error", err)
 		}
 	}
 }
 
 func (webServer *WebServer) IndexHandler(writer http.ResponseWriter, request *http.Request) {
-	webServer.ServeTemplate(writer, nil, "index", StoredFile{})
+	webServer.ServePage(writer, request, "index", templateData{
+		MaxUploadSize: webServer.uploadLimit(request),
+		Usage:         webServer.usageReport(request),
+	})
+}
+
+func (webServer *WebServer) UsageHandler(writer http.ResponseWriter, request *http.Request) {
+	report := webServer.usageReport(request)
+	if report == nil {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusNotFound)
+		webServer.ServeJSON(writer, request, errorResponse{Error: "quotas aren't enabled"})
+		return
+	}
+
+	webServer.ServeJSON(writer, request, report)
 }
 
 func (webServer *WebServer) UploadHandler(writer http.ResponseWriter, request *http.Request) {
+	limit := webServer.uploadLimit(request)
+	if limit > 0 {
+		// Don't bother reading anything if we've been told up front it's too
+		// big, otherwise cut it off once it turns out to be
+		if request.ContentLength > limit+uploadFormOverhead {
+			webServer.ServeError(writer, request, ErrorUploadTooLarge)
+			return
+		}
+		request.Body = http.MaxBytesReader(writer, request.Body, limit+uploadFormOverhead)
+	}
+
+	err := request.ParseMultipartForm(webServer.uploadLimits.Memory)
+	if maxBytesError := new(http.MaxBytesError); errors.As(err, &maxBytesError) {
+		err = ErrorUploadTooLarge
+	}
+	if err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
 	file, header, err := request.FormFile("file")
 	if err != nil {
-		webServer.ServeError(writer, err)
+		webServer.ServeError(writer, request, err)
 		return
 	}
 	defer func() {
 		err := file.Close()
 		if err != nil {
-			slog.Error("Error closing uploaded file", "error", err)
+			slog.ErrorContext(request.Context(), "Error closing uploaded file", "error", err)
 		}
 	}()
 
-	url, err := webServer.storage.UploadFile(file, *header)
+	if limit > 0 && header.Size > limit {
+		webServer.ServeError(writer, request, ErrorUploadTooLarge)
+		return
+	}
+
+	details := FileDetails{
+		Tags:        ParseTags(request.FormValue("tags")),
+		Description: request.FormValue("description"),
+	}
+
+	url, stored, err := webServer.storage.UploadFile(request.Context(), file, *header, details)
 
 	if err != nil {
-		webServer.ServeError(writer, err)
+		webServer.ServeError(writer, request, err)
 	} else {
+		key := strings.TrimPrefix(url, "/")
+		uploaded := webServer.reindex(request.Context(), key)
+		if uploaded == nil {
+			uploaded = &StoredFile{Key: key, OriginalName: header.Filename, Size: header.Size}
+		}
+		// Re-uploading a file we already have doesn't upload anything
+		if stored {
+			webServer.notify(request, EventFileUploaded, *uploaded)
+		}
+
 		writer.Header().Set("Content-Type", "application/json")
 		_, err := fmt.Fprintf(writer, "{\"url\":\"%s\"}", url)
 		if err != nil {
-			slog.Error("Error writing JSON response", "error", err)
+			slog.ErrorContext(request.Context(), "Error writing JSON response", "error", err)
+		}
+	}
+}
+
+// reindex refreshes a file in the search index after it's uploaded or
+// edited, returning it. Failing to index shouldn't fail the request, since
+// the index can be rebuilt, so this returns nil instead.
+func (webServer *WebServer) reindex(ctx context.Context, key string) *StoredFile {
+	file, err := webServer.storage.LookupFile(ctx, key)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error indexing file", "key", key, "error", err)
+		return nil
+	}
+
+	webServer.Search.Add(*file)
+	return file
+}
+
+// notify sends an event about a file to any webhooks. The request is only
+// used to link to the file, and can be nil for events we cause ourselves.
+func (webServer *WebServer) notify(request *http.Request, event string, file StoredFile) {
+	ctx := context.Background()
+	if request != nil {
+		ctx = request.Context()
+	}
+
+	webServer.webhooks.Send(ctx, newWebhookEvent(event, file, webServer.shortURL(request, file.Key)))
+}
+
+// shortURL is the full link to a file's page
+func (webServer *WebServer) shortURL(request *http.Request, key string) string {
+	return fmt.Sprintf("%s/%s", webServer.baseURL(request), key)
+}
+
+// directURL is the full direct link to a file, which unlike its presigned
+// URL doesn't expire
+func (webServer *WebServer) directURL(request *http.Request, file StoredFile) string {
+	return webServer.shortURL(request, file.Key) + strings.ToLower(filepath.Ext(file.OriginalName))
+}
+
+// baseURL is where File Cloud is reached, without a trailing slash: the
+// public URL, or whichever host the request came in on. It's blank without
+// either, leaving links relative.
+func (webServer *WebServer) baseURL(request *http.Request) string {
+	switch {
+	case webServer.publicURL != "":
+		return webServer.publicURL
+	case request != nil && request.Host != "":
+		return "https://" + request.Host
+	default:
+		return ""
+	}
+}
+
+// FileActionHandler routes GET /{key}/{action} pages. They can't be
+// registered individually as they'd conflict with /static/{file}.
+func (webServer *WebServer) FileActionHandler(writer http.ResponseWriter, request *http.Request) {
+	switch request.PathValue("action") {
+	case "edit":
+		webServer.authenticated(webServer.EditHandler)(writer, request)
+	case "stats":
+		webServer.authenticated(webServer.StatsHandler)(writer, request)
+	default:
+		webServer.ServeError(writer, request, ErrorObjectMissing)
+	}
+}
+
+// ownedFile looks up a file the user behind a request wants to change,
+// making sure it's theirs. Without auth anyone can change anything.
+func (webServer *WebServer) ownedFile(request *http.Request, key string) (*StoredFile, error) {
+	file, err := webServer.storage.LookupFile(request.Context(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	if webServer.authEnabled() && !CanModify(request.Context(), *file) {
+		return nil, fmt.Errorf("%w: %s didn't upload %s", ErrorForbidden, AuthenticatedUser(request.Context()), key)
+	}
+
+	return file, nil
+}
+
+func (webServer *WebServer) EditHandler(writer http.ResponseWriter, request *http.Request) {
+	file, err := webServer.ownedFile(request, request.PathValue("key"))
+	if err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	webServer.ServePage(writer, request, "edit", templateData{
+		StoredFile: *file,
+		Control:    webServer.Controls.Get(file.Key),
+	})
+}
+
+func (webServer *WebServer) UpdateHandler(writer http.ResponseWriter, request *http.Request) {
+	key := request.PathValue("key")
+
+	if _, err := webServer.ownedFile(request, key); err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	details := FileDetails{
+		Tags:        ParseTags(request.FormValue("tags")),
+		Description: request.FormValue("description"),
+	}
+
+	err := webServer.storage.UpdateFile(request.Context(), key, details)
+	if err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	webServer.reindex(request.Context(), key)
+
+	http.Redirect(writer, request, "/"+key, http.StatusSeeOther)
+}
+
+func (webServer *WebServer) UpdateAPIHandler(writer http.ResponseWriter, request *http.Request) {
+	key := request.PathValue("key")
+
+	if _, err := webServer.ownedFile(request, key); err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	var details FileDetails
+	err := json.NewDecoder(request.Body).Decode(&details)
+	if err != nil {
+		webServer.ServeError(writer, request, fmt.Errorf("%w: %w", ErrorBadRequest, err))
+		return
+	}
+
+	err = webServer.storage.UpdateFile(request.Context(), key, details)
+	if err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	file, err := webServer.storage.LookupFile(request.Context(), key)
+	if err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	webServer.Search.Add(*file)
+	webServer.ServeJSON(writer, request, file)
+}
+
+// deleteFile removes a file the user behind a request owns from storage and
+// the search index
+func (webServer *WebServer) deleteFile(request *http.Request, key string) error {
+	file, err := webServer.ownedFile(request, key)
+	if err != nil {
+		return err
+	}
+
+	if err := webServer.storage.DeleteFile(request.Context(), key); err != nil {
+		return err
+	}
+
+	webServer.forgetFile(file.Key)
+	webServer.notify(request, EventFileDeleted, *file)
+	slog.InfoContext(request.Context(), "Deleted file", "key", key, "user", AuthenticatedUser(request.Context()))
+
+	return nil
+}
+
+func (webServer *WebServer) DeleteHandler(writer http.ResponseWriter, request *http.Request) {
+	if err := webServer.deleteFile(request, request.PathValue("key")); err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	redirectBack(writer, request, "/")
+}
+
+func (webServer *WebServer) DeleteAPIHandler(writer http.ResponseWriter, request *http.Request) {
+	if err := webServer.deleteFile(request, request.PathValue("key")); err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (webServer *WebServer) SearchHandler(writer http.ResponseWriter, request *http.Request) {
+	page, err := webServer.searchPage(request, maxPageSize)
+	if err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	webServer.ServePage(writer, request, "search", templateData{Listing: page})
+}
+
+func (webServer *WebServer) SearchAPIHandler(writer http.ResponseWriter, request *http.Request) {
+	limit := defaultPageSize
+	if rawLimit := request.URL.Query().Get("limit"); rawLimit != "" {
+		parsed, err := strconv.Atoi(rawLimit)
+		if err != nil || parsed < 1 || parsed > maxPageSize {
+			webServer.ServeError(writer, request, fmt.Errorf("%w: limit must be between 1 and %d", ErrorBadRequest, maxPageSize))
+			return
+		}
+		limit = parsed
+	}
+
+	page, err := webServer.searchPage(request, limit)
+	if err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	webServer.ServeJSON(writer, request, FileListing{Files: page.Files})
+}
+
+// searchPage runs the query from the request, applying any kind or tag
+// filters before the limit
+func (webServer *WebServer) searchPage(request *http.Request, limit int) (*listingPage, error) {
+	query := request.URL.Query()
+
+	page := &listingPage{
+		Query: query.Get("q"),
+		Kind:  query.Get("kind"),
+		Tag:   query.Get("tag"),
+	}
+
+	files, err := page.filterFiles(webServer.Search.Search(page.Query, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) > limit {
+		files = files[:limit]
+	}
+	page.Files = files
+
+	return page, nil
+}
+
+func (webServer *WebServer) BrowseHandler(writer http.ResponseWriter, request *http.Request) {
+	page, err := webServer.listingPage(request)
+	if err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	webServer.ServePage(writer, request, "browse", templateData{Listing: page})
+}
+
+func (webServer *WebServer) ListFilesHandler(writer http.ResponseWriter, request *http.Request) {
+	page, err := webServer.listingPage(request)
+	if err != nil {
+		webServer.ServeError(writer, request, err)
+		return
+	}
+
+	webServer.ServeJSON(writer, request, FileListing{
+		Files:     page.Files,
+		NextToken: page.NextToken,
+	})
+}
+
+// listingPage fetches a page of files and applies the kind filter and sort
+// order from the query string. Sorting only applies within a page, since S3
+// lists objects in key (i.e. hash) order.
+func (webServer *WebServer) listingPage(request *http.Request) (*listingPage, error) {
+	query := request.URL.Query()
+
+	limit := int64(defaultPageSize)
+	if rawLimit := query.Get("limit"); rawLimit != "" {
+		parsed, err := strconv.ParseInt(rawLimit, 10, 32)
+		if err != nil || parsed < 1 || parsed > maxPageSize {
+			return nil, fmt.Errorf("%w: limit must be between 1 and %d", ErrorBadRequest, maxPageSize)
+		}
+		limit = parsed
+	}
+
+	page := &listingPage{
+		Sort:  query.Get("sort"),
+		Order: query.Get("order"),
+		Kind:  query.Get("kind"),
+		Tag:   query.Get("tag"),
+	}
+
+	if page.Sort == "" {
+		page.Sort = "date"
+	}
+	if page.Order == "" {
+		page.Order = "desc"
+	}
+
+	if !slices.Contains([]string{"name", "size", "date"}, page.Sort) {
+		return nil, fmt.Errorf("%w: sort must be one of name, size or date", ErrorBadRequest)
+	}
+	if page.Order != "asc" && page.Order != "desc" {
+		return nil, fmt.Errorf("%w: order must be asc or desc", ErrorBadRequest)
+	}
+
+	// Filters are applied a page of S3 listing at a time, so keep listing
+	// until there's a full page of matches, nothing left to list, or we've
+	// listed as much as one request is allowed to. Whole pages are kept, as
+	// the cursor can't point partway into one, so a filtered page can run a
+	// little over the limit.
+	page.Files = []StoredFile{}
+	cursor := query.Get("cursor")
+	for listed := 0; ; listed++ {
+		listing, err := webServer.storage.ListFiles(request.Context(), cursor, int32(limit))
+		if err != nil {
+			return nil, err
+		}
+
+		// S3 listings don't include metadata, tags or content types, so fill
+		// them in from the search index. That includes when files were
+		// uploaded, as editing a description resets LastModified, and their
+		// sniffed content type rather than one guessed from the extension.
+		for i, file := range listing.Files {
+			if indexed, found := webServer.Search.Get(file.Key); found {
+				listing.Files[i].Tags = indexed.Tags
+				listing.Files[i].Description = indexed.Description
+				if !indexed.UploadedAt.IsZero() {
+					listing.Files[i].UploadedAt = indexed.UploadedAt
+				}
+				if indexed.ContentType != "" {
+					listing.Files[i].ContentType = indexed.ContentType
+					listing.Files[i].Kind = indexed.Kind
+				}
+			}
+		}
+
+		files, err := page.filterFiles(listing.Files)
+		if err != nil {
+			return nil, err
 		}
+
+		page.Files = append(page.Files, files...)
+		page.NextToken = listing.NextToken
+		if !page.filtered() || listing.NextToken == "" || int64(len(page.Files)) >= limit || listed+1 >= maxFilteredListings {
+			break
+		}
+		cursor = listing.NextToken
 	}
+
+	sortFiles(page.Files, page.Sort, page.Order)
+
+	return page, nil
 }
 
 func (webServer *WebServer) LookupHandler(writer http.ResponseWriter, request *http.Request) {
 	key := request.PathValue("key")
 
 	if len(key) < keyLength {
-		webServer.ServeError(writer, ErrorObjectMissing)
+		webServer.ServeError(writer, request, ErrorObjectMissing)
+		return
+	}
+
+	if err := webServer.Controls.Available(key[:keyLength]); err != nil {
+		webServer.ServeError(writer, request, err)
 		return
 	}
 
@@ -194,114 +898,237 @@ func (webServer *WebServer) LookupHandler(writer http.ResponseWriter, request *h
 		return
 	}
 
-	file, err := webServer.storage.LookupFile(key)
+	file, err := webServer.storage.LookupFile(request.Context(), key)
 	if err != nil {
-		webServer.ServeError(writer, err)
+		webServer.ServeError(writer, request, err)
 		return
 	}
 
-	webServer.ServeTemplate(writer, request, "file", *file)
+	webServer.track(request, EventPageview, *file)
+	if previewable(*file) {
+		webServer.track(request, EventPreview, *file)
+	}
+
+	webServer.ServePage(writer, request, "file", templateData{
+		StoredFile:    *file,
+		ServerTracked: webServer.analytics != nil,
+		OEmbedURL:     webServer.oEmbedURL(request, file.Key),
+	})
 }
 
 func (webServer *WebServer) DirectHandler(writer http.ResponseWriter, request *http.Request, key string, ext string) {
-	file, err := webServer.storage.LookupFile(key)
+	file, err := webServer.storage.LookupFile(request.Context(), key)
 	if err != nil {
-		webServer.ServeError(writer, err)
+		webServer.ServeError(writer, request, err)
 		return
 	}
 
 	fileExt := strings.ToLower(filepath.Ext(file.OriginalName))
 	if fileExt != "."+ext {
-		webServer.ServeError(writer, ErrorObjectMissing)
+		webServer.ServeError(writer, request, ErrorObjectMissing)
 		return
 	}
 
-	if len(webServer.Plausible) > 0 {
-		webServer.logPlausibleEvent(*request, plausibleAPIURL)
-	}
+	webServer.track(request, EventPageview, *file)
+	webServer.track(request, EventDownload, *file)
 
 	http.Redirect(writer, request, file.Url, http.StatusMovedPermanently)
 }
 
-func (webServer *WebServer) ServeError(writer http.ResponseWriter, err error) {
-	slog.Error("Request error", "error", err)
+func (webServer *WebServer) ServeError(writer http.ResponseWriter, request *http.Request, err error) {
+	// Nobody's around to read a response, so there's nothing to do but note
+	// it for the logs and metrics
+	if errors.Is(err, context.Canceled) && request.Context().Err() != nil {
+		slog.InfoContext(request.Context(), "Client went away", "error", err)
+		writer.WriteHeader(statusClientClosedRequest)
+		return
+	}
 
-	if errors.Is(err, ErrorObjectMissing) {
-		writer.WriteHeader(http.StatusNotFound)
-		webServer.ServeTemplate(writer, nil, "404", StoredFile{})
-	} else {
-		http.Error(writer, err.Error(), http.StatusInternalServerError)
+	// Expected under load, and a client hammering us shouldn't flood the
+	// logs with errors
+	if errors.Is(err, ErrorRateLimited) {
+		slog.WarnContext(request.Context(), "Rate limited", "path", request.URL.Path)
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusTooManyRequests)
+		webServer.ServeJSON(writer, request, errorResponse{Error: err.Error()})
+		return
 	}
-}
 
-func (webServer *WebServer) ServeTemplate(writer http.ResponseWriter, request *http.Request, name string, data StoredFile) {
-	t, err := template.ParseFS(templates, "templates/layout.tmpl.html", fmt.Sprintf("templates/%s.tmpl.html", name))
-	if err != nil {
-		webServer.ServeError(writer, err)
+	slog.ErrorContext(request.Context(), "Request error", "error", err)
+
+	switch {
+	case errors.Is(err, ErrorQuotaExceeded):
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusForbidden)
+		webServer.ServeJSON(writer, request, quotaExceeded{
+			Error:       err.Error(),
+			usageReport: webServer.usageReport(request),
+		})
+		return
+	case errors.Is(err, ErrorUploadTooLarge):
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusRequestEntityTooLarge)
+		webServer.ServeJSON(writer, request, uploadTooLarge{
+			Error:   err.Error(),
+			MaxSize: webServer.uploadLimit(request),
+		})
 		return
 	}
 
-	var pageURL string
-	if request != nil && request.Host != "" {
-		pageURL = fmt.Sprintf("https://%s%s", request.Host, request.URL.Path)
+	status, message := errorStatus(err)
+
+	// Uploads are sent by scripts, which need an error they can parse
+	if isUpload(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(status)
+		webServer.ServeJSON(writer, request, errorResponse{Error: message})
+		return
 	}
 
-	templateData := struct {
-		Plausible string
-		PageURL   string
-		StoredFile
-	}{
-		Plausible:  webServer.Plausible,
-		PageURL:    pageURL,
-		StoredFile: data,
+	switch status {
+	case http.StatusNotFound:
+		writer.WriteHeader(status)
+		webServer.ServeTemplate(writer, request, "404", StoredFile{})
+	case http.StatusGone:
+		writer.WriteHeader(status)
+		webServer.ServeTemplate(writer, request, "410", StoredFile{})
+	case http.StatusInternalServerError:
+		writer.WriteHeader(status)
+		webServer.ServeTemplate(writer, request, "500", StoredFile{})
+	default:
+		http.Error(writer, message, status)
 	}
+}
 
-	err = t.ExecuteTemplate(writer, "layout", templateData)
-	if err != nil {
-		webServer.ServeError(writer, err)
+// errorStatus is the status code and message an error is served with
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrorBadRequest), errors.Is(err, ErrorInvalidDetails):
+		return http.StatusBadRequest, err.Error()
+	case errors.Is(err, ErrorObjectMissing):
+		return http.StatusNotFound, "File not found"
+	case errors.Is(err, ErrorFileGone):
+		return http.StatusGone, "File is no longer available"
+	case errors.Is(err, ErrorForbidden):
+		return http.StatusForbidden, err.Error()
+	case errors.Is(err, ErrorContentTypeMismatch):
+		return http.StatusUnsupportedMediaType, err.Error()
+	case errors.Is(err, ErrorInfected):
+		return http.StatusUnprocessableEntity, err.Error()
+	case errors.Is(err, ErrorScanFailed):
+		return http.StatusServiceUnavailable, "Couldn't scan the upload for malware, try again later"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "Timed out talking to storage"
+	default:
+		return http.StatusInternalServerError, "Something went wrong, try again later"
 	}
 }
 
-type plausibleEvent struct {
-	Name     string `json:"name"`
-	Domain   string `json:"domain"`
-	URL      string `json:"url"`
-	Referrer string `json:"referrer"`
+// isUpload is whether a request is uploading a file
+func isUpload(request *http.Request) bool {
+	return request.Method == http.MethodPost && request.URL.Path == "/"
+}
+
+type templateData struct {
+	Plausible       string
+	PlausibleScript string
+	ServerTracked   bool // so the tracking script doesn't count it twice
+	PageURL         string
+	OEmbedURL       string // without a format, for discovery
+	RequestID       string
+	MaxUploadSize   int64
+	Usage           *usageReport
+	StoredFile
+	Control FileControl
+	Listing *listingPage
+	Admin   *adminPage
+	Stats   *StatsReport
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type usageReport struct {
+	User  string `json:"user"`
+	Used  Usage  `json:"used"`
+	Quota Quota  `json:"quota"`
+}
+
+type quotaExceeded struct {
+	Error string `json:"error"`
+	*usageReport
+}
+
+type uploadTooLarge struct {
+	Error   string `json:"error"`
+	MaxSize int64  `json:"maxSize"`
 }
 
-func (webServer *WebServer) logPlausibleEvent(request http.Request, apiURL string) {
-	event := plausibleEvent{
-		Name:     "pageview",
-		Domain:   webServer.Plausible,
-		URL:      fmt.Sprintf("https://%s%s", request.Host, request.URL.String()),
-		Referrer: request.Referer(),
+var templateFuncs = template.FuncMap{
+	"humanSize": humanSize,
+	"kindName":  kindName,
+	"join":      strings.Join,
+	"percent":   percent,
+}
+
+// percent formats a fraction like 0.125 as 12.5%
+func percent(fraction float64) string {
+	return strconv.FormatFloat(fraction*100, 'f', 1, 64) + "%"
+}
+
+func (webServer *WebServer) ServeTemplate(writer http.ResponseWriter, request *http.Request, name string, data StoredFile) {
+	webServer.ServePage(writer, request, name, templateData{StoredFile: data})
+}
+
+func (webServer *WebServer) ServePage(writer http.ResponseWriter, request *http.Request, name string, data templateData) {
+	ctx := context.Background()
+	if request != nil {
+		ctx = request.Context()
 	}
+	_, span := tracer().Start(ctx, "ServeTemplate",
+		trace.WithAttributes(attribute.String("template.name", name)))
+	defer span.End()
 
-	var body bytes.Buffer
-	err := json.NewEncoder(&body).Encode(event)
+	t, err := template.New(name).Funcs(templateFuncs).ParseFS(templates,
+		"templates/layout.tmpl.html",
+		"templates/file_table.tmpl.html",
+		fmt.Sprintf("templates/%s.tmpl.html", name),
+	)
 	if err != nil {
-		slog.Error("Failed to encode Plausible event", "error", err)
+		span.SetStatus(codes.Error, err.Error())
+		// Don't try to render an error page about failing to render the error
+		// page
+		if name == "500" {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		webServer.ServeError(writer, request, err)
 		return
 	}
 
-	req, err := http.NewRequest(http.MethodPost, apiURL, &body)
+	if request != nil && request.Host != "" {
+		data.PageURL = fmt.Sprintf("https://%s%s", request.Host, request.URL.Path)
+	}
+	data.RequestID = RequestID(ctx)
+	data.Plausible = webServer.plausibleDomain()
+	data.PlausibleScript = webServer.plausibleScript
+
+	err = t.ExecuteTemplate(writer, "layout", data)
 	if err != nil {
-		slog.Error("Failed to create Plausible request", "error", err)
-		return
+		span.SetStatus(codes.Error, err.Error())
+		if name == "500" {
+			slog.ErrorContext(ctx, "Error rendering error page", "error", err)
+			return
+		}
+		webServer.ServeError(writer, request, err)
 	}
-	req.Header.Add("User-Agent", request.UserAgent())
-	req.Header.Add("X-Forwarded-For", request.RemoteAddr)
-	req.Header.Add("Content-Type", "application/json")
+}
 
-	resp, err := webServer.httpClient.Do(req)
+func (webServer *WebServer) ServeJSON(writer http.ResponseWriter, request *http.Request, data any) {
+	writer.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(writer).Encode(data)
 	if err != nil {
-		slog.Error("Failed to send Plausible event", "error", err)
-		return
+		slog.ErrorContext(request.Context(), "Error writing JSON response", "error", err)
 	}
-	defer func() {
-		err := resp.Body.Close()
-		if err != nil {
-			slog.Error("Error closing response body", "error", err)
-		}
-	}()
 }
@@ -2,51 +2,100 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
 type mockStorage struct {
 	StorageClient
+	updated   *FileDetails
+	bucketErr error
 }
 
-func (c *mockStorage) LookupFile(prefix string) (*StoredFile, error) {
+func (c *mockStorage) LookupFile(ctx context.Context, prefix string) (*StoredFile, error) {
 	return &StoredFile{
 		OriginalName: "file.txt",
 		Url:          "http://cdn.example.com/file.txt",
 	}, nil
 }
 
-func (c *mockStorage) UploadFile(file multipart.File, fileHeader multipart.FileHeader) (string, error) {
-	return "/ABCDE", nil
+func (c *mockStorage) CheckBucket(ctx context.Context) error {
+	return c.bucketErr
+}
+
+func (c *mockStorage) UpdateFile(ctx context.Context, prefix string, details FileDetails) error {
+	c.updated = &details
+	return nil
+}
+
+func (c *mockStorage) ListFiles(ctx context.Context, continuationToken string, limit int32) (*FileListing, error) {
+	if continuationToken == "page-2" {
+		return &FileListing{
+			Files: []StoredFile{
+				{Key: "DDDDD", OriginalName: "d.mp4", Kind: KindVideo, Size: 400, UploadedAt: time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC)},
+			},
+		}, nil
+	}
+
+	return &FileListing{
+		Files: []StoredFile{
+			{Key: "AAAAA", OriginalName: "b.png", Kind: KindImage, Size: 300, UploadedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+			{Key: "BBBBB", OriginalName: "a.txt", Kind: KindText, Size: 100, UploadedAt: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+			{Key: "CCCCC", OriginalName: "c.gif", Kind: KindImage, Size: 200, UploadedAt: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		},
+		NextToken: "page-2",
+	}, nil
+}
+
+func (c *mockStorage) UploadFile(ctx context.Context, file multipart.File, fileHeader multipart.FileHeader, details FileDetails) (string, bool, error) {
+	return "/ABCDE", true, nil
 }
 
 type mockImageStorage struct {
 	StorageClient
 }
 
-func (c *mockImageStorage) LookupFile(prefix string) (*StoredFile, error) {
+func (c *mockImageStorage) LookupFile(ctx context.Context, prefix string) (*StoredFile, error) {
 	return &StoredFile{
+		Key:          "ABCDE",
 		OriginalName: "image.png",
 		Url:          "http://cdn.example.com/image.png",
 		Kind:         KindImage,
 	}, nil
 }
 
-func (c *mockImageStorage) UploadFile(file multipart.File, fileHeader multipart.FileHeader) (string, error) {
-	return "/ABCDE", nil
+func (c *mockImageStorage) UploadFile(ctx context.Context, file multipart.File, fileHeader multipart.FileHeader, details FileDetails) (string, bool, error) {
+	return "/ABCDE", true, nil
+}
+
+type mockTextStorage struct {
+	StorageClient
+}
+
+func (c *mockTextStorage) LookupFile(ctx context.Context, prefix string) (*StoredFile, error) {
+	return &StoredFile{
+		OriginalName:     "notes.txt",
+		Url:              "http://cdn.example.com/notes.txt",
+		Kind:             KindText,
+		Preview:          "<b>hello</b>",
+		PreviewTruncated: true,
+	}, nil
 }
 
 type mockEmptyStorage struct {
 	StorageClient
 }
 
-func (c *mockEmptyStorage) LookupFile(prefix string) (*StoredFile, error) {
+func (c *mockEmptyStorage) LookupFile(ctx context.Context, prefix string) (*StoredFile, error) {
 	return nil, ErrorObjectMissing
 }
 
@@ -173,7 +222,10 @@ func TestPlausibleEvent(t *testing.T) {
 	request.Host = host
 	request.RemoteAddr = requestIP
 
-	server.logPlausibleEvent(*request, plausible.URL)
+	event := server.newAnalyticsEvent(request, "pageview")
+	if err := NewPlausibleSink(plausible.URL).Send(context.Background(), []AnalyticsEvent{event}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
 
 	responseRecorder := httptest.NewRecorder()
 	server.Router.ServeHTTP(responseRecorder, request)
@@ -186,6 +238,26 @@ func TestPlausibleEvent(t *testing.T) {
 	}
 }
 
+func TestPlausibleEventFailure(t *testing.T) {
+	plausible := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusBadRequest)
+	}))
+	defer plausible.Close()
+
+	mockClient := &mockStorage{}
+	server := NewWebServer("", "", "", "example.com", mockClient)
+
+	request, _ := http.NewRequest(http.MethodGet, "/acab1.txt", nil)
+	failures := analyticsFailures.Value("plausible")
+
+	analytics := NewAnalytics(NewPlausibleSink(plausible.URL))
+	analytics.send(context.Background(), []AnalyticsEvent{server.newAnalyticsEvent(request, "pageview")})
+
+	if analyticsFailures.Value("plausible") != failures+1 {
+		t.Error("Expected rejected Plausible event to be counted as a failure")
+	}
+}
+
 func Test404(t *testing.T) {
 	mockClient := &mockEmptyStorage{}
 	server := NewWebServer("", "", "", "", mockClient)
@@ -211,6 +283,48 @@ func Test404(t *testing.T) {
 	}
 }
 
+type mockSlowStorage struct {
+	StorageClient
+}
+
+func (c *mockSlowStorage) LookupFile(ctx context.Context, prefix string) (*StoredFile, error) {
+	return nil, fmt.Errorf("lookup: %w", context.DeadlineExceeded)
+}
+
+func TestLookupHandlerTimeout(t *testing.T) {
+	mockClient := &mockSlowStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	request := httptest.NewRequest(http.MethodGet, "/ACAB1", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	response := responseRecorder.Result()
+
+	if response.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf(`Expected 504 Gateway Timeout, but instead got %s`, response.Status)
+	}
+}
+
+func TestServeErrorClientGone(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	request := httptest.NewRequest(http.MethodGet, "/ACAB1", nil).WithContext(ctx)
+	responseRecorder := httptest.NewRecorder()
+	server.ServeError(responseRecorder, request, context.Canceled)
+	response := responseRecorder.Result()
+
+	if response.StatusCode != statusClientClosedRequest {
+		t.Errorf(`Expected 499, but instead got %s`, response.Status)
+	}
+	if responseRecorder.Body.Len() != 0 {
+		t.Errorf(`Expected no body for a client that's gone, got %s`, responseRecorder.Body.String())
+	}
+}
+
 func TestHeartbeat(t *testing.T) {
 	mockClient := &mockStorage{}
 	server := NewWebServer("", "", "", "", mockClient)
@@ -249,6 +363,74 @@ func TestHeartbeatHead(t *testing.T) {
 	}
 }
 
+func TestMetrics(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("user", "pass", "", "", mockClient)
+
+	// Hit a route first so there's something to report for it
+	request := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	server.Router.ServeHTTP(httptest.NewRecorder(), request)
+
+	request = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	response := responseRecorder.Result()
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf(`Expected 200 OK without auth, but instead got %s`, response.Status)
+	}
+
+	body, _ := io.ReadAll(response.Body)
+	match, _ := regexp.MatchString(`filecloud_http_requests_total\{method="GET",route="GET /ping",status="200"\} \d+`, string(body))
+	if !match {
+		t.Errorf(`Expected request count for /ping, but got %s`, string(body))
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("user", "pass", "", "", mockClient)
+
+	request := httptest.NewRequest(http.MethodGet, "/healthz/ready", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	response := responseRecorder.Result()
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf(`Expected 200 OK without auth, but instead got %s`, response.Status)
+	}
+
+	var report readiness
+	if err := json.NewDecoder(response.Body).Decode(&report); err != nil {
+		t.Fatalf("Expected JSON body, got error %v", err)
+	}
+	if report.Status != "ok" || report.Components["storage"].Status != "ok" {
+		t.Errorf("Expected everything to be ok, got %+v", report)
+	}
+}
+
+func TestReadyHandlerBucketUnavailable(t *testing.T) {
+	mockClient := &mockStorage{bucketErr: ErrorBucketUnavailable}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	request := httptest.NewRequest(http.MethodGet, "/healthz/ready", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	response := responseRecorder.Result()
+
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf(`Expected 503, but instead got %s`, response.Status)
+	}
+
+	var report readiness
+	if err := json.NewDecoder(response.Body).Decode(&report); err != nil {
+		t.Fatalf("Expected JSON body, got error %v", err)
+	}
+	if report.Status != "unavailable" || report.Components["storage"] != (componentStatus{Status: "unavailable"}) {
+		t.Errorf("Expected storage to be reported unavailable without saying why, got %+v", report)
+	}
+}
+
 func TestIndexHandler(t *testing.T) {
 	mockClient := &mockStorage{}
 	server := NewWebServer("", "", "", "", mockClient)
@@ -383,6 +565,37 @@ func TestLookupHandlerImage(t *testing.T) {
 	}
 }
 
+func TestLookupHandlerTextPreview(t *testing.T) {
+	mockClient := &mockTextStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	request := httptest.NewRequest(http.MethodGet, "/ABCDE", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	response := responseRecorder.Result()
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf(`Expected 200 OK, but instead got %s`, response.Status)
+	}
+
+	// Preview content must be escaped, not rendered
+	var preview = regexp.MustCompile(`<pre><code>&lt;b&gt;hello&lt;/b&gt;</code></pre>`)
+	if preview.FindString(responseRecorder.Body.String()) == "" {
+		t.Errorf(
+			`Could not find escaped text preview in body: %s`,
+			responseRecorder.Body.String(),
+		)
+	}
+
+	var truncated = regexp.MustCompile(`Preview truncated`)
+	if truncated.FindString(responseRecorder.Body.String()) == "" {
+		t.Errorf(
+			`Could not find truncation notice in body: %s`,
+			responseRecorder.Body.String(),
+		)
+	}
+}
+
 func TestLookupInvalidKeyLength(t *testing.T) {
 	mockClient := &mockStorage{}
 	server := NewWebServer("", "", "", "", mockClient)
@@ -401,6 +614,41 @@ func TestLookupInvalidKeyLength(t *testing.T) {
 	}
 }
 
+func TestReloadEnablesBasicAuth(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	server.Reload("skalnik", "hunter2", "example.com")
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf(`Expected 401 after credentials were added, but instead got %s`, responseRecorder.Result().Status)
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/", nil)
+	request.SetBasicAuth("skalnik", "hunter2")
+	responseRecorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Result().StatusCode != http.StatusOK {
+		t.Errorf(`Expected 200 OK with the new credentials, but instead got %s`, responseRecorder.Result().Status)
+	}
+
+	if !strings.Contains(responseRecorder.Body.String(), `data-domain="example.com"`) {
+		t.Error("Expected reloaded Plausible domain to be used")
+	}
+
+	server.Reload("", "", "")
+
+	request = httptest.NewRequest(http.MethodGet, "/", nil)
+	responseRecorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Result().StatusCode != http.StatusOK {
+		t.Errorf(`Expected 200 OK once auth was removed, but instead got %s`, responseRecorder.Result().Status)
+	}
+}
+
 func TestBasicAuthWrongCredentials(t *testing.T) {
 	username := "skalnik"
 	password := "hunter2"
@@ -474,3 +722,410 @@ func TestDirectHandlerWithoutExtension(t *testing.T) {
 		t.Errorf(`Expected 200 OK for file page, but instead got %s`, response.Status)
 	}
 }
+
+func TestBrowseHandler(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	request := httptest.NewRequest(http.MethodGet, "/browse", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	response := responseRecorder.Result()
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf(`Expected 200 OK, but instead got %s`, response.Status)
+	}
+
+	body := responseRecorder.Body.String()
+
+	// Newest upload first by default
+	var newestFirst = regexp.MustCompile(`(?s)a\.txt.*c\.gif.*b\.png`)
+	if newestFirst.FindString(body) == "" {
+		t.Errorf(`Expected files sorted newest first in body: %s`, body)
+	}
+
+	var shortLink = regexp.MustCompile(`<a href="/BBBBB">/BBBBB</a>`)
+	if shortLink.FindString(body) == "" {
+		t.Errorf(`Could not find short link in body: %s`, body)
+	}
+
+	var nextLink = regexp.MustCompile(`href="\?cursor=page-2&amp;order=desc&amp;sort=date"`)
+	if nextLink.FindString(body) == "" {
+		t.Errorf(`Could not find next page link in body: %s`, body)
+	}
+}
+
+func TestBrowseHandlerRequiresAuth(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("skalnik", "hunter2", "", "", mockClient)
+
+	for _, path := range []string{"/browse", "/api/files"} {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		responseRecorder := httptest.NewRecorder()
+		server.Router.ServeHTTP(responseRecorder, request)
+		response := responseRecorder.Result()
+
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Errorf(`Expected unauthorized for %s, but instead got %s`, path, response.Status)
+		}
+	}
+}
+
+func TestListFilesHandler(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/files?kind=image&sort=size&order=asc", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	response := responseRecorder.Result()
+
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf(`Expected 200 OK, but instead got %s`, response.Status)
+	}
+
+	listing := &FileListing{}
+	err := json.NewDecoder(response.Body).Decode(listing)
+	if err != nil {
+		t.Fatalf("Got malformed JSON: %v", err)
+	}
+
+	if len(listing.Files) != 2 {
+		t.Fatalf("Expected only images, got %+v", listing.Files)
+	}
+
+	if listing.Files[0].OriginalName != "c.gif" || listing.Files[1].OriginalName != "b.png" {
+		t.Errorf("Expected images sorted by size ascending, got %+v", listing.Files)
+	}
+
+	// The second page had no images, and nothing after it
+	if listing.NextToken != "" {
+		t.Errorf("Expected filtering to list to the end, got next token '%s'", listing.NextToken)
+	}
+}
+
+func TestListFilesHandlerFilterFillsPage(t *testing.T) {
+	storage := &mockPagedStorage{
+		pages: map[string]*FileListing{
+			"": {
+				Files:     []StoredFile{{Key: "AAAAA", OriginalName: "a.txt", Kind: KindText}},
+				NextToken: "page-2",
+			},
+			"page-2": {
+				Files:     []StoredFile{{Key: "BBBBB", OriginalName: "b.txt", Kind: KindText}},
+				NextToken: "page-3",
+			},
+			"page-3": {
+				Files:     []StoredFile{{Key: "CCCCC", OriginalName: "c.png", Kind: KindImage}},
+				NextToken: "page-4",
+			},
+		},
+	}
+	server := NewWebServer("", "", "", "", storage)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/files?kind=image&limit=1", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	listing := &FileListing{}
+	if err := json.NewDecoder(responseRecorder.Result().Body).Decode(listing); err != nil {
+		t.Fatalf("Got malformed JSON: %v", err)
+	}
+
+	if len(listing.Files) != 1 || listing.Files[0].Key != "CCCCC" {
+		t.Errorf("Expected the image from the third page, got %+v", listing.Files)
+	}
+	if listing.NextToken != "page-4" {
+		t.Errorf("Expected next token page-4, got '%s'", listing.NextToken)
+	}
+}
+
+// mockEndlessStorage lists a page without any images, forever
+type mockEndlessStorage struct {
+	StorageClient
+	calls  int
+	limits []int32
+}
+
+func (c *mockEndlessStorage) ListFiles(ctx context.Context, continuationToken string, limit int32) (*FileListing, error) {
+	c.calls++
+	c.limits = append(c.limits, limit)
+	return &FileListing{
+		Files:     []StoredFile{{Key: fmt.Sprintf("%05d", c.calls), OriginalName: "notes.txt", Kind: KindText}},
+		NextToken: fmt.Sprintf("page-%d", c.calls+1),
+	}, nil
+}
+
+func TestListFilesHandlerFilterStopsListing(t *testing.T) {
+	storage := &mockEndlessStorage{}
+	server := NewWebServer("", "", "", "", storage)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/files?kind=image&limit=50", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	listing := &FileListing{}
+	if err := json.NewDecoder(responseRecorder.Result().Body).Decode(listing); err != nil {
+		t.Fatalf("Got malformed JSON: %v", err)
+	}
+
+	if storage.calls != maxFilteredListings {
+		t.Errorf("Expected %d listings, got %d", maxFilteredListings, storage.calls)
+	}
+	for _, limit := range storage.limits {
+		if limit != 50 {
+			t.Errorf("Expected full pages to be listed, got %v", storage.limits)
+			break
+		}
+	}
+	if len(listing.Files) != 0 || listing.NextToken != fmt.Sprintf("page-%d", maxFilteredListings+1) {
+		t.Errorf("Expected no files and a cursor to carry on from, got %+v", listing)
+	}
+}
+
+func TestListFilesHandlerKindFromIndex(t *testing.T) {
+	storage := &mockPagedStorage{
+		pages: map[string]*FileListing{
+			"": {Files: []StoredFile{
+				// Guessed from their extensions
+				{Key: "AAAAA", OriginalName: "photo", Kind: KindOther, ContentType: "application/octet-stream"},
+				{Key: "BBBBB", OriginalName: "notes.png", Kind: KindImage, ContentType: "image/png"},
+			}},
+		},
+	}
+	server := NewWebServer("", "", "", "", storage)
+	server.Search.Add(StoredFile{Key: "AAAAA", OriginalName: "photo", Kind: KindImage, ContentType: "image/jpeg"})
+	server.Search.Add(StoredFile{Key: "BBBBB", OriginalName: "notes.png", Kind: KindText, ContentType: "text/plain; charset=utf-8"})
+
+	request := httptest.NewRequest(http.MethodGet, "/api/files?kind=image", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	listing := &FileListing{}
+	if err := json.NewDecoder(responseRecorder.Result().Body).Decode(listing); err != nil {
+		t.Fatalf("Got malformed JSON: %v", err)
+	}
+
+	if len(listing.Files) != 1 || listing.Files[0].Key != "AAAAA" || listing.Files[0].ContentType != "image/jpeg" {
+		t.Errorf("Expected only the sniffed image, got %+v", listing.Files)
+	}
+}
+
+func TestListFilesHandlerBadParams(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	for _, query := range []string{"?sort=color", "?order=sideways", "?kind=spreadsheet", "?limit=0", "?limit=lots"} {
+		request := httptest.NewRequest(http.MethodGet, "/api/files"+query, nil)
+		responseRecorder := httptest.NewRecorder()
+		server.Router.ServeHTTP(responseRecorder, request)
+		response := responseRecorder.Result()
+
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf(`Expected 400 for %s, but instead got %s`, query, response.Status)
+		}
+	}
+}
+
+func TestSearchAPIHandlerIndexesUploads(t *testing.T) {
+	mockClient := &mockImageStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreateFormFile("file", "image.png")
+	part.Write([]byte("not really a png"))
+	writer.Close()
+
+	request := httptest.NewRequest(http.MethodPost, "/", &body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	server.Router.ServeHTTP(httptest.NewRecorder(), request)
+
+	request = httptest.NewRequest(http.MethodGet, "/api/search?q=imag", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	response := responseRecorder.Result()
+
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf(`Expected 200 OK, but instead got %s`, response.Status)
+	}
+
+	listing := &FileListing{}
+	err := json.NewDecoder(response.Body).Decode(listing)
+	if err != nil {
+		t.Fatalf("Got malformed JSON: %v", err)
+	}
+
+	if len(listing.Files) != 1 || listing.Files[0].OriginalName != "image.png" {
+		t.Errorf("Expected uploaded file in search results, got %+v", listing.Files)
+	}
+}
+
+func TestSearchHandler(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+	server.Search.Add(StoredFile{Key: "AAAAA", OriginalName: "network diagram.png"})
+
+	request := httptest.NewRequest(http.MethodGet, "/search?q=diagram", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	response := responseRecorder.Result()
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf(`Expected 200 OK, but instead got %s`, response.Status)
+	}
+
+	var result = regexp.MustCompile(`<a href="/AAAAA">/AAAAA</a>`)
+	if result.FindString(responseRecorder.Body.String()) == "" {
+		t.Errorf(
+			`Could not find search result in body: %s`,
+			responseRecorder.Body.String(),
+		)
+	}
+}
+
+func TestUpdateHandler(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	form := strings.NewReader("tags=work%2C+diagrams&description=A+diagram")
+	request := httptest.NewRequest(http.MethodPost, "/ABCDE/edit", form)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	response := responseRecorder.Result()
+
+	if response.StatusCode != http.StatusSeeOther || response.Header.Get("Location") != "/ABCDE" {
+		t.Errorf(`Expected redirect to file page, but instead got %s to %s`, response.Status, response.Header.Get("Location"))
+	}
+
+	if mockClient.updated == nil || len(mockClient.updated.Tags) != 2 || mockClient.updated.Description != "A diagram" {
+		t.Errorf("Expected details to be passed to storage, got %+v", mockClient.updated)
+	}
+}
+
+func TestUpdateAPIHandler(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("skalnik", "hunter2", "", "", mockClient)
+
+	request := httptest.NewRequest(http.MethodPatch, "/api/files/ABCDE", strings.NewReader(`{"tags":["work"],"description":"hi"}`))
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	if responseRecorder.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf(`Expected unauthorized, but instead got %s`, responseRecorder.Result().Status)
+	}
+
+	request = httptest.NewRequest(http.MethodPatch, "/api/files/ABCDE", strings.NewReader(`{"tags":["work"],"description":"hi"}`))
+	request.SetBasicAuth("skalnik", "hunter2")
+	responseRecorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	response := responseRecorder.Result()
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf(`Expected 200 OK, but instead got %s`, response.Status)
+	}
+
+	if mockClient.updated == nil || mockClient.updated.Description != "hi" {
+		t.Errorf("Expected details to be passed to storage, got %+v", mockClient.updated)
+	}
+
+	request = httptest.NewRequest(http.MethodPatch, "/api/files/ABCDE", strings.NewReader(`not json`))
+	request.SetBasicAuth("skalnik", "hunter2")
+	responseRecorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	if responseRecorder.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf(`Expected 400 for malformed JSON, but instead got %s`, responseRecorder.Result().Status)
+	}
+}
+
+type mockDetailedStorage struct {
+	mockStorage
+}
+
+func (c *mockDetailedStorage) LookupFile(ctx context.Context, prefix string) (*StoredFile, error) {
+	return &StoredFile{
+		Key:          "ABCDE",
+		OriginalName: "diagram.png",
+		Url:          "http://cdn.example.com/diagram.png",
+		Kind:         KindImage,
+		Tags:         []string{"diagrams", "work"},
+		Description:  "Our network <diagram>",
+	}, nil
+}
+
+func TestLookupHandlerDetails(t *testing.T) {
+	mockClient := &mockDetailedStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	request := httptest.NewRequest(http.MethodGet, "/ABCDE", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	body := responseRecorder.Body.String()
+
+	var ogDescription = regexp.MustCompile(`<meta property="og:description" content="Our network &lt;diagram&gt;" />`)
+	if ogDescription.FindString(body) == "" {
+		t.Errorf(`Could not find og:description in body: %s`, body)
+	}
+
+	var tag = regexp.MustCompile(`<a class="tag" href="/browse\?tag=work">work</a>`)
+	if tag.FindString(body) == "" {
+		t.Errorf(`Could not find tag link in body: %s`, body)
+	}
+}
+
+func TestListFilesHandlerTagFilter(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+	server.Search.Add(StoredFile{Key: "CCCCC", OriginalName: "c.gif", Tags: []string{"cats"}})
+
+	request := httptest.NewRequest(http.MethodGet, "/api/files?tag=Cats", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	listing := &FileListing{}
+	err := json.NewDecoder(responseRecorder.Result().Body).Decode(listing)
+	if err != nil {
+		t.Fatalf("Got malformed JSON: %v", err)
+	}
+
+	if len(listing.Files) != 1 || listing.Files[0].Key != "CCCCC" {
+		t.Errorf("Expected only the tagged file, got %+v", listing.Files)
+	}
+}
+
+func TestStaticFiles(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("", "", "", "", mockClient)
+
+	request := httptest.NewRequest(http.MethodGet, "/static/app.js", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	if responseRecorder.Result().StatusCode != http.StatusOK {
+		t.Errorf(`Expected 200 OK, but instead got %s`, responseRecorder.Result().Status)
+	}
+}
+
+func TestEditHandlerRequiresAuth(t *testing.T) {
+	mockClient := &mockStorage{}
+	server := NewWebServer("skalnik", "hunter2", "", "", mockClient)
+
+	request := httptest.NewRequest(http.MethodGet, "/ABCDE/edit", nil)
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	if responseRecorder.Result().StatusCode != http.StatusUnauthorized {
+		t.Errorf(`Expected unauthorized, but instead got %s`, responseRecorder.Result().Status)
+	}
+
+	request.SetBasicAuth("skalnik", "hunter2")
+	responseRecorder = httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+
+	if responseRecorder.Result().StatusCode != http.StatusOK {
+		t.Errorf(`Expected 200 OK, but instead got %s`, responseRecorder.Result().Status)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrorInvalidWebhook = errors.New("invalid webhook")
+
+const (
+	EventFileUploaded = "file.uploaded"
+	EventFileDeleted  = "file.deleted"
+	EventFileExpired  = "file.expired"
+)
+
+const (
+	webhookQueueSize   = 100
+	webhookWorkers     = 4
+	webhookMaxAttempts = 5
+	webhookLogSize     = 50
+
+	// How long what's left in the queue gets to be sent when shutting down
+	webhookFlushTimeout = 10 * time.Second
+
+	webhookSignatureHeader = "X-File-Cloud-Signature"
+	webhookEventHeader     = "X-File-Cloud-Event"
+	webhookDeliveryHeader  = "X-File-Cloud-Delivery"
+)
+
+// WebhookEvent is the JSON body sent to every webhook
+type WebhookEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Key      string    `json:"key"`
+	URL      string    `json:"url"`
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Kind     string    `json:"kind"`
+	Uploader string    `json:"uploader,omitempty"`
+}
+
+func newWebhookEvent(event string, file StoredFile, shortURL string) WebhookEvent {
+	return WebhookEvent{
+		Event:    event,
+		Time:     time.Now().UTC(),
+		Key:      file.Key,
+		URL:      shortURL,
+		Name:     file.OriginalName,
+		Size:     file.Size,
+		Kind:     kindName(file.Kind),
+		Uploader: file.Uploader,
+	}
+}
+
+// WebhookDelivery is an entry in the delivery log: one event sent to one
+// URL, however many attempts it took
+type WebhookDelivery struct {
+	ID       string
+	Event    string
+	URL      string
+	Key      string
+	Attempts int
+	Status   int // of the last attempt, 0 if there wasn't a response
+	Error    string
+	Time     time.Time // when it finished, or was dropped
+}
+
+func (delivery WebhookDelivery) Delivered() bool {
+	return delivery.Error == ""
+}
+
+type webhookJob struct {
+	id    string
+	url   string
+	event WebhookEvent
+	body  []byte
+}
+
+// Webhooks sends events to a list of URLs from a queue in the background,
+// retrying failures with exponential backoff. Bodies are signed with an
+// HMAC-SHA256 of the secret so receivers can check they came from us.
+type Webhooks struct {
+	URLs   []string
+	Secret string
+
+	client  *http.Client
+	queue   chan webhookJob
+	backoff func(attempt int) time.Duration
+
+	mutex      sync.Mutex
+	deliveries []WebhookDelivery // newest first
+}
+
+// NewWebhooks returns nil without any URLs, which sends nothing
+func NewWebhooks(urls []string, secret string) *Webhooks {
+	if len(urls) == 0 {
+		return nil
+	}
+
+	return &Webhooks{
+		URLs:    urls,
+		Secret:  secret,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan webhookJob, webhookQueueSize),
+		backoff: webhookBackoff,
+	}
+}
+
+// ParseWebhookURLs reads a comma separated list of http or https URLs
+func ParseWebhookURLs(raw string) ([]string, error) {
+	var urls []string
+	for _, rawURL := range strings.Split(raw, ",") {
+		rawURL = strings.TrimSpace(rawURL)
+		if rawURL == "" {
+			continue
+		}
+
+		parsed, err := url.Parse(rawURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("%w: %q must be an http or https URL", ErrorInvalidWebhook, rawURL)
+		}
+		urls = append(urls, rawURL)
+	}
+
+	return urls, nil
+}
+
+// 1s, 2s, 4s, 8s between attempts
+func webhookBackoff(attempt int) time.Duration {
+	return time.Second << (attempt - 1)
+}
+
+// Send queues an event for every URL. If the queue is full the event is
+// dropped rather than holding up the request that caused it.
+func (webhooks *Webhooks) Send(ctx context.Context, event WebhookEvent) {
+	if webhooks == nil {
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode webhook event", "event", event.Event, "error", err)
+		return
+	}
+
+	for _, url := range webhooks.URLs {
+		job := webhookJob{id: newRequestID(), url: url, event: event, body: body}
+
+		select {
+		case webhooks.queue <- job:
+		default:
+			slog.WarnContext(ctx, "Webhook queue full, dropping event", "event", event.Event, "url", url)
+			webhookDeliveries.Inc("dropped")
+			webhooks.record(job, 0, 0, errors.New("queue full"))
+		}
+	}
+}
+
+// Run delivers queued events until ctx is done, then delivers what's left.
+// Deliveries carry on past ctx being done so nothing in flight or queued is
+// lost, but only for webhookFlushTimeout.
+func (webhooks *Webhooks) Run(ctx context.Context) {
+	if webhooks == nil {
+		return
+	}
+
+	deliveryCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(webhookFlushTimeout, cancel)
+	})
+	defer stop()
+
+	var workers sync.WaitGroup
+	for range webhookWorkers {
+		workers.Go(func() {
+			for {
+				select {
+				case <-ctx.Done():
+					webhooks.drain(deliveryCtx)
+					return
+				case job := <-webhooks.queue:
+					webhooks.deliver(deliveryCtx, job)
+				}
+			}
+		})
+	}
+	workers.Wait()
+}
+
+// drain delivers whatever's left in the queue without waiting for more
+func (webhooks *Webhooks) drain(ctx context.Context) {
+	for {
+		select {
+		case job := <-webhooks.queue:
+			webhooks.deliver(ctx, job)
+		default:
+			return
+		}
+	}
+}
+
+func (webhooks *Webhooks) deliver(ctx context.Context, job webhookJob) {
+	var (
+		status int
+		err    error
+	)
+
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		var retry bool
+		status, retry, err = webhooks.post(ctx, job)
+		if err == nil {
+			webhookDeliveries.Inc("delivered")
+			webhooks.record(job, attempt, status, nil)
+			return
+		}
+
+		if !retry || attempt == webhookMaxAttempts {
+			webhooks.fail(job, attempt, status, err)
+			return
+		}
+
+		slog.DebugContext(ctx, "Retrying webhook", "url", job.url, "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			webhooks.fail(job, attempt, status, ctx.Err())
+			return
+		case <-time.After(webhooks.backoff(attempt)):
+		}
+	}
+}
+
+func (webhooks *Webhooks) fail(job webhookJob, attempts int, status int, err error) {
+	slog.Error("Webhook delivery failed", "event", job.event.Event, "url", job.url, "attempts", attempts, "error", err)
+	webhookDeliveries.Inc("failed")
+	webhooks.record(job, attempts, status, err)
+}
+
+// post makes a single attempt, saying whether it's worth trying again if it
+// fails. Anything but a timeout, rate limit or server error won't get better.
+func (webhooks *Webhooks) post(ctx context.Context, job webhookJob) (int, bool, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, job.url, bytes.NewReader(job.body))
+	if err != nil {
+		return 0, false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "File Cloud")
+	request.Header.Set(webhookEventHeader, job.event.Event)
+	request.Header.Set(webhookDeliveryHeader, job.id)
+	if webhooks.Secret != "" {
+		request.Header.Set(webhookSignatureHeader, SignWebhook(webhooks.Secret, job.body))
+	}
+
+	response, err := webhooks.client.Do(request)
+	if err != nil {
+		return 0, true, err
+	}
+	_ = response.Body.Close()
+
+	switch status := response.StatusCode; {
+	case status < 300:
+		return status, false, nil
+	case status == http.StatusRequestTimeout, status == http.StatusTooManyRequests, status >= 500:
+		return status, true, fmt.Errorf("webhook returned %s", response.Status)
+	default:
+		return status, false, fmt.Errorf("webhook returned %s", response.Status)
+	}
+}
+
+// SignWebhook is the signature header value for a body, like GitHub's:
+// sha256= then the hex HMAC-SHA256 of the body keyed with the secret
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (webhooks *Webhooks) record(job webhookJob, attempts int, status int, err error) {
+	delivery := WebhookDelivery{
+		ID:       job.id,
+		Event:    job.event.Event,
+		URL:      job.url,
+		Key:      job.event.Key,
+		Attempts: attempts,
+		Status:   status,
+		Time:     time.Now(),
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+
+	webhooks.mutex.Lock()
+	defer webhooks.mutex.Unlock()
+
+	webhooks.deliveries = append([]WebhookDelivery{delivery}, webhooks.deliveries...)
+	if len(webhooks.deliveries) > webhookLogSize {
+		webhooks.deliveries = webhooks.deliveries[:webhookLogSize]
+	}
+}
+
+// Deliveries returns the most recent deliveries, newest first
+func (webhooks *Webhooks) Deliveries() []WebhookDelivery {
+	if webhooks == nil {
+		return nil
+	}
+
+	webhooks.mutex.Lock()
+	defer webhooks.mutex.Unlock()
+
+	return append([]WebhookDelivery(nil), webhooks.deliveries...)
+}
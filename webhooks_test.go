@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+	event  WebhookEvent
+}
+
+// newWebhookReceiver serves each status in turn, then 200 OK, passing on
+// everything it receives
+func newWebhookReceiver(t *testing.T, statuses ...int) (*httptest.Server, chan receivedWebhook) {
+	t.Helper()
+
+	received := make(chan receivedWebhook, 10)
+	var calls atomic.Int32
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		webhook := receivedWebhook{header: request.Header, body: body}
+		_ = json.Unmarshal(body, &webhook.event)
+		received <- webhook
+
+		if call := int(calls.Add(1)); call <= len(statuses) {
+			writer.WriteHeader(statuses[call-1])
+		}
+	}))
+	t.Cleanup(receiver.Close)
+
+	return receiver, received
+}
+
+// startWebhooks runs webhooks without any backoff until the test is done
+func startWebhooks(t *testing.T, webhooks *Webhooks) {
+	t.Helper()
+
+	webhooks.backoff = func(int) time.Duration { return 0 }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go webhooks.Run(ctx)
+}
+
+// waitForDelivery waits for a delivery to be logged, which happens after the
+// receiver has responded
+func waitForDelivery(t *testing.T, webhooks *Webhooks) WebhookDelivery {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if deliveries := webhooks.Deliveries(); len(deliveries) > 0 {
+			return deliveries[0]
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatal("Timed out waiting for a webhook delivery")
+	return WebhookDelivery{}
+}
+
+func receive(t *testing.T, received chan receivedWebhook) receivedWebhook {
+	t.Helper()
+
+	select {
+	case webhook := <-received:
+		return webhook
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a webhook")
+		return receivedWebhook{}
+	}
+}
+
+func TestParseWebhookURLs(t *testing.T) {
+	urls, err := ParseWebhookURLs(" https://chat.example.com/hook, ,http://localhost:9000/events")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(urls) != 2 || urls[0] != "https://chat.example.com/hook" || urls[1] != "http://localhost:9000/events" {
+		t.Errorf("Expected both URLs, got %v", urls)
+	}
+
+	if urls, _ := ParseWebhookURLs(""); NewWebhooks(urls, "") != nil {
+		t.Error("Expected no webhooks without any URLs")
+	}
+
+	for _, raw := range []string{"chat.example.com/hook", "ftp://example.com", "https://"} {
+		if _, err := ParseWebhookURLs(raw); !errors.Is(err, ErrorInvalidWebhook) {
+			t.Errorf("Expected ErrorInvalidWebhook for %q, got %v", raw, err)
+		}
+	}
+}
+
+func TestWebhooksSend(t *testing.T) {
+	receiver, received := newWebhookReceiver(t)
+	webhooks := NewWebhooks([]string{receiver.URL}, "sekrit")
+	startWebhooks(t, webhooks)
+
+	file := StoredFile{Key: "ABCDE", OriginalName: "cat.png", Size: 1234, Kind: KindImage, Uploader: "skalnik"}
+	webhooks.Send(context.Background(), newWebhookEvent(EventFileUploaded, file, "https://files.example.com/ABCDE"))
+
+	webhook := receive(t, received)
+	if webhook.header.Get(webhookSignatureHeader) != SignWebhook("sekrit", webhook.body) {
+		t.Errorf("Expected the body to be signed, got %q", webhook.header.Get(webhookSignatureHeader))
+	}
+	if webhook.header.Get(webhookEventHeader) != EventFileUploaded || webhook.header.Get(webhookDeliveryHeader) == "" {
+		t.Errorf("Expected event and delivery headers, got %v", webhook.header)
+	}
+
+	event := webhook.event
+	if event.Event != EventFileUploaded || event.URL != "https://files.example.com/ABCDE" || event.Name != "cat.png" ||
+		event.Size != 1234 || event.Kind != "image" || event.Uploader != "skalnik" {
+		t.Errorf("Expected the file's details, got %+v", event)
+	}
+
+	delivery := waitForDelivery(t, webhooks)
+	if !delivery.Delivered() || delivery.Attempts != 1 || delivery.Status != http.StatusOK || delivery.Key != "ABCDE" {
+		t.Errorf("Expected a logged delivery, got %+v", delivery)
+	}
+}
+
+func TestWebhooksSentOnShutdown(t *testing.T) {
+	receiver, received := newWebhookReceiver(t)
+	webhooks := NewWebhooks([]string{receiver.URL}, "")
+
+	file := StoredFile{Key: "ABCDE", OriginalName: "cat.png"}
+	webhooks.Send(context.Background(), newWebhookEvent(EventFileDeleted, file, "https://files.example.com/ABCDE"))
+
+	// Shutting down before anything's been sent still sends what's queued
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	webhooks.Run(ctx)
+
+	if webhook := receive(t, received); webhook.event.Event != EventFileDeleted {
+		t.Errorf("Expected the queued event, got %+v", webhook.event)
+	}
+	if delivery := webhooks.Deliveries()[0]; !delivery.Delivered() {
+		t.Errorf("Expected the delivery to succeed, got %+v", delivery)
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// From echo -n hello | openssl dgst -sha256 -hmac sekrit
+	expected := "sha256=3ffea2c7e630ed8f52654e8e7328870035fdf02ac33d381a2fe2d20510d2df96"
+	if signature := SignWebhook("sekrit", []byte("hello")); signature != expected {
+		t.Errorf("Expected %q, got %q", expected, signature)
+	}
+}
+
+func TestWebhooksRetry(t *testing.T) {
+	receiver, received := newWebhookReceiver(t, http.StatusBadGateway, http.StatusTooManyRequests)
+	webhooks := NewWebhooks([]string{receiver.URL}, "")
+	startWebhooks(t, webhooks)
+
+	webhooks.Send(context.Background(), WebhookEvent{Event: EventFileDeleted, Key: "ABCDE"})
+
+	first, retried := receive(t, received), receive(t, received)
+	if first.header.Get(webhookDeliveryHeader) != retried.header.Get(webhookDeliveryHeader) {
+		t.Error("Expected retries to keep the same delivery ID")
+	}
+	if first.header.Get(webhookSignatureHeader) != "" {
+		t.Error("Expected no signature without a secret")
+	}
+
+	delivery := waitForDelivery(t, webhooks)
+	if !delivery.Delivered() || delivery.Attempts != 3 {
+		t.Errorf("Expected delivery on the third attempt, got %+v", delivery)
+	}
+}
+
+func TestWebhooksGiveUp(t *testing.T) {
+	receiver, _ := newWebhookReceiver(t, http.StatusNotFound)
+	webhooks := NewWebhooks([]string{receiver.URL}, "")
+	startWebhooks(t, webhooks)
+
+	webhooks.Send(context.Background(), WebhookEvent{Event: EventFileDeleted, Key: "ABCDE"})
+
+	delivery := waitForDelivery(t, webhooks)
+	if delivery.Delivered() || delivery.Attempts != 1 || delivery.Status != http.StatusNotFound {
+		t.Errorf("Expected a 404 not to be retried, got %+v", delivery)
+	}
+
+	receiver, _ = newWebhookReceiver(t, 500, 500, 500, 500, 500)
+	webhooks = NewWebhooks([]string{receiver.URL}, "")
+	startWebhooks(t, webhooks)
+
+	webhooks.Send(context.Background(), WebhookEvent{Event: EventFileDeleted, Key: "ABCDE"})
+
+	delivery = waitForDelivery(t, webhooks)
+	if delivery.Delivered() || delivery.Attempts != webhookMaxAttempts {
+		t.Errorf("Expected to give up after %d attempts, got %+v", webhookMaxAttempts, delivery)
+	}
+}
+
+func TestWebhooksQueueFull(t *testing.T) {
+	// Never started, so nothing is taken off the queue
+	webhooks := NewWebhooks([]string{"http://localhost/hook"}, "")
+	for range webhookQueueSize + 1 {
+		webhooks.Send(context.Background(), WebhookEvent{Event: EventFileUploaded, Key: "ABCDE"})
+	}
+
+	deliveries := webhooks.Deliveries()
+	if len(deliveries) != 1 || deliveries[0].Delivered() || deliveries[0].Attempts != 0 {
+		t.Errorf("Expected one dropped event, got %+v", deliveries)
+	}
+}
+
+func TestUploadSendsWebhook(t *testing.T) {
+	receiver, received := newWebhookReceiver(t)
+	webhooks := NewWebhooks([]string{receiver.URL}, "")
+	startWebhooks(t, webhooks)
+
+	server := NewWebServer("", "", "", "", &mockOwnedStorage{})
+	server.SetWebhooks(webhooks, "")
+
+	request := uploadRequest(t, 10)
+	request.Host = "files.example.com"
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, request)
+	if responseRecorder.Code != http.StatusOK {
+		t.Fatalf(`Expected 200 OK, but instead got %d`, responseRecorder.Code)
+	}
+
+	event := receive(t, received).event
+	if event.Event != EventFileUploaded || event.Key != "ABCDE" || event.URL != "https://files.example.com/ABCDE" || event.Uploader != "guest" {
+		t.Errorf("Expected an upload event for ABCDE, got %+v", event)
+	}
+}
+
+type mockDuplicateStorage struct {
+	mockOwnedStorage
+}
+
+func (c *mockDuplicateStorage) UploadFile(ctx context.Context, file multipart.File, fileHeader multipart.FileHeader, details FileDetails) (string, bool, error) {
+	return "/ABCDE", false, nil
+}
+
+func TestDuplicateUploadSendsNoWebhook(t *testing.T) {
+	// Never started, so anything sent stays queued
+	webhooks := NewWebhooks([]string{"http://localhost/hook"}, "")
+
+	server := NewWebServer("", "", "", "", &mockDuplicateStorage{})
+	server.SetWebhooks(webhooks, "")
+
+	responseRecorder := httptest.NewRecorder()
+	server.Router.ServeHTTP(responseRecorder, uploadRequest(t, 10))
+	if responseRecorder.Code != http.StatusOK {
+		t.Fatalf(`Expected 200 OK, but instead got %d`, responseRecorder.Code)
+	}
+
+	if len(webhooks.queue) != 0 {
+		t.Errorf("Expected no webhook for a file we already had, got %d", len(webhooks.queue))
+	}
+}
+
+func TestDeleteSendsWebhooks(t *testing.T) {
+	receiver, received := newWebhookReceiver(t)
+	webhooks := NewWebhooks([]string{receiver.URL}, "")
+	startWebhooks(t, webhooks)
+
+	server := NewWebServer("", "", "", "", &mockOwnedStorage{})
+	server.SetWebhooks(webhooks, "https://files.example.com/")
+
+	request := httptest.NewRequest(http.MethodDelete, "/api/files/ABCDE", nil)
+	server.Router.ServeHTTP(httptest.NewRecorder(), request)
+
+	event := receive(t, received).event
+	if event.Event != EventFileDeleted || event.Key != "ABCDE" || event.URL != "https://files.example.com/ABCDE" {
+		t.Errorf("Expected a delete event for ABCDE, got %+v", event)
+	}
+
+	// Expiry happens outside of a request, so it relies on the public URL
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	server.Controls.now = clock.Now
+	server.Search.Add(StoredFile{Key: "FGHIJ", OriginalName: "old.txt", Size: 10})
+	server.Controls.Expire("FGHIJ", clock.now)
+	server.deleteExpired(context.Background())
+
+	event = receive(t, received).event
+	if event.Event != EventFileExpired || event.Name != "old.txt" || event.URL != "https://files.example.com/FGHIJ" {
+		t.Errorf("Expected an expiry event for FGHIJ, got %+v", event)
+	}
+}